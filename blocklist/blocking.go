@@ -18,6 +18,7 @@ import (
 // Various namespaces used by this package, provided as a convenience.
 const (
 	NS          = `urn:xmpp:blocking`
+	NSErrors    = `urn:xmpp:blocking:errors`
 	NSReporting = `urn:xmpp:reporting:1`
 )
 
@@ -0,0 +1,239 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package blocklist
+
+import (
+	"context"
+	"encoding/xml"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// Sender is used by a Filter to send unavailable presence to blocked contacts.
+// It is satisfied by *xmpp.Session, but a server will normally provide an
+// implementation that routes stanzas to the correct session.
+type Sender interface {
+	Send(context.Context, xml.TokenReader) error
+}
+
+// Filter enforces the blocklist of a single user on a server.
+//
+// Stanzas that the user sends to blocked entities should be passed through the
+// handler returned by Outbound, and stanzas that are delivered to the user
+// through the handler returned by Inbound.
+// To keep the list up to date, the handler returned by Handler should be
+// registered on the user's multiplexer with Handle.
+// The zero value is an empty blocklist that does not send presence when an
+// entity is blocked.
+type Filter struct {
+	// Sender sends unavailable presence to entities when they are blocked.
+	// If nil, no presence is sent.
+	Sender Sender
+
+	// Resources returns the full JIDs of the user's available resources.
+	// When an entity is blocked unavailable presence is sent from each of them.
+	Resources func() []jid.JID
+
+	// Presence reports whether the blocked entity was allowed to receive the
+	// user's presence (for example, because it has a presence subscription).
+	// If nil, unavailable presence is always sent.
+	Presence func(j jid.JID) bool
+
+	m    sync.Mutex
+	jids []jid.JID
+}
+
+// Handler returns a Handler that updates the blocklist when the user sends
+// blocking commands.
+// Errors sending unavailable presence from the handler are ignored.
+func (f *Filter) Handler() Handler {
+	return Handler{
+		Block: func(item Item) {
+			/* #nosec */
+			f.Block(context.Background(), item.JID)
+		},
+		Unblock: func(j jid.JID) {
+			f.Unblock(j)
+		},
+		UnblockAll: f.UnblockAll,
+		List: func(c chan<- jid.JID) {
+			for _, j := range f.List() {
+				c <- j
+			}
+		},
+	}
+}
+
+// Block adds JIDs to the blocklist and sends unavailable presence to them from
+// each of the user's available resources.
+func (f *Filter) Block(ctx context.Context, j ...jid.JID) error {
+	var added []jid.JID
+	f.m.Lock()
+	for _, b := range j {
+		if f.contains(b) {
+			continue
+		}
+		f.jids = append(f.jids, b)
+		added = append(added, b)
+	}
+	f.m.Unlock()
+
+	if f.Sender == nil || f.Resources == nil {
+		return nil
+	}
+	resources := f.Resources()
+	for _, b := range added {
+		if f.Presence != nil && !f.Presence(b) {
+			continue
+		}
+		for _, from := range resources {
+			err := f.Sender.Send(ctx, stanza.Presence{
+				From: from,
+				To:   b,
+				Type: stanza.UnavailablePresence,
+			}.Wrap(nil))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Unblock removes JIDs from the blocklist.
+func (f *Filter) Unblock(j ...jid.JID) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	jids := f.jids[:0]
+	for _, b := range f.jids {
+		var remove bool
+		for _, u := range j {
+			if b.Equal(u) {
+				remove = true
+				break
+			}
+		}
+		if !remove {
+			jids = append(jids, b)
+		}
+	}
+	f.jids = jids
+}
+
+// UnblockAll empties the blocklist.
+func (f *Filter) UnblockAll() {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.jids = nil
+}
+
+// List returns the JIDs on the blocklist.
+func (f *Filter) List() []jid.JID {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return append([]jid.JID(nil), f.jids...)
+}
+
+// Blocked reports whether j matches any JID on the blocklist.
+func (f *Filter) Blocked(j jid.JID) bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+	for _, b := range f.jids {
+		if Match(j, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains must be called with the lock held.
+func (f *Filter) contains(j jid.JID) bool {
+	for _, b := range f.jids {
+		if b.Equal(j) {
+			return true
+		}
+	}
+	return false
+}
+
+// Inbound returns a handler that drops stanzas from blocked entities before
+// they reach h.
+// As required by XEP-0191, IQ requests are answered with a
+// service-unavailable error so that the entity cannot tell whether it has been
+// blocked, all other stanzas are dropped silently.
+func (f *Filter) Inbound(h xmpp.Handler) xmpp.Handler {
+	return xmpp.HandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		_, from := attr.Get(start.Attr, "from")
+		if !f.blockedAttr(from) {
+			return h.HandleXMPP(t, start)
+		}
+		if start.Name.Local != "iq" || !isRequest(*start) {
+			return nil
+		}
+		_, err := xmlstream.Copy(t, bounce(*start, stanza.Error{
+			Type:      stanza.Cancel,
+			Condition: stanza.ServiceUnavailable,
+		}.TokenReader()))
+		return err
+	})
+}
+
+// Outbound returns a handler that prevents stanzas sent by the user to blocked
+// entities from reaching h.
+// Instead the stanza is returned to the user with a not-acceptable error that
+// contains a blocked application error condition.
+func (f *Filter) Outbound(h xmpp.Handler) xmpp.Handler {
+	return xmpp.HandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		_, to := attr.Get(start.Attr, "to")
+		if !f.blockedAttr(to) {
+			return h.HandleXMPP(t, start)
+		}
+		if _, typ := attr.Get(start.Attr, "type"); typ == "error" || (start.Name.Local == "iq" && !isRequest(*start)) {
+			return nil
+		}
+		_, err := xmlstream.Copy(t, bounce(*start, stanza.Error{
+			Type:      stanza.Cancel,
+			Condition: stanza.NotAcceptable,
+		}.Wrap(xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Space: NSErrors, Local: "blocked"}}))))
+		return err
+	})
+}
+
+func (f *Filter) blockedAttr(addr string) bool {
+	if addr == "" {
+		return false
+	}
+	j, err := jid.Parse(addr)
+	if err != nil {
+		return false
+	}
+	return f.Blocked(j)
+}
+
+func isRequest(start xml.StartElement) bool {
+	_, typ := attr.Get(start.Attr, "type")
+	return typ == string(stanza.GetIQ) || typ == string(stanza.SetIQ)
+}
+
+// bounce returns an error stanza in response to the stanza starting with
+// start.
+func bounce(start xml.StartElement, e xml.TokenReader) xml.TokenReader {
+	attrs := []xml.Attr{{Name: xml.Name{Local: "type"}, Value: "error"}}
+	if _, id := attr.Get(start.Attr, "id"); id != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "id"}, Value: id})
+	}
+	if _, from := attr.Get(start.Attr, "from"); from != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "to"}, Value: from})
+	}
+	if _, to := attr.Get(start.Attr, "to"); to != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "from"}, Value: to})
+	}
+	return xmlstream.Wrap(e, xml.StartElement{Name: start.Name, Attr: attrs})
+}
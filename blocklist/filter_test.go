@@ -0,0 +1,156 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package blocklist_test
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/blocklist"
+	"mellium.im/xmpp/jid"
+)
+
+// presenceSender records the stanzas sent by a filter.
+type presenceSender struct {
+	sent []string
+}
+
+func (s *presenceSender) Send(_ context.Context, r xml.TokenReader) error {
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	_, err := xmlstream.Copy(e, r)
+	if err != nil {
+		return err
+	}
+	err = e.Flush()
+	if err != nil {
+		return err
+	}
+	s.sent = append(s.sent, b.String())
+	return nil
+}
+
+var filterTests = [...]struct {
+	inbound bool
+	in      string
+	out     string
+	handled bool
+}{
+	0: {
+		in:      `<message xmlns="jabber:client" to="juliet@example.com/balcony" id="1"><body>Hi</body></message>`,
+		handled: true,
+	},
+	1: {
+		in:  `<message xmlns="jabber:client" to="tybalt@example.com/street" id="1"><body>Hi</body></message>`,
+		out: `<message xmlns="jabber:client" type="error" id="1" from="tybalt@example.com/street"><error type="cancel"><not-acceptable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></not-acceptable><blocked xmlns="urn:xmpp:blocking:errors"></blocked></error></message>`,
+	},
+	2: {
+		in:  `<iq xmlns="jabber:client" to="capulet.example" type="get" id="2"><query xmlns="jabber:iq:version"/></iq>`,
+		out: `<iq xmlns="jabber:client" type="error" id="2" from="capulet.example"><error type="cancel"><not-acceptable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></not-acceptable><blocked xmlns="urn:xmpp:blocking:errors"></blocked></error></iq>`,
+	},
+	3: {
+		in: `<message xmlns="jabber:client" to="tybalt@example.com" type="error" id="3"/>`,
+	},
+	4: {
+		inbound: true,
+		in:      `<message xmlns="jabber:client" from="tybalt@example.com/street" to="romeo@example.net" id="4"><body>Draw</body></message>`,
+	},
+	5: {
+		inbound: true,
+		in:      `<iq xmlns="jabber:client" from="tybalt@example.com/street" to="romeo@example.net/orchard" type="get" id="5"><ping xmlns="urn:xmpp:ping"/></iq>`,
+		out:     `<iq xmlns="jabber:client" type="error" id="5" to="tybalt@example.com/street" from="romeo@example.net/orchard"><error type="cancel"><service-unavailable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></service-unavailable></error></iq>`,
+	},
+	6: {
+		inbound: true,
+		in:      `<presence xmlns="jabber:client" from="benvolio@example.net/street" to="romeo@example.net"/>`,
+		handled: true,
+	},
+}
+
+func TestFilter(t *testing.T) {
+	romeo := jid.MustParse("romeo@example.net/orchard")
+	sender := &presenceSender{}
+	f := &blocklist.Filter{
+		Sender: sender,
+		Resources: func() []jid.JID {
+			return []jid.JID{romeo}
+		},
+		Presence: func(j jid.JID) bool {
+			return j.Localpart() != ""
+		},
+	}
+	err := f.Block(context.Background(), jid.MustParse("tybalt@example.com"), jid.MustParse("capulet.example"), jid.MustParse("tybalt@example.com"))
+	if err != nil {
+		t.Fatalf("error blocking: %v", err)
+	}
+	if want := []string{`<presence type="unavailable" to="tybalt@example.com" from="romeo@example.net/orchard"></presence>`}; !reflect.DeepEqual(sender.sent, want) {
+		t.Errorf("wrong presence sent on block:\nwant=%v,\n got=%v", want, sender.sent)
+	}
+	if l := f.List(); len(l) != 2 {
+		t.Errorf("duplicate JIDs should not be added to the list, got %v", l)
+	}
+
+	for i, tc := range filterTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var handled bool
+			var h xmpp.Handler = xmpp.HandlerFunc(func(xmlstream.TokenReadEncoder, *xml.StartElement) error {
+				handled = true
+				return nil
+			})
+			if tc.inbound {
+				h = f.Inbound(h)
+			} else {
+				h = f.Outbound(h)
+			}
+
+			d := xml.NewDecoder(strings.NewReader(tc.in))
+			tok, err := d.Token()
+			if err != nil {
+				t.Fatalf("error decoding stanza: %v", err)
+			}
+			start := tok.(xml.StartElement)
+			var b strings.Builder
+			e := xml.NewEncoder(&b)
+			err = h.HandleXMPP(struct {
+				xml.TokenReader
+				xmlstream.Encoder
+			}{
+				TokenReader: d,
+				Encoder:     e,
+			}, &start)
+			if err != nil {
+				t.Fatalf("error handling stanza: %v", err)
+			}
+			err = e.Flush()
+			if err != nil {
+				t.Fatalf("error flushing: %v", err)
+			}
+			if out := b.String(); out != tc.out {
+				t.Errorf("wrong output:\nwant=%s,\n got=%s", tc.out, out)
+			}
+			if handled != tc.handled {
+				t.Errorf("wrong value for handled: want=%t, got=%t", tc.handled, handled)
+			}
+		})
+	}
+
+	f.Unblock(jid.MustParse("tybalt@example.com"))
+	if f.Blocked(jid.MustParse("tybalt@example.com/street")) {
+		t.Errorf("JID still blocked after unblocking")
+	}
+	if !f.Blocked(jid.MustParse("paris@capulet.example")) {
+		t.Errorf("JIDs at a blocked domain should be blocked")
+	}
+	f.UnblockAll()
+	if l := f.List(); len(l) != 0 {
+		t.Errorf("list not empty after unblocking all: %v", l)
+	}
+}
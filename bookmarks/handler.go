@@ -5,11 +5,26 @@
 package bookmarks
 
 import (
+	"encoding/xml"
+
 	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/pubsub"
+	"mellium.im/xmpp/stanza"
 )
 
 // Handler can be registered against a mux to handle bookmark pushes.
+//
+// To receive pushes the handler should also be registered for the NS node
+// using a pubsub.Events.
+// Events are not checked to make sure that they originate from the user's own
+// account, this is the responsibility of the caller.
 type Handler struct {
+	// Publish is called when a bookmark is added or updated.
+	Publish func(Channel)
+
+	// Retract is called when a bookmark is removed.
+	Retract func(jid.JID)
 }
 
 // ForFeatures implements info.FeatureIter.
@@ -24,3 +39,34 @@ func (h Handler) ForFeatures(node string, f func(info.Feature) error) error {
 	}
 	return f(Feature)
 }
+
+// HandleEvent implements pubsub.Handler.
+func (h Handler) HandleEvent(_ stanza.Message, e pubsub.Event) error {
+	switch e.Type {
+	case pubsub.EventItem:
+		if h.Publish == nil {
+			return nil
+		}
+		j, err := jid.Parse(e.ID)
+		if err != nil {
+			return err
+		}
+		var bookmark Channel
+		err = xml.NewTokenDecoder(e.Item).Decode(&bookmark)
+		if err != nil {
+			return err
+		}
+		bookmark.JID = j
+		h.Publish(bookmark)
+	case pubsub.EventRetract:
+		if h.Retract == nil {
+			return nil
+		}
+		j, err := jid.Parse(e.ID)
+		if err != nil {
+			return err
+		}
+		h.Retract(j)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package bookmarks_test
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"mellium.im/xmpp/bookmarks"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/pubsub"
+	"mellium.im/xmpp/stanza"
+)
+
+var _ pubsub.Handler = bookmarks.Handler{}
+
+func TestHandleEvent(t *testing.T) {
+	var (
+		published bookmarks.Channel
+		retracted jid.JID
+	)
+	h := bookmarks.Handler{
+		Publish: func(c bookmarks.Channel) {
+			published = c
+		},
+		Retract: func(j jid.JID) {
+			retracted = j
+		},
+	}
+
+	d := xml.NewDecoder(strings.NewReader(`<conference xmlns="urn:xmpp:bookmarks:1" name="The Play's the Thing" autojoin="true"><nick>JC</nick></conference>`))
+	err := h.HandleEvent(stanza.Message{}, pubsub.Event{
+		Type: pubsub.EventItem,
+		Node: bookmarks.NS,
+		ID:   "theplay@conference.shakespeare.lit",
+		Item: d,
+	})
+	if err != nil {
+		t.Fatalf("error handling publish: %v", err)
+	}
+	if published.JID.String() != "theplay@conference.shakespeare.lit" || published.Nick != "JC" || !published.Autojoin {
+		t.Errorf("wrong bookmark published: %+v", published)
+	}
+
+	err = h.HandleEvent(stanza.Message{}, pubsub.Event{
+		Type: pubsub.EventRetract,
+		Node: bookmarks.NS,
+		ID:   "theplay@conference.shakespeare.lit",
+	})
+	if err != nil {
+		t.Fatalf("error handling retract: %v", err)
+	}
+	if retracted.String() != "theplay@conference.shakespeare.lit" {
+		t.Errorf("wrong bookmark retracted: %v", retracted)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package carbons
+
+import (
+	"context"
+	"encoding/xml"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/delay"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/xmltok"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// NSHints is the namespace of the message processing hints that may be used to
+// prevent a message from being carbon copied.
+const NSHints = "urn:xmpp:hints"
+
+// Sender is used by a Service to send carbon copies.
+// It is satisfied by *xmpp.Session, but a server will normally provide an
+// implementation that routes stanzas to the correct session.
+type Sender interface {
+	Send(context.Context, xml.TokenReader) error
+}
+
+// HandleService returns an option that registers a carbons service on the mux.
+func HandleService(srv *Service) mux.Option {
+	return func(m *mux.ServeMux) {
+		mux.IQ(stanza.SetIQ, xml.Name{Space: NS, Local: "enable"}, srv)(m)
+		mux.IQ(stanza.SetIQ, xml.Name{Space: NS, Local: "disable"}, srv)(m)
+	}
+}
+
+// Service tracks which of a server's connected resources have enabled carbons
+// and sends them copies of messages.
+//
+// The IQ handled by the service must have its from attribute set to the full
+// JID of the requesting resource.
+// As the server routes messages it should call Received for each message that
+// is delivered to a user and Sent for each message that a user sends.
+// The zero value is a service with no carbon-enabled resources that does not
+// send copies.
+type Service struct {
+	// Sender sends carbon copies.
+	// If nil, nothing is sent.
+	Sender Sender
+
+	m       sync.Mutex
+	enabled map[string]map[string]jid.JID
+}
+
+// HandleIQ implements mux.IQHandler.
+func (srv *Service) HandleIQ(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	user := iq.From.Bare()
+	switch {
+	case iq.From.Equal(jid.JID{}) || iq.From.Resourcepart() == "":
+		_, err := xmlstream.Copy(r, iq.Error(stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}))
+		return err
+	case !iq.To.Equal(jid.JID{}) && !iq.To.Equal(user):
+		_, err := xmlstream.Copy(r, iq.Error(stanza.Error{Type: stanza.Auth, Condition: stanza.Forbidden}))
+		return err
+	}
+
+	if start.Name.Local == "enable" {
+		srv.Enable(iq.From)
+	} else {
+		srv.Disable(iq.From)
+	}
+	_, err := xmlstream.Copy(r, iq.Result(nil))
+	return err
+}
+
+// ForFeatures implements info.FeatureIter.
+func (srv *Service) ForFeatures(node string, f func(info.Feature) error) error {
+	return Handler{}.ForFeatures(node, f)
+}
+
+// Enable starts sending carbon copies to the resource j.
+func (srv *Service) Enable(j jid.JID) {
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	if srv.enabled == nil {
+		srv.enabled = make(map[string]map[string]jid.JID)
+	}
+	bare := j.Bare().String()
+	resources := srv.enabled[bare]
+	if resources == nil {
+		resources = make(map[string]jid.JID)
+		srv.enabled[bare] = resources
+	}
+	resources[j.String()] = j
+}
+
+// Disable stops sending carbon copies to the resource j.
+// If j is a bare JID, carbons are disabled for all of its resources.
+func (srv *Service) Disable(j jid.JID) {
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	bare := j.Bare().String()
+	if j.Resourcepart() == "" {
+		delete(srv.enabled, bare)
+		return
+	}
+	resources := srv.enabled[bare]
+	delete(resources, j.String())
+	if len(resources) == 0 {
+		delete(srv.enabled, bare)
+	}
+}
+
+// Unavailable forgets the resource j and should be called when its session
+// ends.
+// It is equivalent to Disable.
+func (srv *Service) Unavailable(j jid.JID) {
+	srv.Disable(j)
+}
+
+// Enabled reports whether the resource j has enabled carbons.
+func (srv *Service) Enabled(j jid.JID) bool {
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	_, ok := srv.enabled[j.Bare().String()][j.String()]
+	return ok
+}
+
+// Received sends copies of a message that is being delivered to a user to each
+// of the user's other carbon-enabled resources.
+// The resource in the to attribute of the message and any resources in
+// delivered are considered to have received the original message and do not
+// get a copy.
+//
+// Only chat messages and normal messages with a body are copied, and messages
+// that contain a private element or a no-copy hint are never copied.
+func (srv *Service) Received(ctx context.Context, msg xml.TokenReader, delivered ...jid.JID) error {
+	return srv.copyMessage(ctx, msg, false, delivered)
+}
+
+// Sent sends copies of a message that was sent by a user to each of the user's
+// other carbon-enabled resources.
+// The resource in the from attribute of the message does not get a copy.
+//
+// The same messages that are copied by Received are copied by Sent.
+func (srv *Service) Sent(ctx context.Context, msg xml.TokenReader) error {
+	return srv.copyMessage(ctx, msg, true, nil)
+}
+
+func (srv *Service) copyMessage(ctx context.Context, msg xml.TokenReader, sent bool, skip []jid.JID) error {
+	toks, err := xmlstream.ReadAll(msg)
+	if err != nil {
+		return err
+	}
+	if len(toks) == 0 {
+		return nil
+	}
+	start, ok := toks[0].(xml.StartElement)
+	if !ok || start.Name.Local != "message" || !eligible(toks) {
+		return nil
+	}
+
+	addrAttr := "to"
+	if sent {
+		addrAttr = "from"
+	}
+	_, addr := attr.Get(start.Attr, addrAttr)
+	j, err := jid.Parse(addr)
+	if err != nil {
+		return err
+	}
+	skip = append(skip, j)
+	user := j.Bare()
+
+	var resources []jid.JID
+	srv.m.Lock()
+outer:
+	for _, res := range srv.enabled[user.String()] {
+		for _, s := range skip {
+			if res.Equal(s) {
+				continue outer
+			}
+		}
+		resources = append(resources, res)
+	}
+	srv.m.Unlock()
+
+	if srv.Sender == nil {
+		return nil
+	}
+	wrap := WrapReceived
+	if sent {
+		wrap = WrapSent
+	}
+	_, typ := attr.Get(start.Attr, "type")
+	if typ == "" {
+		typ = string(stanza.NormalMessage)
+	}
+	d := delay.Delay{Time: time.Now()}
+	for _, res := range resources {
+		err = srv.Sender.Send(ctx, stanza.Message{
+			From: user,
+			To:   res,
+			Type: stanza.MessageType(typ),
+		}.Wrap(wrap(d, xmltok.Replay(toks))))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eligible reports whether the message stanza in toks should be carbon copied.
+func eligible(toks []xml.Token) bool {
+	start := toks[0].(xml.StartElement)
+	_, typ := attr.Get(start.Attr, "type")
+	var hasBody bool
+	var depth int
+	for _, tok := range toks[1:] {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth != 1 {
+				continue
+			}
+			switch t.Name {
+			case xml.Name{Space: NS, Local: "private"},
+				xml.Name{Space: NSHints, Local: "no-copy"},
+				xml.Name{Space: NS, Local: "received"},
+				xml.Name{Space: NS, Local: "sent"}:
+				return false
+			}
+			if t.Name.Local == "body" && (t.Name.Space == "" || t.Name.Space == start.Name.Space) {
+				hasBody = true
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	switch stanza.MessageType(typ) {
+	case stanza.ChatMessage:
+		return true
+	case "", stanza.NormalMessage:
+		return hasBody
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package carbons_test
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/carbons"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var stampRegexp = regexp.MustCompile(`stamp="[^"]*"`)
+
+// recordSender records the stanzas sent by a service with the delay timestamps
+// removed.
+type recordSender struct {
+	sent []string
+}
+
+func (s *recordSender) Send(_ context.Context, r xml.TokenReader) error {
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	_, err := xmlstream.Copy(e, r)
+	if err != nil {
+		return err
+	}
+	err = e.Flush()
+	if err != nil {
+		return err
+	}
+	s.sent = append(s.sent, stampRegexp.ReplaceAllString(b.String(), `stamp=""`))
+	return nil
+}
+
+func serviceHandle(t *testing.T, m *mux.ServeMux, in string) string {
+	t.Helper()
+	d := xml.NewDecoder(strings.NewReader(in))
+	tok, err := d.Token()
+	if err != nil {
+		t.Fatalf("error decoding stanza: %v", err)
+	}
+	start := tok.(xml.StartElement)
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	err = m.HandleXMPP(struct {
+		xml.TokenReader
+		xmlstream.Encoder
+	}{
+		TokenReader: d,
+		Encoder:     e,
+	}, &start)
+	if err != nil {
+		t.Fatalf("error handling stanza: %v", err)
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	return b.String()
+}
+
+func TestServiceEnable(t *testing.T) {
+	srv := &carbons.Service{}
+	m := mux.New(stanza.NSClient, carbons.HandleService(srv))
+
+	out := serviceHandle(t, m, `<iq xmlns="jabber:client" type="set" id="1" from="romeo@example.net/orchard"><enable xmlns="urn:xmpp:carbons:2"/></iq>`)
+	if want := `<iq xmlns="jabber:client" type="result" to="romeo@example.net/orchard" id="1"></iq>`; out != want {
+		t.Errorf("wrong response to enable:\nwant=%s,\n got=%s", want, out)
+	}
+	if !srv.Enabled(jid.MustParse("romeo@example.net/orchard")) {
+		t.Errorf("expected carbons to be enabled")
+	}
+
+	out = serviceHandle(t, m, `<iq xmlns="jabber:client" type="set" id="2" from="romeo@example.net/orchard" to="juliet@example.com"><enable xmlns="urn:xmpp:carbons:2"/></iq>`)
+	if !strings.Contains(out, `type="error"`) || !strings.Contains(out, "<forbidden") {
+		t.Errorf("expected forbidden error enabling carbons for another user, got: %s", out)
+	}
+
+	serviceHandle(t, m, `<iq xmlns="jabber:client" type="set" id="3" from="romeo@example.net/orchard"><disable xmlns="urn:xmpp:carbons:2"/></iq>`)
+	if srv.Enabled(jid.MustParse("romeo@example.net/orchard")) {
+		t.Errorf("expected carbons to be disabled")
+	}
+}
+
+var copyTests = [...]struct {
+	sent bool
+	in   string
+	to   []string
+}{
+	0: {
+		in: `<message xmlns="jabber:client" type="chat" from="juliet@example.com/balcony" to="romeo@example.net/orchard"><body>Art thou not Romeo?</body></message>`,
+		to: []string{"romeo@example.net/garden", "romeo@example.net/street"},
+	},
+	1: {
+		sent: true,
+		in:   `<message xmlns="jabber:client" type="chat" from="romeo@example.net/street" to="juliet@example.com"><body>Neither, fair saint</body></message>`,
+		to:   []string{"romeo@example.net/garden", "romeo@example.net/orchard"},
+	},
+	2: {
+		in: `<message xmlns="jabber:client" from="juliet@example.com/balcony" to="romeo@example.net/orchard"><body>Wherefore?</body></message>`,
+		to: []string{"romeo@example.net/garden", "romeo@example.net/street"},
+	},
+	3: {
+		in: `<message xmlns="jabber:client" from="juliet@example.com/balcony" to="romeo@example.net/orchard"><subject>No body</subject></message>`,
+	},
+	4: {
+		in: `<message xmlns="jabber:client" type="groupchat" from="room@muc.example.com/juliet" to="romeo@example.net/orchard"><body>Hi</body></message>`,
+	},
+	5: {
+		in: `<message xmlns="jabber:client" type="chat" from="juliet@example.com/balcony" to="romeo@example.net/orchard"><body>Secret</body><private xmlns="urn:xmpp:carbons:2"/></message>`,
+	},
+	6: {
+		sent: true,
+		in:   `<message xmlns="jabber:client" type="chat" from="romeo@example.net/street" to="juliet@example.com"><body>Secret</body><no-copy xmlns="urn:xmpp:hints"/></message>`,
+	},
+	7: {
+		in: `<message xmlns="jabber:client" type="chat" from="juliet@example.com/balcony" to="romeo@example.net"><body>To all</body></message>`,
+		to: []string{"romeo@example.net/garden", "romeo@example.net/orchard", "romeo@example.net/street"},
+	},
+	8: {
+		in: `<message xmlns="jabber:client" type="chat" from="juliet@example.com/balcony" to="benvolio@example.net/street"><body>Not enabled</body></message>`,
+	},
+}
+
+func TestServiceCopy(t *testing.T) {
+	for i, tc := range copyTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			sender := &recordSender{}
+			srv := &carbons.Service{Sender: sender}
+			srv.Enable(jid.MustParse("romeo@example.net/orchard"))
+			srv.Enable(jid.MustParse("romeo@example.net/garden"))
+			srv.Enable(jid.MustParse("romeo@example.net/street"))
+			srv.Enable(jid.MustParse("romeo@example.net/tomb"))
+			srv.Unavailable(jid.MustParse("romeo@example.net/tomb"))
+
+			var err error
+			if tc.sent {
+				err = srv.Sent(context.Background(), xml.NewDecoder(strings.NewReader(tc.in)))
+			} else {
+				err = srv.Received(context.Background(), xml.NewDecoder(strings.NewReader(tc.in)))
+			}
+			if err != nil {
+				t.Fatalf("error copying message: %v", err)
+			}
+
+			wrapper := "received"
+			if tc.sent {
+				wrapper = "sent"
+			}
+			var want []string
+			for _, to := range tc.to {
+				want = append(want, `<message type="`+typeOf(tc.in)+`" to="`+to+`" from="romeo@example.net"><`+wrapper+` xmlns="urn:xmpp:carbons:2"><forwarded xmlns="urn:xmpp:forward:0"><delay xmlns="urn:xmpp:delay" stamp=""></delay>`+reencode(t, tc.in)+`</forwarded></`+wrapper+`></message>`)
+			}
+			sort.Strings(sender.sent)
+			if !reflect.DeepEqual(sender.sent, want) {
+				t.Errorf("wrong copies:\nwant=%v,\n got=%v", want, sender.sent)
+			}
+		})
+	}
+}
+
+func typeOf(in string) string {
+	if strings.Contains(in, `type="chat"`) {
+		return "chat"
+	}
+	return "normal"
+}
+
+func reencode(t *testing.T, in string) string {
+	t.Helper()
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	_, err := xmlstream.Copy(e, xml.NewDecoder(strings.NewReader(in)))
+	if err != nil {
+		t.Fatalf("error encoding message: %v", err)
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	return b.String()
+}
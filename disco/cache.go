@@ -0,0 +1,260 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/crypto"
+	"mellium.im/xmpp/internal/xmltok"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// ErrVerify is returned by CapsCache when the service discovery information
+// returned by an entity does not match the verification string that it
+// advertised.
+var ErrVerify = errors.New("disco: entity caps verification failed")
+
+// CapsStore is used by a CapsCache to persist verified service discovery
+// information between sessions.
+// Info is keyed by the hash algorithm and verification string of the entity
+// capabilities that it was verified against.
+type CapsStore interface {
+	// GetCaps returns the info previously stored for the hash and verification
+	// string.
+	// If no info is stored, ok is false.
+	GetCaps(ctx context.Context, h crypto.Hash, ver string) (info Info, ok bool, err error)
+
+	// PutCaps stores info for the hash and verification string.
+	PutCaps(ctx context.Context, h crypto.Hash, ver string, info Info) error
+}
+
+type capsKey struct {
+	hash crypto.Hash
+	ver  string
+}
+
+type capsCall struct {
+	done chan struct{}
+	info Info
+	err  error
+}
+
+// CapsCache keeps track of the entity capabilities advertised by other entities
+// and caches the service discovery information that they correspond to.
+// This lets the features supported by an entity be checked without querying it
+// every time, and lets entities that advertise the same capabilities (for
+// example, many users running the same client) share a single query.
+//
+// Service discovery information is only cached after it has been verified
+// against the advertised verification string.
+// Verified information is kept in memory and, if Store is set, persisted.
+// The zero value is ready to use, but Session must be set before any
+// information can be fetched.
+type CapsCache struct {
+	// Session is used to query entities for service discovery information when
+	// it is not already cached.
+	Session *xmpp.Session
+
+	// Store, if set, is used to persist verified service discovery information.
+	Store CapsStore
+
+	m       sync.Mutex
+	info    map[capsKey]Info
+	addrs   map[string]Caps
+	pending map[capsKey]*capsCall
+}
+
+// Handler returns a handler that records the entity capabilities advertised in
+// incoming presence before passing it on to h.
+// Available presence that contains entity capabilities replaces any that were
+// previously recorded for the sender, and unavailable presence or available
+// presence without entity capabilities removes them.
+// Service discovery information is not fetched until it is first needed.
+// All stanzas are passed to h unchanged.
+func (c *CapsCache) Handler(h xmpp.Handler) xmpp.Handler {
+	return xmpp.HandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		if start.Name.Local != "presence" {
+			return h.HandleXMPP(t, start)
+		}
+		p, err := stanza.NewPresence(*start)
+		if err != nil {
+			return err
+		}
+		if p.Type != stanza.AvailablePresence && p.Type != stanza.UnavailablePresence {
+			return h.HandleXMPP(t, start)
+		}
+		inner, err := xmlstream.ReadAll(xmlstream.Inner(t))
+		if err != nil {
+			return err
+		}
+		toks := append([]xml.Token{start.Copy()}, inner...)
+		toks = append(toks, start.End())
+		var s struct {
+			stanza.Presence
+			Caps *Caps
+		}
+		err = xml.NewTokenDecoder(xmltok.Replay(toks)).Decode(&s)
+		if err != nil {
+			return err
+		}
+		if p.Type == stanza.AvailablePresence && s.Caps != nil {
+			c.Set(p.From, *s.Caps)
+		} else {
+			c.Remove(p.From)
+		}
+		return h.HandleXMPP(struct {
+			xml.TokenReader
+			xmlstream.Encoder
+		}{
+			TokenReader: xmltok.Replay(append(inner, start.End())),
+			Encoder:     t,
+		}, start)
+	})
+}
+
+// Set records the entity capabilities currently advertised by j.
+func (c *CapsCache) Set(j jid.JID, caps Caps) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.addrs == nil {
+		c.addrs = make(map[string]Caps)
+	}
+	c.addrs[j.String()] = caps
+}
+
+// Remove forgets the entity capabilities advertised by j.
+// Cached service discovery information is not removed.
+func (c *CapsCache) Remove(j jid.JID) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.addrs, j.String())
+}
+
+// Caps returns the entity capabilities currently advertised by j.
+// If no entity capabilities are known for j, ok is false.
+func (c *CapsCache) Caps(j jid.JID) (caps Caps, ok bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	caps, ok = c.addrs[j.String()]
+	return caps, ok
+}
+
+// Info returns the service discovery information for the entity capabilities
+// currently advertised by j.
+// If no entity capabilities are known for j, ok is false and no query is sent.
+// For more information see Lookup.
+func (c *CapsCache) Info(ctx context.Context, j jid.JID) (info Info, ok bool, err error) {
+	caps, ok := c.Caps(j)
+	if !ok {
+		return Info{}, false, nil
+	}
+	info, err = c.Lookup(ctx, j, caps)
+	return info, true, err
+}
+
+// Supports reports whether the full JID j supports the feature.
+// If no entity capabilities are known for j, Supports returns false without
+// sending a query.
+func (c *CapsCache) Supports(ctx context.Context, j jid.JID, feature string) (bool, error) {
+	info, ok, err := c.Info(ctx, j)
+	if !ok || err != nil {
+		return false, err
+	}
+	for _, f := range info.Features {
+		if f.Var == feature {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Lookup returns the service discovery information corresponding to caps.
+//
+// If the information is not cached, the node "node#ver" is queried on j and the
+// result is verified before it is cached and returned.
+// If another lookup for the same capabilities is already in progress, Lookup
+// waits for its result (including any error) instead of sending a second
+// query.
+// If verification fails, ErrVerify is returned and nothing is cached.
+func (c *CapsCache) Lookup(ctx context.Context, j jid.JID, caps Caps) (Info, error) {
+	key := capsKey{hash: caps.Hash, ver: caps.Ver}
+
+	c.m.Lock()
+	if info, ok := c.info[key]; ok {
+		c.m.Unlock()
+		return info, nil
+	}
+	call, ok := c.pending[key]
+	if !ok {
+		call = &capsCall{done: make(chan struct{})}
+		if c.pending == nil {
+			c.pending = make(map[capsKey]*capsCall)
+		}
+		c.pending[key] = call
+	}
+	c.m.Unlock()
+
+	if ok {
+		select {
+		case <-call.done:
+			return call.info, call.err
+		case <-ctx.Done():
+			return Info{}, ctx.Err()
+		}
+	}
+
+	call.info, call.err = c.load(ctx, j, caps)
+	c.m.Lock()
+	if call.err == nil {
+		if c.info == nil {
+			c.info = make(map[capsKey]Info)
+		}
+		c.info[key] = call.info
+	}
+	delete(c.pending, key)
+	c.m.Unlock()
+	close(call.done)
+	return call.info, call.err
+}
+
+func (c *CapsCache) load(ctx context.Context, j jid.JID, caps Caps) (Info, error) {
+	if c.Store != nil {
+		info, ok, err := c.Store.GetCaps(ctx, caps.Hash, caps.Ver)
+		if err != nil {
+			return Info{}, err
+		}
+		if ok {
+			return info, nil
+		}
+	}
+
+	if !caps.Hash.Available() {
+		return Info{}, crypto.ErrUnlinkedAlgo
+	}
+	if c.Session == nil {
+		return Info{}, errors.New("disco: no session configured on caps cache")
+	}
+	info, err := GetInfo(ctx, caps.Node+"#"+caps.Ver, j, c.Session)
+	if err != nil {
+		return Info{}, err
+	}
+	if info.Hash(caps.Hash.New()) != caps.Ver {
+		return Info{}, ErrVerify
+	}
+	if c.Store != nil {
+		err = c.Store.PutCaps(ctx, caps.Hash, caps.Ver, info)
+		if err != nil {
+			return Info{}, err
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/xml"
+	"errors"
+	"sync"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/crypto"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/ping"
+	"mellium.im/xmpp/stanza"
+)
+
+type capsStore struct {
+	m    sync.Mutex
+	info map[string]disco.Info
+}
+
+func (s *capsStore) GetCaps(_ context.Context, h crypto.Hash, ver string) (disco.Info, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	info, ok := s.info[h.String()+ver]
+	return info, ok, nil
+}
+
+func (s *capsStore) PutCaps(_ context.Context, h crypto.Hash, ver string, info disco.Info) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.info == nil {
+		s.info = make(map[string]disco.Info)
+	}
+	s.info[h.String()+ver] = info
+	return nil
+}
+
+func TestCapsCache(t *testing.T) {
+	const (
+		capsNode = "https://mellium.im/xmpp"
+		feature  = "urn:xmpp:bookmarks:1+notify"
+	)
+	serverInfo := disco.Info{
+		Identity: []info.Identity{{Category: "client", Type: "pc", Name: "Test"}},
+		Features: []info.Feature{{Var: disco.NSInfo}, {Var: feature}},
+	}
+	ver := serverInfo.Hash(sha1.New())
+
+	var m sync.Mutex
+	var queries []string
+	handler := mux.New(stanza.NSClient, mux.IQFunc(stanza.GetIQ, xml.Name{Space: disco.NSInfo, Local: "query"}, func(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		var node string
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "node" {
+				node = attr.Value
+			}
+		}
+		m.Lock()
+		queries = append(queries, node)
+		m.Unlock()
+		resp := serverInfo
+		resp.Node = node
+		_, err := xmlstream.Copy(t, iq.Result(resp.TokenReader()))
+		return err
+	}))
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(handler))
+	defer cs.Close()
+
+	store := &capsStore{}
+	cache := &disco.CapsCache{Session: cs.Client, Store: store}
+	ctx := context.Background()
+	good := jid.MustParse("juliet@example.com/balcony")
+	other := jid.MustParse("romeo@example.net/orchard")
+	bad := jid.MustParse("iago@example.org/lies")
+
+	ok, err := cache.Supports(ctx, good, feature)
+	if err != nil || ok {
+		t.Fatalf("unexpected support before caps were known: %t, %v", ok, err)
+	}
+
+	cache.Set(good, disco.Caps{Hash: crypto.SHA1, Node: capsNode, Ver: ver})
+	cache.Set(other, disco.Caps{Hash: crypto.SHA1, Node: capsNode, Ver: ver})
+	cache.Set(bad, disco.Caps{Hash: crypto.SHA1, Node: capsNode, Ver: "bad"})
+
+	for _, j := range []jid.JID{good, other} {
+		ok, err = cache.Supports(ctx, j, feature)
+		if err != nil {
+			t.Fatalf("error checking support for %s: %v", j, err)
+		}
+		if !ok {
+			t.Errorf("expected %s to support %s", j, feature)
+		}
+		ok, err = cache.Supports(ctx, j, "urn:example")
+		if err != nil || ok {
+			t.Errorf("unexpected support for unknown feature: %t, %v", ok, err)
+		}
+	}
+	if want := []string{capsNode + "#" + ver}; len(queries) != 1 || queries[0] != want[0] {
+		t.Errorf("wrong queries: want=%v, got=%v", want, queries)
+	}
+
+	_, err = cache.Supports(ctx, bad, feature)
+	if !errors.Is(err, disco.ErrVerify) {
+		t.Errorf("wrong error for bad verification string: want=%v, got=%v", disco.ErrVerify, err)
+	}
+	if _, ok, _ := store.GetCaps(ctx, crypto.SHA1, "bad"); ok {
+		t.Errorf("unverified info was persisted")
+	}
+
+	cache.Remove(good)
+	if _, ok := cache.Caps(good); ok {
+		t.Errorf("caps were not removed")
+	}
+
+	// A new cache using the same store should not need to query again.
+	m.Lock()
+	queries = queries[:0]
+	m.Unlock()
+	cache = &disco.CapsCache{Session: cs.Client, Store: store}
+	cache.Set(good, disco.Caps{Hash: crypto.SHA1, Node: capsNode, Ver: ver})
+	ok, err = cache.Supports(ctx, good, feature)
+	if err != nil || !ok {
+		t.Errorf("expected support from persisted info: %t, %v", ok, err)
+	}
+	if len(queries) != 0 {
+		t.Errorf("unexpected queries: %v", queries)
+	}
+}
+
+func TestCapsCacheHandler(t *testing.T) {
+	cache := &disco.CapsCache{}
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(cache.Handler(mux.New(stanza.NSClient, ping.Handle()))))
+	defer cs.Close()
+
+	from := jid.MustParse("juliet@example.com/balcony")
+	want := disco.Caps{Hash: crypto.SHA1, Node: "https://mellium.im/xmpp", Ver: "ver"}
+	send := func(p stanza.Presence, payload xml.TokenReader) {
+		t.Helper()
+		err := cs.Client.Send(context.Background(), p.Wrap(payload))
+		if err != nil {
+			t.Fatalf("error sending presence: %v", err)
+		}
+		// Wait for the presence to be handled.
+		err = ping.Send(context.Background(), cs.Client, jid.JID{})
+		if err != nil {
+			t.Fatalf("error sending ping: %v", err)
+		}
+	}
+
+	send(stanza.Presence{From: from}, want.TokenReader())
+	got, ok := cache.Caps(from)
+	if !ok {
+		t.Fatalf("caps not recorded for %s", from)
+	}
+	got.XMLName = xml.Name{}
+	if got != want {
+		t.Errorf("wrong caps: want=%+v, got=%+v", want, got)
+	}
+
+	// Presence without caps means that the entity no longer advertises any.
+	send(stanza.Presence{From: from}, nil)
+	if _, ok := cache.Caps(from); ok {
+		t.Errorf("caps not removed after presence without caps")
+	}
+
+	send(stanza.Presence{From: from}, want.TokenReader())
+	send(stanza.Presence{From: from, Type: stanza.UnavailablePresence}, nil)
+	if _, ok := cache.Caps(from); ok {
+		t.Errorf("caps not removed after unavailable presence")
+	}
+}
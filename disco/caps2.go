@@ -0,0 +1,248 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"sort"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/crypto"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// Separators used in the XEP-0390 hash function input.
+const (
+	unitSep   = 0x1f
+	recordSep = 0x1e
+	groupSep  = 0x1d
+	fileSep   = 0x1c
+)
+
+// HandleCaps2 calls f for each incoming presence containing Entity
+// Capabilities 2.0 information.
+func HandleCaps2(f func(stanza.Presence, Caps2)) mux.Option {
+	return mux.PresenceFunc("", xml.Name{Space: NSCaps2, Local: "c"}, func(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+		s := struct {
+			stanza.Presence
+			Caps Caps2
+		}{}
+		err := xml.NewTokenDecoder(r).Decode(&s)
+		if err != nil {
+			return err
+		}
+		f(p, s.Caps)
+		return nil
+	})
+}
+
+// StreamFeature2 is an informational stream feature that saves any Entity
+// Capabilities 2.0 information that was published by the server during session
+// negotiation.
+// StreamFeature2 should not be used on the server side.
+func StreamFeature2() xmpp.StreamFeature {
+	return xmpp.StreamFeature{
+		Name: xml.Name{Space: NSCaps2, Local: "c"},
+		Parse: func(ctx context.Context, d *xml.Decoder, start *xml.StartElement) (bool, interface{}, error) {
+			c := Caps2{}
+			err := d.DecodeElement(&c, start)
+			return false, c, err
+		},
+	}
+}
+
+// ServerCaps2 returns any Entity Capabilities 2.0 information advertised by the
+// server when we first connected.
+// If the StreamFeature2 feature was not used during session negotiation or no
+// caps were advertised when connecting, ok will be false.
+func ServerCaps2(s *xmpp.Session) (c Caps2, ok bool) {
+	data, advertised := s.Feature(NSCaps2)
+	c, ok = data.(Caps2)
+	return c, ok && advertised
+}
+
+// Caps2 can be included in a presence stanza or in stream features to advertise
+// entity capabilities using Entity Capabilities 2.0 (XEP-0390).
+// Unlike Caps it may contain the output of several hash functions over the same
+// Info.
+//
+// Caps2 and Caps use different namespaces and both may be included in the same
+// presence to advertise capabilities to entities that only support one of
+// them.
+type Caps2 struct {
+	XMLName xml.Name            `xml:"urn:xmpp:caps c"`
+	Hashes  []crypto.HashOutput `xml:"urn:xmpp:hashes:2 hash"`
+}
+
+// TokenReader implements xmlstream.Marshaler.
+// TokenReader panics if any of the hashes are invalid.
+func (c Caps2) TokenReader() xml.TokenReader {
+	var inner []xml.TokenReader
+	for _, h := range c.Hashes {
+		inner = append(inner, h.TokenReader())
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(inner...),
+		xml.StartElement{Name: xml.Name{Space: NSCaps2, Local: "c"}},
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (c Caps2) WriteXML(w xmlstream.TokenWriter) (n int, err error) {
+	for _, h := range c.Hashes {
+		_, err = h.Hash.MarshalXMLAttr(xml.Name{})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return xmlstream.Copy(w, c.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (c Caps2) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	_, err := c.WriteXML(e)
+	return err
+}
+
+// Caps2Node returns the service discovery node that may be queried to retrieve
+// the Info that h was calculated over (eg.
+// "urn:xmpp:caps#sha-256.K1Njy3HZBThlo4moOD5gBGhn0U0oK7/CbfLlIUDi6o4=").
+func Caps2Node(h crypto.HashOutput) string {
+	return NSCaps2 + "#" + h.Hash.String() + "." + base64.StdEncoding.EncodeToString(h.Out)
+}
+
+// Verify reports whether info matches any of the hashes in c that use a hash
+// function that has been linked into the program.
+// If none of the hash functions are available, Verify returns false.
+func (c Caps2) Verify(info Info) bool {
+	var input []byte
+	for _, h := range c.Hashes {
+		if !h.Hash.Available() {
+			continue
+		}
+		if input == nil {
+			input = info.AppendCaps2Input(nil)
+		}
+		hash := h.Hash.New()
+		/* #nosec */
+		hash.Write(input)
+		if bytes.Equal(hash.Sum(nil), h.Out) {
+			return true
+		}
+	}
+	return false
+}
+
+// Caps2 calculates the Entity Capabilities 2.0 information for i using each of
+// the provided hash functions.
+// If any of the hash functions have not been linked into the program,
+// crypto.ErrUnlinkedAlgo is returned.
+func (i Info) Caps2(h ...crypto.Hash) (Caps2, error) {
+	input := i.AppendCaps2Input(nil)
+	c := Caps2{Hashes: make([]crypto.HashOutput, 0, len(h))}
+	for _, algo := range h {
+		if !algo.Available() {
+			return Caps2{}, crypto.ErrUnlinkedAlgo
+		}
+		hash := algo.New()
+		/* #nosec */
+		hash.Write(input)
+		c.Hashes = append(c.Hashes, crypto.HashOutput{Hash: algo, Out: hash.Sum(nil)})
+	}
+	return c, nil
+}
+
+// Advertise returns a presence payload that advertises i using both Entity
+// Capabilities with the hash function legacy and Entity Capabilities 2.0 with
+// each of the provided hash functions.
+// If legacy is zero the Entity Capabilities element is omitted, and if no
+// hashes are provided the Entity Capabilities 2.0 element is omitted.
+func (i Info) Advertise(node string, legacy crypto.Hash, hashes ...crypto.Hash) (xml.TokenReader, error) {
+	var payload []xml.TokenReader
+	if legacy != 0 {
+		if !legacy.Available() {
+			return nil, crypto.ErrUnlinkedAlgo
+		}
+		payload = append(payload, Caps{
+			Hash: legacy,
+			Node: node,
+			Ver:  i.Hash(legacy.New()),
+		}.TokenReader())
+	}
+	if len(hashes) > 0 {
+		c, err := i.Caps2(hashes...)
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, c.TokenReader())
+	}
+	return xmlstream.MultiReader(payload...), nil
+}
+
+// AppendCaps2Input appends the canonical binary serialization of i used as the
+// input to the hash functions in Entity Capabilities 2.0 to dst and returns the
+// resulting slice.
+func (i Info) AppendCaps2Input(dst []byte) []byte {
+	// Features
+	features := make([][]byte, 0, len(i.Features))
+	for _, f := range i.Features {
+		features = append(features, append([]byte(f.Var), unitSep))
+	}
+	dst = appendSorted(dst, features)
+	dst = append(dst, fileSep)
+
+	// Identities
+	idents := make([][]byte, 0, len(i.Identity))
+	for _, ident := range i.Identity {
+		var b []byte
+		for _, s := range [...]string{ident.Category, ident.Type, ident.Lang, ident.Name} {
+			b = append(b, s...)
+			b = append(b, unitSep)
+		}
+		idents = append(idents, append(b, recordSep))
+	}
+	dst = appendSorted(dst, idents)
+	dst = append(dst, fileSep)
+
+	// Extensions
+	forms := make([][]byte, 0, len(i.Form))
+	for _, infoForm := range i.Form {
+		infoForm := infoForm
+		var fields [][]byte
+		infoForm.ForFields(func(f form.FieldData) {
+			if f.Var == "" {
+				return
+			}
+			b := append([]byte(f.Var), unitSep)
+			vals, _ := infoForm.Raw(f.Var)
+			vals = append([]string(nil), vals...)
+			sort.Strings(vals)
+			for _, val := range vals {
+				b = append(b, val...)
+				b = append(b, unitSep)
+			}
+			fields = append(fields, append(b, recordSep))
+		})
+		forms = append(forms, append(appendSorted(nil, fields), groupSep))
+	}
+	dst = appendSorted(dst, forms)
+	return append(dst, fileSep)
+}
+
+func appendSorted(dst []byte, b [][]byte) []byte {
+	sort.Slice(b, func(i, j int) bool {
+		return bytes.Compare(b[i], b[j]) < 0
+	})
+	for _, v := range b {
+		dst = append(dst, v...)
+	}
+	return dst
+}
@@ -0,0 +1,267 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco_test
+
+import (
+	"context"
+	_ "crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"strconv"
+	"testing"
+
+	_ "golang.org/x/crypto/sha3"
+
+	"mellium.im/xmpp/crypto"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/ping"
+	"mellium.im/xmpp/stanza"
+)
+
+var caps2Info = disco.Info{
+	Identity: []info.Identity{
+		{Category: "client", Type: "pc", Name: "Tkabber"},
+		{Category: "client", Type: "pc", Lang: "en", Name: "Psi"},
+	},
+	Features: []info.Feature{
+		{Var: disco.NSItems},
+		{Var: disco.NSInfo},
+	},
+	Form: []form.Data{*form.New(
+		form.Hidden("FORM_TYPE", form.Value("urn:xmpp:dataforms:softwareinfo")),
+		form.TextMulti("ip_version", form.Value("ipv6"), form.Value("ipv4")),
+	)},
+}
+
+func TestCaps2Input(t *testing.T) {
+	const want = disco.NSInfo + "\x1f" + disco.NSItems + "\x1f" + "\x1c" +
+		"client\x1fpc\x1f\x1fTkabber\x1f\x1e" + "client\x1fpc\x1fen\x1fPsi\x1f\x1e" + "\x1c" +
+		"FORM_TYPE\x1furn:xmpp:dataforms:softwareinfo\x1f\x1e" + "ip_version\x1fipv4\x1fipv6\x1f\x1e" + "\x1d" + "\x1c"
+	got := string(caps2Info.AppendCaps2Input(nil))
+	if got != want {
+		t.Errorf("wrong hash input:\nwant=%q,\n got=%q", want, got)
+	}
+}
+
+// caps2Vectors are the examples from XEP-0390 along with their published
+// hashes.
+var caps2Vectors = [...]struct {
+	info     string
+	sha256   string
+	sha3_256 string
+}{
+	0: {
+		info: `<query xmlns="http://jabber.org/protocol/disco#info">
+  <identity category="client" name="BombusMod" type="mobile"/>
+  <feature var="http://jabber.org/protocol/si"/>
+  <feature var="http://jabber.org/protocol/bytestreams"/>
+  <feature var="http://jabber.org/protocol/chatstates"/>
+  <feature var="http://jabber.org/protocol/disco#info"/>
+  <feature var="http://jabber.org/protocol/disco#items"/>
+  <feature var="urn:xmpp:ping"/>
+  <feature var="jabber:iq:time"/>
+  <feature var="jabber:iq:privacy"/>
+  <feature var="jabber:iq:version"/>
+  <feature var="http://jabber.org/protocol/rosterx"/>
+  <feature var="urn:xmpp:time"/>
+  <feature var="jabber:x:oob"/>
+  <feature var="http://jabber.org/protocol/ibb"/>
+  <feature var="http://jabber.org/protocol/si/profile/file-transfer"/>
+  <feature var="urn:xmpp:receipts"/>
+  <feature var="jabber:iq:roster"/>
+  <feature var="jabber:iq:last"/>
+</query>`,
+		sha256:   "kzBZbkqJ3ADrj7v08reD1qcWUwNGHaidNUgD7nHpiw8=",
+		sha3_256: "79mdYAfU9rEdTOcWDO7UEAt6E56SUzk/g6TnqUeuD9Q=",
+	},
+	1: {
+		info: `<query xmlns="http://jabber.org/protocol/disco#info">
+  <identity category="client" name="Tkabber" type="pc" xml:lang="en"/>
+  <identity category="client" name="Ткаббер" type="pc" xml:lang="ru"/>
+  <feature var="games:board"/>
+  <feature var="http://jabber.org/protocol/activity"/>
+  <feature var="http://jabber.org/protocol/activity+notify"/>
+  <feature var="http://jabber.org/protocol/bytestreams"/>
+  <feature var="http://jabber.org/protocol/chatstates"/>
+  <feature var="http://jabber.org/protocol/commands"/>
+  <feature var="http://jabber.org/protocol/disco#info"/>
+  <feature var="http://jabber.org/protocol/disco#items"/>
+  <feature var="http://jabber.org/protocol/evil"/>
+  <feature var="http://jabber.org/protocol/feature-neg"/>
+  <feature var="http://jabber.org/protocol/geoloc"/>
+  <feature var="http://jabber.org/protocol/geoloc+notify"/>
+  <feature var="http://jabber.org/protocol/ibb"/>
+  <feature var="http://jabber.org/protocol/iqibb"/>
+  <feature var="http://jabber.org/protocol/mood"/>
+  <feature var="http://jabber.org/protocol/mood+notify"/>
+  <feature var="http://jabber.org/protocol/rosterx"/>
+  <feature var="http://jabber.org/protocol/si"/>
+  <feature var="http://jabber.org/protocol/si/profile/file-transfer"/>
+  <feature var="http://jabber.org/protocol/tune"/>
+  <feature var="http://www.facebook.com/xmpp/messages"/>
+  <feature var="http://www.xmpp.org/extensions/xep-0084.html#ns-metadata+notify"/>
+  <feature var="jabber:iq:avatar"/>
+  <feature var="jabber:iq:browse"/>
+  <feature var="jabber:iq:dtcp"/>
+  <feature var="jabber:iq:filexfer"/>
+  <feature var="jabber:iq:ibb"/>
+  <feature var="jabber:iq:inband"/>
+  <feature var="jabber:iq:jidlink"/>
+  <feature var="jabber:iq:last"/>
+  <feature var="jabber:iq:oob"/>
+  <feature var="jabber:iq:privacy"/>
+  <feature var="jabber:iq:roster"/>
+  <feature var="jabber:iq:time"/>
+  <feature var="jabber:iq:version"/>
+  <feature var="jabber:x:data"/>
+  <feature var="jabber:x:event"/>
+  <feature var="jabber:x:oob"/>
+  <feature var="urn:xmpp:avatar:metadata+notify"/>
+  <feature var="urn:xmpp:ping"/>
+  <feature var="urn:xmpp:receipts"/>
+  <feature var="urn:xmpp:time"/>
+  <x xmlns="jabber:x:data" type="result">
+    <field type="hidden" var="FORM_TYPE">
+      <value>urn:xmpp:dataforms:softwareinfo</value>
+    </field>
+    <field var="software">
+      <value>Tkabber</value>
+    </field>
+    <field var="software_version">
+      <value>0.11.1-svn-20111216-mod (Tcl/Tk 8.6b2)</value>
+    </field>
+    <field var="os">
+      <value>Windows</value>
+    </field>
+    <field var="os_version">
+      <value>XP</value>
+    </field>
+  </x>
+</query>`,
+		sha256:   "u79ZroNJbdSWhdSp311mddz44oHHPsEBntQ5b1jqBSY=",
+		sha3_256: "XpUJzLAc93258sMECZ3FJpebkzuyNXDzRNwQog8eycg=",
+	},
+}
+
+func TestCaps2Vectors(t *testing.T) {
+	for i, tc := range caps2Vectors {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var inf disco.Info
+			err := xml.Unmarshal([]byte(tc.info), &inf)
+			if err != nil {
+				t.Fatalf("error decoding info: %v", err)
+			}
+			c, err := inf.Caps2(crypto.SHA256, crypto.SHA3_256)
+			if err != nil {
+				t.Fatalf("error calculating caps: %v", err)
+			}
+			for j, want := range []string{tc.sha256, tc.sha3_256} {
+				if got := base64.StdEncoding.EncodeToString(c.Hashes[j].Out); got != want {
+					t.Errorf("wrong %v hash: want=%s, got=%s", c.Hashes[j].Hash, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCaps2Verify(t *testing.T) {
+	c, err := caps2Info.Caps2(crypto.SHA256, crypto.SHA1)
+	if err != nil {
+		t.Fatalf("error calculating caps: %v", err)
+	}
+	if len(c.Hashes) != 2 {
+		t.Fatalf("wrong number of hashes: want=2, got=%d", len(c.Hashes))
+	}
+	if !c.Verify(caps2Info) {
+		t.Errorf("expected caps to verify")
+	}
+	other := caps2Info
+	other.Features = []info.Feature{{Var: disco.NSInfo}}
+	if c.Verify(other) {
+		t.Errorf("expected caps not to verify for different info")
+	}
+	if _, err = caps2Info.Caps2(crypto.BLAKE2b_512); err != crypto.ErrUnlinkedAlgo {
+		t.Errorf("wrong error for unlinked hash: want=%v, got=%v", crypto.ErrUnlinkedAlgo, err)
+	}
+	if node, want := disco.Caps2Node(crypto.HashOutput{Hash: crypto.SHA256, Out: []byte{0, 1, 2}}), disco.NSCaps2+"#sha-256.AAEC"; node != want {
+		t.Errorf("wrong node: want=%s, got=%s", want, node)
+	}
+}
+
+func TestAdvertise(t *testing.T) {
+	legacy := make(chan disco.Caps, 1)
+	caps2 := make(chan disco.Caps2, 1)
+	m := mux.New(stanza.NSClient,
+		disco.HandleCaps(func(_ stanza.Presence, c disco.Caps) {
+			legacy <- c
+		}),
+		disco.HandleCaps2(func(_ stanza.Presence, c disco.Caps2) {
+			caps2 <- c
+		}),
+		ping.Handle(),
+	)
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(m))
+	defer cs.Close()
+
+	payload, err := caps2Info.Advertise("https://mellium.im/xmpp", crypto.SHA1, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("error generating caps: %v", err)
+	}
+	err = cs.Client.Send(context.Background(), stanza.Presence{}.Wrap(payload))
+	if err != nil {
+		t.Fatalf("error sending presence: %v", err)
+	}
+	// Wait for the presence to be handled.
+	err = ping.Send(context.Background(), cs.Client, jid.JID{})
+	if err != nil {
+		t.Fatalf("error sending ping: %v", err)
+	}
+
+	select {
+	case c := <-legacy:
+		if want := caps2Info.Hash(crypto.SHA1.New()); c.Ver != want {
+			t.Errorf("wrong legacy ver: want=%s, got=%s", want, c.Ver)
+		}
+	default:
+		t.Errorf("no legacy caps received")
+	}
+	select {
+	case c := <-caps2:
+		if len(c.Hashes) != 1 || c.Hashes[0].Hash != crypto.SHA256 || !c.Verify(caps2Info) {
+			t.Errorf("wrong caps2 received: %+v", c)
+		}
+	default:
+		t.Errorf("no caps2 received")
+	}
+}
+
+var caps2EncodingTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value: &disco.Caps2{
+			XMLName: xml.Name{Space: disco.NSCaps2, Local: "c"},
+			Hashes: []crypto.HashOutput{
+				{Hash: crypto.SHA256, Out: []byte{0, 1, 2}},
+				{Hash: crypto.SHA1, Out: []byte{3, 4, 5}},
+			},
+		},
+		XML: `<c xmlns="urn:xmpp:caps"><hash xmlns="urn:xmpp:hashes:2" algo="sha-256">AAEC</hash><hash xmlns="urn:xmpp:hashes:2" algo="sha-1">AwQF</hash></c>`,
+	},
+	1: {
+		NoUnmarshal: true,
+		Value: &disco.Caps2{
+			Hashes: []crypto.HashOutput{{Out: []byte{0}}},
+		},
+		Err: crypto.ErrUnknownAlgo,
+	},
+}
+
+func TestEncodeCaps2(t *testing.T) {
+	xmpptest.RunEncodingTests(t, caps2EncodingTestCases)
+}
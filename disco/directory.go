@@ -0,0 +1,294 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/items"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+)
+
+// Namespaces of forms and features used to classify services.
+const (
+	nsServerInfo = "http://jabber.org/network/serverinfo"
+	nsUpload     = "urn:xmpp:http:upload:0"
+	nsPush       = "urn:xmpp:push:0"
+)
+
+const defConcurrency = 4
+
+// Service is an item discovered by a Crawler along with its service discovery
+// information.
+type Service struct {
+	Item items.Item
+	Info Info
+}
+
+// HasFeature reports whether the service advertises the feature.
+func (s Service) HasFeature(feature string) bool {
+	for _, f := range s.Info.Features {
+		if f.Var == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// HasIdentity reports whether the service advertises an identity with the
+// category and type.
+func (s Service) HasIdentity(category, typ string) bool {
+	for _, ident := range s.Info.Identity {
+		if ident.Category == category && ident.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadService is a service that supports HTTP File Upload (XEP-0363).
+type UploadService struct {
+	Service
+
+	// MaxFileSize is the maximum size of files that may be uploaded in bytes.
+	// If it is zero, no maximum was advertised.
+	MaxFileSize uint64
+}
+
+// Directory is the set of services discovered on a domain by a Crawler.
+type Directory struct {
+	// Server is the domain that was crawled.
+	Server Service
+
+	// Services contains every item discovered below the domain, in the order
+	// they were discovered.
+	Services []Service
+
+	// Contacts contains the contact addresses advertised by the domain (see
+	// XEP-0157: Contact Addresses for XMPP Services) keyed by the name of the
+	// field (eg. "abuse-addresses" or "admin-addresses").
+	Contacts map[string][]string
+
+	MUC    []Service       // conference/text
+	Upload []UploadService // store/file or urn:xmpp:http:upload:0
+	Proxy  []Service       // proxy/bytestreams
+	PubSub []Service       // pubsub/service
+	Push   []Service       // pubsub/push or urn:xmpp:push:0
+}
+
+// Identity returns all services that advertise an identity with the category
+// and type.
+func (d Directory) Identity(category, typ string) []Service {
+	var found []Service
+	for _, s := range d.Services {
+		if s.HasIdentity(category, typ) {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// Feature returns all services that advertise the feature.
+func (d Directory) Feature(feature string) []Service {
+	var found []Service
+	for _, s := range d.Services {
+		if s.HasFeature(feature) {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// A Crawler discovers the services available on a domain.
+// Info responses are cached so that repeated crawls do not send the same
+// queries again.
+// The zero value is ready to use and a Crawler is safe for concurrent use.
+type Crawler struct {
+	// Concurrency is the maximum number of info queries that will be in flight
+	// at the same time.
+	// If it is zero, a small default is used.
+	Concurrency int
+
+	// MaxDepth is the number of levels of items below the domain that will be
+	// walked.
+	// If it is zero, only the items of the domain itself are discovered.
+	MaxDepth int
+
+	m     sync.Mutex
+	cache map[string]Info
+}
+
+// Crawl walks the items of the domain using WalkItem, queries each item that is
+// found for its identities and features, and classifies the results.
+//
+// Items that cannot be queried are omitted from the directory instead of
+// causing the crawl to fail.
+// If the context is canceled, the error from the context is returned.
+func (c *Crawler) Crawl(ctx context.Context, s *xmpp.Session, domain jid.JID) (Directory, error) {
+	maxDepth := c.MaxDepth
+	if maxDepth < 1 {
+		maxDepth = 1
+	}
+
+	// Walking must finish before any info queries are sent because the session
+	// may not be used while an items iterator is open.
+	var found []items.Item
+	seen := make(map[string]struct{})
+	err := WalkItem(ctx, items.Item{JID: domain}, s, func(level int, item items.Item, err error) error {
+		if err != nil {
+			// Keep walking the rest of the tree if a single item fails.
+			return nil
+		}
+		key := cacheKey(item)
+		if _, ok := seen[key]; ok {
+			return ErrSkipItem
+		}
+		seen[key] = struct{}{}
+		found = append(found, item)
+		if level >= maxDepth {
+			return ErrSkipItem
+		}
+		return nil
+	})
+	if err != nil {
+		return Directory{}, err
+	}
+
+	concurrency := c.Concurrency
+	if concurrency < 1 {
+		concurrency = defConcurrency
+	}
+	infos := make([]Info, len(found))
+	ok := make([]bool, len(found))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, item := range found {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return Directory{}, ctx.Err()
+		}
+		wg.Add(1)
+		go func(i int, item items.Item) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			infos[i], ok[i] = c.info(ctx, s, item)
+		}(i, item)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return Directory{}, err
+	}
+
+	dir := Directory{Server: Service{Item: found[0], Info: infos[0]}}
+	dir.Contacts = contacts(infos[0])
+	for i, item := range found[1:] {
+		if !ok[i+1] {
+			continue
+		}
+		dir.add(Service{Item: item, Info: infos[i+1]})
+	}
+	return dir, nil
+}
+
+func (c *Crawler) info(ctx context.Context, s *xmpp.Session, item items.Item) (Info, bool) {
+	key := cacheKey(item)
+	c.m.Lock()
+	cached, ok := c.cache[key]
+	c.m.Unlock()
+	if ok {
+		return cached, true
+	}
+
+	discoInfo, err := GetInfo(ctx, item.Node, item.JID, s)
+	if err != nil {
+		return Info{}, false
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.cache == nil {
+		c.cache = make(map[string]Info)
+	}
+	c.cache[key] = discoInfo
+	return discoInfo, true
+}
+
+func cacheKey(item items.Item) string {
+	return item.JID.String() + "#" + item.Node
+}
+
+func (d *Directory) add(s Service) {
+	d.Services = append(d.Services, s)
+	if s.HasIdentity(ConferenceText.Category, ConferenceText.Type) {
+		d.MUC = append(d.MUC, s)
+	}
+	if s.HasIdentity(StoreFile.Category, StoreFile.Type) || s.HasFeature(nsUpload) {
+		d.Upload = append(d.Upload, UploadService{Service: s, MaxFileSize: maxFileSize(s.Info)})
+	}
+	if s.HasIdentity(ProxyBytestreams.Category, ProxyBytestreams.Type) {
+		d.Proxy = append(d.Proxy, s)
+	}
+	if s.HasIdentity(PubsubService.Category, PubsubService.Type) {
+		d.PubSub = append(d.PubSub, s)
+	}
+	if s.HasIdentity(PubsubService.Category, "push") || s.HasFeature(nsPush) {
+		d.Push = append(d.Push, s)
+	}
+}
+
+// formValues returns the values of the field in the first form in info with
+// the given FORM_TYPE.
+func formValues(discoInfo Info, formType, field string) []string {
+	for _, data := range discoInfo.Form {
+		if typ, _ := data.GetString("FORM_TYPE"); typ != formType {
+			continue
+		}
+		vals, _ := data.Raw(field)
+		return vals
+	}
+	return nil
+}
+
+func maxFileSize(discoInfo Info) uint64 {
+	vals := formValues(discoInfo, nsUpload, "max-file-size")
+	if len(vals) == 0 {
+		return 0
+	}
+	/* #nosec */
+	size, _ := strconv.ParseUint(vals[0], 10, 64)
+	return size
+}
+
+func contacts(discoInfo Info) map[string][]string {
+	var addrs map[string][]string
+	for _, data := range discoInfo.Form {
+		data := data
+		if typ, _ := data.GetString("FORM_TYPE"); typ != nsServerInfo {
+			continue
+		}
+		data.ForFields(func(f form.FieldData) {
+			if !strings.HasSuffix(f.Var, "-addresses") {
+				return
+			}
+			vals, _ := data.Raw(f.Var)
+			if len(vals) == 0 {
+				return
+			}
+			if addrs == nil {
+				addrs = make(map[string][]string)
+			}
+			addrs[f.Var] = append(addrs[f.Var], vals...)
+		})
+	}
+	return addrs
+}
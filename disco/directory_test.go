@@ -0,0 +1,145 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco_test
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"sync"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/disco/items"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var directoryItems = map[string][]string{
+	"example.net":     {"muc.example.net", "upload.example.net", "proxy.example.net", "pubsub.example.net", "broken.example.net", "muc.example.net"},
+	"muc.example.net": {"room@muc.example.net"},
+}
+
+var directoryInfo = map[string]disco.Info{
+	"example.net": {
+		Identity: []info.Identity{disco.ServerIM},
+		Form: []form.Data{*form.New(
+			form.Hidden("FORM_TYPE", form.Value("http://jabber.org/network/serverinfo")),
+			form.ListMulti("abuse-addresses", form.Value("mailto:abuse@example.net"), form.Value("xmpp:abuse@example.net")),
+			form.ListMulti("admin-addresses", form.Value("xmpp:admin@example.net")),
+		)},
+	},
+	"muc.example.net": {
+		Identity: []info.Identity{disco.ConferenceText},
+	},
+	"upload.example.net": {
+		Identity: []info.Identity{disco.StoreFile},
+		Features: []info.Feature{{Var: "urn:xmpp:http:upload:0"}},
+		Form: []form.Data{*form.New(
+			form.Hidden("FORM_TYPE", form.Value("urn:xmpp:http:upload:0")),
+			form.Text("max-file-size", form.Value("5242880")),
+		)},
+	},
+	"proxy.example.net": {
+		Identity: []info.Identity{disco.ProxyBytestreams},
+	},
+	"pubsub.example.net": {
+		Identity: []info.Identity{disco.PubsubService},
+		Features: []info.Feature{{Var: "urn:xmpp:push:0"}},
+	},
+}
+
+func TestCrawl(t *testing.T) {
+	var m sync.Mutex
+	var infoQueries, itemQueries []string
+	handler := mux.New(stanza.NSClient,
+		mux.IQFunc(stanza.GetIQ, xml.Name{Space: disco.NSInfo, Local: "query"}, func(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			m.Lock()
+			infoQueries = append(infoQueries, iq.To.String())
+			m.Unlock()
+			resp, ok := directoryInfo[iq.To.String()]
+			if !ok {
+				_, err := xmlstream.Copy(t, iq.Error(stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound}))
+				return err
+			}
+			_, err := xmlstream.Copy(t, iq.Result(resp.TokenReader()))
+			return err
+		}),
+		mux.IQFunc(stanza.GetIQ, xml.Name{Space: disco.NSItems, Local: "query"}, func(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			m.Lock()
+			itemQueries = append(itemQueries, iq.To.String())
+			m.Unlock()
+			var payload []xml.TokenReader
+			for _, addr := range directoryItems[iq.To.String()] {
+				payload = append(payload, items.Item{JID: jid.MustParse(addr)}.TokenReader())
+			}
+			_, err := xmlstream.Copy(t, iq.Result(xmlstream.Wrap(
+				xmlstream.MultiReader(payload...),
+				xml.StartElement{Name: xml.Name{Space: disco.NSItems, Local: "query"}},
+			)))
+			return err
+		}),
+	)
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(handler))
+	defer cs.Close()
+
+	crawler := &disco.Crawler{Concurrency: 2}
+	dir, err := crawler.Crawl(context.Background(), cs.Client, jid.MustParse("example.net"))
+	if err != nil {
+		t.Fatalf("error crawling: %v", err)
+	}
+
+	var services []string
+	for _, s := range dir.Services {
+		services = append(services, s.Item.JID.String())
+	}
+	if want := []string{"muc.example.net", "upload.example.net", "proxy.example.net", "pubsub.example.net"}; !reflect.DeepEqual(services, want) {
+		t.Errorf("wrong services: want=%v, got=%v", want, services)
+	}
+	if want := []string{"example.net"}; !reflect.DeepEqual(itemQueries, want) {
+		t.Errorf("wrong items queries: want=%v, got=%v", want, itemQueries)
+	}
+	for _, tc := range []struct {
+		name     string
+		services []disco.Service
+		want     string
+	}{
+		{name: "muc", services: dir.MUC, want: "muc.example.net"},
+		{name: "proxy", services: dir.Proxy, want: "proxy.example.net"},
+		{name: "pubsub", services: dir.PubSub, want: "pubsub.example.net"},
+		{name: "push", services: dir.Push, want: "pubsub.example.net"},
+		{name: "identity", services: dir.Identity("store", "file"), want: "upload.example.net"},
+		{name: "feature", services: dir.Feature("urn:xmpp:http:upload:0"), want: "upload.example.net"},
+	} {
+		if len(tc.services) != 1 || tc.services[0].Item.JID.String() != tc.want {
+			t.Errorf("wrong %s services: want=[%s], got=%v", tc.name, tc.want, tc.services)
+		}
+	}
+	if len(dir.Upload) != 1 || dir.Upload[0].MaxFileSize != 5242880 {
+		t.Errorf("wrong upload services: %+v", dir.Upload)
+	}
+	wantContacts := map[string][]string{
+		"abuse-addresses": {"mailto:abuse@example.net", "xmpp:abuse@example.net"},
+		"admin-addresses": {"xmpp:admin@example.net"},
+	}
+	if !reflect.DeepEqual(dir.Contacts, wantContacts) {
+		t.Errorf("wrong contacts: want=%v, got=%v", wantContacts, dir.Contacts)
+	}
+
+	// Cached info should not be queried again, but failed queries should be.
+	infoQueries = infoQueries[:0]
+	_, err = crawler.Crawl(context.Background(), cs.Client, jid.MustParse("example.net"))
+	if err != nil {
+		t.Fatalf("error crawling a second time: %v", err)
+	}
+	if want := []string{"broken.example.net"}; !reflect.DeepEqual(infoQueries, want) {
+		t.Errorf("wrong info queries on second crawl: want=%v, got=%v", want, infoQueries)
+	}
+}
@@ -13,4 +13,5 @@ const (
 	NSInfo  = `http://jabber.org/protocol/disco#info`
 	NSItems = `http://jabber.org/protocol/disco#items`
 	NSCaps  = `http://jabber.org/protocol/caps`
+	NSCaps2 = `urn:xmpp:caps`
 )
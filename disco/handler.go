@@ -6,12 +6,14 @@ package disco
 
 import (
 	"encoding/xml"
+	"strconv"
 
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp/disco/info"
 	"mellium.im/xmpp/disco/items"
 	"mellium.im/xmpp/form"
 	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/paging"
 	"mellium.im/xmpp/stanza"
 )
 
@@ -35,16 +37,42 @@ func (h *discoHandler) HandleXMPP(t xmlstream.TokenReadEncoder, start *xml.Start
 }
 
 func (h *discoHandler) HandleIQ(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	var node string
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "node" {
+			node = attr.Value
+			break
+		}
+	}
+	var rsm *paging.Request
+	if start.Name.Space == NSItems {
+		var err error
+		rsm, err = paging.ParseRequest(r)
+		if err != nil {
+			_, err = xmlstream.Copy(r, iq.Error(stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}))
+			return err
+		}
+	}
+	if rsm != nil {
+		page, err := h.page(node, rsm)
+		if err != nil {
+			se, ok := err.(stanza.Error)
+			if !ok {
+				se = stanza.Error{Type: stanza.Wait, Condition: stanza.InternalServerError}
+			}
+			_, err = xmlstream.Copy(r, iq.Error(se))
+			return err
+		}
+		_, err = xmlstream.Copy(r, iq.Result(xmlstream.Wrap(
+			page,
+			*start,
+		)))
+		return err
+	}
+
 	seen := make(map[string]struct{})
 	pr, pw := xmlstream.Pipe()
 	go func() {
-		var node string
-		for _, attr := range start.Attr {
-			if attr.Name.Local == "node" {
-				node = attr.Value
-				break
-			}
-		}
 		switch start.Name.Space {
 		case NSInfo:
 			err := h.ServeMux.ForFeatures(node, func(f info.Feature) error {
@@ -84,11 +112,12 @@ func (h *discoHandler) HandleIQ(iq stanza.IQ, r xmlstream.TokenReadEncoder, star
 			}))
 		case NSItems:
 			pw.CloseWithError(h.ServeMux.ForItems(node, func(i items.Item) error {
-				_, ok := seen[i.Node]
+				key := itemKey(i)
+				_, ok := seen[key]
 				if ok {
 					return nil
 				}
-				seen[i.Node] = struct{}{}
+				seen[key] = struct{}{}
 				_, err := xmlstream.Copy(pw, i.TokenReader())
 				return err
 			}))
@@ -101,3 +130,67 @@ func (h *discoHandler) HandleIQ(iq stanza.IQ, r xmlstream.TokenReadEncoder, star
 	)))
 	return err
 }
+
+// itemKey returns the value used to detect duplicate items.
+// Items are identified by their JID and node.
+func itemKey(i items.Item) string {
+	return i.JID.String() + " " + i.Node
+}
+
+// itemsSource is a paging.Source over the items of a node.
+// The IDs used for paging are the positions of the items in the full list of
+// items for the node, so they are only meaningful when passed back to the same
+// entity.
+// Only the items on the requested page are fetched from handlers that
+// implement items.Pager.
+// Unlike unpaged requests, duplicate items returned by different handlers are
+// not removed since doing so would require iterating over every item.
+type itemsSource struct {
+	mux   *mux.ServeMux
+	node  string
+	total *uint64
+	items []xml.TokenReader
+}
+
+func (s *itemsSource) Len() (uint64, error) {
+	if s.total != nil {
+		return *s.total, nil
+	}
+	total, err := s.mux.ForItemsPage(s.node, 0, 0, func(items.Item) error { return nil })
+	if err != nil {
+		return 0, err
+	}
+	s.total = &total
+	return total, nil
+}
+
+func (s *itemsSource) Index(id string) (uint64, bool, error) {
+	idx, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, false, nil
+	}
+	total, err := s.Len()
+	if err != nil {
+		return 0, false, err
+	}
+	return idx, idx < total, nil
+}
+
+func (s *itemsSource) Page(offset, max uint64, f func(id string) error) error {
+	_, err := s.mux.ForItemsPage(s.node, offset, max, func(i items.Item) error {
+		s.items = append(s.items, i.TokenReader())
+		return f(strconv.FormatUint(offset+uint64(len(s.items))-1, 10))
+	})
+	return err
+}
+
+// page returns the items selected by the result set management request
+// followed by a set describing the page.
+func (h *discoHandler) page(node string, req *paging.Request) (xml.TokenReader, error) {
+	src := &itemsSource{mux: h.ServeMux, node: node}
+	page, err := paging.Respond(src, req, defPageSize)
+	if err != nil {
+		return nil, err
+	}
+	return xmlstream.MultiReader(append(src.items, page.TokenReader())...), nil
+}
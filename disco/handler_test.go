@@ -7,13 +7,19 @@ package disco_test
 import (
 	"context"
 	"encoding/xml"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp/disco"
 	"mellium.im/xmpp/disco/items"
 	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/paging"
 	"mellium.im/xmpp/stanza"
 )
 
@@ -94,3 +100,96 @@ func TestItemsRoundTrip(t *testing.T) {
 		t.Fatalf("error closing empty iter: %v", err)
 	}
 }
+
+type pagedItems struct{}
+
+func (pagedItems) HandleXMPP(xmlstream.TokenReadEncoder, *xml.StartElement) error {
+	panic("should not be called")
+}
+
+func (pagedItems) ForItems(node string, f func(items.Item) error) error {
+	_, err := pagedItems{}.ForItemsPage(node, 0, 10, f)
+	return err
+}
+
+func (pagedItems) ForItemsPage(node string, offset, max uint64, f func(items.Item) error) (uint64, error) {
+	if node != "rooms" {
+		return 0, nil
+	}
+	for i := offset; i < 10 && i < offset+max; i++ {
+		name := strconv.FormatUint(i, 10)
+		err := f(items.Item{JID: jid.MustParse(name + "@example.net"), Name: name})
+		if err != nil {
+			return 10, err
+		}
+	}
+	return 10, nil
+}
+
+func TestItemsPaging(t *testing.T) {
+	m := mux.New(
+		stanza.NSClient,
+		disco.Handle(),
+		mux.Handle(xml.Name{}, pagedItems{}),
+		mux.Handle(xml.Name{Space: "urn:example", Local: "rooms"}, pagedItems{}),
+	)
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandler(m),
+	)
+	defer cs.Close()
+
+	for i, tc := range []struct {
+		set   string
+		names []string
+		first string
+		last  string
+		err   stanza.Condition
+	}{
+		{set: `<max>3</max>`, names: []string{"0", "1", "2"}, first: "0", last: "2"},
+		{set: `<max>3</max><after>2</after>`, names: []string{"3", "4", "5"}, first: "3", last: "5"},
+		{set: `<max>3</max><before>5</before>`, names: []string{"2", "3", "4"}, first: "2", last: "4"},
+		{set: `<max>4</max><before></before>`, names: []string{"6", "7", "8", "9"}, first: "6", last: "9"},
+		{set: `<max>2</max><index>8</index>`, names: []string{"8", "9"}, first: "8", last: "9"},
+		{set: `<max>0</max>`},
+		{set: `<max>3</max><after>9</after>`},
+		{set: `<after>foo</after>`, err: stanza.ItemNotFound},
+		{set: `<after>999</after>`, err: stanza.ItemNotFound},
+		{set: `<before>10</before>`, err: stanza.ItemNotFound},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			const query = `<query xmlns="http://jabber.org/protocol/disco#items" node="rooms"><set xmlns="http://jabber.org/protocol/rsm">`
+			var resp struct {
+				Items []items.Item `xml:"item"`
+				Set   paging.Set   `xml:"http://jabber.org/protocol/rsm set"`
+			}
+			err := cs.Client.UnmarshalIQ(
+				context.Background(),
+				stanza.IQ{Type: stanza.GetIQ}.Wrap(xml.NewDecoder(strings.NewReader(query+tc.set+`</set></query>`))),
+				&resp,
+			)
+			if tc.err != "" {
+				var se stanza.Error
+				if !errors.As(err, &se) || se.Condition != tc.err {
+					t.Fatalf("wrong error: want=%v, got=%v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var names []string
+			for _, item := range resp.Items {
+				names = append(names, item.Name)
+			}
+			if !reflect.DeepEqual(names, tc.names) {
+				t.Errorf("wrong items: want=%v, got=%v", tc.names, names)
+			}
+			if resp.Set.First.ID != tc.first || resp.Set.Last != tc.last {
+				t.Errorf("wrong page: want=%s-%s, got=%s-%s", tc.first, tc.last, resp.Set.First.ID, resp.Set.Last)
+			}
+			if resp.Set.Count == nil || *resp.Set.Count != 10 {
+				t.Errorf("wrong count: want=10, got=%v", resp.Set.Count)
+			}
+		})
+	}
+}
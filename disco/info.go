@@ -68,6 +68,11 @@ func (i Info) TokenReader() xml.TokenReader {
 	for _, ident := range i.Identity {
 		payloads = append(payloads, ident.TokenReader())
 	}
+	for _, f := range i.Form {
+		f := f
+		result, _ := f.Submit()
+		payloads = append(payloads, result)
+	}
 	return i.InfoQuery.wrap(xmlstream.MultiReader(payloads...))
 }
 
@@ -6,11 +6,13 @@ package disco_test
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/xml"
 	"testing"
 
 	"mellium.im/xmpp/disco"
 	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
 )
 
 func TestMarshalQuery(t *testing.T) {
@@ -103,3 +105,34 @@ func TestUnmarshal(t *testing.T) {
 		t.Errorf("wrong value for FORM_TYPE: want=5222, got=%s", s)
 	}
 }
+
+func TestMarshalForms(t *testing.T) {
+	in := disco.Info{
+		Features: []info.Feature{{Var: disco.NSInfo}},
+		Form: []form.Data{*form.New(
+			form.Hidden("FORM_TYPE", form.Value("http://jabber.org/network/serverinfo")),
+			form.TextMulti("abuse-addresses", form.Value("xmpp:abuse@example.net")),
+		)},
+	}
+	b, err := xml.Marshal(in)
+	if err != nil {
+		t.Fatalf("unexpected error marshaling info: %v", err)
+	}
+	var out disco.Info
+	err = xml.Unmarshal(b, &out)
+	if err != nil {
+		t.Fatalf("unexpected error unmarshaling info: %v", err)
+	}
+	if len(out.Form) != 1 {
+		t.Fatalf("wrong number of forms in %s: want=1, got=%d", b, len(out.Form))
+	}
+	if typ, _ := out.Form[0].GetString("FORM_TYPE"); typ != "http://jabber.org/network/serverinfo" {
+		t.Errorf("wrong form type: %q", typ)
+	}
+	if addrs, _ := out.Form[0].Raw("abuse-addresses"); len(addrs) != 1 || addrs[0] != "xmpp:abuse@example.net" {
+		t.Errorf("wrong field values: %v", addrs)
+	}
+	if out.Hash(sha1.New()) != in.Hash(sha1.New()) {
+		t.Errorf("hash changed after round trip")
+	}
+}
@@ -60,3 +60,17 @@ func (i Item) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
 type Iter interface {
 	ForItems(node string, f func(Item) error) error
 }
+
+// Pager is an Iter that can efficiently respond with a single page of items.
+// It is used when a service discovery request for items uses Result Set
+// Management so that large result sets (such as lists of chat rooms or pubsub
+// nodes) do not have to be iterated over for every request.
+type Pager interface {
+	Iter
+
+	// ForItemsPage calls f for at most max items belonging to node, skipping the
+	// first offset items.
+	// It returns the total number of items belonging to node.
+	// If max is zero, f is not called and only the total is returned.
+	ForItemsPage(node string, offset, max uint64, f func(Item) error) (total uint64, err error)
+}
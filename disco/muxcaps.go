@@ -0,0 +1,161 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco
+
+import (
+	"encoding/xml"
+	"strings"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/crypto"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// MuxInfo returns the Info that a multiplexer configured with Handle would
+// respond with when queried for the node.
+func MuxInfo(m *mux.ServeMux, node string) (Info, error) {
+	discoInfo := Info{InfoQuery: InfoQuery{Node: node}}
+	seen := make(map[string]struct{})
+	err := m.ForFeatures(node, func(f info.Feature) error {
+		if _, ok := seen[f.Var]; ok {
+			return nil
+		}
+		seen[f.Var] = struct{}{}
+		discoInfo.Features = append(discoInfo.Features, f)
+		return nil
+	})
+	if err != nil {
+		return Info{}, err
+	}
+	for k := range seen {
+		delete(seen, k)
+	}
+	err = m.ForIdentities(node, func(ident info.Identity) error {
+		loopKey := ident.Category + ":" + ident.Type + ":" + ident.Name + ":" + ident.Lang
+		if _, ok := seen[loopKey]; ok {
+			return nil
+		}
+		seen[loopKey] = struct{}{}
+		discoInfo.Identity = append(discoInfo.Identity, ident)
+		return nil
+	})
+	if err != nil {
+		return Info{}, err
+	}
+	err = m.ForForms(node, func(data *form.Data) error {
+		discoInfo.Form = append(discoInfo.Form, *data)
+		return nil
+	})
+	if err != nil {
+		return Info{}, err
+	}
+	return discoInfo, nil
+}
+
+// MuxCaps returns the entity capabilities for the Info that a multiplexer
+// configured with Handle would respond with when queried without a node.
+// Node is a string that uniquely identifies your client (eg.
+// https://example.com/myclient) and h is the hash function used to calculate
+// the verification string.
+// If h has not been linked into the program, crypto.ErrUnlinkedAlgo is
+// returned.
+func MuxCaps(m *mux.ServeMux, node string, h crypto.Hash) (Caps, error) {
+	if !h.Available() {
+		return Caps{}, crypto.ErrUnlinkedAlgo
+	}
+	discoInfo, err := MuxInfo(m, "")
+	if err != nil {
+		return Caps{}, err
+	}
+	return Caps{
+		Hash: h,
+		Node: node,
+		Ver:  discoInfo.Hash(h.New()),
+	}, nil
+}
+
+// HandleMuxCaps returns an option that configures a multiplexer to respond to
+// queries for the node "node#ver", where ver is the verification string
+// returned by MuxCaps, with the same information as a query without a node.
+// The multiplexer must also be configured with Handle.
+//
+// Entities that receive presence containing the output of MuxCaps or
+// InsertCaps will send this query to discover our features.
+func HandleMuxCaps(node string, h crypto.Hash) mux.Option {
+	return func(m *mux.ServeMux) {
+		handler := capsNodeHandler{mux: m, node: node, hash: h}
+		mux.Feature(handler)(m)
+		mux.Ident(handler)(m)
+		mux.Form(handler)(m)
+	}
+}
+
+type capsNodeHandler struct {
+	mux  *mux.ServeMux
+	node string
+	hash crypto.Hash
+}
+
+// match reports whether node is the "node#ver" node for the current
+// capabilities of the multiplexer.
+func (h capsNodeHandler) match(node string) bool {
+	ver := strings.TrimPrefix(node, h.node+"#")
+	if node == "" || ver == node {
+		return false
+	}
+	caps, err := MuxCaps(h.mux, h.node, h.hash)
+	return err == nil && caps.Ver == ver
+}
+
+func (h capsNodeHandler) ForFeatures(node string, f func(info.Feature) error) error {
+	if !h.match(node) {
+		return nil
+	}
+	return h.mux.ForFeatures("", f)
+}
+
+func (h capsNodeHandler) ForIdentities(node string, f func(info.Identity) error) error {
+	if !h.match(node) {
+		return nil
+	}
+	return h.mux.ForIdentities("", f)
+}
+
+func (h capsNodeHandler) ForForms(node string, f func(*form.Data) error) error {
+	if !h.match(node) {
+		return nil
+	}
+	return h.mux.ForForms("", f)
+}
+
+// InsertCaps returns a transformer that inserts entity capabilities into every
+// available presence read through it.
+// The capabilities are calculated by MuxCaps each time a presence is read so
+// that they reflect any features that were added to the multiplexer since the
+// previous presence.
+// Presence that already contains entity capabilities will end up with
+// multiple caps elements, so the payloads passed through InsertCaps should not
+// contain any.
+func InsertCaps(m *mux.ServeMux, node string, h crypto.Hash) xmlstream.Transformer {
+	return xmlstream.InsertFunc(func(start xml.StartElement, level uint64, w xmlstream.TokenWriter) error {
+		if level != 1 || start.Name.Local != "presence" || !stanza.Is(start.Name, "") {
+			return nil
+		}
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "type" && attr.Value != "" {
+				return nil
+			}
+		}
+		caps, err := MuxCaps(m, node, h)
+		if err != nil {
+			return err
+		}
+		_, err = caps.WriteXML(w)
+		return err
+	})
+}
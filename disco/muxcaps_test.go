@@ -0,0 +1,135 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/crypto"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+const muxCapsNode = "https://mellium.im/xmpp"
+
+type clientInfo struct{}
+
+func (clientInfo) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(info.Feature{Var: "urn:xmpp:bookmarks:1+notify"})
+}
+
+func (clientInfo) ForIdentities(node string, f func(info.Identity) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(info.Identity{Category: "client", Type: "pc", Name: "Test"})
+}
+
+func (clientInfo) ForForms(node string, f func(*form.Data) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(form.New(
+		form.Hidden("FORM_TYPE", form.Value("urn:xmpp:dataforms:softwareinfo")),
+		form.Text("software", form.Value("Test")),
+	))
+}
+
+func newCapsMux() *mux.ServeMux {
+	return mux.New(stanza.NSClient,
+		disco.Handle(),
+		disco.HandleMuxCaps(muxCapsNode, crypto.SHA1),
+		mux.Feature(clientInfo{}),
+		mux.Ident(clientInfo{}),
+		mux.Form(clientInfo{}),
+	)
+}
+
+func TestMuxCaps(t *testing.T) {
+	m := newCapsMux()
+	discoInfo, err := disco.MuxInfo(m, "")
+	if err != nil {
+		t.Fatalf("error getting info: %v", err)
+	}
+	if len(discoInfo.Features) != 2 || len(discoInfo.Identity) != 1 || len(discoInfo.Form) != 1 {
+		t.Fatalf("wrong info: %+v", discoInfo)
+	}
+	caps, err := disco.MuxCaps(m, muxCapsNode, crypto.SHA1)
+	if err != nil {
+		t.Fatalf("error calculating caps: %v", err)
+	}
+	if want := discoInfo.Hash(crypto.SHA1.New()); caps.Ver != want {
+		t.Errorf("wrong ver: want=%s, got=%s", want, caps.Ver)
+	}
+	if caps.Node != muxCapsNode || caps.Hash != crypto.SHA1 {
+		t.Errorf("wrong caps: %+v", caps)
+	}
+	if _, err = disco.MuxCaps(m, muxCapsNode, crypto.BLAKE2b_512); err != crypto.ErrUnlinkedAlgo {
+		t.Errorf("wrong error for unlinked hash: want=%v, got=%v", crypto.ErrUnlinkedAlgo, err)
+	}
+
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(m))
+	defer cs.Close()
+	for _, tc := range []struct {
+		node  string
+		empty bool
+	}{
+		{node: muxCapsNode + "#" + caps.Ver},
+		{node: muxCapsNode + "#badver", empty: true},
+		{node: "urn:example#" + caps.Ver, empty: true},
+	} {
+		resp, err := disco.GetInfo(context.Background(), tc.node, cs.Client.RemoteAddr(), cs.Client)
+		if err != nil {
+			t.Fatalf("error querying %s: %v", tc.node, err)
+		}
+		if tc.empty {
+			if len(resp.Features) != 0 || len(resp.Identity) != 0 || len(resp.Form) != 0 {
+				t.Errorf("unexpected info for %s: %+v", tc.node, resp)
+			}
+			continue
+		}
+		if resp.Node != tc.node {
+			t.Errorf("wrong node in response: want=%s, got=%s", tc.node, resp.Node)
+		}
+		if ver := resp.Hash(crypto.SHA1.New()); ver != caps.Ver {
+			t.Errorf("response for %s did not verify: want=%s, got=%s", tc.node, caps.Ver, ver)
+		}
+	}
+}
+
+func TestInsertCaps(t *testing.T) {
+	m := newCapsMux()
+	caps, err := disco.MuxCaps(m, muxCapsNode, crypto.SHA1)
+	if err != nil {
+		t.Fatalf("error calculating caps: %v", err)
+	}
+
+	const in = `<presence><show>away</show></presence><presence type="unavailable"></presence><message></message>`
+	var buf bytes.Buffer
+	e := xml.NewEncoder(&buf)
+	_, err = xmlstream.Copy(e, disco.InsertCaps(m, muxCapsNode, crypto.SHA1)(xml.NewDecoder(strings.NewReader(in))))
+	if err != nil {
+		t.Fatalf("error transforming stream: %v", err)
+	}
+	if err = e.Flush(); err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	want := `<presence><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="` + muxCapsNode + `" ver="` + caps.Ver + `"></c><show>away</show></presence><presence type="unavailable"></presence><message></message>`
+	if out := buf.String(); out != want {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", want, out)
+	}
+}
@@ -3,6 +3,7 @@ module mellium.im/xmpp
 go 1.18
 
 require (
+	golang.org/x/crypto v0.6.0
 	golang.org/x/image v0.0.0-20181116024801-cd38e8056d9b
 	golang.org/x/net v0.7.0
 	golang.org/x/sys v0.5.0
@@ -13,7 +14,6 @@ require (
 )
 
 require (
-	golang.org/x/crypto v0.6.0 // indirect
 	golang.org/x/mod v0.8.0 // indirect
 	mellium.im/reader v0.1.0 // indirect
 )
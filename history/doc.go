@@ -7,6 +7,7 @@ package history // import "mellium.im/xmpp/history"
 
 // The namespaces used by this package, provided as a convenience.
 const (
-	NS    = `urn:xmpp:mam:2`
-	NSExt = `urn:xmpp:mam:2#extended`
+	NS         = `urn:xmpp:mam:2`
+	NSExt      = `urn:xmpp:mam:2#extended`
+	NSMetadata = `urn:xmpp:mam:2#metadata`
 )
@@ -13,6 +13,7 @@ import (
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp"
 	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/xmltok"
 	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/mux"
 	"mellium.im/xmpp/stanza"
@@ -41,9 +42,17 @@ func NewHandler(inner mux.MessageHandler) *Handler {
 // to the underlying handler if they are not being tracked or ensures they are
 // passed to the correct iterator for syncronous processing if they are.
 type Handler struct {
+	// Cursors stores the position of the last message synchronized from each
+	// archive by Sync.
+	// If nil, cursors are stored in memory.
+	Cursors CursorStore
+
 	inner    mux.MessageHandler
 	tracked  map[string]*Iter
 	trackedM sync.Mutex
+	mem      MemCursorStore
+	syncing  map[string]map[string]struct{}
+	syncM    sync.Mutex
 }
 
 func (h *Handler) remove(id string) {
@@ -90,7 +99,13 @@ func (h *Handler) HandleMessage(msg stanza.Message, r xmlstream.TokenReadEncoder
 		return nil
 	}
 
-	iter.msgC <- xmlstream.MultiReader(xmlstream.Token(msgTok), xmlstream.Token(tok), r)
+	// The reader is only valid until the handler returns, so buffer the message
+	// before passing it to the iterator.
+	toks, err := xmlstream.ReadAll(xmlstream.MultiReader(xmlstream.Token(msgTok), xmlstream.Token(tok), r))
+	if err != nil {
+		return err
+	}
+	iter.msgC <- xmltok.Replay(toks)
 	return nil
 }
 
@@ -131,7 +146,7 @@ func (h *Handler) FetchIQ(ctx context.Context, filter Query, iq stanza.IQ, s *xm
 			iq.Wrap(filter.TokenReader()),
 			&result,
 		)
-		if err != nil && iter.err != nil {
+		if err != nil && iter.err == nil {
 			// Technically this is racey. I'm not sure that we care though as long as
 			// an error is set?
 			iter.err = err
@@ -0,0 +1,120 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history
+
+import (
+	"context"
+	"encoding/xml"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// Bound is the first or last message in an archive.
+type Bound struct {
+	ID   string
+	Time time.Time
+}
+
+// Metadata describes the range of messages in an archive.
+// If the archive is empty, Start and End are both the zero value.
+type Metadata struct {
+	XMLName xml.Name `xml:"urn:xmpp:mam:2#metadata metadata"`
+	Start   Bound
+	End     Bound
+}
+
+// Empty reports whether the archive contains no messages.
+func (m Metadata) Empty() bool {
+	return m.Start.ID == "" && m.End.ID == ""
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (m Metadata) TokenReader() xml.TokenReader {
+	var inner []xml.TokenReader
+	if !m.Empty() {
+		bound := func(name string, b Bound) xml.TokenReader {
+			return xmlstream.Wrap(nil, xml.StartElement{
+				Name: xml.Name{Local: name},
+				Attr: []xml.Attr{
+					{Name: xml.Name{Local: "id"}, Value: b.ID},
+					{Name: xml.Name{Local: "timestamp"}, Value: b.Time.UTC().Format(time.RFC3339)},
+				},
+			})
+		}
+		inner = append(inner, bound("start", m.Start), bound("end", m.End))
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(inner...),
+		xml.StartElement{Name: xml.Name{Space: NSMetadata, Local: "metadata"}},
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (m Metadata) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, m.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (m Metadata) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := m.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (m *Metadata) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type bound struct {
+		ID        string `xml:"id,attr"`
+		Timestamp string `xml:"timestamp,attr"`
+	}
+	s := struct {
+		XMLName xml.Name `xml:"urn:xmpp:mam:2#metadata metadata"`
+		Start   *bound   `xml:"start"`
+		End     *bound   `xml:"end"`
+	}{}
+	err := d.DecodeElement(&s, &start)
+	if err != nil {
+		return err
+	}
+	m.XMLName = s.XMLName
+	for _, b := range []struct {
+		in  *bound
+		out *Bound
+	}{{in: s.Start, out: &m.Start}, {in: s.End, out: &m.End}} {
+		if b.in == nil {
+			continue
+		}
+		b.out.ID = b.in.ID
+		if b.in.Timestamp != "" {
+			b.out.Time, err = time.Parse(time.RFC3339, b.in.Timestamp)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GetMetadata fetches the IDs and times of the first and last messages in the
+// archive at the provided address.
+// If the address is empty the archive of the account is queried.
+func GetMetadata(ctx context.Context, to jid.JID, s *xmpp.Session) (Metadata, error) {
+	return GetMetadataIQ(ctx, stanza.IQ{To: to}, s)
+}
+
+// GetMetadataIQ is like GetMetadata but it allows modifying the underlying IQ.
+// Changing the type of the IQ has no effect.
+func GetMetadataIQ(ctx context.Context, iq stanza.IQ, s *xmpp.Session) (Metadata, error) {
+	iq.Type = stanza.GetIQ
+	var meta Metadata
+	err := s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		nil,
+		xml.StartElement{Name: xml.Name{Space: NSMetadata, Local: "metadata"}},
+	), iq, &meta)
+	return meta, err
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history_test
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/history"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Unmarshaler     = (*history.Metadata)(nil)
+	_ xml.Marshaler       = history.Metadata{}
+	_ xmlstream.Marshaler = history.Metadata{}
+	_ xmlstream.WriterTo  = history.Metadata{}
+)
+
+var metadataEncodingTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value: &history.Metadata{
+			XMLName: xml.Name{Space: history.NSMetadata, Local: "metadata"},
+		},
+		XML: `<metadata xmlns="urn:xmpp:mam:2#metadata"></metadata>`,
+	},
+	1: {
+		Value: &history.Metadata{
+			XMLName: xml.Name{Space: history.NSMetadata, Local: "metadata"},
+			Start:   history.Bound{ID: "YWxwaGEg", Time: time.Date(2008, 8, 22, 21, 9, 4, 0, time.UTC)},
+			End:     history.Bound{ID: "b21lZ2Eg", Time: time.Date(2020, 4, 20, 14, 34, 21, 0, time.UTC)},
+		},
+		XML: `<metadata xmlns="urn:xmpp:mam:2#metadata"><start id="YWxwaGEg" timestamp="2008-08-22T21:09:04Z"></start><end id="b21lZ2Eg" timestamp="2020-04-20T14:34:21Z"></end></metadata>`,
+	},
+}
+
+func TestEncodeMetadata(t *testing.T) {
+	xmpptest.RunEncodingTests(t, metadataEncodingTestCases)
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	archive := jid.MustParse("test@example.net")
+	srv := &history.Service{}
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandler(mux.New(stanza.NSClient, history.HandleService(srv))),
+	)
+	defer cs.Close()
+
+	meta, err := history.GetMetadata(context.Background(), archive, cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching metadata: %v", err)
+	}
+	if !meta.Empty() {
+		t.Errorf("expected empty archive, got %+v", meta)
+	}
+
+	var ids []string
+	for _, body := range []string{"one", "two", "three"} {
+		msg, err := srv.Archive(context.Background(), archive, xml.NewDecoder(strings.NewReader(
+			`<message from="romeo@example.net/orchard" to="test@example.net"><body>`+body+`</body></message>`,
+		)))
+		if err != nil {
+			t.Fatalf("error archiving message: %v", err)
+		}
+		ids = append(ids, msg.ID)
+	}
+
+	meta, err = history.GetMetadata(context.Background(), archive, cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching metadata: %v", err)
+	}
+	if meta.Start.ID != ids[0] || meta.End.ID != ids[2] {
+		t.Errorf("wrong metadata: want=%s-%s, got=%s-%s", ids[0], ids[2], meta.Start.ID, meta.End.ID)
+	}
+	if meta.Start.Time.IsZero() || meta.End.Time.Before(meta.Start.Time) {
+		t.Errorf("wrong times: %v-%v", meta.Start.Time, meta.End.Time)
+	}
+}
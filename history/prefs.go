@@ -0,0 +1,171 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// Default is the archiving behavior for JIDs that are not explicitly listed
+// in the preferences.
+type Default string
+
+// Possible default archiving behaviors.
+const (
+	// DefaultAlways archives all messages.
+	DefaultAlways Default = "always"
+
+	// DefaultNever archives no messages.
+	DefaultNever Default = "never"
+
+	// DefaultRoster archives messages from contacts in the users roster.
+	DefaultRoster Default = "roster"
+)
+
+// Prefs are the archiving preferences of an account.
+type Prefs struct {
+	XMLName xml.Name `xml:"urn:xmpp:mam:2 prefs"`
+
+	// Default is the behavior for JIDs that are in neither Always nor Never.
+	Default Default
+
+	// Always is a list of JIDs whose messages are always archived.
+	Always []jid.JID
+
+	// Never is a list of JIDs whose messages are never archived.
+	// If a JID is in both Always and Never, Never takes precedence.
+	Never []jid.JID
+}
+
+// ShouldArchive reports whether a message to or from with should be archived
+// according to the preferences.
+// InRoster is only used if the default is DefaultRoster and reports whether
+// with is in the roster of the owner of the archive.
+func (p Prefs) ShouldArchive(with jid.JID, inRoster bool) bool {
+	if containsJID(p.Never, with) {
+		return false
+	}
+	if containsJID(p.Always, with) {
+		return true
+	}
+	switch p.Default {
+	case DefaultNever:
+		return false
+	case DefaultRoster:
+		return inRoster
+	}
+	return true
+}
+
+// containsJID reports whether j or its bare JID is in list.
+func containsJID(list []jid.JID, j jid.JID) bool {
+	bare := j.Bare()
+	for _, item := range list {
+		if item.Equal(j) || item.Equal(bare) {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (p Prefs) TokenReader() xml.TokenReader {
+	list := func(name string, jids []jid.JID) xml.TokenReader {
+		var inner []xml.TokenReader
+		for _, j := range jids {
+			inner = append(inner, xmlstream.Wrap(
+				xmlstream.Token(xml.CharData(j.String())),
+				xml.StartElement{Name: xml.Name{Local: "jid"}},
+			))
+		}
+		return xmlstream.Wrap(
+			xmlstream.MultiReader(inner...),
+			xml.StartElement{Name: xml.Name{Local: name}},
+		)
+	}
+	start := xml.StartElement{Name: xml.Name{Space: NS, Local: "prefs"}}
+	if p.Default != "" {
+		start.Attr = append(start.Attr, xml.Attr{
+			Name:  xml.Name{Local: "default"},
+			Value: string(p.Default),
+		})
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(
+			list("always", p.Always),
+			list("never", p.Never),
+		),
+		start,
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (p Prefs) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, p.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (p Prefs) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := p.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (p *Prefs) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	s := struct {
+		XMLName xml.Name  `xml:"urn:xmpp:mam:2 prefs"`
+		Default Default   `xml:"default,attr"`
+		Always  []jid.JID `xml:"always>jid"`
+		Never   []jid.JID `xml:"never>jid"`
+	}{}
+	err := d.DecodeElement(&s, &start)
+	if err != nil {
+		return err
+	}
+	p.XMLName = s.XMLName
+	p.Default = s.Default
+	p.Always = s.Always
+	p.Never = s.Never
+	return nil
+}
+
+// GetPrefs fetches the archiving preferences of the account.
+func GetPrefs(ctx context.Context, s *xmpp.Session) (Prefs, error) {
+	return GetPrefsIQ(ctx, stanza.IQ{}, s)
+}
+
+// GetPrefsIQ is like GetPrefs but it allows modifying the underlying IQ.
+// Changing the type of the IQ has no effect.
+func GetPrefsIQ(ctx context.Context, iq stanza.IQ, s *xmpp.Session) (Prefs, error) {
+	iq.Type = stanza.GetIQ
+	var prefs Prefs
+	err := s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		nil,
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "prefs"}},
+	), iq, &prefs)
+	return prefs, err
+}
+
+// SetPrefs replaces the archiving preferences of the account and returns the
+// preferences that the server will use, which may differ from those that were
+// requested.
+func SetPrefs(ctx context.Context, prefs Prefs, s *xmpp.Session) (Prefs, error) {
+	return SetPrefsIQ(ctx, prefs, stanza.IQ{}, s)
+}
+
+// SetPrefsIQ is like SetPrefs but it allows modifying the underlying IQ.
+// Changing the type of the IQ has no effect.
+func SetPrefsIQ(ctx context.Context, prefs Prefs, iq stanza.IQ, s *xmpp.Session) (Prefs, error) {
+	iq.Type = stanza.SetIQ
+	var resp Prefs
+	err := s.UnmarshalIQElement(ctx, prefs.TokenReader(), iq, &resp)
+	return resp, err
+}
@@ -0,0 +1,149 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/history"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Unmarshaler     = (*history.Prefs)(nil)
+	_ xml.Marshaler       = history.Prefs{}
+	_ xmlstream.Marshaler = history.Prefs{}
+	_ xmlstream.WriterTo  = history.Prefs{}
+)
+
+var prefsEncodingTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value: &history.Prefs{
+			XMLName: xml.Name{Space: history.NS, Local: "prefs"},
+			Default: history.DefaultRoster,
+			Always:  []jid.JID{jid.MustParse("romeo@example.net")},
+			Never:   []jid.JID{jid.MustParse("tybalt@example.net"), jid.MustParse("example.org")},
+		},
+		XML: `<prefs xmlns="urn:xmpp:mam:2" default="roster"><always><jid>romeo@example.net</jid></always><never><jid>tybalt@example.net</jid><jid>example.org</jid></never></prefs>`,
+	},
+	1: {
+		Value: &history.Prefs{
+			XMLName: xml.Name{Space: history.NS, Local: "prefs"},
+		},
+		XML: `<prefs xmlns="urn:xmpp:mam:2"><always></always><never></never></prefs>`,
+	},
+}
+
+func TestEncodePrefs(t *testing.T) {
+	xmpptest.RunEncodingTests(t, prefsEncodingTestCases)
+}
+
+func TestShouldArchive(t *testing.T) {
+	romeo := jid.MustParse("romeo@example.net/orchard")
+	tybalt := jid.MustParse("tybalt@example.net")
+	nurse := jid.MustParse("nurse@example.com")
+	for i, tc := range []struct {
+		prefs    history.Prefs
+		with     jid.JID
+		inRoster bool
+		want     bool
+	}{
+		0: {with: nurse, want: true},
+		1: {prefs: history.Prefs{Default: history.DefaultNever}, with: nurse},
+		2: {prefs: history.Prefs{Default: history.DefaultNever, Always: []jid.JID{romeo.Bare()}}, with: romeo, want: true},
+		3: {prefs: history.Prefs{Always: []jid.JID{tybalt}, Never: []jid.JID{tybalt}}, with: tybalt},
+		4: {prefs: history.Prefs{Default: history.DefaultRoster}, with: nurse},
+		5: {prefs: history.Prefs{Default: history.DefaultRoster}, with: nurse, inRoster: true, want: true},
+		6: {prefs: history.Prefs{Never: []jid.JID{romeo}}, with: romeo.Bare(), want: true},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if got := tc.prefs.ShouldArchive(tc.with, tc.inRoster); got != tc.want {
+				t.Errorf("wrong result: want=%t, got=%t", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPrefsRoundTrip(t *testing.T) {
+	archive := jid.MustParse("test@example.net")
+	srv := &history.Service{Default: history.DefaultRoster}
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandler(mux.New(stanza.NSClient, history.HandleService(srv))),
+	)
+	defer cs.Close()
+
+	prefs, err := history.GetPrefs(context.Background(), cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching prefs: %v", err)
+	}
+	if prefs.Default != history.DefaultRoster {
+		t.Errorf("wrong default: want=%s, got=%s", history.DefaultRoster, prefs.Default)
+	}
+
+	want := history.Prefs{
+		XMLName: xml.Name{Space: history.NS, Local: "prefs"},
+		Default: history.DefaultAlways,
+		Never:   []jid.JID{jid.MustParse("tybalt@example.net")},
+	}
+	// The test server does not set the from attribute, so address the archive
+	// explicitly.
+	prefs, err = history.SetPrefsIQ(context.Background(), want, stanza.IQ{To: archive}, cs.Client)
+	if err != nil {
+		t.Fatalf("error setting prefs: %v", err)
+	}
+	if !reflect.DeepEqual(prefs, want) {
+		t.Errorf("wrong prefs after setting: want=%+v, got=%+v", want, prefs)
+	}
+	prefs, err = history.GetPrefsIQ(context.Background(), stanza.IQ{To: archive}, cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching prefs: %v", err)
+	}
+	if !reflect.DeepEqual(prefs, want) {
+		t.Errorf("wrong prefs: want=%+v, got=%+v", want, prefs)
+	}
+
+	// Unknown default preferences are rejected and do not change the stored
+	// preferences.
+	_, err = history.SetPrefsIQ(context.Background(), history.Prefs{Default: "sometimes"}, stanza.IQ{To: archive}, cs.Client)
+	var se stanza.Error
+	if !errors.As(err, &se) || se.Condition != stanza.BadRequest {
+		t.Errorf("wrong error for invalid default: want=%v, got=%v", stanza.BadRequest, err)
+	}
+	prefs, err = history.GetPrefsIQ(context.Background(), stanza.IQ{To: archive}, cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching prefs: %v", err)
+	}
+	if !reflect.DeepEqual(prefs, want) {
+		t.Errorf("prefs changed by invalid request: want=%+v, got=%+v", want, prefs)
+	}
+
+	// Messages with JIDs that are opted out of archiving should not be stored or
+	// stamped.
+	for _, tc := range []struct {
+		msg      string
+		archived bool
+	}{
+		{msg: `<message from="tybalt@example.net/street" to="test@example.net"><body>Draw!</body></message>`},
+		{msg: `<message from="romeo@example.net/orchard" to="test@example.net"><body>Hi</body></message>`, archived: true},
+	} {
+		msg, err := srv.Archive(context.Background(), archive, xml.NewDecoder(strings.NewReader(tc.msg)))
+		if err != nil {
+			t.Fatalf("error archiving message: %v", err)
+		}
+		if archived := msg.ID != ""; archived != tc.archived {
+			t.Errorf("wrong archive status for %s: want=%t, got=%t", tc.msg, tc.archived, archived)
+		}
+	}
+}
@@ -147,6 +147,7 @@ func (f *Query) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 			After   string   `xml:"after"`
 			Before  struct {
 				XMLName xml.Name `xml:"before"`
+				ID      string   `xml:",chardata"`
 			}
 		}
 	}{}
@@ -155,29 +156,45 @@ func (f *Query) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 		return err
 	}
 
+	// Raw is used instead of the typed getters because submitted forms are not
+	// required to include the types of their fields.
+	value := func(id string) (string, bool) {
+		vals, _ := s.Form.Raw(id)
+		if len(vals) == 0 {
+			return "", false
+		}
+		return vals[0], true
+	}
+
 	f.ID = s.ID
-	f.With, _ = s.Form.GetJID(fieldWith)
-	startTime, ok := s.Form.GetString(fieldStart)
-	if ok {
-		//panic(startTime)
+	if with, ok := value(fieldWith); ok {
+		f.With, err = jid.Parse(with)
+		if err != nil {
+			return err
+		}
+	}
+	if startTime, ok := value(fieldStart); ok {
 		f.Start, err = time.Parse(time.RFC3339, startTime)
 		if err != nil {
 			return err
 		}
 	}
-	endTime, ok := s.Form.GetString(fieldEnd)
-	if ok {
+	if endTime, ok := value(fieldEnd); ok {
 		f.End, err = time.Parse(time.RFC3339, endTime)
 		if err != nil {
 			return err
 		}
 	}
-	f.BeforeID, _ = s.Form.GetString(fieldBefore)
-	f.AfterID, _ = s.Form.GetString(fieldAfter)
-	f.IDs, _ = s.Form.GetStrings(fieldIDs)
+	f.BeforeID, _ = value(fieldBefore)
+	f.AfterID, _ = value(fieldAfter)
+	f.IDs, _ = s.Form.Raw(fieldIDs)
 	f.Limit = s.Set.Max
 
 	f.Last = s.Set.Before.XMLName.Local == "before"
+	f.PageID = s.Set.After
+	if f.Last {
+		f.PageID = s.Set.Before.ID
+	}
 	f.Reverse = s.Flip.XMLName.Local == "flip-page"
 	return nil
 }
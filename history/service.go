@@ -0,0 +1,404 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history
+
+import (
+	"context"
+	"encoding/xml"
+	"strconv"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/delay"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/forward"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/xmltok"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/paging"
+	"mellium.im/xmpp/stanza"
+)
+
+const defMaxPage = 50
+
+// HandleService returns an option that registers an archive service on the
+// mux.
+func HandleService(srv *Service) mux.Option {
+	return func(m *mux.ServeMux) {
+		query := xml.Name{Space: NS, Local: "query"}
+		prefs := xml.Name{Space: NS, Local: "prefs"}
+		mux.IQ(stanza.GetIQ, query, srv)(m)
+		mux.IQ(stanza.SetIQ, query, srv)(m)
+		mux.IQ(stanza.GetIQ, prefs, srv)(m)
+		mux.IQ(stanza.SetIQ, prefs, srv)(m)
+		mux.IQ(stanza.GetIQ, xml.Name{Space: NSMetadata, Local: "metadata"}, srv)(m)
+	}
+}
+
+// Service is a message archive that can be queried using Message Archive
+// Management.
+// It supports the extended query fields (see NSExt) in addition to the
+// standard filters.
+//
+// The IQ handled by the service must have its from attribute set to the
+// address of the requesting entity.
+// If the IQ has a to attribute it is used as the address of the archive,
+// otherwise the bare JID of the requesting entity is used.
+// Checking whether the requesting entity is allowed to access the archive is
+// left to the server.
+//
+// The zero value is a service that stores messages in memory.
+type Service struct {
+	// Store persists messages.
+	// If nil, messages are stored in memory.
+	Store Store
+
+	// MaxPage is the largest number of messages returned in a single page.
+	// If it is zero, a default of 50 is used.
+	MaxPage uint64
+
+	// Default is the default archiving behavior used for archives that have not
+	// set any preferences.
+	// If it is empty, DefaultAlways is used.
+	Default Default
+
+	// InRoster reports whether contact is in the roster of the owner of archive.
+	// It is used to implement the DefaultRoster archiving preference, and if it
+	// is nil no contacts are considered to be in the roster.
+	InRoster func(archive, contact jid.JID) bool
+
+	mem MemStore
+}
+
+func (srv *Service) store() Store {
+	if srv.Store != nil {
+		return srv.Store
+	}
+	return &srv.mem
+}
+
+// Archive assigns a stanza ID to the message read from r and stores it in the
+// archive owned by the bare JID archive.
+// Any existing stanza IDs set by the archive are removed before the new one is
+// added so that they cannot be spoofed by the sender.
+// The message, including the new stanza ID, is returned so that it can be
+// delivered.
+//
+// If the archiving preferences of the archive exclude the other party in the
+// conversation, the message is not stored and is returned without a stanza ID.
+// Deciding which other messages should be archived is left to the caller.
+func (srv *Service) Archive(ctx context.Context, archive jid.JID, r xml.TokenReader) (Message, error) {
+	archive = archive.Bare()
+	by := archive.String()
+	toks, err := xmlstream.ReadAll(xmlstream.RemoveElement(func(start xml.StartElement) bool {
+		if start.Name.Space != stanza.NSSid || start.Name.Local != "stanza-id" {
+			return false
+		}
+		_, attrBy := attr.Get(start.Attr, "by")
+		return attrBy == by
+	})(r))
+	if err != nil {
+		return Message{}, err
+	}
+
+	msg := Message{
+		Time:   time.Now().UTC(),
+		Stanza: toks,
+	}
+	if len(toks) > 0 {
+		if start, ok := toks[0].(xml.StartElement); ok {
+			// Outgoing messages are archived with the recipient, incoming messages
+			// with the sender.
+			_, with := attr.Get(start.Attr, "from")
+			if from, err := jid.Parse(with); with == "" || err == nil && from.Bare().Equal(archive) {
+				_, with = attr.Get(start.Attr, "to")
+			}
+			if with != "" {
+				msg.With, err = jid.Parse(with)
+				if err != nil {
+					return Message{}, err
+				}
+			}
+		}
+	}
+
+	prefs, err := srv.prefs(ctx, archive)
+	if err != nil {
+		return Message{}, err
+	}
+	var inRoster bool
+	if prefs.Default == DefaultRoster && srv.InRoster != nil {
+		inRoster = srv.InRoster(archive, msg.With.Bare())
+	}
+	if !prefs.ShouldArchive(msg.With, inRoster) {
+		return msg, nil
+	}
+
+	msg.Stanza, err = xmlstream.ReadAll(stanza.AddID(archive, "")(xmltok.Replay(toks)))
+	if err != nil {
+		return Message{}, err
+	}
+	var depth int
+	for _, tok := range msg.Stanza {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 && t.Name.Space == stanza.NSSid && t.Name.Local == "stanza-id" {
+				_, attrBy := attr.Get(t.Attr, "by")
+				if attrBy == by {
+					_, msg.ID = attr.Get(t.Attr, "id")
+				}
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+
+	err = srv.store().Append(ctx, archive, msg)
+	if err != nil {
+		return Message{}, err
+	}
+	return msg, nil
+}
+
+// prefs returns the archiving preferences of archive or the defaults if none
+// have been set.
+func (srv *Service) prefs(ctx context.Context, archive jid.JID) (Prefs, error) {
+	prefs, ok, err := srv.store().Prefs(ctx, archive)
+	if err != nil {
+		return Prefs{}, err
+	}
+	if !ok {
+		prefs = Prefs{Default: srv.Default}
+	}
+	if prefs.Default == "" {
+		prefs.Default = DefaultAlways
+	}
+	return prefs, nil
+}
+
+// ForFeatures implements info.FeatureIter.
+func (srv *Service) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	for _, feature := range []string{NS, NSExt, NSMetadata} {
+		err := f(info.Feature{Var: feature})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleIQ implements mux.IQHandler.
+func (srv *Service) HandleIQ(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	ctx := context.Background()
+	archive := iq.To.Bare()
+	if archive.Equal(jid.JID{}) {
+		archive = iq.From.Bare()
+	}
+
+	var (
+		payload xml.TokenReader
+		err     error
+	)
+	switch {
+	case start.Name.Local == "metadata":
+		var meta Metadata
+		meta, err = srv.store().Metadata(ctx, archive)
+		payload = meta.TokenReader()
+	case start.Name.Local == "prefs" && iq.Type == stanza.GetIQ:
+		var prefs Prefs
+		prefs, err = srv.prefs(ctx, archive)
+		payload = prefs.TokenReader()
+	case start.Name.Local == "prefs":
+		var prefs Prefs
+		err = xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&prefs)
+		if err != nil || !validDefault(prefs.Default) {
+			err = stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}
+			break
+		}
+		err = srv.store().SetPrefs(ctx, archive, prefs)
+		if err != nil {
+			break
+		}
+		prefs, err = srv.prefs(ctx, archive)
+		payload = prefs.TokenReader()
+	case iq.Type == stanza.GetIQ:
+		payload = xmlstream.Wrap(
+			queryForm().TokenReader(),
+			xml.StartElement{Name: xml.Name{Space: NS, Local: "query"}},
+		)
+	default:
+		return srv.handleQuery(ctx, iq, archive, r, start)
+	}
+	if err != nil {
+		return replyErr(iq, r, err)
+	}
+	_, err = xmlstream.Copy(r, iq.Result(payload))
+	return err
+}
+
+// validDefault reports whether d is one of the default archiving preferences
+// defined by XEP-0313.
+func validDefault(d Default) bool {
+	switch d {
+	case DefaultAlways, DefaultNever, DefaultRoster:
+		return true
+	}
+	return false
+}
+
+// replyErr responds to iq with err if it is a stanza error or a generic error
+// otherwise.
+func replyErr(iq stanza.IQ, r xmlstream.TokenWriter, err error) error {
+	se, ok := err.(stanza.Error)
+	if !ok {
+		se = stanza.Error{Type: stanza.Wait, Condition: stanza.InternalServerError}
+	}
+	_, err = xmlstream.Copy(r, iq.Error(se))
+	return err
+}
+
+func (srv *Service) handleQuery(ctx context.Context, iq stanza.IQ, archive jid.JID, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	var q Query
+	err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&q)
+	if err != nil {
+		return replyErr(iq, r, stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest})
+	}
+
+	msgs, page, err := srv.query(ctx, archive, q)
+	if err != nil {
+		return replyErr(iq, r, err)
+	}
+
+	for _, msg := range msgs {
+		_, err = xmlstream.Copy(r, stanza.Message{
+			ID:   attr.RandomID(),
+			To:   iq.From,
+			From: archive,
+		}.Wrap(xmlstream.Wrap(
+			forward.Forwarded{
+				Delay: delay.Delay{Time: msg.Time},
+			}.Wrap(xmltok.Replay(msg.Stanza)),
+			xml.StartElement{
+				Name: xml.Name{Space: NS, Local: "result"},
+				Attr: []xml.Attr{
+					{Name: xml.Name{Local: "queryid"}, Value: q.ID},
+					{Name: xml.Name{Local: "id"}, Value: msg.ID},
+				},
+			},
+		)))
+		if err != nil {
+			return err
+		}
+	}
+
+	var complete bool
+	if q.Last {
+		complete = page.Set.First.Index == nil || *page.Set.First.Index == 0
+	} else {
+		var offset uint64
+		if page.Set.First.Index != nil {
+			offset = *page.Set.First.Index
+		}
+		complete = offset+uint64(len(page.IDs)) == *page.Set.Count
+	}
+	_, err = xmlstream.Copy(r, iq.Result(xmlstream.Wrap(
+		page.TokenReader(),
+		xml.StartElement{
+			Name: xml.Name{Space: NS, Local: "fin"},
+			Attr: []xml.Attr{{
+				Name:  xml.Name{Local: "complete"},
+				Value: strconv.FormatBool(complete),
+			}},
+		},
+	)))
+	return err
+}
+
+// query returns the page of messages selected by q in the order they should be
+// sent.
+func (srv *Service) query(ctx context.Context, archive jid.JID, q Query) ([]Message, paging.Page, error) {
+	msgs, err := srv.store().Query(ctx, archive, q)
+	if err != nil {
+		return nil, paging.Page{}, err
+	}
+
+	req := &paging.Request{}
+	if q.Limit > 0 {
+		req.Max = &q.Limit
+	}
+	switch {
+	case q.Last:
+		req.Before = &q.PageID
+	case q.PageID != "":
+		req.After = &q.PageID
+	}
+	max := srv.MaxPage
+	if max == 0 {
+		max = defMaxPage
+	}
+	page, err := paging.Respond(messageSlice(msgs), req, max)
+	if err != nil {
+		return nil, paging.Page{}, err
+	}
+
+	var offset uint64
+	if page.Set.First.Index != nil {
+		offset = *page.Set.First.Index
+	}
+	msgs = msgs[offset : offset+uint64(len(page.IDs))]
+	if q.Reverse {
+		reversed := make([]Message, 0, len(msgs))
+		for i := len(msgs) - 1; i >= 0; i-- {
+			reversed = append(reversed, msgs[i])
+		}
+		msgs = reversed
+	}
+	return msgs, page, nil
+}
+
+// queryForm returns the form describing the fields supported by a Service.
+func queryForm() *form.Data {
+	return form.New(
+		form.Hidden("FORM_TYPE", form.Value(NS)),
+		form.JID(fieldWith),
+		form.Text(fieldStart),
+		form.Text(fieldEnd),
+		form.Text(fieldAfter),
+		form.Text(fieldBefore),
+		form.ListMulti(fieldIDs),
+	)
+}
+
+// messageSlice is a paging.Source over a list of messages.
+type messageSlice []Message
+
+func (s messageSlice) Len() (uint64, error) {
+	return uint64(len(s)), nil
+}
+
+func (s messageSlice) Index(id string) (uint64, bool, error) {
+	for i, msg := range s {
+		if msg.ID == id {
+			return uint64(i), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (s messageSlice) Page(offset, max uint64, f func(id string) error) error {
+	for _, msg := range s[offset : offset+max] {
+		err := f(msg.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
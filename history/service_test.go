@@ -0,0 +1,157 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/history"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+func TestMemStoreQuery(t *testing.T) {
+	archive := jid.MustParse("juliet@example.com")
+	romeo := jid.MustParse("romeo@example.net/orchard")
+	nurse := jid.MustParse("nurse@example.com")
+	epoch := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &history.MemStore{}
+	for i, with := range []jid.JID{romeo, nurse, romeo, nurse, romeo.Bare()} {
+		err := store.Append(context.Background(), archive, history.Message{
+			ID:   strconv.Itoa(i),
+			With: with,
+			Time: epoch.Add(time.Duration(i) * time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("error appending message %d: %v", i, err)
+		}
+	}
+
+	for i, tc := range []struct {
+		q   history.Query
+		ids []string
+		err stanza.Condition
+	}{
+		0: {ids: []string{"0", "1", "2", "3", "4"}},
+		1: {q: history.Query{With: romeo.Bare()}, ids: []string{"0", "2", "4"}},
+		2: {q: history.Query{With: romeo}, ids: []string{"0", "2"}},
+		3: {q: history.Query{Start: epoch.Add(time.Hour), End: epoch.Add(3 * time.Hour)}, ids: []string{"1", "2", "3"}},
+		4: {q: history.Query{AfterID: "1", BeforeID: "4"}, ids: []string{"2", "3"}},
+		5: {q: history.Query{IDs: []string{"3", "1"}, With: nurse}, ids: []string{"1", "3"}},
+		6: {q: history.Query{AfterID: "missing"}, err: stanza.ItemNotFound},
+		7: {q: history.Query{IDs: []string{"1", "missing"}}, err: stanza.ItemNotFound},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			msgs, err := store.Query(context.Background(), archive, tc.q)
+			if tc.err != "" {
+				var se stanza.Error
+				if !errors.As(err, &se) || se.Condition != tc.err {
+					t.Fatalf("wrong error: want=%v, got=%v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var ids []string
+			for _, msg := range msgs {
+				ids = append(ids, msg.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.ids) {
+				t.Errorf("wrong messages: want=%v, got=%v", tc.ids, ids)
+			}
+		})
+	}
+}
+
+func TestService(t *testing.T) {
+	archive := jid.MustParse("juliet@example.com")
+	srv := &history.Service{}
+	var ids []string
+	for i, msg := range []string{
+		`<message from="romeo@example.net/orchard" to="juliet@example.com/balcony"><body>1</body><stanza-id xmlns="urn:xmpp:sid:0" by="juliet@example.com" id="spoofed"/></message>`,
+		`<message from="juliet@example.com/balcony" to="romeo@example.net/orchard"><body>2</body></message>`,
+		`<message from="nurse@example.com/kitchen" to="juliet@example.com"><body>3</body></message>`,
+	} {
+		stored, err := srv.Archive(context.Background(), archive, xml.NewDecoder(strings.NewReader(msg)))
+		if err != nil {
+			t.Fatalf("error archiving message %d: %v", i, err)
+		}
+		if stored.ID == "" || stored.ID == "spoofed" {
+			t.Fatalf("wrong stanza ID for message %d: %q", i, stored.ID)
+		}
+		var n int
+		for _, tok := range stored.Stanza {
+			if start, ok := tok.(xml.StartElement); ok && start.Name.Local == "stanza-id" {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Errorf("wrong number of stanza IDs on message %d: want=1, got=%d", i, n)
+		}
+		ids = append(ids, stored.ID)
+	}
+
+	var results []string
+	h := history.NewHandler(mux.MessageHandlerFunc(func(_ stanza.Message, r xmlstream.TokenReadEncoder) error {
+		tok, err := r.Token()
+		if err != nil {
+			return err
+		}
+		_, id := attr.Get(tok.(xml.StartElement).Attr, "id")
+		results = append(results, id)
+		return nil
+	}))
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandler(mux.New(stanza.NSClient, history.HandleService(srv))),
+		xmpptest.ClientHandler(mux.New("", history.Handle(h))),
+	)
+	defer cs.Close()
+
+	for i, tc := range []struct {
+		q        history.Query
+		ids      []string
+		complete bool
+	}{
+		0: {q: history.Query{}, ids: ids, complete: true},
+		1: {q: history.Query{Limit: 2}, ids: ids[:2]},
+		2: {q: history.Query{Limit: 2, PageID: ids[1]}, ids: ids[2:], complete: true},
+		3: {q: history.Query{Limit: 2, Last: true}, ids: ids[1:]},
+		4: {q: history.Query{Limit: 2, Last: true, PageID: ids[1]}, ids: ids[:1], complete: true},
+		5: {q: history.Query{With: jid.MustParse("romeo@example.net")}, ids: ids[:2], complete: true},
+		6: {q: history.Query{AfterID: ids[0], Reverse: true}, ids: []string{ids[2], ids[1]}, complete: true},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			results = results[:0]
+			res, err := history.Fetch(context.Background(), tc.q, archive, cs.Client)
+			if err != nil {
+				t.Fatalf("error fetching history: %v", err)
+			}
+			if !reflect.DeepEqual(results, tc.ids) {
+				t.Errorf("wrong messages: want=%v, got=%v", tc.ids, results)
+			}
+			if res.Complete != tc.complete {
+				t.Errorf("wrong value for complete: want=%t, got=%t", tc.complete, res.Complete)
+			}
+		})
+	}
+
+	_, err := history.Fetch(context.Background(), history.Query{BeforeID: "missing"}, archive, cs.Client)
+	var se stanza.Error
+	if !errors.As(err, &se) || se.Condition != stanza.ItemNotFound {
+		t.Errorf("wrong error for missing ID: want=%v, got=%v", stanza.ItemNotFound, err)
+	}
+}
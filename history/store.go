@@ -0,0 +1,185 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history
+
+import (
+	"context"
+	"encoding/xml"
+	"sync"
+	"time"
+
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// Message is a message stored in an archive.
+type Message struct {
+	// ID is the stanza ID assigned to the message by the archive.
+	ID string
+
+	// With is the address of the other party in the conversation.
+	With jid.JID
+
+	// Time is when the message was archived.
+	Time time.Time
+
+	// Stanza is the tokens that make up the message stanza.
+	Stanza []xml.Token
+}
+
+// Store is used by a Service to persist messages.
+// The archive address passed to each method is the bare JID of the account or
+// the address of the room that owns the archive.
+type Store interface {
+	// Append adds a message to the end of an archive.
+	Append(ctx context.Context, archive jid.JID, msg Message) error
+
+	// Query returns the messages in an archive that match the With, Start, End,
+	// BeforeID, AfterID, and IDs filters of q, ordered from oldest to newest.
+	// The paging fields of q are handled by the Service and may be ignored.
+	// If BeforeID, AfterID, or any of the IDs do not exist in the archive, a
+	// stanza error with the item-not-found condition should be returned.
+	Query(ctx context.Context, archive jid.JID, q Query) ([]Message, error)
+
+	// Metadata returns the IDs and times of the first and last messages in an
+	// archive.
+	Metadata(ctx context.Context, archive jid.JID) (Metadata, error)
+
+	// Prefs returns the archiving preferences of an archive.
+	// If no preferences have been set, ok is false.
+	Prefs(ctx context.Context, archive jid.JID) (prefs Prefs, ok bool, err error)
+
+	// SetPrefs replaces the archiving preferences of an archive.
+	SetPrefs(ctx context.Context, archive jid.JID, prefs Prefs) error
+}
+
+// MemStore is an in-memory implementation of Store.
+// The zero value is ready to use.
+type MemStore struct {
+	m        sync.Mutex
+	archives map[string][]Message
+	prefs    map[string]Prefs
+}
+
+// Append implements Store.
+func (s *MemStore) Append(_ context.Context, archive jid.JID, msg Message) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.archives == nil {
+		s.archives = make(map[string][]Message)
+	}
+	key := archive.Bare().String()
+	s.archives[key] = append(s.archives[key], msg)
+	return nil
+}
+
+// Query implements Store.
+func (s *MemStore) Query(_ context.Context, archive jid.JID, q Query) ([]Message, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	msgs := s.archives[archive.Bare().String()]
+
+	indexOf := func(id string) (int, error) {
+		for i, msg := range msgs {
+			if msg.ID == id {
+				return i, nil
+			}
+		}
+		return 0, stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound}
+	}
+	start, end := 0, len(msgs)
+	if q.AfterID != "" {
+		idx, err := indexOf(q.AfterID)
+		if err != nil {
+			return nil, err
+		}
+		start = idx + 1
+	}
+	if q.BeforeID != "" {
+		idx, err := indexOf(q.BeforeID)
+		if err != nil {
+			return nil, err
+		}
+		end = idx
+	}
+	var ids map[string]struct{}
+	if len(q.IDs) > 0 {
+		ids = make(map[string]struct{}, len(q.IDs))
+		for _, id := range q.IDs {
+			if _, err := indexOf(id); err != nil {
+				return nil, err
+			}
+			ids[id] = struct{}{}
+		}
+	}
+
+	var found []Message
+	for i := start; i < end; i++ {
+		msg := msgs[i]
+		if ids != nil {
+			if _, ok := ids[msg.ID]; !ok {
+				continue
+			}
+		}
+		if matches(q, msg) {
+			found = append(found, msg)
+		}
+	}
+	return found, nil
+}
+
+// Metadata implements Store.
+func (s *MemStore) Metadata(_ context.Context, archive jid.JID) (Metadata, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	msgs := s.archives[archive.Bare().String()]
+	if len(msgs) == 0 {
+		return Metadata{}, nil
+	}
+	first, last := msgs[0], msgs[len(msgs)-1]
+	return Metadata{
+		Start: Bound{ID: first.ID, Time: first.Time},
+		End:   Bound{ID: last.ID, Time: last.Time},
+	}, nil
+}
+
+// Prefs implements Store.
+func (s *MemStore) Prefs(_ context.Context, archive jid.JID) (Prefs, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	prefs, ok := s.prefs[archive.Bare().String()]
+	return prefs, ok, nil
+}
+
+// SetPrefs implements Store.
+func (s *MemStore) SetPrefs(_ context.Context, archive jid.JID, prefs Prefs) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.prefs == nil {
+		s.prefs = make(map[string]Prefs)
+	}
+	s.prefs[archive.Bare().String()] = prefs
+	return nil
+}
+
+// matches reports whether msg matches the With, Start, and End filters of q.
+func matches(q Query, msg Message) bool {
+	switch {
+	case q.With.Equal(jid.JID{}):
+	case q.With.Resourcepart() != "":
+		if !msg.With.Equal(q.With) {
+			return false
+		}
+	case !msg.With.Bare().Equal(q.With):
+		return false
+	}
+	if !q.Start.IsZero() && msg.Time.Before(q.Start) {
+		return false
+	}
+	if !q.End.IsZero() && msg.Time.After(q.End) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,241 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/delay"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/xmltok"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// Cursor is the position of the last message that was synchronized from an
+// archive.
+type Cursor struct {
+	// ID is the stanza ID assigned to the message by the archive.
+	ID string
+
+	// Time is when the message was archived.
+	// It is used to resume synchronization if the archive no longer contains a
+	// message with the ID.
+	Time time.Time
+}
+
+// CursorStore is used by a Handler to persist the position of the last message
+// synchronized from each archive.
+type CursorStore interface {
+	// Cursor returns the cursor for an archive.
+	// If no cursor has been stored, ok is false.
+	Cursor(ctx context.Context, archive jid.JID) (c Cursor, ok bool, err error)
+
+	// SetCursor replaces the cursor for an archive.
+	SetCursor(ctx context.Context, archive jid.JID, c Cursor) error
+}
+
+// MemCursorStore is an in-memory implementation of CursorStore.
+// The zero value is ready to use.
+type MemCursorStore struct {
+	m       sync.Mutex
+	cursors map[string]Cursor
+}
+
+// Cursor implements CursorStore.
+func (s *MemCursorStore) Cursor(_ context.Context, archive jid.JID) (Cursor, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	c, ok := s.cursors[archive.String()]
+	return c, ok, nil
+}
+
+// SetCursor implements CursorStore.
+func (s *MemCursorStore) SetCursor(_ context.Context, archive jid.JID, c Cursor) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.cursors == nil {
+		s.cursors = make(map[string]Cursor)
+	}
+	s.cursors[archive.String()] = c
+	return nil
+}
+
+func (h *Handler) cursors() CursorStore {
+	if h.Cursors != nil {
+		return h.Cursors
+	}
+	return &h.mem
+}
+
+// Sync fetches all messages from the archive at the provided address that are
+// newer than the stored cursor and calls f for each of them, oldest first.
+// The cursor is updated after each page of messages so that an interrupted
+// synchronization resumes where it left off.
+// The token stream passed to f is the full result message as sent by the
+// archive, including the forwarded message.
+//
+// If no cursor has been stored the entire archive is fetched.
+// If the stored cursor references a message that is no longer in the archive,
+// messages archived after the time recorded in the cursor are fetched instead.
+//
+// While Sync is running, messages with a stanza ID that were already reported
+// as having been received live using Live are skipped.
+// Sync should be called once for the account archive (using the bare JID of
+// the account) and once for each group chat archive.
+// The handler must be registered on the multiplexer used by the session with
+// Handle.
+func (h *Handler) Sync(ctx context.Context, archive jid.JID, s *xmpp.Session, f func(xml.TokenReader) error) error {
+	h.syncM.Lock()
+	if h.syncing == nil {
+		h.syncing = make(map[string]map[string]struct{})
+	}
+	key := archive.String()
+	if _, ok := h.syncing[key]; ok {
+		h.syncM.Unlock()
+		return fmt.Errorf("history: archive %s is already being synchronized", key)
+	}
+	h.syncing[key] = make(map[string]struct{})
+	h.syncM.Unlock()
+	defer func() {
+		h.syncM.Lock()
+		delete(h.syncing, key)
+		h.syncM.Unlock()
+	}()
+
+	cursor, ok, err := h.cursors().Cursor(ctx, archive)
+	if err != nil {
+		return err
+	}
+	var (
+		q     Query
+		since Cursor
+	)
+	switch {
+	case ok && cursor.ID != "":
+		q.AfterID = cursor.ID
+	case ok:
+		q.Start = cursor.Time
+	}
+
+	for {
+		var res Result
+		cursor, res, err = h.syncPage(ctx, archive, s, q, since, cursor, f)
+		var se stanza.Error
+		if q.AfterID != "" && q.PageID == "" && errors.As(err, &se) && se.Condition == stanza.ItemNotFound {
+			// The message we last saw is gone, fall back to using its timestamp.
+			// The start of a query is inclusive and only precise to the second, so
+			// anything at or before the cursor has to be filtered out as well.
+			q = Query{Start: cursor.Time}
+			since = cursor
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if res.Complete || res.Set.Last == "" {
+			return nil
+		}
+		q.PageID = res.Set.Last
+	}
+}
+
+// syncPage fetches a single page of messages, calls f for any that have not
+// already been seen, and stores the new cursor.
+// If since is not the zero value, messages with its ID or that were archived at
+// or before its time are skipped.
+func (h *Handler) syncPage(ctx context.Context, archive jid.JID, s *xmpp.Session, q Query, since, cursor Cursor, f func(xml.TokenReader) error) (Cursor, Result, error) {
+	iter := h.Fetch(ctx, q, archive, s)
+	for iter.Next() {
+		toks, err := xmlstream.ReadAll(iter.Current())
+		if err != nil {
+			/* #nosec */
+			iter.Close()
+			return cursor, Result{}, err
+		}
+		id, stamp := resultInfo(toks)
+		if id == "" || (!since.Time.IsZero() && (id == since.ID || !stamp.After(since.Time))) {
+			continue
+		}
+		if !h.markSeen(archive, id) {
+			continue
+		}
+		err = f(xmltok.Replay(toks))
+		if err != nil {
+			/* #nosec */
+			iter.Close()
+			return cursor, Result{}, err
+		}
+		cursor = Cursor{ID: id, Time: stamp}
+	}
+	if err := iter.Err(); err != nil {
+		return cursor, Result{}, err
+	}
+	err := h.cursors().SetCursor(ctx, archive, cursor)
+	return cursor, iter.Result(), err
+}
+
+// markSeen records that the message with the stanza ID has been seen during
+// synchronization of the archive and reports whether it was not already seen.
+func (h *Handler) markSeen(archive jid.JID, id string) bool {
+	h.syncM.Lock()
+	defer h.syncM.Unlock()
+	seen, ok := h.syncing[archive.String()]
+	if !ok {
+		return true
+	}
+	if _, ok := seen[id]; ok {
+		return false
+	}
+	seen[id] = struct{}{}
+	return true
+}
+
+// Live records that a message with the stanza ID assigned by the archive was
+// received live and reports whether it was already received by Sync, in which
+// case it should be discarded as a duplicate.
+// If the archive is not being synchronized the cursor is advanced to the
+// message so that the next synchronization starts after it.
+// The stamp should be the time the message was archived, taken from its delay
+// element if it has one.
+func (h *Handler) Live(ctx context.Context, archive jid.JID, id string, stamp time.Time) (dup bool, err error) {
+	h.syncM.Lock()
+	_, syncing := h.syncing[archive.String()]
+	h.syncM.Unlock()
+	if syncing {
+		return !h.markSeen(archive, id), nil
+	}
+	return false, h.cursors().SetCursor(ctx, archive, Cursor{ID: id, Time: stamp})
+}
+
+// resultInfo returns the archive ID and the time the message was archived from
+// the tokens of a result message.
+func resultInfo(toks []xml.Token) (id string, stamp time.Time) {
+	var depth int
+	for _, tok := range toks {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case depth == 2 && t.Name.Space == NS && t.Name.Local == "result":
+				_, id = attr.Get(t.Attr, "id")
+			case depth == 4 && t.Name.Space == delay.NS && t.Name.Local == "delay":
+				_, s := attr.Get(t.Attr, "stamp")
+				/* #nosec */
+				stamp, _ = time.Parse(time.RFC3339, s)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return id, stamp
+}
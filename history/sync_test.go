@@ -0,0 +1,159 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history_test
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/history"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// body returns the body of the forwarded message in a result.
+func body(t *testing.T, r xml.TokenReader) string {
+	t.Helper()
+	var s struct {
+		Body string `xml:"result>forwarded>message>body"`
+	}
+	err := xml.NewTokenDecoder(r).Decode(&s)
+	if err != nil {
+		t.Fatalf("error decoding result: %v", err)
+	}
+	return s.Body
+}
+
+func TestSync(t *testing.T) {
+	archive := jid.MustParse("room@muc.example.net")
+	srv := &history.Service{MaxPage: 2}
+	var (
+		ids   []string
+		times []time.Time
+	)
+	archiveMsg := func(text string) {
+		msg, err := srv.Archive(context.Background(), archive, xml.NewDecoder(strings.NewReader(
+			`<message from="room@muc.example.net/romeo" to="room@muc.example.net" type="groupchat"><body>`+text+`</body></message>`,
+		)))
+		if err != nil {
+			t.Fatalf("error archiving message: %v", err)
+		}
+		ids = append(ids, msg.ID)
+		times = append(times, msg.Time)
+	}
+
+	h := history.NewHandler(mux.MessageHandlerFunc(func(stanza.Message, xmlstream.TokenReadEncoder) error {
+		t.Errorf("untracked message received")
+		return nil
+	}))
+	h.Cursors = &history.MemCursorStore{}
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandler(mux.New(stanza.NSClient, history.HandleService(srv))),
+		xmpptest.ClientHandler(mux.New("", history.Handle(h))),
+	)
+	defer cs.Close()
+
+	sync := func(f func(string)) []string {
+		t.Helper()
+		var bodies []string
+		err := h.Sync(context.Background(), archive, cs.Client, func(r xml.TokenReader) error {
+			b := body(t, r)
+			bodies = append(bodies, b)
+			if f != nil {
+				f(b)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("error syncing: %v", err)
+		}
+		return bodies
+	}
+
+	// The first sync pages through the entire archive.
+	for _, text := range []string{"1", "2", "3"} {
+		archiveMsg(text)
+	}
+	if bodies, want := sync(nil), []string{"1", "2", "3"}; !reflect.DeepEqual(bodies, want) {
+		t.Errorf("wrong messages on first sync: want=%v, got=%v", want, bodies)
+	}
+	cursor, _, err := h.Cursors.(*history.MemCursorStore).Cursor(context.Background(), archive)
+	if err != nil {
+		t.Fatalf("error fetching cursor: %v", err)
+	}
+	if cursor.ID != ids[2] {
+		t.Errorf("wrong cursor after first sync: want=%s, got=%s", ids[2], cursor.ID)
+	}
+
+	// Later syncs only fetch new messages and skip any that arrived live.
+	for _, text := range []string{"4", "5", "6"} {
+		archiveMsg(text)
+	}
+	bodies := sync(func(b string) {
+		if b != "4" {
+			return
+		}
+		dup, err := h.Live(context.Background(), archive, ids[3], times[3])
+		if err != nil || !dup {
+			t.Errorf("expected already synced message to be a duplicate: dup=%t, err=%v", dup, err)
+		}
+		dup, err = h.Live(context.Background(), archive, ids[4], times[4])
+		if err != nil || dup {
+			t.Errorf("expected new message not to be a duplicate: dup=%t, err=%v", dup, err)
+		}
+	})
+	if want := []string{"4", "6"}; !reflect.DeepEqual(bodies, want) {
+		t.Errorf("wrong messages on second sync: want=%v, got=%v", want, bodies)
+	}
+	if bodies := sync(nil); len(bodies) != 0 {
+		t.Errorf("expected no messages on third sync, got %v", bodies)
+	}
+
+	// Messages received live outside of a sync advance the cursor to the time
+	// they were archived.
+	_, err = h.Live(context.Background(), archive, ids[5], times[5])
+	if err != nil {
+		t.Fatalf("error recording live message: %v", err)
+	}
+	cursor, _, err = h.Cursors.(*history.MemCursorStore).Cursor(context.Background(), archive)
+	if err != nil {
+		t.Fatalf("error fetching cursor: %v", err)
+	}
+	if want := (history.Cursor{ID: ids[5], Time: times[5]}); cursor != want {
+		t.Errorf("wrong cursor after live message: want=%+v, got=%+v", want, cursor)
+	}
+
+	// If the last message is gone from the archive, fall back to a time query
+	// that skips anything at or before the cursor.
+	for _, tc := range []struct {
+		name string
+		time time.Time
+		want []string
+	}{
+		{name: "before", time: times[0].Add(-time.Hour), want: []string{"1", "2", "3", "4", "5", "6"}},
+		{name: "boundary", time: times[2], want: []string{"4", "5", "6"}},
+		{name: "last", time: times[5]},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := h.Cursors.SetCursor(context.Background(), archive, history.Cursor{
+				ID:   "gone",
+				Time: tc.time,
+			})
+			if err != nil {
+				t.Fatalf("error setting cursor: %v", err)
+			}
+			if bodies := sync(nil); !reflect.DeepEqual(bodies, tc.want) {
+				t.Errorf("wrong messages after falling back: want=%v, got=%v", tc.want, bodies)
+			}
+		})
+	}
+}
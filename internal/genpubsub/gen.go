@@ -187,6 +187,9 @@ func main() {
 			features = append(features, f.Value)
 		}
 	}
+	// The precondition-not-met condition is defined in XEP-0060 §7.1.5 but is
+	// missing from the schema.
+	conditions = append(conditions, "precondition-not-met")
 	for _, e := range event.Element {
 		for _, a := range e.Attrs {
 			if a.Name == "subscription" {
@@ -0,0 +1,48 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package xmltok contains unexported functionality for working with buffered
+// XML tokens.
+package xmltok // import "mellium.im/xmpp/internal/xmltok"
+
+import (
+	"encoding/xml"
+	"io"
+
+	"mellium.im/xmlstream"
+)
+
+// Replay returns a token reader that returns each of the provided tokens in
+// order and then io.EOF.
+func Replay(toks []xml.Token) xml.TokenReader {
+	return xmlstream.ReaderFunc(func() (xml.Token, error) {
+		if len(toks) == 0 {
+			return nil, io.EOF
+		}
+		tok := toks[0]
+		toks = toks[1:]
+		return tok, nil
+	})
+}
+
+// StripNS removes namespace declarations from start elements.
+// It is meant to be used with xmlstream.Map on tokens that were read from a
+// decoder and will be encoded again, since the encoder recreates the
+// declarations from the names of the elements and attributes and they would
+// otherwise be duplicated.
+func StripNS(tok xml.Token) xml.Token {
+	start, ok := tok.(xml.StartElement)
+	if !ok {
+		return tok
+	}
+	attrs := make([]xml.Attr, 0, len(start.Attr))
+	for _, a := range start.Attr {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			continue
+		}
+		attrs = append(attrs, a)
+	}
+	start.Attr = attrs
+	return start
+}
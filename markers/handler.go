@@ -0,0 +1,211 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package markers
+
+import (
+	"context"
+	"encoding/xml"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/delay"
+	"mellium.im/xmpp/internal/xmltok"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// Handle returns an option that registers a Handler for chat markers.
+func Handle(h *Handler) mux.Option {
+	return func(m *mux.ServeMux) {
+		for _, marker := range []Marker{Received, Displayed, Acknowledged} {
+			name := xml.Name{Space: NS, Local: string(marker)}
+			mux.Message(stanza.NormalMessage, name, h)(m)
+			mux.Message(stanza.ChatMessage, name, h)(m)
+			mux.Message(stanza.GroupChatMessage, name, h)(m)
+		}
+	}
+}
+
+// Handler handles incoming chat markers.
+//
+// To keep track of the messages that were displayed on the user's other
+// devices, Carbon should also be set as the F field of a carbons.Handler.
+type Handler struct {
+	// F is called for each chat marker with the message that contained it, the
+	// type of marker, and the ID of the message being marked.
+	// Sent is true if the marker was sent by another of the user's resources and
+	// was received as a carbon copy or reflected by a group chat room.
+	F func(msg stanza.Message, m Marker, id string, sent bool) error
+
+	// Tracker, if set, records displayed markers sent by the user's other
+	// resources.
+	Tracker *Tracker
+
+	// Nick, if set, returns the user's nickname in the provided room.
+	// It is used to recognize displayed markers that the user sent to a group
+	// chat from another resource when they are reflected back by the room.
+	Nick func(room jid.JID) string
+}
+
+// HandleMessage implements mux.MessageHandler.
+func (h *Handler) HandleMessage(msg stanza.Message, r xmlstream.TokenReadEncoder) error {
+	toks, err := xmlstream.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return h.handle(msg, toks, false, time.Time{})
+}
+
+// Carbon handles carbon copies of chat markers.
+// It has the signature of the F field on carbons.Handler.
+func (h *Handler) Carbon(_ stanza.Message, sent bool, inner xml.TokenReader) error {
+	toks, err := xmlstream.ReadAll(inner)
+	if err != nil {
+		return err
+	}
+	// The forwarded message may be preceded by a delay element.
+	var (
+		depth int
+		stamp time.Time
+	)
+	for i, tok := range toks {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case depth == 0 && t.Name.Local == "message":
+				msg, err := stanza.NewMessage(t)
+				if err != nil {
+					return err
+				}
+				return h.handle(msg, toks[i:], sent, stamp)
+			case depth == 0 && t.Name.Space == delay.NS && t.Name.Local == "delay":
+				stamp = delayStamp(t)
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return nil
+}
+
+// handle processes a message stanza whose tokens, including the start
+// element, are in toks.
+// If the message was forwarded, stamp is the time from the forwarded delay
+// element.
+func (h *Handler) handle(msg stanza.Message, toks []xml.Token, sent bool, stamp time.Time) error {
+	if len(toks) == 0 {
+		return nil
+	}
+	if _, ok := toks[0].(xml.StartElement); !ok {
+		return nil
+	}
+	inf := messageInfo(toks, msg)
+	if inf.marker == "" {
+		return nil
+	}
+	conv := msg.To.Bare()
+	if !sent && msg.Type == stanza.GroupChatMessage && h.Nick != nil {
+		room := msg.From.Bare()
+		if nick := h.Nick(room); nick != "" && msg.From.Resourcepart() == nick {
+			sent = true
+			conv = room
+		}
+	}
+	if sent && inf.marker == Displayed && h.Tracker != nil {
+		if stamp.IsZero() {
+			stamp = inf.stamp
+		}
+		if stamp.IsZero() {
+			stamp = time.Now()
+		}
+		h.Tracker.Displayed(conv, inf.ref, stamp)
+	}
+	if h.F != nil {
+		return h.F(msg, inf.marker, inf.ref, sent)
+	}
+	return nil
+}
+
+// Tracker records the last message that was displayed in each conversation.
+// Conversations are identified by the bare JID of the peer or room.
+//
+// The zero value is an empty tracker ready to use.
+type Tracker struct {
+	// Changed, if set, is called when the last displayed message in a
+	// conversation changes.
+	Changed func(conv jid.JID, id string)
+
+	m    sync.Mutex
+	last map[string]displayed
+}
+
+type displayed struct {
+	id    string
+	stamp time.Time
+}
+
+// Displayed records that the message with the provided ID, and all messages
+// before it, were displayed at time t in the conversation with conv.
+// If a later displayed marker has already been recorded for the conversation
+// nothing is changed, so that markers received out of order, for example from
+// an archive, do not move the state backwards.
+// Displayed reports whether the last displayed message was changed.
+func (t *Tracker) Displayed(conv jid.JID, id string, stamp time.Time) bool {
+	conv = conv.Bare()
+	t.m.Lock()
+	if t.last == nil {
+		t.last = make(map[string]displayed)
+	}
+	key := conv.String()
+	last, ok := t.last[key]
+	if ok && (last.id == id || stamp.Before(last.stamp)) {
+		t.m.Unlock()
+		return false
+	}
+	t.last[key] = displayed{id: id, stamp: stamp}
+	t.m.Unlock()
+	if t.Changed != nil {
+		t.Changed(conv, id)
+	}
+	return true
+}
+
+// LastDisplayed returns the ID of the last message that was displayed in the
+// conversation with conv or the empty string if none is known.
+func (t *Tracker) LastDisplayed(conv jid.JID) string {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.last[conv.Bare().String()].id
+}
+
+// Mark sends a displayed marker for the message stanza read from r, as if by
+// calling Mark, and records it as the last displayed message in its
+// conversation.
+// If the message is not markable, nothing is sent or recorded.
+func (t *Tracker) Mark(ctx context.Context, s *xmpp.Session, r xml.TokenReader) error {
+	toks, err := xmlstream.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	err = Mark(ctx, s, Displayed, xmltok.Replay(toks))
+	if err != nil {
+		return err
+	}
+	start, _ := firstStart(toks)
+	msg, err := stanza.NewMessage(start)
+	if err != nil {
+		return err
+	}
+	inf := messageInfo(toks, msg)
+	if !inf.markable || inf.id == "" {
+		return nil
+	}
+	t.Displayed(msg.From, inf.id, time.Now())
+	return nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+//go:generate go run ../internal/genfeature -receiver "h *Handler"
+
+// Package markers implements XEP-0333: Chat Markers.
+//
+// Chat markers let the recipient of a message tell the sender that the message
+// was received, displayed, or acknowledged by the user.
+// Unlike message delivery receipts, a displayed marker also indicates that all
+// earlier messages in the conversation have been displayed, so markers are
+// normally only sent for the latest message.
+// Because displayed markers sent by one of the user's own devices are carbon
+// copied to the others, they can also be used to keep track of which messages
+// have been read across devices.
+package markers // import "mellium.im/xmpp/markers"
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/delay"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the namespace used by this package.
+const NS = "urn:xmpp:chat-markers:0"
+
+// Marker is the type of a chat marker.
+type Marker string
+
+// A list of chat markers.
+const (
+	// Received indicates that the message was received by a client.
+	Received Marker = "received"
+
+	// Displayed indicates that the message was displayed to the user.
+	Displayed Marker = "displayed"
+
+	// Acknowledged indicates that the user has acted on the message, for
+	// example by replying to it.
+	Acknowledged Marker = "acknowledged"
+)
+
+// Markable is an xmlstream.Transformer that marks all top level <message/>
+// elements as markable by adding a <markable/> element.
+// Recipients only send chat markers for markable messages.
+func Markable(r xml.TokenReader) xml.TokenReader {
+	return xmlstream.InsertFunc(
+		func(start xml.StartElement, level uint64, w xmlstream.TokenWriter) error {
+			if level == 1 &&
+				start.Name.Local == "message" &&
+				(start.Name.Space == "" || start.Name.Space == stanza.NSClient || start.Name.Space == stanza.NSServer) {
+				_, err := xmlstream.Copy(w, xmlstream.Wrap(nil, xml.StartElement{
+					Name: xml.Name{Space: NS, Local: "markable"},
+				}))
+				return err
+			}
+			return nil
+		},
+	)(r)
+}
+
+// TokenReader returns a marker element referencing the message with the
+// provided ID.
+func (m Marker) TokenReader(id string) xml.TokenReader {
+	return xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: NS, Local: string(m)},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: id}},
+	})
+}
+
+// Send sends a chat marker referencing the message with the provided ID.
+// The marker is wrapped in a message with the to address and type taken from
+// msg.
+// For group chat messages the ID must be the stanza ID assigned by the room
+// and msg must be addressed to the bare JID of the room.
+//
+// Most users will want to use Mark instead, which derives the ID and address
+// from the message being marked.
+func Send(ctx context.Context, s *xmpp.Session, msg stanza.Message, m Marker, id string) error {
+	return s.Send(ctx, msg.Wrap(xmlstream.MultiReader(
+		m.TokenReader(id),
+		xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Space: nsHints, Local: "store"}}),
+	)))
+}
+
+// Mark sends a chat marker for the message stanza read from r back to its
+// sender.
+// If the message is not markable, Mark does nothing.
+//
+// The marker references the message using the ID returned by ID and is sent
+// with the same type as the message.
+// Markers for group chat messages are sent to the room.
+func Mark(ctx context.Context, s *xmpp.Session, m Marker, r xml.TokenReader) error {
+	toks, err := xmlstream.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	start, ok := firstStart(toks)
+	if !ok || start.Name.Local != "message" {
+		return fmt.Errorf("markers: expected a message start element, got %v", start.Name)
+	}
+	msg, err := stanza.NewMessage(start)
+	if err != nil {
+		return err
+	}
+	inf := messageInfo(toks, msg)
+	if !inf.markable {
+		return nil
+	}
+	if inf.id == "" {
+		return fmt.Errorf("markers: message from %v has no ID to reference", msg.From)
+	}
+	to := msg.From
+	if msg.Type == stanza.GroupChatMessage {
+		to = msg.From.Bare()
+	}
+	return Send(ctx, s, stanza.Message{To: to, Type: msg.Type}, m, inf.id)
+}
+
+// ID returns the ID that chat markers for the message stanza read from r should
+// reference and whether the message is markable.
+//
+// For group chat messages this is the stanza ID assigned by the room, and for
+// all other messages it is the origin ID or, if the message does not have one,
+// the value of its id attribute.
+func ID(r xml.TokenReader) (id string, markable bool, err error) {
+	toks, err := xmlstream.ReadAll(r)
+	if err != nil {
+		return "", false, err
+	}
+	start, ok := firstStart(toks)
+	if !ok {
+		return "", false, nil
+	}
+	msg, err := stanza.NewMessage(start)
+	if err != nil {
+		return "", false, err
+	}
+	inf := messageInfo(toks, msg)
+	return inf.id, inf.markable, nil
+}
+
+const nsHints = "urn:xmpp:hints"
+
+func firstStart(toks []xml.Token) (xml.StartElement, bool) {
+	if len(toks) == 0 {
+		return xml.StartElement{}, false
+	}
+	start, ok := toks[0].(xml.StartElement)
+	return start, ok
+}
+
+type msgInfo struct {
+	id       string
+	markable bool
+
+	// marker and ref are set if the message contains a chat marker.
+	marker Marker
+	ref    string
+
+	// stamp is set if the message contains a delay element.
+	stamp time.Time
+}
+
+// messageInfo returns information about the children of the message stanza in
+// toks, which must start with the message start element.
+func messageInfo(toks []xml.Token, msg stanza.Message) msgInfo {
+	var (
+		inf      msgInfo
+		originID string
+		stanzaID string
+		depth    int
+	)
+	for _, tok := range toks[1:] {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth != 1 {
+				continue
+			}
+			switch {
+			case t.Name.Space == NS && t.Name.Local == "markable":
+				inf.markable = true
+			case t.Name.Space == NS:
+				switch m := Marker(t.Name.Local); m {
+				case Received, Displayed, Acknowledged:
+					inf.marker = m
+					_, inf.ref = attr.Get(t.Attr, "id")
+				}
+			case t.Name.Space == stanza.NSSid && t.Name.Local == "origin-id":
+				_, originID = attr.Get(t.Attr, "id")
+			case t.Name.Space == delay.NS && t.Name.Local == "delay":
+				inf.stamp = delayStamp(t)
+			case t.Name.Space == stanza.NSSid && t.Name.Local == "stanza-id":
+				_, by := attr.Get(t.Attr, "by")
+				if j, err := jid.Parse(by); err == nil && j.Equal(msg.From.Bare()) {
+					_, stanzaID = attr.Get(t.Attr, "id")
+				}
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	switch {
+	case msg.Type == stanza.GroupChatMessage:
+		inf.id = stanzaID
+	case originID != "":
+		inf.id = originID
+	default:
+		inf.id = msg.ID
+	}
+	return inf
+}
+
+// delayStamp returns the time from a delay element or the zero time if it
+// cannot be parsed.
+func delayStamp(start xml.StartElement) time.Time {
+	_, s := attr.Get(start.Attr, "stamp")
+	/* #nosec */
+	stamp, _ := time.Parse(time.RFC3339, s)
+	return stamp
+}
@@ -0,0 +1,282 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package markers_test
+
+import (
+	"context"
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/carbons"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/markers"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+func TestMarkable(t *testing.T) {
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	_, err := xmlstream.Copy(e, markers.Markable(stanza.Message{ID: "1", Type: stanza.ChatMessage}.Wrap(nil)))
+	if err != nil {
+		t.Fatalf("error encoding: %v", err)
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	const want = `<message type="chat" id="1"><markable xmlns="urn:xmpp:chat-markers:0"></markable></message>`
+	if out := b.String(); out != want {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", want, out)
+	}
+}
+
+var idTests = [...]struct {
+	in       string
+	id       string
+	markable bool
+}{
+	0: {
+		in:       `<message xmlns="jabber:client" from="juliet@example.com/balcony" type="chat" id="a"><markable xmlns="urn:xmpp:chat-markers:0"/></message>`,
+		id:       "a",
+		markable: true,
+	},
+	1: {
+		in:       `<message xmlns="jabber:client" from="juliet@example.com/balcony" type="chat" id="a"><origin-id xmlns="urn:xmpp:sid:0" id="b"/><markable xmlns="urn:xmpp:chat-markers:0"/></message>`,
+		id:       "b",
+		markable: true,
+	},
+	2: {
+		in:       `<message xmlns="jabber:client" from="room@muc.example.com/juliet" type="groupchat" id="a"><stanza-id xmlns="urn:xmpp:sid:0" by="juliet@example.com" id="c"/><stanza-id xmlns="urn:xmpp:sid:0" by="room@muc.example.com" id="d"/><markable xmlns="urn:xmpp:chat-markers:0"/></message>`,
+		id:       "d",
+		markable: true,
+	},
+	3: {
+		in: `<message xmlns="jabber:client" from="juliet@example.com/balcony" type="chat" id="a"><body>Hi</body></message>`,
+		id: "a",
+	},
+}
+
+func TestID(t *testing.T) {
+	for i, tc := range idTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			id, markable, err := markers.ID(xml.NewDecoder(strings.NewReader(tc.in)))
+			if err != nil {
+				t.Fatalf("error getting ID: %v", err)
+			}
+			if id != tc.id {
+				t.Errorf("wrong ID: want=%q, got=%q", tc.id, id)
+			}
+			if markable != tc.markable {
+				t.Errorf("wrong value for markable: want=%t, got=%t", tc.markable, markable)
+			}
+		})
+	}
+}
+
+func TestMark(t *testing.T) {
+	sent := make(chan string, 10)
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			var msg struct {
+				Type     string `xml:"type,attr"`
+				To       string `xml:"to,attr"`
+				Children []struct {
+					XMLName xml.Name
+					ID      string `xml:"id,attr"`
+				} `xml:",any"`
+			}
+			err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), t)).Decode(&msg)
+			if err != nil {
+				return err
+			}
+			out := msg.Type + " " + msg.To
+			for _, m := range msg.Children {
+				out += " " + m.XMLName.Local + ":" + m.ID
+			}
+			sent <- out
+			return nil
+		}),
+	)
+	defer cs.Close()
+
+	var changed []string
+	tracker := &markers.Tracker{
+		Changed: func(conv jid.JID, id string) {
+			changed = append(changed, conv.String()+":"+id)
+		},
+	}
+	ctx := context.Background()
+	for _, tc := range idTests {
+		err := tracker.Mark(ctx, cs.Client, xml.NewDecoder(strings.NewReader(tc.in)))
+		if err != nil {
+			t.Fatalf("error sending marker: %v", err)
+		}
+	}
+	err := markers.Mark(ctx, cs.Client, markers.Acknowledged, xml.NewDecoder(strings.NewReader(idTests[0].in)))
+	if err != nil {
+		t.Fatalf("error sending marker: %v", err)
+	}
+
+	for _, want := range []string{
+		"chat juliet@example.com/balcony displayed:a store:",
+		"chat juliet@example.com/balcony displayed:b store:",
+		"groupchat room@muc.example.com displayed:d store:",
+		"chat juliet@example.com/balcony acknowledged:a store:",
+	} {
+		if out := <-sent; out != want {
+			t.Errorf("wrong marker sent:\nwant=%s,\n got=%s", want, out)
+		}
+	}
+	if want := "juliet@example.com:a,juliet@example.com:b,room@muc.example.com:d"; strings.Join(changed, ",") != want {
+		t.Errorf("wrong changes: want=%s, got=%s", want, strings.Join(changed, ","))
+	}
+	if id := tracker.LastDisplayed(jid.MustParse("juliet@example.com/garden")); id != "b" {
+		t.Errorf("wrong last displayed ID: want=b, got=%q", id)
+	}
+}
+
+var handlerTests = [...]struct {
+	in     string
+	marker markers.Marker
+	id     string
+	sent   bool
+	conv   string
+	last   string
+}{
+	0: {
+		in:     `<message xmlns="jabber:client" from="juliet@example.com/balcony" to="romeo@example.net/orchard" type="chat"><displayed xmlns="urn:xmpp:chat-markers:0" id="a"/></message>`,
+		marker: markers.Displayed,
+		id:     "a",
+	},
+	1: {
+		in:     `<message xmlns="jabber:client" from="romeo@example.net" to="romeo@example.net/orchard" type="chat"><sent xmlns="urn:xmpp:carbons:2"><forwarded xmlns="urn:xmpp:forward:0"><message xmlns="jabber:client" from="romeo@example.net/garden" to="juliet@example.com/balcony" type="chat"><displayed xmlns="urn:xmpp:chat-markers:0" id="b"/></message></forwarded></sent></message>`,
+		marker: markers.Displayed,
+		id:     "b",
+		sent:   true,
+		last:   "b",
+	},
+	2: {
+		in:     `<message xmlns="jabber:client" from="romeo@example.net" to="romeo@example.net/orchard" type="chat"><received xmlns="urn:xmpp:carbons:2"><forwarded xmlns="urn:xmpp:forward:0"><message xmlns="jabber:client" from="juliet@example.com/balcony" to="romeo@example.net/garden" type="chat"><received xmlns="urn:xmpp:chat-markers:0" id="c"/></message></forwarded></received></message>`,
+		marker: markers.Received,
+		id:     "c",
+	},
+	3: {
+		in: `<message xmlns="jabber:client" from="juliet@example.com/balcony" to="romeo@example.net/orchard" type="chat"><body>No marker</body></message>`,
+	},
+	4: {
+		in:     `<message xmlns="jabber:client" from="room@muc.example.com/romeo" to="romeo@example.net/orchard" type="groupchat"><displayed xmlns="urn:xmpp:chat-markers:0" id="d"/></message>`,
+		marker: markers.Displayed,
+		id:     "d",
+		sent:   true,
+		conv:   "room@muc.example.com",
+		last:   "d",
+	},
+	5: {
+		in:     `<message xmlns="jabber:client" from="room@muc.example.com/juliet" to="romeo@example.net/orchard" type="groupchat"><displayed xmlns="urn:xmpp:chat-markers:0" id="e"/></message>`,
+		marker: markers.Displayed,
+		id:     "e",
+		conv:   "room@muc.example.com",
+	},
+}
+
+func TestHandler(t *testing.T) {
+	for i, tc := range handlerTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var (
+				marker markers.Marker
+				id     string
+				sent   bool
+			)
+			h := &markers.Handler{
+				Tracker: &markers.Tracker{},
+				Nick: func(room jid.JID) string {
+					return "romeo"
+				},
+				F: func(_ stanza.Message, m markers.Marker, ref string, s bool) error {
+					marker, id, sent = m, ref, s
+					return nil
+				},
+			}
+			m := mux.New(stanza.NSClient,
+				markers.Handle(h),
+				carbons.Handle(carbons.Handler{F: h.Carbon}),
+			)
+			d := xml.NewDecoder(strings.NewReader(tc.in))
+			tok, err := d.Token()
+			if err != nil {
+				t.Fatalf("error decoding stanza: %v", err)
+			}
+			start := tok.(xml.StartElement)
+			err = m.HandleXMPP(struct {
+				xml.TokenReader
+				xmlstream.Encoder
+			}{
+				TokenReader: d,
+				Encoder:     xml.NewEncoder(&strings.Builder{}),
+			}, &start)
+			if err != nil {
+				t.Fatalf("error handling stanza: %v", err)
+			}
+			if marker != tc.marker || id != tc.id || sent != tc.sent {
+				t.Errorf("wrong marker: want=%s/%s/%t, got=%s/%s/%t", tc.marker, tc.id, tc.sent, marker, id, sent)
+			}
+			conv := tc.conv
+			if conv == "" {
+				conv = "juliet@example.com"
+			}
+			if last := h.Tracker.LastDisplayed(jid.MustParse(conv)); last != tc.last {
+				t.Errorf("wrong last displayed ID: want=%q, got=%q", tc.last, last)
+			}
+		})
+	}
+}
+
+func TestTrackerOrder(t *testing.T) {
+	conv := jid.MustParse("juliet@example.com")
+	now := time.Now()
+	tracker := &markers.Tracker{}
+	if !tracker.Displayed(conv, "b", now) {
+		t.Errorf("first displayed marker was not recorded")
+	}
+	if tracker.Displayed(conv, "a", now.Add(-time.Minute)) {
+		t.Errorf("older displayed marker should not be recorded")
+	}
+	if id := tracker.LastDisplayed(conv); id != "b" {
+		t.Errorf("wrong last displayed ID: want=b, got=%q", id)
+	}
+	if !tracker.Displayed(conv, "c", now.Add(time.Minute)) {
+		t.Errorf("newer displayed marker was not recorded")
+	}
+
+	// Carbon copies use the time from the forwarded delay element.
+	h := &markers.Handler{Tracker: tracker}
+	m := mux.New(stanza.NSClient, carbons.Handle(carbons.Handler{F: h.Carbon}))
+	const in = `<message xmlns="jabber:client" from="romeo@example.net" to="romeo@example.net/orchard" type="chat"><sent xmlns="urn:xmpp:carbons:2"><forwarded xmlns="urn:xmpp:forward:0"><delay xmlns="urn:xmpp:delay" stamp="2010-07-10T23:08:25Z"/><message xmlns="jabber:client" from="romeo@example.net/garden" to="juliet@example.com/balcony" type="chat"><displayed xmlns="urn:xmpp:chat-markers:0" id="old"/></message></forwarded></sent></message>`
+	d := xml.NewDecoder(strings.NewReader(in))
+	tok, err := d.Token()
+	if err != nil {
+		t.Fatalf("error decoding stanza: %v", err)
+	}
+	start := tok.(xml.StartElement)
+	err = m.HandleXMPP(struct {
+		xml.TokenReader
+		xmlstream.Encoder
+	}{
+		TokenReader: d,
+		Encoder:     xml.NewEncoder(&strings.Builder{}),
+	}, &start)
+	if err != nil {
+		t.Fatalf("error handling stanza: %v", err)
+	}
+	if id := tracker.LastDisplayed(conv); id != "c" {
+		t.Errorf("delayed carbon moved the state backwards: want=c, got=%q", id)
+	}
+}
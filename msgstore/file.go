@@ -0,0 +1,185 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package msgstore
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/xmltok"
+	"mellium.im/xmpp/jid"
+)
+
+// FileStore is an implementation of Store that appends changes to a file and
+// keeps the messages in memory.
+// The file is read when the store is opened.
+type FileStore struct {
+	mem MemStore
+	m   sync.Mutex
+	f   *os.File
+	e   *xml.Encoder
+}
+
+// OpenFile opens the named file, creating it if it does not exist, and loads
+// any messages that were previously stored in it.
+func OpenFile(name string) (*FileStore, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{f: f}
+	err = s.load()
+	if err != nil {
+		/* #nosec */
+		f.Close()
+		return nil, fmt.Errorf("msgstore: error loading %s: %w", name, err)
+	}
+	s.e = xml.NewEncoder(f)
+	return s, nil
+}
+
+// Close closes the underlying file.
+func (s *FileStore) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.f.Close()
+}
+
+// Put implements Store.
+func (s *FileStore) Put(ctx context.Context, msg Message) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	start := xml.StartElement{
+		Name: xml.Name{Local: "msg"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "id"}, Value: msg.ID},
+			{Name: xml.Name{Local: "origin-id"}, Value: msg.OriginID},
+			{Name: xml.Name{Local: "peer"}, Value: msg.Peer.String()},
+			{Name: xml.Name{Local: "sent"}, Value: strconv.FormatBool(msg.Sent)},
+			{Name: xml.Name{Local: "delivered"}, Value: strconv.FormatBool(msg.Delivered)},
+		},
+	}
+	if !msg.Time.IsZero() {
+		start.Attr = append(start.Attr, xml.Attr{
+			Name:  xml.Name{Local: "time"},
+			Value: msg.Time.UTC().Format(time.RFC3339Nano),
+		})
+	}
+	err := s.write(xmlstream.Wrap(xmlstream.Map(xmltok.StripNS)(xmltok.Replay(msg.Stanza)), start))
+	if err != nil {
+		return err
+	}
+	return s.mem.Put(ctx, msg)
+}
+
+// MarkDelivered implements Store.
+func (s *FileStore) MarkDelivered(_ context.Context, peer jid.JID, id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !s.mem.markDelivered(peer, id) {
+		return nil
+	}
+	return s.write(xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Local: "delivered"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "peer"}, Value: peer.Bare().String()},
+			{Name: xml.Name{Local: "id"}, Value: id},
+		},
+	}))
+}
+
+// Query implements Store.
+func (s *FileStore) Query(ctx context.Context, peer jid.JID, start, end time.Time) ([]Message, error) {
+	return s.mem.Query(ctx, peer, start, end)
+}
+
+func (s *FileStore) write(r xml.TokenReader) error {
+	_, err := xmlstream.Copy(s.e, r)
+	if err != nil {
+		return err
+	}
+	return s.e.Flush()
+}
+
+func (s *FileStore) load() error {
+	d := xml.NewDecoder(s.f)
+	for {
+		tok, err := d.Token()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "msg":
+			msg, err := decodeMsg(d, start)
+			if err != nil {
+				return err
+			}
+			err = s.mem.Put(context.Background(), msg)
+			if err != nil {
+				return err
+			}
+		case "delivered":
+			_, peer := attr.Get(start.Attr, "peer")
+			_, id := attr.Get(start.Attr, "id")
+			j, err := jid.Parse(peer)
+			if err != nil {
+				return err
+			}
+			s.mem.markDelivered(j, id)
+			err = d.Skip()
+			if err != nil {
+				return err
+			}
+		default:
+			err = d.Skip()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func decodeMsg(d *xml.Decoder, start xml.StartElement) (Message, error) {
+	var msg Message
+	var err error
+	for _, a := range start.Attr {
+		switch a.Name.Local {
+		case "id":
+			msg.ID = a.Value
+		case "origin-id":
+			msg.OriginID = a.Value
+		case "peer":
+			msg.Peer, err = jid.Parse(a.Value)
+		case "sent":
+			msg.Sent, err = strconv.ParseBool(a.Value)
+		case "delivered":
+			msg.Delivered, err = strconv.ParseBool(a.Value)
+		case "time":
+			msg.Time, err = time.Parse(time.RFC3339Nano, a.Value)
+		}
+		if err != nil {
+			return msg, err
+		}
+	}
+	msg.Stanza, err = xmlstream.ReadAll(xmlstream.Map(xmltok.StripNS)(xmlstream.Inner(d)))
+	return msg, err
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package msgstore
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"mellium.im/xmpp/jid"
+)
+
+// MemStore is an in-memory implementation of Store.
+// The zero value is ready to use.
+type MemStore struct {
+	m     sync.Mutex
+	convs map[string][]Message
+}
+
+// Put implements Store.
+func (s *MemStore) Put(_ context.Context, msg Message) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.convs == nil {
+		s.convs = make(map[string][]Message)
+	}
+	key := msg.Peer.Bare().String()
+	msgs := s.convs[key]
+	for i, stored := range msgs {
+		if same(stored, msg) {
+			msgs[i] = merge(stored, msg)
+			return nil
+		}
+	}
+	idx := sort.Search(len(msgs), func(i int) bool {
+		return msgs[i].Time.After(msg.Time)
+	})
+	msgs = append(msgs, Message{})
+	copy(msgs[idx+1:], msgs[idx:])
+	msgs[idx] = msg
+	s.convs[key] = msgs
+	return nil
+}
+
+// MarkDelivered implements Store.
+func (s *MemStore) MarkDelivered(_ context.Context, peer jid.JID, id string) error {
+	s.markDelivered(peer, id)
+	return nil
+}
+
+// markDelivered marks a sent message as delivered and reports whether it was
+// found.
+func (s *MemStore) markDelivered(peer jid.JID, id string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	msgs := s.convs[peer.Bare().String()]
+	for i, msg := range msgs {
+		if msg.Sent && msg.ID == id {
+			msgs[i].Delivered = true
+			return true
+		}
+	}
+	for i, msg := range msgs {
+		if msg.Sent && msg.OriginID == id {
+			msgs[i].Delivered = true
+			return true
+		}
+	}
+	return false
+}
+
+// Query implements Store.
+func (s *MemStore) Query(_ context.Context, peer jid.JID, start, end time.Time) ([]Message, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var found []Message
+	for _, msg := range s.convs[peer.Bare().String()] {
+		if peer.Resourcepart() != "" && !msg.Peer.Equal(peer) {
+			continue
+		}
+		if !start.IsZero() && msg.Time.Before(start) {
+			continue
+		}
+		if !end.IsZero() && msg.Time.After(end) {
+			continue
+		}
+		found = append(found, msg)
+	}
+	return found, nil
+}
+
+// same reports whether a and b are the same message.
+func same(a, b Message) bool {
+	return (a.ID != "" && a.ID == b.ID) || (a.OriginID != "" && a.OriginID == b.OriginID)
+}
+
+// merge fills in any empty fields of the stored message from msg.
+func merge(stored, msg Message) Message {
+	if stored.ID == "" {
+		stored.ID = msg.ID
+	}
+	if stored.OriginID == "" {
+		stored.OriginID = msg.OriginID
+	}
+	if stored.Time.IsZero() {
+		stored.Time = msg.Time
+	}
+	if len(stored.Stanza) == 0 {
+		stored.Stanza = msg.Stanza
+	}
+	stored.Sent = stored.Sent || msg.Sent
+	stored.Delivered = stored.Delivered || msg.Delivered
+	return stored
+}
@@ -0,0 +1,390 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package msgstore implements a local store of the messages in conversations.
+//
+// Messages that are sent and received through a Log are recorded in a Store so
+// that clients can display conversations without being connected.
+// The Log can also be used to fill gaps in the conversation from a message
+// archive (XEP-0313: Message Archive Management) and to mark messages as
+// delivered when a message delivery receipt (XEP-0184) is received.
+package msgstore // import "mellium.im/xmpp/msgstore"
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/delay"
+	"mellium.im/xmpp/history"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/xmltok"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// Message is a message that was sent or received.
+type Message struct {
+	// ID is the id attribute of a message sent by the account or, for received
+	// messages, the stanza ID assigned to the message by the archive that stores
+	// the conversation, if known.
+	ID string
+
+	// OriginID is the origin ID of the message or, if it does not have one, the
+	// value of its id attribute.
+	OriginID string
+
+	// Peer is the address of the other party in the conversation.
+	// For group chats this is the address of the occupant that sent the message.
+	Peer jid.JID
+
+	// Sent is true if the message was sent by the account.
+	Sent bool
+
+	// Time is when the message was sent or received.
+	Time time.Time
+
+	// Delivered is true if a delivery receipt has been received for the
+	// message.
+	Delivered bool
+
+	// Stanza is the tokens that make up the message stanza.
+	Stanza []xml.Token
+}
+
+// Store is used by a Log to persist messages.
+// Conversations are identified by the bare JID of the peer.
+//
+// Two messages in the same conversation are the same message if they have the
+// same ID or the same OriginID.
+type Store interface {
+	// Put adds a message to a conversation.
+	// If the message is already stored, any fields that are empty in the stored
+	// message are filled in from msg.
+	Put(ctx context.Context, msg Message) error
+
+	// MarkDelivered marks the message sent to peer with the provided ID as
+	// delivered, falling back to a message with the provided origin ID if none
+	// has the ID.
+	// If no such message has been stored, MarkDelivered does nothing.
+	MarkDelivered(ctx context.Context, peer jid.JID, id string) error
+
+	// Query returns the messages in the conversation with peer that were sent or
+	// received between start and end, ordered from oldest to newest.
+	// If peer is a full JID only messages exchanged with that resource are
+	// returned.
+	// If start or end is the zero time the range is unbounded in that
+	// direction.
+	Query(ctx context.Context, peer jid.JID, start, end time.Time) ([]Message, error)
+}
+
+// Log records messages in a Store.
+//
+// To record incoming messages the handler used by the session must be wrapped
+// using Handler.
+// To record outgoing messages they must be sent with SendMessage or
+// SendMessageElement.
+// To mark messages as delivered, Received should be set as the Received
+// callback of a receipts.Handler.
+type Log struct {
+	// Store persists messages.
+	// If nil, messages are stored in memory.
+	Store Store
+
+	// History is used by Sync to fetch messages from archives.
+	// If it is set, stanza IDs of incoming messages are also reported to it so
+	// that later synchronizations start after them.
+	History *history.Handler
+
+	mem MemStore
+}
+
+func (l *Log) store() Store {
+	if l.Store != nil {
+		return l.Store
+	}
+	return &l.mem
+}
+
+// Query returns the messages in the conversation with peer that were sent or
+// received between start and end.
+// For more information see the Query method on Store.
+func (l *Log) Query(ctx context.Context, peer jid.JID, start, end time.Time) ([]Message, error) {
+	return l.store().Query(ctx, peer, start, end)
+}
+
+// Handler returns a handler that records incoming messages with a body before
+// passing them on to h.
+// Each message is recorded once no matter how many bodies it contains, and all
+// stanzas, including the ones that were recorded, are passed to h unchanged.
+func (l *Log) Handler(h xmpp.Handler) xmpp.Handler {
+	return xmpp.HandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		if start.Name.Local != "message" {
+			return h.HandleXMPP(t, start)
+		}
+		msg, err := stanza.NewMessage(*start)
+		if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case stanza.NormalMessage, stanza.ChatMessage, stanza.GroupChatMessage, "":
+		default:
+			return h.HandleXMPP(t, start)
+		}
+		inner, err := xmlstream.ReadAll(xmlstream.Inner(t))
+		if err != nil {
+			return err
+		}
+		toks := append([]xml.Token{start.Copy()}, inner...)
+		toks = append(toks, start.End())
+		if hasBody(inner) {
+			err = l.record(msg, toks)
+			if err != nil {
+				return err
+			}
+		}
+		return h.HandleXMPP(struct {
+			xml.TokenReader
+			xmlstream.Encoder
+		}{
+			TokenReader: xmltok.Replay(append(inner, start.End())),
+			Encoder:     t,
+		}, start)
+	})
+}
+
+// record stores an incoming message whose tokens, including the start element,
+// are in toks.
+func (l *Log) record(msg stanza.Message, toks []xml.Token) error {
+	// Group chat messages are archived by the room, all others by the account.
+	by := msg.To.Bare()
+	if msg.Type == stanza.GroupChatMessage {
+		by = msg.From.Bare()
+	}
+	id, originID, stamp := messageInfo(toks, by)
+	if originID == "" {
+		originID = msg.ID
+	}
+	if stamp.IsZero() {
+		stamp = time.Now().UTC()
+	}
+
+	ctx := context.Background()
+	if l.History != nil && id != "" {
+		_, err := l.History.Live(ctx, by, id, stamp)
+		if err != nil {
+			return err
+		}
+	}
+	return l.store().Put(ctx, Message{
+		ID:       id,
+		OriginID: originID,
+		Peer:     msg.From,
+		Time:     stamp,
+		Stanza:   toks,
+	})
+}
+
+// Received marks the message with the provided ID that was sent to from as
+// delivered.
+// It has the signature of the Received callback on receipts.Handler.
+func (l *Log) Received(from jid.JID, id string) error {
+	return l.store().MarkDelivered(context.Background(), from, id)
+}
+
+// SendMessage records the first element read from the provided token reader
+// and then transmits it over the session using the SendMessage method on
+// Session.
+// If the message does not have an ID or an origin ID, they are added before
+// the message is recorded.
+//
+// SendMessage is safe for concurrent use by multiple goroutines.
+func (l *Log) SendMessage(ctx context.Context, s *xmpp.Session, r xml.TokenReader) (xmlstream.TokenReadCloser, error) {
+	tok, err := r.Token()
+	if err != nil {
+		return nil, err
+	}
+	start, ok := tok.(xml.StartElement)
+	if !ok || start.Name.Local != "message" {
+		return nil, fmt.Errorf("msgstore: expected a message start element, got %v", tok)
+	}
+	msg, err := stanza.NewMessage(start)
+	if err != nil {
+		return nil, err
+	}
+	if msg.ID == "" {
+		msg.ID = attr.RandomID()
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "id"}, Value: msg.ID})
+	}
+
+	inner, err := xmlstream.ReadAll(xmlstream.Inner(r))
+	if err != nil {
+		return nil, err
+	}
+	_, originID, _ := messageInfo(inner, jid.JID{})
+	if originID == "" {
+		originID = msg.ID
+		originToks, err := xmlstream.ReadAll(stanza.OriginID{ID: originID}.TokenReader())
+		if err != nil {
+			return nil, err
+		}
+		inner = append(originToks, inner...)
+	}
+	toks := append([]xml.Token{start}, inner...)
+	toks = append(toks, start.End())
+
+	err = l.store().Put(ctx, Message{
+		ID:       msg.ID,
+		OriginID: originID,
+		Peer:     msg.To,
+		Sent:     true,
+		Time:     time.Now().UTC(),
+		Stanza:   toks,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.SendMessage(ctx, xmltok.Replay(toks))
+}
+
+// SendMessageElement is like SendMessage except that it wraps the payload in
+// the message element derived from msg.
+// For more information see SendMessage.
+//
+// SendMessageElement is safe for concurrent use by multiple goroutines.
+func (l *Log) SendMessageElement(ctx context.Context, s *xmpp.Session, payload xml.TokenReader, msg stanza.Message) (xmlstream.TokenReadCloser, error) {
+	return l.SendMessage(ctx, s, msg.Wrap(payload))
+}
+
+// Sync fetches any messages from the archive at the provided address that were
+// not already synchronized and records them, filling in any gaps in the stored
+// conversations.
+// Messages that were already recorded are matched by their stanza ID or origin
+// ID and are not duplicated.
+//
+// Sync uses the Sync method on the History handler, which must be set and
+// registered on the multiplexer used by the session.
+// If the address is empty the archive of the account is synchronized.
+func (l *Log) Sync(ctx context.Context, archive jid.JID, s *xmpp.Session) error {
+	if l.History == nil {
+		return errors.New("msgstore: no history handler configured")
+	}
+	local := s.LocalAddr().Bare()
+	return l.History.Sync(ctx, archive, s, func(r xml.TokenReader) error {
+		toks, err := xmlstream.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		id, stamp, msgToks := resultInfo(toks)
+		if len(msgToks) == 0 {
+			return nil
+		}
+		msg, err := stanza.NewMessage(msgToks[0].(xml.StartElement))
+		if err != nil {
+			return err
+		}
+		_, originID, _ := messageInfo(msgToks, jid.JID{})
+		if originID == "" {
+			originID = msg.ID
+		}
+		stored := Message{
+			ID:       id,
+			OriginID: originID,
+			Peer:     msg.From,
+			Time:     stamp,
+			Stanza:   msgToks,
+		}
+		if msg.From.Bare().Equal(local) {
+			stored.Sent = true
+			stored.Peer = msg.To
+		}
+		return l.store().Put(ctx, stored)
+	})
+}
+
+// messageInfo returns the stanza ID assigned by the provided entity, the origin
+// ID, and the delay stamp from the child elements of a message.
+// If toks starts with the message start element it is skipped.
+func messageInfo(toks []xml.Token, by jid.JID) (id, originID string, stamp time.Time) {
+	var depth int
+	if len(toks) > 0 {
+		if start, ok := toks[0].(xml.StartElement); ok && start.Name.Local == "message" {
+			depth = -1
+		}
+	}
+	for _, tok := range toks {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth != 1 {
+				continue
+			}
+			switch {
+			case t.Name.Space == stanza.NSSid && t.Name.Local == "stanza-id":
+				_, idBy := attr.Get(t.Attr, "by")
+				if j, err := jid.Parse(idBy); err == nil && j.Equal(by) {
+					_, id = attr.Get(t.Attr, "id")
+				}
+			case t.Name.Space == stanza.NSSid && t.Name.Local == "origin-id":
+				_, originID = attr.Get(t.Attr, "id")
+			case t.Name.Space == delay.NS && t.Name.Local == "delay":
+				_, s := attr.Get(t.Attr, "stamp")
+				/* #nosec */
+				stamp, _ = time.Parse(time.RFC3339, s)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return id, originID, stamp
+}
+
+// hasBody reports whether the child elements of a message contain a body.
+func hasBody(toks []xml.Token) bool {
+	var depth int
+	for _, tok := range toks {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 && t.Name.Local == "body" {
+				return true
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return false
+}
+
+// resultInfo returns the archive ID, the time the message was archived, and the
+// tokens of the forwarded message from the tokens of a message archive result.
+func resultInfo(toks []xml.Token) (id string, stamp time.Time, msg []xml.Token) {
+	var depth, msgStart int
+	for i, tok := range toks {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case depth == 2 && t.Name.Space == history.NS && t.Name.Local == "result":
+				_, id = attr.Get(t.Attr, "id")
+			case depth == 4 && t.Name.Space == delay.NS && t.Name.Local == "delay":
+				_, s := attr.Get(t.Attr, "stamp")
+				/* #nosec */
+				stamp, _ = time.Parse(time.RFC3339, s)
+			case depth == 4 && t.Name.Local == "message":
+				msgStart = i
+			}
+		case xml.EndElement:
+			if depth == 4 && t.Name.Local == "message" {
+				msg = toks[msgStart : i+1]
+			}
+			depth--
+		}
+	}
+	return id, stamp, msg
+}
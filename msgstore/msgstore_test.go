@@ -0,0 +1,318 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package msgstore_test
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/history"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/msgstore"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/receipts"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	juliet  = jid.MustParse("juliet@example.net/balcony")
+	nurse   = jid.MustParse("nurse@example.net")
+	account = jid.MustParse("test@example.net")
+)
+
+// body returns the first body of the message stanza.
+func body(t *testing.T, msg msgstore.Message) string {
+	t.Helper()
+	var s struct {
+		Body []string `xml:"body"`
+	}
+	err := xml.NewTokenDecoder(tokens(msg.Stanza)).Decode(&s)
+	if err != nil {
+		t.Fatalf("error decoding message: %v", err)
+	}
+	if len(s.Body) == 0 {
+		return ""
+	}
+	return s.Body[0]
+}
+
+func tokens(toks []xml.Token) xml.TokenReader {
+	return xmlstream.ReaderFunc(func() (xml.Token, error) {
+		if len(toks) == 0 {
+			return nil, io.EOF
+		}
+		tok := toks[0]
+		toks = toks[1:]
+		return tok, nil
+	})
+}
+
+func stanzaToks(t *testing.T, s string) []xml.Token {
+	t.Helper()
+	toks, err := xmlstream.ReadAll(xml.NewDecoder(strings.NewReader(s)))
+	if err != nil {
+		t.Fatalf("error decoding stanza: %v", err)
+	}
+	return toks
+}
+
+func testStore(t *testing.T, s msgstore.Store) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	put := func(msg msgstore.Message) {
+		t.Helper()
+		err := s.Put(ctx, msg)
+		if err != nil {
+			t.Fatalf("error storing message: %v", err)
+		}
+	}
+	put(msgstore.Message{
+		OriginID: "1",
+		Peer:     juliet,
+		Sent:     true,
+		Time:     now,
+		Stanza:   stanzaToks(t, `<message xmlns="jabber:client" id="1"><body>one</body></message>`),
+	})
+	put(msgstore.Message{
+		ID:       "b",
+		OriginID: "3",
+		Peer:     juliet.Bare(),
+		Time:     now.Add(2 * time.Minute),
+		Stanza:   stanzaToks(t, `<message xmlns="jabber:client" id="3"><body>three</body></message>`),
+	})
+	put(msgstore.Message{
+		OriginID: "2",
+		Peer:     juliet,
+		Time:     now.Add(time.Minute),
+		Stanza:   stanzaToks(t, `<message xmlns="jabber:client" id="2"><body>two</body></message>`),
+	})
+	put(msgstore.Message{
+		OriginID: "x",
+		Peer:     nurse,
+		Time:     now,
+		Stanza:   stanzaToks(t, `<message xmlns="jabber:client" id="x"><body>other</body></message>`),
+	})
+	// Merged with the existing messages.
+	put(msgstore.Message{
+		ID:       "a",
+		OriginID: "1",
+		Peer:     juliet,
+		Time:     now.Add(time.Hour),
+	})
+	put(msgstore.Message{
+		ID:   "b",
+		Peer: juliet.Bare(),
+		Time: now.Add(time.Hour),
+	})
+	err := s.MarkDelivered(ctx, juliet, "1")
+	if err != nil {
+		t.Fatalf("error marking message delivered: %v", err)
+	}
+	err = s.MarkDelivered(ctx, juliet, "2")
+	if err != nil {
+		t.Fatalf("error marking message delivered: %v", err)
+	}
+
+	check := func(peer jid.JID, start, end time.Time, want ...string) {
+		t.Helper()
+		msgs, err := s.Query(ctx, peer, start, end)
+		if err != nil {
+			t.Fatalf("error querying messages: %v", err)
+		}
+		var got []string
+		for _, msg := range msgs {
+			got = append(got, body(t, msg))
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("wrong messages for %s: want=%v, got=%v", peer, want, got)
+		}
+	}
+	check(juliet.Bare(), time.Time{}, time.Time{}, "one", "two", "three")
+	check(juliet, time.Time{}, time.Time{}, "one", "two")
+	check(juliet.Bare(), now.Add(time.Minute), time.Time{}, "two", "three")
+	check(juliet.Bare(), time.Time{}, now.Add(time.Minute), "one", "two")
+	check(nurse, time.Time{}, time.Time{}, "other")
+
+	msgs, err := s.Query(ctx, juliet.Bare(), time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("error querying messages: %v", err)
+	}
+	if msgs[0].ID != "a" || !msgs[0].Delivered || !msgs[0].Sent || !msgs[0].Time.Equal(now) {
+		t.Errorf("first message not merged: %+v", msgs[0])
+	}
+	if msgs[1].Delivered {
+		t.Errorf("received message should not be marked delivered")
+	}
+	if msgs[2].OriginID != "3" || !msgs[2].Peer.Equal(juliet.Bare()) {
+		t.Errorf("third message should not be changed by merge: %+v", msgs[2])
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, &msgstore.MemStore{})
+}
+
+func TestFileStore(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "messages.xml")
+	s, err := msgstore.OpenFile(name)
+	if err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	testStore(t, s)
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("error closing store: %v", err)
+	}
+
+	// The messages are loaded again when the file is reopened.
+	s, err = msgstore.OpenFile(name)
+	if err != nil {
+		t.Fatalf("error reopening store: %v", err)
+	}
+	defer s.Close()
+	msgs, err := s.Query(context.Background(), juliet.Bare(), time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("error querying messages: %v", err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("wrong number of messages after reopening: want=3, got=%d", len(msgs))
+	}
+	if body(t, msgs[0]) != "one" || msgs[0].ID != "a" || !msgs[0].Delivered {
+		t.Errorf("wrong first message after reopening: %+v", msgs[0])
+	}
+}
+
+func TestLog(t *testing.T) {
+	ctx := context.Background()
+	srv := &history.Service{}
+	l := &msgstore.Log{History: history.NewHandler(nil)}
+
+	received := make(chan struct{}, 10)
+	var bodies int
+	h := l.Handler(mux.New("",
+		receipts.Handle(&receipts.Handler{Received: l.Received}),
+		history.Handle(l.History),
+		mux.MessageFunc(stanza.ChatMessage, xml.Name{Local: "body"}, func(stanza.Message, xmlstream.TokenReadEncoder) error {
+			bodies++
+			return nil
+		}),
+	))
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandler(mux.New(stanza.NSClient, history.HandleService(srv))),
+		xmpptest.ClientHandler(xmpp.HandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			err := h.HandleXMPP(t, start)
+			if start.Name.Local == "message" {
+				received <- struct{}{}
+			}
+			return err
+		})),
+	)
+	defer cs.Close()
+
+	// Sent messages are recorded and marked as delivered when a receipt is
+	// received.
+	sendCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err := l.SendMessageElement(sendCtx, cs.Client, xmlstream.Wrap(
+		xmlstream.Token(xml.CharData("Art thou not Romeo?")),
+		xml.StartElement{Name: xml.Name{Local: "body"}},
+	), stanza.Message{ID: "sent", To: juliet, Type: stanza.ChatMessage})
+	if err != nil && err != context.DeadlineExceeded {
+		t.Fatalf("error sending message: %v", err)
+	}
+	err = cs.Server.Send(ctx, stanza.Message{
+		From: juliet,
+		To:   account,
+		Type: stanza.ChatMessage,
+	}.Wrap(xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: receipts.NS, Local: "received"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: "sent"}},
+	})))
+	if err != nil {
+		t.Fatalf("error sending receipt: %v", err)
+	}
+	<-received
+
+	// Receipts reference the id attribute of the message, even if it has a
+	// different origin ID.
+	_, err = l.SendMessage(sendCtx, cs.Client, xml.NewDecoder(strings.NewReader(
+		`<message xmlns="jabber:client" to="juliet@example.net/balcony" type="chat" id="stanza"><origin-id xmlns="urn:xmpp:sid:0" id="origin"/><body>She speaks</body></message>`,
+	)))
+	if err != nil && err != context.DeadlineExceeded {
+		t.Fatalf("error sending message: %v", err)
+	}
+	err = cs.Server.Send(ctx, stanza.Message{
+		From: juliet,
+		To:   account,
+		Type: stanza.ChatMessage,
+	}.Wrap(xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: receipts.NS, Local: "received"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: "stanza"}},
+	})))
+	if err != nil {
+		t.Fatalf("error sending receipt: %v", err)
+	}
+	<-received
+
+	// Received messages are recorded with the stanza ID assigned by the archive.
+	err = cs.Server.Send(ctx, xml.NewDecoder(strings.NewReader(
+		`<message from="juliet@example.net/balcony" to="test@example.net/res" type="chat" id="live"><body>Neither, fair saint</body><body xml:lang="fr">Ni l'un ni l'autre</body><stanza-id xmlns="urn:xmpp:sid:0" by="test@example.net" id="live-id"/></message>`,
+	)))
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	<-received
+	if bodies != 2 {
+		t.Errorf("bodies not passed to the next handler: want=2, got=%d", bodies)
+	}
+
+	// Synchronizing fills gaps without duplicating the messages that were sent
+	// or received live.
+	for _, s := range []string{
+		`<message from="test@example.net/res" to="juliet@example.net/balcony" type="chat" id="sent"><origin-id xmlns="urn:xmpp:sid:0" id="sent"/><body>Art thou not Romeo?</body></message>`,
+		`<message from="juliet@example.net/balcony" to="test@example.net/res" type="chat" id="missed"><body>Wherefore art thou Romeo?</body></message>`,
+	} {
+		_, err = srv.Archive(ctx, account, xml.NewDecoder(strings.NewReader(s)))
+		if err != nil {
+			t.Fatalf("error archiving message: %v", err)
+		}
+	}
+	err = l.Sync(ctx, account, cs.Client)
+	if err != nil {
+		t.Fatalf("error syncing: %v", err)
+	}
+
+	msgs, err := l.Query(ctx, juliet.Bare(), time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("error querying messages: %v", err)
+	}
+	if len(msgs) != 4 {
+		t.Fatalf("wrong number of messages: want=4, got=%d", len(msgs))
+	}
+	byOrigin := make(map[string]msgstore.Message)
+	for _, msg := range msgs {
+		byOrigin[msg.OriginID] = msg
+	}
+	if msg := byOrigin["sent"]; !msg.Sent || !msg.Delivered || msg.ID == "" || !msg.Peer.Equal(juliet) {
+		t.Errorf("wrong sent message: %+v", msg)
+	}
+	if msg := byOrigin["origin"]; !msg.Sent || !msg.Delivered || msg.ID != "stanza" {
+		t.Errorf("wrong sent message with origin ID: %+v", msg)
+	}
+	if msg := byOrigin["live"]; msg.Sent || msg.ID != "live-id" || body(t, msg) != "Neither, fair saint" {
+		t.Errorf("wrong live message: %+v", msg)
+	}
+	if msg := byOrigin["missed"]; msg.Sent || msg.ID == "" || body(t, msg) != "Wherefore art thou Romeo?" {
+		t.Errorf("wrong synchronized message: %+v", msg)
+	}
+}
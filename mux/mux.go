@@ -14,6 +14,8 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io"
+	"reflect"
+	"sort"
 	"strings"
 
 	"mellium.im/xmlstream"
@@ -57,6 +59,8 @@ type ServeMux struct {
 	presencePatterns map[pattern]PresenceHandler
 	features         []info.FeatureIter
 	idents           []info.IdentityIter
+	forms            []form.Iter
+	items            []items.Iter
 	stanzaNS         string
 }
 
@@ -249,9 +253,119 @@ func (m *ServeMux) ForItems(node string, f func(items.Item) error) error {
 			}
 		}
 	}
+	for _, iter := range m.items {
+		err := iter.ForItems(node, f)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// ForItemsPage implements items.Pager for the mux by iterating over all child
+// items.
+// Unlike ForItems, children are always visited in the same order so that
+// consecutive pages do not overlap.
+// Children that implement items.Pager are asked only for the items that fall
+// on the page, other children are iterated over in full.
+func (m *ServeMux) ForItemsPage(node string, offset, max uint64, f func(items.Item) error) (uint64, error) {
+	var total uint64
+	for _, iter := range m.itemIters() {
+		var n uint64
+		var err error
+		if pager, ok := iter.(items.Pager); ok {
+			var delivered uint64
+			n, err = pager.ForItemsPage(node, offset, max, func(i items.Item) error {
+				delivered++
+				return f(i)
+			})
+			max -= delivered
+		} else {
+			err = iter.ForItems(node, func(i items.Item) error {
+				n++
+				if n <= offset || max == 0 {
+					return nil
+				}
+				max--
+				return f(i)
+			})
+		}
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if offset > n {
+			offset -= n
+		} else {
+			offset = 0
+		}
+	}
+	return total, nil
+}
+
+// itemIters returns all children that implement items.Iter in a stable order.
+// Handlers registered under more than one pattern are only returned once.
+func (m *ServeMux) itemIters() []items.Iter {
+	var iters []items.Iter
+	seen := make(map[interface{}]struct{})
+	add := func(h interface{}) {
+		itemIter, ok := h.(items.Iter)
+		if !ok {
+			return
+		}
+		// Handlers that cannot be compared, such as slices, are never deduped.
+		if reflect.TypeOf(itemIter).Comparable() {
+			if _, ok := seen[itemIter]; ok {
+				return
+			}
+			seen[itemIter] = struct{}{}
+		}
+		iters = append(iters, itemIter)
+	}
+	names := make([]xml.Name, 0, len(m.patterns))
+	for name := range m.patterns {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].Space != names[j].Space {
+			return names[i].Space < names[j].Space
+		}
+		return names[i].Local < names[j].Local
+	})
+	for _, name := range names {
+		add(m.patterns[name])
+	}
+	var pats []pattern
+	for pat := range m.iqPatterns {
+		pats = append(pats, pat)
+	}
+	for pat := range m.msgPatterns {
+		pats = append(pats, pat)
+	}
+	for pat := range m.presencePatterns {
+		pats = append(pats, pat)
+	}
+	sort.Slice(pats, func(i, j int) bool {
+		return pats[i].String() < pats[j].String()
+	})
+	for _, pat := range pats {
+		var h interface{}
+		switch pat.Stanza {
+		case iqStanza:
+			h = m.iqPatterns[pat]
+		case msgStanza:
+			h = m.msgPatterns[pat]
+		case presStanza:
+			h = m.presencePatterns[pat]
+		}
+		add(h)
+	}
+	for _, iter := range m.items {
+		add(iter)
+	}
+	return iters
+}
+
 // ForFeatures implements info.FeatureIter for the mux by iterating over all
 // child features.
 func (m *ServeMux) ForFeatures(node string, f func(info.Feature) error) error {
@@ -375,6 +489,12 @@ func (m *ServeMux) ForForms(node string, f func(*form.Data) error) error {
 			}
 		}
 	}
+	for _, iter := range m.forms {
+		err := iter.ForForms(node, f)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
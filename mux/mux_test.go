@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -17,6 +18,7 @@ import (
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp/disco/info"
 	"mellium.im/xmpp/disco/items"
+	"mellium.im/xmpp/form"
 	"mellium.im/xmpp/internal/marshal"
 	"mellium.im/xmpp/internal/xmpptest"
 	"mellium.im/xmpp/mux"
@@ -739,6 +741,9 @@ func (otherFeature) ForIdentities(node string, f func(info.Identity) error) erro
 		Name: otherTestFeature,
 	})
 }
+func (otherFeature) ForForms(node string, f func(*form.Data) error) error {
+	return f(form.New(form.Hidden("FORM_TYPE", form.Value(otherTestFeature))))
+}
 
 func TestFeatures(t *testing.T) {
 	m := mux.New(
@@ -749,6 +754,7 @@ func TestFeatures(t *testing.T) {
 		mux.Presence("", xml.Name{}, presenceFeature{}),
 		mux.Feature(otherFeature{}),
 		mux.Ident(otherFeature{}),
+		mux.Form(otherFeature{}),
 	)
 	var (
 		foundHandler  bool
@@ -803,6 +809,19 @@ func TestFeatures(t *testing.T) {
 	if !foundOtherIdent {
 		t.Errorf("ident iter did not find other test identity")
 	}
+	var foundOtherForm bool
+	err = m.ForForms("", func(data *form.Data) error {
+		if formType, _ := data.GetString("FORM_TYPE"); formType == otherTestFeature {
+			foundOtherForm = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error while iterating over forms: %v", err)
+	}
+	if !foundOtherForm {
+		t.Errorf("form iter did not find other test form")
+	}
 }
 
 func TestItems(t *testing.T) {
@@ -849,6 +868,91 @@ func TestItems(t *testing.T) {
 	}
 }
 
+type itemList []string
+
+func (l itemList) ForItems(node string, f func(items.Item) error) error {
+	for _, name := range l {
+		err := f(items.Item{Name: name})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type itemPager struct {
+	itemList
+}
+
+func (itemPager) HandleXMPP(xmlstream.TokenReadEncoder, *xml.StartElement) error {
+	panic("should not be called")
+}
+
+func (p itemPager) ForItemsPage(node string, offset, max uint64, f func(items.Item) error) (uint64, error) {
+	total := uint64(len(p.itemList))
+	for i := offset; i < total && i < offset+max; i++ {
+		err := f(items.Item{Name: p.itemList[i]})
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func TestItemsPage(t *testing.T) {
+	m := mux.New(
+		stanza.NSClient,
+		mux.Items(itemList{"a", "b", "c"}),
+		mux.Items(itemPager{itemList{"d", "e", "f", "g"}}),
+	)
+	for _, tc := range []struct {
+		offset, max uint64
+		want        []string
+	}{
+		{offset: 0, max: 0},
+		{offset: 0, max: 2, want: []string{"a", "b"}},
+		{offset: 2, max: 3, want: []string{"c", "d", "e"}},
+		{offset: 4, max: 10, want: []string{"e", "f", "g"}},
+		{offset: 7, max: 2},
+	} {
+		var names []string
+		total, err := m.ForItemsPage("", tc.offset, tc.max, func(i items.Item) error {
+			names = append(names, i.Name)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if total != 7 {
+			t.Errorf("wrong total for offset %d and max %d: want=7, got=%d", tc.offset, tc.max, total)
+		}
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("wrong page for offset %d and max %d: want=%v, got=%v", tc.offset, tc.max, tc.want, names)
+		}
+	}
+}
+
+func TestItemsPageDedupe(t *testing.T) {
+	pager := &itemPager{itemList{"a", "b"}}
+	m := mux.New(
+		stanza.NSClient,
+		mux.Handle(xml.Name{Space: "urn:example", Local: "a"}, pager),
+		mux.Handle(xml.Name{Space: "urn:example", Local: "b"}, pager),
+		mux.Items(pager),
+	)
+	var names []string
+	total, err := m.ForItemsPage("", 0, 10, func(i items.Item) error {
+		names = append(names, i.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"a", "b"}; total != 2 || !reflect.DeepEqual(names, want) {
+		t.Errorf("wrong page: want=%v/2, got=%v/%d", want, names, total)
+	}
+}
+
 func TestFeaturesHandlerErr(t *testing.T) {
 	m := mux.New(
 		stanza.NSClient,
@@ -9,6 +9,8 @@ import (
 
 	"mellium.im/xmpp"
 	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/disco/items"
+	"mellium.im/xmpp/form"
 	"mellium.im/xmpp/stanza"
 )
 
@@ -113,6 +115,36 @@ func Ident(iter info.IdentityIter) Option {
 	}
 }
 
+// Form registers the provided forms for service discovery.
+//
+// Most forms will be implemented by Handlers and do not need to be registered
+// again, Form is just for forms that should be advertised but do not have any
+// corresponding handler.
+func Form(iter form.Iter) Option {
+	if iter == nil {
+		panic("mux: nil form.Iter")
+	}
+	return func(m *ServeMux) {
+		m.forms = append(m.forms, iter)
+	}
+}
+
+// Items registers the provided items for service discovery.
+//
+// Most items will be implemented by Handlers and do not need to be registered
+// again, Items is just for items that should be advertised but do not have any
+// corresponding handler.
+// If iter also implements items.Pager it will be used to respond to paged
+// requests.
+func Items(iter items.Iter) Option {
+	if iter == nil {
+		panic("mux: nil items.Iter")
+	}
+	return func(m *ServeMux) {
+		m.items = append(m.items, iter)
+	}
+}
+
 // Handle returns an option that matches on the provided XML name.
 // If a handler already exists for n when the option is applied, the option
 // panics.
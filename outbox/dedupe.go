@@ -0,0 +1,131 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package outbox
+
+import (
+	"encoding/xml"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/xmltok"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/receipts"
+	"mellium.im/xmpp/stanza"
+)
+
+// DefaultDedupeLimit is the number of origin IDs remembered for each sender by
+// a Dedupe with no limit set.
+const DefaultDedupeLimit = 100
+
+// Dedupe drops messages that have already been received by checking their
+// origin IDs.
+// It is used on the receiving side to ignore messages that were sent again by
+// an outbox because no delivery receipt arrived.
+//
+// The zero value remembers DefaultDedupeLimit origin IDs for each sender.
+type Dedupe struct {
+	// Limit is the number of origin IDs remembered for each sender.
+	// If zero, DefaultDedupeLimit is used.
+	Limit int
+
+	m    sync.Mutex
+	seen map[string][]string
+}
+
+// Seen records the origin ID of a message from the provided address and reports
+// whether it was already recorded.
+// Messages from different resources of the same entity are considered to be
+// from the same sender.
+// An empty origin ID is never considered to have been seen.
+func (d *Dedupe) Seen(from jid.JID, originID string) bool {
+	if originID == "" {
+		return false
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.seen == nil {
+		d.seen = make(map[string][]string)
+	}
+	key := from.Bare().String()
+	ids := d.seen[key]
+	for _, id := range ids {
+		if id == originID {
+			return true
+		}
+	}
+	limit := d.Limit
+	if limit <= 0 {
+		limit = DefaultDedupeLimit
+	}
+	ids = append(ids, originID)
+	if len(ids) > limit {
+		ids = ids[len(ids)-limit:]
+	}
+	d.seen[key] = ids
+	return false
+}
+
+// Handler returns a handler that drops duplicate messages before they reach h.
+// If a dropped message requests a delivery receipt, the receipt is sent again
+// so that the sender stops resending it.
+// All other stanzas are passed through to h unchanged.
+func (d *Dedupe) Handler(h xmpp.Handler) xmpp.Handler {
+	return xmpp.HandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		if start.Name.Local != "message" {
+			return h.HandleXMPP(t, start)
+		}
+		inner, err := xmlstream.ReadAll(xmlstream.Inner(t))
+		if err != nil {
+			return err
+		}
+		_, from := attr.Get(start.Attr, "from")
+		fromJID, err := jid.Parse(from)
+		if err != nil || !d.Seen(fromJID, originID(inner)) {
+			return h.HandleXMPP(struct {
+				xml.TokenReader
+				xmlstream.Encoder
+			}{
+				TokenReader: xmltok.Replay(append(inner, start.End())),
+				Encoder:     t,
+			}, start)
+		}
+
+		if !requestsReceipt(inner) {
+			return nil
+		}
+		msg, err := stanza.NewMessage(*start)
+		if err != nil {
+			return err
+		}
+		msg.From, msg.To = msg.To, msg.From
+		id := msg.ID
+		msg.ID = ""
+		_, err = xmlstream.Copy(t, msg.Wrap(xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Space: receipts.NS, Local: "received"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: id}},
+		})))
+		return err
+	})
+}
+
+// requestsReceipt reports whether the child elements of a message contain a
+// request for a delivery receipt.
+func requestsReceipt(toks []xml.Token) bool {
+	var depth int
+	for _, tok := range toks {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 && t.Name.Space == receipts.NS && t.Name.Local == "request" {
+				return true
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return false
+}
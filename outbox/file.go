@@ -0,0 +1,237 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package outbox
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/xmltok"
+	"mellium.im/xmpp/jid"
+)
+
+// FileStore is an implementation of Store that appends each message to a file
+// when it changes and keeps the messages in memory.
+// The file is read when the store is opened and the last version of each
+// message is used.
+//
+// When the store is opened, messages that were delivered or failed are
+// forgotten and the file is rewritten to contain only the remaining messages.
+// If the last record in the file is incomplete, for example because the
+// program exited while writing it, it is discarded.
+type FileStore struct {
+	mem MemStore
+	m   sync.Mutex
+	f   *os.File
+	e   *xml.Encoder
+}
+
+// OpenFile opens the named file, creating it if it does not exist, and loads
+// any messages that were previously stored in it.
+func OpenFile(name string) (*FileStore, error) {
+	s := &FileStore{}
+	err := s.load(name)
+	if err != nil {
+		return nil, fmt.Errorf("outbox: error loading %s: %w", name, err)
+	}
+	err = s.compact(name)
+	if err != nil {
+		return nil, fmt.Errorf("outbox: error compacting %s: %w", name, err)
+	}
+	return s, nil
+}
+
+// Close closes the underlying file.
+func (s *FileStore) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.f.Close()
+}
+
+// Put implements Store.
+func (s *FileStore) Put(ctx context.Context, msg Message) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	err := writeMsg(s.e, msg)
+	if err != nil {
+		return err
+	}
+	return s.mem.Put(ctx, msg)
+}
+
+// Get implements Store.
+func (s *FileStore) Get(ctx context.Context, id string) (Message, bool, error) {
+	return s.mem.Get(ctx, id)
+}
+
+// Pending implements Store.
+func (s *FileStore) Pending(ctx context.Context) ([]Message, error) {
+	return s.mem.Pending(ctx)
+}
+
+// compact replaces the named file with one that only contains the pending
+// messages and opens it for appending.
+func (s *FileStore) compact(name string) error {
+	pending, err := s.mem.Pending(context.Background())
+	if err != nil {
+		return err
+	}
+	s.mem = MemStore{}
+
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	e := xml.NewEncoder(f)
+	for _, msg := range pending {
+		err = writeMsg(e, msg)
+		if err != nil {
+			/* #nosec */
+			f.Close()
+			return err
+		}
+		err = s.mem.Put(context.Background(), msg)
+		if err != nil {
+			/* #nosec */
+			f.Close()
+			return err
+		}
+	}
+	err = f.Sync()
+	if err != nil {
+		/* #nosec */
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, name)
+	if err != nil {
+		return err
+	}
+
+	s.f, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.e = xml.NewEncoder(s.f)
+	return nil
+}
+
+// load reads the messages stored in the named file, if it exists.
+// Reading stops without an error at the first record that is not well formed.
+func (s *FileStore) load(name string) error {
+	f, err := os.Open(name)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	/* #nosec */
+	defer f.Close()
+
+	d := xml.NewDecoder(f)
+	for {
+		tok, err := d.Token()
+		var syntaxErr *xml.SyntaxError
+		switch {
+		case err == io.EOF || errors.As(err, &syntaxErr):
+			return nil
+		case err != nil:
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "msg" {
+			err = d.Skip()
+			if err != nil {
+				if errors.As(err, &syntaxErr) {
+					return nil
+				}
+				return err
+			}
+			continue
+		}
+		msg, err := decodeMsg(d, start)
+		if err != nil {
+			if errors.As(err, &syntaxErr) {
+				return nil
+			}
+			return err
+		}
+		err = s.mem.Put(context.Background(), msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeMsg encodes a message as a record and flushes the encoder.
+func writeMsg(e *xml.Encoder, msg Message) error {
+	start := xml.StartElement{
+		Name: xml.Name{Local: "msg"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "id"}, Value: msg.ID},
+			{Name: xml.Name{Local: "origin-id"}, Value: msg.OriginID},
+			{Name: xml.Name{Local: "to"}, Value: msg.To.String()},
+			{Name: xml.Name{Local: "state"}, Value: strconv.Itoa(int(msg.State))},
+			{Name: xml.Name{Local: "attempts"}, Value: strconv.Itoa(msg.Attempts)},
+		},
+	}
+	if !msg.Time.IsZero() {
+		start.Attr = append(start.Attr, xml.Attr{
+			Name:  xml.Name{Local: "time"},
+			Value: msg.Time.UTC().Format(time.RFC3339Nano),
+		})
+	}
+	_, err := xmlstream.Copy(e, xmlstream.Wrap(xmlstream.Map(xmltok.StripNS)(xmltok.Replay(msg.Stanza)), start))
+	if err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+func decodeMsg(d *xml.Decoder, start xml.StartElement) (Message, error) {
+	var msg Message
+	var err error
+	for _, a := range start.Attr {
+		switch a.Name.Local {
+		case "id":
+			msg.ID = a.Value
+		case "origin-id":
+			msg.OriginID = a.Value
+		case "to":
+			msg.To, err = jid.Parse(a.Value)
+		case "state":
+			var state uint64
+			state, err = strconv.ParseUint(a.Value, 10, 8)
+			msg.State = State(state)
+		case "attempts":
+			msg.Attempts, err = strconv.Atoi(a.Value)
+		case "time":
+			msg.Time, err = time.Parse(time.RFC3339Nano, a.Value)
+		}
+		if err != nil {
+			return msg, err
+		}
+	}
+	msg.Stanza, err = xmlstream.ReadAll(xmlstream.Map(xmltok.StripNS)(xmlstream.Inner(d)))
+	return msg, err
+}
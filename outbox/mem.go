@@ -0,0 +1,55 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package outbox
+
+import (
+	"context"
+	"sync"
+)
+
+// MemStore is an in-memory implementation of Store.
+// The zero value is ready to use.
+type MemStore struct {
+	m     sync.Mutex
+	msgs  map[string]Message
+	order []string
+}
+
+// Put implements Store.
+func (s *MemStore) Put(_ context.Context, msg Message) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.msgs == nil {
+		s.msgs = make(map[string]Message)
+	}
+	if _, ok := s.msgs[msg.ID]; !ok {
+		s.order = append(s.order, msg.ID)
+	}
+	s.msgs[msg.ID] = msg
+	return nil
+}
+
+// Get implements Store.
+func (s *MemStore) Get(_ context.Context, id string) (Message, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	msg, ok := s.msgs[id]
+	return msg, ok, nil
+}
+
+// Pending implements Store.
+func (s *MemStore) Pending(_ context.Context) ([]Message, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var pending []Message
+	for _, id := range s.order {
+		msg := s.msgs[id]
+		if msg.State == Delivered || msg.State == Failed {
+			continue
+		}
+		pending = append(pending, msg)
+	}
+	return pending, nil
+}
@@ -0,0 +1,382 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+//go:generate go run -tags=tools golang.org/x/tools/cmd/stringer -type=State
+
+// Package outbox implements a durable queue of outgoing messages that tracks
+// their delivery.
+//
+// Messages sent through an Outbox are stored before they are transmitted and
+// request a message delivery receipt (XEP-0184).
+// The state of each message is updated as it is sent, acknowledged by the
+// server, and delivered to the recipient, and messages that were never
+// delivered can be sent again after reconnecting.
+// Because a message may be sent more than once, each message is given an
+// origin ID (XEP-0359) that recipients can use to drop duplicates with Dedupe.
+package outbox // import "mellium.im/xmpp/outbox"
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/xmltok"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/receipts"
+	"mellium.im/xmpp/stanza"
+)
+
+// State is the delivery state of a message in the outbox.
+type State uint8
+
+// A list of possible message states.
+const (
+	// Queued messages have been stored but not yet transmitted, for example
+	// because the session was not connected.
+	Queued State = iota
+
+	// Sent messages have been written to the session.
+	Sent
+
+	// ServerAcked messages have been acknowledged by the server, for example
+	// using stream management.
+	ServerAcked
+
+	// Delivered messages have been acknowledged by the recipient with a
+	// delivery receipt.
+	Delivered
+
+	// Failed messages were bounced with an error or could not be sent within
+	// the maximum number of attempts and will not be sent again.
+	Failed
+)
+
+// Message is a message in the outbox.
+type Message struct {
+	// ID is the value of the id attribute of the message, which is used to match
+	// delivery receipts and errors.
+	ID string
+
+	// OriginID is the origin ID of the message.
+	OriginID string
+
+	// To is the address the message was sent to.
+	To jid.JID
+
+	// State is the delivery state of the message.
+	State State
+
+	// Attempts is the number of times the message has been sent.
+	Attempts int
+
+	// Time is when the message was added to the outbox.
+	Time time.Time
+
+	// Stanza is the tokens that make up the message stanza.
+	Stanza []xml.Token
+}
+
+// Store is used by an Outbox to persist messages.
+type Store interface {
+	// Put adds a message to the store or replaces the message with the same ID.
+	Put(ctx context.Context, msg Message) error
+
+	// Get returns the message with the provided ID.
+	// If no such message has been stored, ok is false.
+	Get(ctx context.Context, id string) (msg Message, ok bool, err error)
+
+	// Pending returns the messages that have been neither delivered nor failed,
+	// ordered from oldest to newest.
+	Pending(ctx context.Context) ([]Message, error)
+}
+
+// Handle returns an option that registers an Outbox to mark messages that are
+// bounced with an error as failed.
+func Handle(o *Outbox) mux.Option {
+	return mux.Message(stanza.ErrorMessage, xml.Name{Local: "error"}, o)
+}
+
+// Outbox stores outgoing messages and tracks their delivery.
+//
+// To mark messages as delivered, Received should be set as the Received
+// callback of a receipts.Handler, and to mark messages as acknowledged by the
+// server, Acked should be called when the server acknowledges them.
+// To mark bounced messages as failed, the outbox must be registered with a
+// multiplexer using Handle.
+// The zero value is an outbox that stores messages in memory and sends them
+// until they are delivered.
+type Outbox struct {
+	// Store persists messages.
+	// If nil, messages are stored in memory.
+	Store Store
+
+	// Changed, if set, is called with the updated message every time the state
+	// of a message changes.
+	Changed func(Message)
+
+	// MaxAttempts is the number of times a message is sent before it is marked
+	// as failed.
+	// If zero, messages are sent again until they are delivered.
+	MaxAttempts int
+
+	m   sync.Mutex
+	mem MemStore
+}
+
+func (o *Outbox) store() Store {
+	if o.Store != nil {
+		return o.Store
+	}
+	return &o.mem
+}
+
+// SendMessage stores the first element read from the provided token reader
+// and then transmits it over the session.
+// If the message does not have an ID or an origin ID, they are added, and a
+// request for a delivery receipt is added using receipts.Request.
+// The stored message is returned.
+//
+// If the message cannot be transmitted it remains queued and is sent by the
+// next call to Resend.
+//
+// SendMessage is safe for concurrent use by multiple goroutines.
+func (o *Outbox) SendMessage(ctx context.Context, s *xmpp.Session, r xml.TokenReader) (Message, error) {
+	tok, err := r.Token()
+	if err != nil {
+		return Message{}, err
+	}
+	start, ok := tok.(xml.StartElement)
+	if !ok || start.Name.Local != "message" {
+		return Message{}, fmt.Errorf("outbox: expected a message start element, got %v", tok)
+	}
+	msg, err := stanza.NewMessage(start)
+	if err != nil {
+		return Message{}, err
+	}
+	if msg.ID == "" {
+		msg.ID = attr.RandomID()
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "id"}, Value: msg.ID})
+	}
+
+	inner, err := xmlstream.ReadAll(xmlstream.Inner(r))
+	if err != nil {
+		return Message{}, err
+	}
+	originID := originID(inner)
+	if originID == "" {
+		originID = attr.RandomID()
+		originToks, err := xmlstream.ReadAll(stanza.OriginID{ID: originID}.TokenReader())
+		if err != nil {
+			return Message{}, err
+		}
+		inner = append(originToks, inner...)
+	}
+	// The receipt request is only added to messages in the client or server
+	// namespace.
+	if start.Name.Space == "" {
+		start.Name.Space = stanza.NSClient
+	}
+	toks, err := xmlstream.ReadAll(receipts.Request(xmltok.Replay(
+		append(append([]xml.Token{start}, inner...), start.End()),
+	)))
+	if err != nil {
+		return Message{}, err
+	}
+
+	stored := Message{
+		ID:       msg.ID,
+		OriginID: originID,
+		To:       msg.To,
+		State:    Queued,
+		Time:     time.Now().UTC(),
+		Stanza:   toks,
+	}
+	err = o.store().Put(ctx, stored)
+	if err != nil {
+		return stored, err
+	}
+	o.changed(stored)
+	return o.send(ctx, s, stored)
+}
+
+// SendMessageElement is like SendMessage except that it wraps the payload in
+// the message element derived from msg.
+// For more information see SendMessage.
+//
+// SendMessageElement is safe for concurrent use by multiple goroutines.
+func (o *Outbox) SendMessageElement(ctx context.Context, s *xmpp.Session, payload xml.TokenReader, msg stanza.Message) (Message, error) {
+	return o.SendMessage(ctx, s, msg.Wrap(payload))
+}
+
+// Resend transmits all messages that have not been delivered or failed, oldest
+// first.
+// It should be called after the session is reconnected.
+// Messages that have reached the maximum number of attempts are marked as
+// failed instead of being sent.
+func (o *Outbox) Resend(ctx context.Context, s *xmpp.Session) error {
+	pending, err := o.store().Pending(ctx)
+	if err != nil {
+		return err
+	}
+	for _, msg := range pending {
+		if o.MaxAttempts > 0 && msg.Attempts >= o.MaxAttempts {
+			err = o.update(ctx, msg.ID, Failed)
+		} else {
+			_, err = o.send(ctx, s, msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the message with the provided ID.
+func (o *Outbox) Get(ctx context.Context, id string) (Message, bool, error) {
+	return o.store().Get(ctx, id)
+}
+
+// Pending returns the messages that have been neither delivered nor failed.
+func (o *Outbox) Pending(ctx context.Context) ([]Message, error) {
+	return o.store().Pending(ctx)
+}
+
+// Acked marks the message with the provided ID as acknowledged by the server.
+// Messages that have already been delivered or failed are not changed.
+func (o *Outbox) Acked(ctx context.Context, id string) error {
+	return o.update(ctx, id, ServerAcked)
+}
+
+// Received marks the message with the provided ID as delivered if the receipt
+// came from the entity that the message was sent to.
+// It has the signature of the Received callback on receipts.Handler.
+func (o *Outbox) Received(from jid.JID, id string) error {
+	ctx := context.Background()
+	msg, ok, err := o.Get(ctx, id)
+	if err != nil || !ok {
+		return err
+	}
+	if !from.Bare().Equal(msg.To.Bare()) {
+		return nil
+	}
+	return o.update(ctx, id, Delivered)
+}
+
+// Fail marks the message with the provided ID as failed so that it is not sent
+// again.
+func (o *Outbox) Fail(ctx context.Context, id string) error {
+	return o.update(ctx, id, Failed)
+}
+
+// HandleMessage implements mux.MessageHandler and marks messages that are
+// bounced with an error as failed.
+// Errors are only accepted from the bare JID or the domain of the entity that
+// the message was sent to.
+func (o *Outbox) HandleMessage(msg stanza.Message, _ xmlstream.TokenReadEncoder) error {
+	if msg.ID == "" {
+		return nil
+	}
+	ctx := context.Background()
+	stored, ok, err := o.Get(ctx, msg.ID)
+	if err != nil || !ok {
+		return err
+	}
+	from := msg.From.Bare()
+	if !from.Equal(stored.To.Bare()) && !from.Equal(stored.To.Domain()) {
+		return nil
+	}
+	return o.Fail(ctx, msg.ID)
+}
+
+// update changes the state of a stored message if it is not already in the
+// same or a later state.
+func (o *Outbox) update(ctx context.Context, id string, state State) error {
+	o.m.Lock()
+	msg, ok, err := o.store().Get(ctx, id)
+	if err != nil || !ok {
+		o.m.Unlock()
+		return err
+	}
+	switch {
+	case msg.State == Delivered || msg.State == state:
+		o.m.Unlock()
+		return nil
+	case msg.State > state && state != Delivered:
+		// A late receipt still marks a failed message as delivered, but nothing
+		// else moves a message back to an earlier state.
+		o.m.Unlock()
+		return nil
+	}
+	msg.State = state
+	err = o.store().Put(ctx, msg)
+	o.m.Unlock()
+	if err != nil {
+		return err
+	}
+	o.changed(msg)
+	return nil
+}
+
+func (o *Outbox) send(ctx context.Context, s *xmpp.Session, msg Message) (Message, error) {
+	err := s.Send(ctx, xmltok.Replay(msg.Stanza))
+	if err != nil {
+		return msg, err
+	}
+
+	// A receipt may have arrived while the message was being sent, so reload it
+	// before recording the attempt.
+	o.m.Lock()
+	stored, ok, err := o.store().Get(ctx, msg.ID)
+	if err != nil {
+		o.m.Unlock()
+		return msg, err
+	}
+	if ok {
+		msg = stored
+	}
+	msg.Attempts++
+	prev := msg.State
+	if msg.State == Queued || msg.State == ServerAcked {
+		msg.State = Sent
+	}
+	err = o.store().Put(ctx, msg)
+	o.m.Unlock()
+	if err != nil {
+		return msg, err
+	}
+	if prev != msg.State {
+		o.changed(msg)
+	}
+	return msg, nil
+}
+
+func (o *Outbox) changed(msg Message) {
+	if o.Changed != nil {
+		o.Changed(msg)
+	}
+}
+
+// originID returns the origin ID from the child elements of a message.
+func originID(toks []xml.Token) string {
+	var depth int
+	for _, tok := range toks {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 && t.Name.Space == stanza.NSSid && t.Name.Local == "origin-id" {
+				_, id := attr.Get(t.Attr, "id")
+				return id
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return ""
+}
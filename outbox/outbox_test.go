@@ -0,0 +1,332 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package outbox_test
+
+import (
+	"context"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/outbox"
+	"mellium.im/xmpp/receipts"
+	"mellium.im/xmpp/stanza"
+)
+
+var juliet = jid.MustParse("juliet@example.net/balcony")
+
+type received struct {
+	ID       string `xml:"id,attr"`
+	OriginID struct {
+		ID string `xml:"id,attr"`
+	} `xml:"urn:xmpp:sid:0 origin-id"`
+	Request *struct{} `xml:"urn:xmpp:receipts request"`
+	Body    string    `xml:"body"`
+}
+
+func waitState(t *testing.T, c <-chan outbox.Message, id string, state outbox.State) outbox.Message {
+	t.Helper()
+	for {
+		select {
+		case msg := <-c:
+			if msg.ID == id && msg.State == state {
+				return msg
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for message %s to enter state %v", id, state)
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	changes := make(chan outbox.Message, 100)
+	o := &outbox.Outbox{
+		MaxAttempts: 2,
+		Changed: func(msg outbox.Message) {
+			changes <- msg
+		},
+	}
+	serverRecv := make(chan received, 10)
+	cs := xmpptest.NewClientServer(
+		xmpptest.ClientHandler(mux.New("",
+			receipts.Handle(&receipts.Handler{Received: o.Received}),
+			outbox.Handle(o),
+		)),
+		xmpptest.ServerHandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			var msg received
+			err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), t)).Decode(&msg)
+			if err != nil {
+				return err
+			}
+			serverRecv <- msg
+			return nil
+		}),
+	)
+	defer cs.Close()
+
+	// A delivered message moves through each state in order.
+	msg, err := o.SendMessageElement(ctx, cs.Client, xmlstream.Wrap(
+		xmlstream.Token(xml.CharData("Art thou not Romeo?")),
+		xml.StartElement{Name: xml.Name{Local: "body"}},
+	), stanza.Message{To: juliet, Type: stanza.ChatMessage})
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	if msg.State != outbox.Sent || msg.Attempts != 1 {
+		t.Errorf("wrong state after sending: want=%v/1, got=%v/%d", outbox.Sent, msg.State, msg.Attempts)
+	}
+	waitState(t, changes, msg.ID, outbox.Queued)
+	waitState(t, changes, msg.ID, outbox.Sent)
+	recv := <-serverRecv
+	if recv.ID != msg.ID || recv.OriginID.ID != msg.OriginID || msg.OriginID == "" || recv.Request == nil || recv.Body != "Art thou not Romeo?" {
+		t.Errorf("wrong message received by server: %+v", recv)
+	}
+	err = o.Acked(ctx, msg.ID)
+	if err != nil {
+		t.Fatalf("error acking message: %v", err)
+	}
+	waitState(t, changes, msg.ID, outbox.ServerAcked)
+	err = o.Received(jid.MustParse("nurse@example.net"), msg.ID)
+	if err != nil {
+		t.Fatalf("error handling receipt: %v", err)
+	}
+	if stored, _, _ := o.Get(ctx, msg.ID); stored.State != outbox.ServerAcked {
+		t.Errorf("receipt from the wrong entity changed the state to %v", stored.State)
+	}
+	err = cs.Server.Send(ctx, stanza.Message{From: juliet, To: cs.Client.LocalAddr(), Type: stanza.NormalMessage}.Wrap(
+		xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Space: receipts.NS, Local: "received"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: msg.ID}},
+		}),
+	))
+	if err != nil {
+		t.Fatalf("error sending receipt: %v", err)
+	}
+	waitState(t, changes, msg.ID, outbox.Delivered)
+
+	// A message with no receipt is resent with the same IDs until it fails.
+	undelivered, err := o.SendMessageElement(ctx, cs.Client, nil, stanza.Message{ID: "wherefore", To: juliet, Type: stanza.ChatMessage})
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	first := <-serverRecv
+	err = o.Resend(ctx, cs.Client)
+	if err != nil {
+		t.Fatalf("error resending: %v", err)
+	}
+	second := <-serverRecv
+	if !reflect.DeepEqual(first, second) || second.ID != "wherefore" {
+		t.Errorf("resent message differs: first=%+v, second=%+v", first, second)
+	}
+	stored, _, err := o.Get(ctx, undelivered.ID)
+	if err != nil {
+		t.Fatalf("error getting message: %v", err)
+	}
+	if stored.Attempts != 2 {
+		t.Errorf("wrong number of attempts: want=2, got=%d", stored.Attempts)
+	}
+	err = o.Resend(ctx, cs.Client)
+	if err != nil {
+		t.Fatalf("error resending: %v", err)
+	}
+	waitState(t, changes, undelivered.ID, outbox.Failed)
+	pending, err := o.Pending(ctx)
+	if err != nil {
+		t.Fatalf("error listing pending messages: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("expected no pending messages, got %v", pending)
+	}
+
+	// A bounced message fails.
+	bounced, err := o.SendMessageElement(ctx, cs.Client, nil, stanza.Message{To: juliet, Type: stanza.ChatMessage})
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	<-serverRecv
+	err = o.HandleMessage(stanza.Message{ID: bounced.ID, From: jid.MustParse("nurse@example.net"), Type: stanza.ErrorMessage}, nil)
+	if err != nil {
+		t.Fatalf("error handling bounce: %v", err)
+	}
+	if stored, _, _ := o.Get(ctx, bounced.ID); stored.State == outbox.Failed {
+		t.Errorf("bounce from the wrong entity marked the message as failed")
+	}
+	err = cs.Server.Send(ctx, stanza.Message{ID: bounced.ID, From: cs.Client.LocalAddr(), To: juliet.Domain()}.Error(stanza.Error{
+		Type:      stanza.Cancel,
+		Condition: stanza.ServiceUnavailable,
+	}))
+	if err != nil {
+		t.Fatalf("error sending bounce: %v", err)
+	}
+	waitState(t, changes, bounced.ID, outbox.Failed)
+}
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	name := filepath.Join(t.TempDir(), "outbox.xml")
+	s, err := outbox.OpenFile(name)
+	if err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	toks, err := xmlstream.ReadAll(stanza.Message{ID: "1", To: juliet, Type: stanza.ChatMessage}.Wrap(xmlstream.Wrap(
+		xmlstream.Token(xml.CharData("one")),
+		xml.StartElement{Name: xml.Name{Local: "body"}},
+	)))
+	if err != nil {
+		t.Fatalf("error decoding stanza: %v", err)
+	}
+	now := time.Now().UTC()
+	msgs := []outbox.Message{
+		{ID: "1", OriginID: "o1", To: juliet, Time: now, Stanza: toks},
+		{ID: "2", OriginID: "o2", To: juliet, Time: now, State: outbox.Delivered},
+	}
+	for _, msg := range msgs {
+		err = s.Put(ctx, msg)
+		if err != nil {
+			t.Fatalf("error storing message: %v", err)
+		}
+	}
+	msgs[0].State = outbox.Sent
+	msgs[0].Attempts = 1
+	err = s.Put(ctx, msgs[0])
+	if err != nil {
+		t.Fatalf("error updating message: %v", err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("error closing store: %v", err)
+	}
+
+	// A record that was only partially written is discarded.
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	_, err = f.WriteString(`<msg id="3" origin-id="o3" to="juliet@example.net/balcony" state="0" attempts="0"><message xmlns="jabber:client" id="3"><body>thr`)
+	if err != nil {
+		t.Fatalf("error writing partial record: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("error closing file: %v", err)
+	}
+
+	s, err = outbox.OpenFile(name)
+	if err != nil {
+		t.Fatalf("error reopening store: %v", err)
+	}
+	pending, err := s.Pending(ctx)
+	if err != nil {
+		t.Fatalf("error listing pending messages: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("wrong number of pending messages: want=1, got=%d", len(pending))
+	}
+	got := pending[0]
+	if got.ID != "1" || got.OriginID != "o1" || !got.To.Equal(juliet) || got.State != outbox.Sent || got.Attempts != 1 || !got.Time.Equal(now) {
+		t.Errorf("wrong message loaded: %+v", got)
+	}
+	if !reflect.DeepEqual(got.Stanza, toks) {
+		t.Errorf("wrong stanza loaded:\nwant=%v,\n got=%v", toks, got.Stanza)
+	}
+	if _, ok, _ := s.Get(ctx, "2"); ok {
+		t.Errorf("delivered message should not be loaded")
+	}
+	err = s.Put(ctx, outbox.Message{ID: "4", OriginID: "o4", To: juliet, Time: now})
+	if err != nil {
+		t.Fatalf("error storing message: %v", err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("error closing store: %v", err)
+	}
+
+	// The file only contains the pending messages after it is compacted.
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	for _, id := range []string{`id="2"`, `id="3"`} {
+		if strings.Contains(string(b), id) {
+			t.Errorf("file was not compacted, found %s in %s", id, b)
+		}
+	}
+	s, err = outbox.OpenFile(name)
+	if err != nil {
+		t.Fatalf("error reopening compacted store: %v", err)
+	}
+	defer s.Close()
+	pending, err = s.Pending(ctx)
+	if err != nil {
+		t.Fatalf("error listing pending messages: %v", err)
+	}
+	if len(pending) != 2 || pending[0].ID != "1" || pending[1].ID != "4" {
+		t.Errorf("wrong messages after compacting: %+v", pending)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	d := &outbox.Dedupe{Limit: 1}
+	var handled int
+	h := d.Handler(xmpp.HandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		handled++
+		_, err := xmlstream.ReadAll(t)
+		return err
+	}))
+
+	const msg = `<message xmlns="jabber:client" from="juliet@example.net/balcony" to="romeo@example.net" id="a"><origin-id xmlns="urn:xmpp:sid:0" id="o1"/><body>Hi</body><request xmlns="urn:xmpp:receipts"/></message>`
+	handle := func(in string) string {
+		t.Helper()
+		dec := xml.NewDecoder(strings.NewReader(in))
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatalf("error decoding stanza: %v", err)
+		}
+		start := tok.(xml.StartElement)
+		var b strings.Builder
+		e := xml.NewEncoder(&b)
+		err = h.HandleXMPP(struct {
+			xml.TokenReader
+			xmlstream.Encoder
+		}{
+			TokenReader: dec,
+			Encoder:     e,
+		}, &start)
+		if err != nil {
+			t.Fatalf("error handling stanza: %v", err)
+		}
+		err = e.Flush()
+		if err != nil {
+			t.Fatalf("error flushing: %v", err)
+		}
+		return b.String()
+	}
+
+	if out := handle(msg); out != "" || handled != 1 {
+		t.Errorf("first message not passed through: handled=%d, out=%s", handled, out)
+	}
+	out := handle(strings.Replace(msg, "balcony", "garden", 1))
+	if handled != 1 {
+		t.Errorf("duplicate message from another resource was handled")
+	}
+	if want := `<message xmlns="jabber:client" type="normal" to="juliet@example.net/garden" from="romeo@example.net"><received xmlns="urn:xmpp:receipts" id="a"></received></message>`; out != want {
+		t.Errorf("wrong receipt for duplicate:\nwant=%s,\n got=%s", want, out)
+	}
+	handle(strings.Replace(msg, "o1", "o2", 1))
+	handle(msg)
+	if handled != 3 {
+		t.Errorf("origin ID beyond the limit should be forgotten: want=3 handled, got=%d", handled)
+	}
+}
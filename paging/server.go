@@ -0,0 +1,189 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package paging
+
+import (
+	"encoding/xml"
+	"strconv"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/stanza"
+)
+
+// Request is a result set management request received by the entity that
+// owns the result set.
+// Unlike RequestNext, RequestPrev, and RequestIndex it records which elements
+// were present in the request so that, for example, an empty before element
+// (requesting the last page) can be told apart from no before element.
+type Request struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/rsm set"`
+	Max     *uint64  `xml:"max"`
+	After   *string  `xml:"after"`
+	Before  *string  `xml:"before"`
+	Index   *uint64  `xml:"index"`
+}
+
+// ParseRequest looks for a result set management request in the children of
+// the most recent start element already consumed from r.
+// If no request is found, ParseRequest returns nil.
+func ParseRequest(r xml.TokenReader) (*Request, error) {
+	iter := xmlstream.NewIter(r)
+	/* #nosec */
+	defer iter.Close()
+	for iter.Next() {
+		start, child := iter.Current()
+		if start == nil || start.Name.Space != NS || start.Name.Local != "set" {
+			continue
+		}
+		req := &Request{}
+		err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), child)).Decode(req)
+		if err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+	return nil, iter.Err()
+}
+
+// Source is an ordered result set that can be paged through by Respond.
+// Each item in the result set is identified by a unique, opaque ID that is
+// used as a cursor by the requesting entity.
+type Source interface {
+	// Len returns the total number of items in the result set.
+	Len() (uint64, error)
+
+	// Index returns the position of the item with the given ID.
+	// If no such item exists, ok is false.
+	Index(id string) (idx uint64, ok bool, err error)
+
+	// Page calls f with the IDs of at most max items starting with the item at
+	// position offset.
+	// Sources that need to return the items themselves (and not just their IDs)
+	// can collect them as f is called.
+	Page(offset, max uint64, f func(id string) error) error
+}
+
+// Page is a page from a result set selected by Respond.
+type Page struct {
+	// IDs contains the IDs of the items on the page in order.
+	IDs []string
+
+	// Set describes the page.
+	Set Set
+}
+
+// TokenReader implements xmlstream.Marshaler.
+// If the page is empty, only the count is included as required by XEP-0059.
+func (p Page) TokenReader() xml.TokenReader {
+	if len(p.IDs) == 0 {
+		var count uint64
+		if p.Set.Count != nil {
+			count = *p.Set.Count
+		}
+		return xmlstream.Wrap(
+			xmlstream.Wrap(
+				xmlstream.Token(xml.CharData(strconv.FormatUint(count, 10))),
+				xml.StartElement{Name: xml.Name{Local: "count"}},
+			),
+			xml.StartElement{Name: xml.Name{Space: NS, Local: "set"}},
+		)
+	}
+	return p.Set.TokenReader()
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (p Page) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, p.TokenReader())
+}
+
+// MarshalXML satisfies the xml.Marshaler interface.
+func (p Page) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := p.WriteXML(e)
+	return err
+}
+
+// Respond selects the page of src requested by req.
+//
+// If req does not specify a maximum page size or specifies one larger than
+// max, max is used instead.
+// If max is zero there is no limit.
+// If req is nil, the first page is returned.
+// If the request references an ID that does not exist in src, a stanza error
+// with the item-not-found condition is returned.
+func Respond(src Source, req *Request, max uint64) (Page, error) {
+	if req == nil {
+		req = &Request{}
+	}
+	total, err := src.Len()
+	if err != nil {
+		return Page{}, err
+	}
+	limit := max
+	if req.Max != nil && (max == 0 || *req.Max < max) {
+		limit = *req.Max
+	}
+	if req.Max == nil && max == 0 {
+		limit = total
+	}
+
+	index := func(id string) (uint64, error) {
+		idx, ok, err := src.Index(id)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound}
+		}
+		return idx, nil
+	}
+
+	var offset uint64
+	switch {
+	case req.Index != nil:
+		offset = *req.Index
+	case req.Before != nil:
+		end := total
+		if *req.Before != "" {
+			end, err = index(*req.Before)
+			if err != nil {
+				return Page{}, err
+			}
+		}
+		if end > limit {
+			offset = end - limit
+		}
+		limit = end - offset
+	case req.After != nil:
+		idx, err := index(*req.After)
+		if err != nil {
+			return Page{}, err
+		}
+		offset = idx + 1
+	}
+	if offset > total {
+		offset = total
+	}
+	if limit > total-offset {
+		limit = total - offset
+	}
+
+	page := Page{Set: Set{Count: &total}}
+	page.Set.XMLName = xml.Name{Space: NS, Local: "set"}
+	if limit > 0 {
+		err = src.Page(offset, limit, func(id string) error {
+			page.IDs = append(page.IDs, id)
+			return nil
+		})
+		if err != nil {
+			return Page{}, err
+		}
+	}
+	if len(page.IDs) > 0 {
+		page.Set.First.ID = page.IDs[0]
+		page.Set.First.Index = &offset
+		page.Set.Last = page.IDs[len(page.IDs)-1]
+	}
+	return page, nil
+}
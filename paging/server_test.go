@@ -0,0 +1,180 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package paging_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/paging"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xmlstream.Marshaler = paging.Page{}
+	_ xmlstream.WriterTo  = paging.Page{}
+	_ xml.Marshaler       = paging.Page{}
+)
+
+type letters string
+
+func (l letters) Len() (uint64, error) {
+	return uint64(len(l)), nil
+}
+
+func (l letters) Index(id string) (uint64, bool, error) {
+	idx := strings.Index(string(l), id)
+	return uint64(idx), idx >= 0 && len(id) == 1, nil
+}
+
+func (l letters) Page(offset, max uint64, f func(id string) error) error {
+	for _, c := range l[offset : offset+max] {
+		err := f(string(c))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var respondTestCases = [...]struct {
+	req   string
+	max   uint64
+	ids   []string
+	index uint64
+	out   string
+	err   stanza.Condition
+}{
+	0: {
+		ids: []string{"a", "b", "c", "d", "e", "f", "g"},
+		out: `<set xmlns="http://jabber.org/protocol/rsm"><first index="0">a</first><last>g</last><count>7</count></set>`,
+	},
+	1: {
+		max: 3,
+		ids: []string{"a", "b", "c"},
+		out: `<set xmlns="http://jabber.org/protocol/rsm"><first index="0">a</first><last>c</last><count>7</count></set>`,
+	},
+	2: {
+		req:   `<max>2</max><after>c</after>`,
+		max:   3,
+		ids:   []string{"d", "e"},
+		index: 3,
+		out:   `<set xmlns="http://jabber.org/protocol/rsm"><first index="3">d</first><last>e</last><count>7</count></set>`,
+	},
+	3: {
+		req:   `<max>10</max><after>c</after>`,
+		max:   3,
+		ids:   []string{"d", "e", "f"},
+		index: 3,
+		out:   `<set xmlns="http://jabber.org/protocol/rsm"><first index="3">d</first><last>f</last><count>7</count></set>`,
+	},
+	4: {
+		req:   `<max>2</max><before>c</before>`,
+		ids:   []string{"a", "b"},
+		index: 0,
+		out:   `<set xmlns="http://jabber.org/protocol/rsm"><first index="0">a</first><last>b</last><count>7</count></set>`,
+	},
+	5: {
+		req:   `<max>2</max><before></before>`,
+		ids:   []string{"f", "g"},
+		index: 5,
+		out:   `<set xmlns="http://jabber.org/protocol/rsm"><first index="5">f</first><last>g</last><count>7</count></set>`,
+	},
+	6: {
+		req:   `<max>3</max><index>5</index>`,
+		ids:   []string{"f", "g"},
+		index: 5,
+		out:   `<set xmlns="http://jabber.org/protocol/rsm"><first index="5">f</first><last>g</last><count>7</count></set>`,
+	},
+	7: {
+		req: `<max>0</max>`,
+		out: `<set xmlns="http://jabber.org/protocol/rsm"><count>7</count></set>`,
+	},
+	8: {
+		req: `<after>g</after>`,
+		out: `<set xmlns="http://jabber.org/protocol/rsm"><count>7</count></set>`,
+	},
+	9: {
+		req: `<after>z</after>`,
+		err: stanza.ItemNotFound,
+	},
+	10: {
+		req: `<before>z</before>`,
+		err: stanza.ItemNotFound,
+	},
+}
+
+func TestRespond(t *testing.T) {
+	for i, tc := range respondTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var req *paging.Request
+			if tc.req != "" {
+				d := xml.NewDecoder(strings.NewReader(`<query><set xmlns="http://jabber.org/protocol/rsm">` + tc.req + `</set></query>`))
+				_, err := d.Token()
+				if err != nil {
+					t.Fatalf("error popping query token: %v", err)
+				}
+				req, err = paging.ParseRequest(d)
+				if err != nil {
+					t.Fatalf("error parsing request: %v", err)
+				}
+				if req == nil {
+					t.Fatalf("did not find request")
+				}
+			}
+			page, err := paging.Respond(letters("abcdefg"), req, tc.max)
+			if tc.err != "" {
+				var se stanza.Error
+				if !errors.As(err, &se) || se.Condition != tc.err {
+					t.Fatalf("wrong error: want=%v, got=%v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(page.IDs, tc.ids) {
+				t.Errorf("wrong page: want=%v, got=%v", tc.ids, page.IDs)
+			}
+			if len(tc.ids) > 0 && (page.Set.First.Index == nil || *page.Set.First.Index != tc.index) {
+				t.Errorf("wrong first index: want=%d, got=%v", tc.index, page.Set.First.Index)
+			}
+			var buf bytes.Buffer
+			e := xml.NewEncoder(&buf)
+			_, err = page.WriteXML(e)
+			if err != nil {
+				t.Fatalf("error encoding page: %v", err)
+			}
+			err = e.Flush()
+			if err != nil {
+				t.Fatalf("error flushing: %v", err)
+			}
+			if out := buf.String(); out != tc.out {
+				t.Errorf("wrong output:\nwant=%s,\n got=%s", tc.out, out)
+			}
+		})
+	}
+}
+
+func TestParseRequestMissing(t *testing.T) {
+	d := xml.NewDecoder(strings.NewReader(`<query><foo/></query>`))
+	_, err := d.Token()
+	if err != nil {
+		t.Fatalf("error popping query token: %v", err)
+	}
+	req, err := paging.ParseRequest(d)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if req != nil {
+		t.Errorf("expected no request, got %+v", req)
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package presence tracks the availability of other entities.
+//
+// A Tracker records the most recent available presence sent by each resource
+// so that clients do not have to keep their own map of contacts to resources.
+// It can also be used to pick the most appropriate resource to send a stanza
+// to when only a bare JID is known.
+package presence // import "mellium.im/xmpp/presence"
+
+import (
+	"encoding/xml"
+	"sort"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/delay"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// Values of the show element that indicate the availability of a resource in
+// more detail.
+// An empty value means that the resource is online and available.
+const (
+	ShowAway = "away"
+	ShowChat = "chat"
+	ShowDND  = "dnd"
+	ShowXA   = "xa"
+)
+
+// Resource is the last available presence received from a full JID.
+type Resource struct {
+	JID      jid.JID
+	Show     string
+	Status   string
+	Priority int8
+	Caps     disco.Caps
+
+	// Time is the time the presence was sent, taken from any delay element on
+	// the presence or the time it was received if there was none.
+	Time time.Time
+}
+
+// Change is a change in the availability of a resource.
+type Change struct {
+	// Available is false if the resource has gone offline.
+	Available bool
+
+	// Resource is the new state of the resource.
+	// If it is no longer available only the JID, status, and time are set.
+	Resource Resource
+
+	// Prev is the state of the resource before the change.
+	// If the resource was not previously available it is the zero value.
+	Prev Resource
+}
+
+// Handle returns an option that registers a Tracker for available and
+// unavailable presence.
+func Handle(t *Tracker) mux.Option {
+	return func(m *mux.ServeMux) {
+		mux.Presence("", xml.Name{}, t)(m)
+		mux.Presence(stanza.UnavailablePresence, xml.Name{}, t)(m)
+	}
+}
+
+type watcher struct {
+	j jid.JID
+	f func(Change)
+}
+
+// Tracker records the availability of the resources of other entities.
+// The zero value is ready to use.
+type Tracker struct {
+	m        sync.Mutex
+	entities map[string]map[string]Resource
+	watchers map[int]watcher
+	nextID   int
+}
+
+// HandlePresence implements mux.PresenceHandler.
+func (t *Tracker) HandlePresence(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+	var v struct {
+		stanza.Presence
+		Show     string       `xml:"show"`
+		Status   string       `xml:"status"`
+		Priority int8         `xml:"priority"`
+		Caps     *disco.Caps  `xml:"http://jabber.org/protocol/caps c"`
+		Delay    *delay.Delay `xml:"urn:xmpp:delay delay"`
+	}
+	err := xml.NewTokenDecoder(r).Decode(&v)
+	if err != nil {
+		return err
+	}
+	res := Resource{
+		JID:      p.From,
+		Show:     v.Show,
+		Status:   v.Status,
+		Priority: v.Priority,
+		Time:     time.Now(),
+	}
+	if v.Caps != nil {
+		res.Caps = *v.Caps
+	}
+	if v.Delay != nil && !v.Delay.Time.IsZero() {
+		res.Time = v.Delay.Time
+	}
+
+	switch p.Type {
+	case "":
+		t.Set(res)
+	case stanza.UnavailablePresence:
+		t.remove(res)
+	}
+	return nil
+}
+
+// Set records that the resource is available and notifies any watchers if its
+// state has changed.
+func (t *Tracker) Set(res Resource) {
+	t.m.Lock()
+	if t.entities == nil {
+		t.entities = make(map[string]map[string]Resource)
+	}
+	bare := res.JID.Bare().String()
+	resources, ok := t.entities[bare]
+	if !ok {
+		resources = make(map[string]Resource)
+		t.entities[bare] = resources
+	}
+	key := res.JID.String()
+	prev, ok := resources[key]
+	resources[key] = res
+	t.m.Unlock()
+
+	// The multiplexer may pass the same presence to the tracker once for each of
+	// its children, so only report changes to the state of the resource.
+	if ok && same(prev, res) {
+		return
+	}
+	t.emit(Change{Available: true, Resource: res, Prev: prev})
+}
+
+// Unavailable records that the resource is no longer available.
+// If j is a bare JID all of its resources are marked as unavailable.
+func (t *Tracker) Unavailable(j jid.JID) {
+	t.remove(Resource{JID: j, Time: time.Now()})
+}
+
+func (t *Tracker) remove(res Resource) {
+	t.m.Lock()
+	bare := res.JID.Bare().String()
+	resources := t.entities[bare]
+	var changes []Change
+	for key, prev := range resources {
+		if res.JID.Resourcepart() != "" && key != res.JID.String() {
+			continue
+		}
+		delete(resources, key)
+		gone := res
+		gone.JID = prev.JID
+		changes = append(changes, Change{Resource: gone, Prev: prev})
+	}
+	if len(resources) == 0 {
+		delete(t.entities, bare)
+	}
+	t.m.Unlock()
+
+	for _, c := range changes {
+		t.emit(c)
+	}
+}
+
+// Clear forgets all resources without notifying any watchers.
+// It should be called when the session ends since any presence will be
+// resent after the session is reestablished.
+func (t *Tracker) Clear() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.entities = nil
+}
+
+// Resources returns the available resources of the bare JID of j, ordered from
+// the most to the least appropriate resource to send stanzas to.
+func (t *Tracker) Resources(j jid.JID) []Resource {
+	t.m.Lock()
+	resources := t.entities[j.Bare().String()]
+	list := make([]Resource, 0, len(resources))
+	for _, res := range resources {
+		list = append(list, res)
+	}
+	t.m.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return better(list[i], list[j])
+	})
+	return list
+}
+
+// Resource returns the state of the full JID j if it is available.
+func (t *Tracker) Resource(j jid.JID) (Resource, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	res, ok := t.entities[j.Bare().String()][j.String()]
+	return res, ok
+}
+
+// Available reports whether j is available.
+// If j is a bare JID it reports whether any of its resources are available.
+func (t *Tracker) Available(j jid.JID) bool {
+	if j.Resourcepart() != "" {
+		_, ok := t.Resource(j)
+		return ok
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	return len(t.entities[j.Bare().String()]) > 0
+}
+
+// Best returns the most appropriate resource of the bare JID of j to send
+// stanzas to.
+// Resources with the highest priority are preferred, followed by the resource
+// that most recently sent presence.
+// Resources with a negative priority are never returned.
+func (t *Tracker) Best(j jid.JID) (Resource, bool) {
+	resources := t.Resources(j)
+	if len(resources) == 0 || resources[0].Priority < 0 {
+		return Resource{}, false
+	}
+	return resources[0], true
+}
+
+// Route returns the address that a stanza for j should be sent to.
+// If j is a full JID that is available it is returned unchanged, otherwise the
+// best resource of the bare JID is returned.
+// If no suitable resource is available, ok is false and the bare JID is
+// returned.
+func (t *Tracker) Route(j jid.JID) (to jid.JID, ok bool) {
+	if j.Resourcepart() != "" && t.Available(j) {
+		return j, true
+	}
+	res, ok := t.Best(j)
+	if !ok {
+		return j.Bare(), false
+	}
+	return res.JID, true
+}
+
+// Watch calls f for each change to the availability of the bare JID of j, or
+// for changes to any entity if j is the zero value.
+// The returned function stops any future calls to f.
+func (t *Tracker) Watch(j jid.JID, f func(Change)) (cancel func()) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.watchers == nil {
+		t.watchers = make(map[int]watcher)
+	}
+	id := t.nextID
+	t.nextID++
+	t.watchers[id] = watcher{j: j.Bare(), f: f}
+	return func() {
+		t.m.Lock()
+		defer t.m.Unlock()
+		delete(t.watchers, id)
+	}
+}
+
+func (t *Tracker) emit(c Change) {
+	t.m.Lock()
+	var fs []func(Change)
+	for _, w := range t.watchers {
+		if w.j.Equal(jid.JID{}) || w.j.Equal(c.Resource.JID.Bare()) {
+			fs = append(fs, w.f)
+		}
+	}
+	t.m.Unlock()
+	for _, f := range fs {
+		f(c)
+	}
+}
+
+// better reports whether a is more appropriate to send stanzas to than b.
+func better(a, b Resource) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if !a.Time.Equal(b.Time) {
+		return a.Time.After(b.Time)
+	}
+	return a.JID.String() < b.JID.String()
+}
+
+// same reports whether two presences from a resource have the same state,
+// ignoring the time they were sent.
+func same(a, b Resource) bool {
+	return a.JID.Equal(b.JID) && a.Show == b.Show && a.Status == b.Status &&
+		a.Priority == b.Priority && a.Caps == b.Caps
+}
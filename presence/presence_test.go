@@ -0,0 +1,121 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package presence_test
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/presence"
+	"mellium.im/xmpp/stanza"
+)
+
+func handle(t *testing.T, m *mux.ServeMux, in string) {
+	t.Helper()
+	d := xml.NewDecoder(strings.NewReader(in))
+	tok, err := d.Token()
+	if err != nil {
+		t.Fatalf("error decoding presence: %v", err)
+	}
+	start := tok.(xml.StartElement)
+	var b strings.Builder
+	err = m.HandleXMPP(struct {
+		xml.TokenReader
+		xmlstream.Encoder
+	}{
+		TokenReader: d,
+		Encoder:     xml.NewEncoder(&b),
+	}, &start)
+	if err != nil {
+		t.Fatalf("error handling presence: %v", err)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tracker := &presence.Tracker{}
+	m := mux.New(stanza.NSClient, presence.Handle(tracker))
+	juliet := jid.MustParse("juliet@example.com")
+	balcony := jid.MustParse("juliet@example.com/balcony")
+	chamber := jid.MustParse("juliet@example.com/chamber")
+
+	var changes []presence.Change
+	cancel := tracker.Watch(juliet, func(c presence.Change) {
+		changes = append(changes, c)
+	})
+	var other int
+	tracker.Watch(jid.MustParse("romeo@example.net"), func(presence.Change) {
+		other++
+	})
+
+	if _, ok := tracker.Route(juliet); ok {
+		t.Errorf("did not expect a route before any presence is received")
+	}
+
+	handle(t, m, `<presence xmlns="jabber:client" from="juliet@example.com/balcony"><show>away</show><status>Gone</status><priority>1</priority><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="https://example.com" ver="abc"/><delay xmlns="urn:xmpp:delay" stamp="2002-09-10T23:41:07Z"/></presence>`)
+	if len(changes) != 1 {
+		t.Fatalf("wrong number of changes: want=1, got=%d", len(changes))
+	}
+	res, ok := tracker.Resource(balcony)
+	if !ok {
+		t.Fatalf("resource not recorded")
+	}
+	want := time.Date(2002, 9, 10, 23, 41, 7, 0, time.UTC)
+	if res.Show != presence.ShowAway || res.Status != "Gone" || res.Priority != 1 || res.Caps.Ver != "abc" || !res.Time.Equal(want) {
+		t.Errorf("wrong resource state: %+v", res)
+	}
+
+	handle(t, m, `<presence xmlns="jabber:client" from="juliet@example.com/chamber"><priority>1</priority></presence>`)
+	if to, ok := tracker.Route(juliet); !ok || !to.Equal(chamber) {
+		t.Errorf("most recent resource should be preferred at equal priority, got %s", to)
+	}
+	handle(t, m, `<presence xmlns="jabber:client" from="juliet@example.com/balcony"><priority>5</priority></presence>`)
+	if to, ok := tracker.Route(juliet); !ok || !to.Equal(balcony) {
+		t.Errorf("highest priority resource should be preferred, got %s", to)
+	}
+	if to, _ := tracker.Route(chamber); !to.Equal(chamber) {
+		t.Errorf("available full JID should be routed to directly, got %s", to)
+	}
+	if n := len(tracker.Resources(juliet)); n != 2 {
+		t.Errorf("wrong number of resources: want=2, got=%d", n)
+	}
+
+	handle(t, m, `<presence xmlns="jabber:client" from="juliet@example.com/balcony" type="unavailable"><status>Bye</status></presence>`)
+	if tracker.Available(balcony) {
+		t.Errorf("resource still available after unavailable presence")
+	}
+	if c := changes[len(changes)-1]; c.Available || c.Resource.Status != "Bye" || c.Prev.Priority != 5 {
+		t.Errorf("wrong change for unavailable presence: %+v", c)
+	}
+
+	// Negative priority resources are never picked.
+	handle(t, m, `<presence xmlns="jabber:client" from="juliet@example.com/chamber"><priority>-1</priority></presence>`)
+	if to, ok := tracker.Route(balcony); ok || !to.Equal(juliet) {
+		t.Errorf("negative priority resource should not be routed to, got %s", to)
+	}
+	if !tracker.Available(juliet) {
+		t.Errorf("bare JID should be available")
+	}
+
+	if len(changes) != 5 {
+		t.Errorf("wrong number of changes: want=5, got=%d", len(changes))
+	}
+	if other != 0 {
+		t.Errorf("watcher called for changes to another entity")
+	}
+
+	cancel()
+	tracker.Unavailable(juliet)
+	if tracker.Available(juliet) {
+		t.Errorf("bare JID still available after all resources went offline")
+	}
+	if len(changes) != 5 {
+		t.Errorf("cancelled watcher was called")
+	}
+}
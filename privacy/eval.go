@@ -0,0 +1,150 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package privacy
+
+import (
+	"encoding/xml"
+	"sort"
+
+	"mellium.im/xmpp/blocklist"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/stanza"
+)
+
+// StanzaKind returns the kind of the stanza starting with start for the
+// purpose of evaluating privacy lists.
+// Inbound is true if the stanza is being delivered to the user and false if it
+// was sent by the user.
+// Stanzas that are not covered by a more specific kind (for example, outbound
+// messages or subscription requests) result in an empty Kind and are only
+// matched by items that apply to all stanzas.
+func StanzaKind(start xml.StartElement, inbound bool) Kind {
+	switch start.Name.Local {
+	case "message":
+		if inbound {
+			return KindMessage
+		}
+	case "iq":
+		if inbound {
+			return KindIQ
+		}
+	case "presence":
+		_, typ := attr.Get(start.Attr, "type")
+		if typ != "" && typ != string(stanza.UnavailablePresence) {
+			return ""
+		}
+		if inbound {
+			return KindPresenceIn
+		}
+		return KindPresenceOut
+	}
+	return ""
+}
+
+// Allowed reports whether a stanza of the provided kind may be exchanged with
+// j.
+// Contact is the item for the bare JID of j in the user's roster, or the zero
+// value if j is not in the roster, and is used to evaluate group and
+// subscription items.
+//
+// Items are evaluated in order and the action of the first matching item is
+// used.
+// If no item matches, the stanza is allowed.
+func (l List) Allowed(kind Kind, j jid.JID, contact roster.Item) bool {
+	items := make([]Item, len(l.Items))
+	copy(items, l.Items)
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Order < items[j].Order
+	})
+	for _, item := range items {
+		if item.applies(kind) && item.matches(j, contact) {
+			return item.Action != ActionDeny
+		}
+	}
+	return true
+}
+
+func (item Item) applies(kind Kind) bool {
+	if len(item.Stanzas) == 0 {
+		return true
+	}
+	if kind == "" {
+		return false
+	}
+	for _, k := range item.Stanzas {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (item Item) matches(j jid.JID, contact roster.Item) bool {
+	switch item.Type {
+	case "":
+		return true
+	case TypeJID:
+		v, err := jid.Parse(item.Value)
+		if err != nil {
+			return false
+		}
+		return blocklist.Match(j, v)
+	case TypeGroup:
+		for _, g := range contact.Group {
+			if g == item.Value {
+				return true
+			}
+		}
+		return false
+	case TypeSubscription:
+		sub := contact.Subscription
+		if sub == "" {
+			sub = "none"
+		}
+		return sub == item.Value
+	}
+	return false
+}
+
+// FromBlocklist returns a privacy list that blocks all communication with each
+// of the blocked items.
+func FromBlocklist(name string, items []blocklist.Item) List {
+	l := List{Name: name}
+	for i, item := range items {
+		l.Items = append(l.Items, Item{
+			Type:   TypeJID,
+			Value:  item.JID.String(),
+			Action: ActionDeny,
+			Order:  uint(i + 1),
+		})
+	}
+	return l
+}
+
+// Blocklist returns the JIDs that the privacy list blocks all communication
+// with as blocklist items.
+// Items that only block some kinds of stanza or that match groups or
+// subscription states cannot be represented in a blocklist and are ignored.
+func (l List) Blocklist() []blocklist.Item {
+	items := make([]Item, len(l.Items))
+	copy(items, l.Items)
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Order < items[j].Order
+	})
+	var blocked []blocklist.Item
+	for _, item := range items {
+		if item.Type != TypeJID || item.Action != ActionDeny || len(item.Stanzas) > 0 {
+			continue
+		}
+		j, err := jid.Parse(item.Value)
+		if err != nil {
+			continue
+		}
+		blocked = append(blocked, blocklist.Item{JID: j})
+	}
+	return blocked
+}
@@ -0,0 +1,323 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package privacy implements XEP-0016: Privacy Lists.
+//
+// Privacy lists have largely been replaced by the simpler blocking command
+// implemented in the blocklist package, but they are still used by some
+// servers and older clients.
+// This package provides functions for managing privacy lists, an evaluator
+// that can be used by servers to enforce them, and conversion to and from
+// blocklist items.
+package privacy // import "mellium.im/xmpp/privacy"
+
+import (
+	"context"
+	"encoding/xml"
+	"strconv"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the namespace used by this package.
+const NS = "jabber:iq:privacy"
+
+// Types of item that determine what the value of the item is matched against.
+// Items without a type match every entity.
+const (
+	TypeJID          = "jid"
+	TypeGroup        = "group"
+	TypeSubscription = "subscription"
+)
+
+// Actions that may be taken when an item matches.
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// Kind is a kind of stanza that an item may apply to.
+type Kind string
+
+// A list of the kinds of stanza that items may be restricted to.
+const (
+	// KindMessage matches inbound messages.
+	KindMessage Kind = "message"
+
+	// KindIQ matches inbound IQs.
+	KindIQ Kind = "iq"
+
+	// KindPresenceIn matches inbound presence notifications.
+	KindPresenceIn Kind = "presence-in"
+
+	// KindPresenceOut matches outbound presence notifications.
+	KindPresenceOut Kind = "presence-out"
+)
+
+// Item is a rule in a privacy list.
+type Item struct {
+	// Type is one of TypeJID, TypeGroup, or TypeSubscription.
+	// If it is empty the item matches every entity.
+	Type  string
+	Value string
+
+	// Action is either ActionAllow or ActionDeny.
+	Action string
+
+	// Order determines the order in which items are evaluated, from lowest to
+	// highest.
+	// It must be unique within a list.
+	Order uint
+
+	// Stanzas is the kinds of stanza that the item applies to.
+	// If it is empty the item applies to all stanzas.
+	Stanzas []Kind
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (item Item) TokenReader() xml.TokenReader {
+	var attrs []xml.Attr
+	if item.Type != "" {
+		attrs = append(attrs,
+			xml.Attr{Name: xml.Name{Local: "type"}, Value: item.Type},
+			xml.Attr{Name: xml.Name{Local: "value"}, Value: item.Value},
+		)
+	}
+	attrs = append(attrs,
+		xml.Attr{Name: xml.Name{Local: "action"}, Value: item.Action},
+		xml.Attr{Name: xml.Name{Local: "order"}, Value: strconv.FormatUint(uint64(item.Order), 10)},
+	)
+	var children []xml.TokenReader
+	for _, k := range item.Stanzas {
+		children = append(children, xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: string(k)}}))
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(children...),
+		xml.StartElement{Name: xml.Name{Local: "item"}, Attr: attrs},
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (item Item) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, item.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (item Item) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := item.WriteXML(e)
+	if err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (item *Item) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		switch attr.Name.Local {
+		case "type":
+			item.Type = attr.Value
+		case "value":
+			item.Value = attr.Value
+		case "action":
+			item.Action = attr.Value
+		case "order":
+			order, err := strconv.ParseUint(attr.Value, 10, 0)
+			if err != nil {
+				return err
+			}
+			item.Order = uint(order)
+		}
+	}
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			item.Stanzas = append(item.Stanzas, Kind(t.Name.Local))
+			err = d.Skip()
+			if err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// List is a named privacy list.
+type List struct {
+	Name  string `xml:"name,attr"`
+	Items []Item `xml:"item"`
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (l List) TokenReader() xml.TokenReader {
+	var items []xml.TokenReader
+	for _, item := range l.Items {
+		items = append(items, item.TokenReader())
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(items...),
+		xml.StartElement{
+			Name: xml.Name{Local: "list"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: l.Name}},
+		},
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (l List) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, l.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (l List) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := l.WriteXML(e)
+	if err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// Lists is a summary of the user's privacy lists.
+type Lists struct {
+	// Active is the name of the list that is active for the current session.
+	Active string
+
+	// Default is the name of the list that applies when no list is active.
+	Default string
+
+	// Names contains the names of all privacy lists.
+	Names []string
+}
+
+type listName struct {
+	Name string `xml:"name,attr"`
+}
+
+type query struct {
+	XMLName xml.Name  `xml:"jabber:iq:privacy query"`
+	Active  *listName `xml:"active"`
+	Default *listName `xml:"default"`
+	Lists   []List    `xml:"list"`
+}
+
+func wrapQuery(inner xml.TokenReader) xml.TokenReader {
+	return xmlstream.Wrap(inner, xml.StartElement{Name: xml.Name{Space: NS, Local: "query"}})
+}
+
+func named(local, name string) xml.TokenReader {
+	start := xml.StartElement{Name: xml.Name{Local: local}}
+	if name != "" {
+		start.Attr = []xml.Attr{{Name: xml.Name{Local: "name"}, Value: name}}
+	}
+	return xmlstream.Wrap(nil, start)
+}
+
+// Fetch returns the names of the user's privacy lists and which lists are
+// active and the default.
+func Fetch(ctx context.Context, s *xmpp.Session) (Lists, error) {
+	return FetchIQ(ctx, stanza.IQ{}, s)
+}
+
+// FetchIQ is like Fetch but it allows you to customize the IQ.
+// Changing the type of the provided IQ has no effect.
+func FetchIQ(ctx context.Context, iq stanza.IQ, s *xmpp.Session) (Lists, error) {
+	iq.Type = stanza.GetIQ
+	var q query
+	err := s.UnmarshalIQ(ctx, iq.Wrap(wrapQuery(nil)), &q)
+	if err != nil {
+		return Lists{}, err
+	}
+	var lists Lists
+	if q.Active != nil {
+		lists.Active = q.Active.Name
+	}
+	if q.Default != nil {
+		lists.Default = q.Default.Name
+	}
+	for _, l := range q.Lists {
+		lists.Names = append(lists.Names, l.Name)
+	}
+	return lists, nil
+}
+
+// FetchList returns the privacy list with the provided name.
+func FetchList(ctx context.Context, s *xmpp.Session, name string) (List, error) {
+	return FetchListIQ(ctx, stanza.IQ{}, s, name)
+}
+
+// FetchListIQ is like FetchList but it allows you to customize the IQ.
+// Changing the type of the provided IQ has no effect.
+func FetchListIQ(ctx context.Context, iq stanza.IQ, s *xmpp.Session, name string) (List, error) {
+	iq.Type = stanza.GetIQ
+	var q query
+	err := s.UnmarshalIQ(ctx, iq.Wrap(wrapQuery(named("list", name))), &q)
+	if err != nil {
+		return List{}, err
+	}
+	for _, l := range q.Lists {
+		if l.Name == name {
+			return l, nil
+		}
+	}
+	return List{Name: name}, nil
+}
+
+// SetList creates or replaces a privacy list.
+// Setting a list with no items deletes it.
+func SetList(ctx context.Context, s *xmpp.Session, l List) error {
+	return SetListIQ(ctx, stanza.IQ{}, s, l)
+}
+
+// SetListIQ is like SetList but it allows you to customize the IQ.
+// Changing the type of the provided IQ has no effect.
+func SetListIQ(ctx context.Context, iq stanza.IQ, s *xmpp.Session, l List) error {
+	iq.Type = stanza.SetIQ
+	return s.UnmarshalIQ(ctx, iq.Wrap(wrapQuery(l.TokenReader())), nil)
+}
+
+// DeleteList removes the privacy list with the provided name.
+func DeleteList(ctx context.Context, s *xmpp.Session, name string) error {
+	return SetListIQ(ctx, stanza.IQ{}, s, List{Name: name})
+}
+
+// DeleteListIQ is like DeleteList but it allows you to customize the IQ.
+// Changing the type of the provided IQ has no effect.
+func DeleteListIQ(ctx context.Context, iq stanza.IQ, s *xmpp.Session, name string) error {
+	return SetListIQ(ctx, iq, s, List{Name: name})
+}
+
+// Activate makes the named list the active list for the current session.
+// If name is empty, the active list is declined and the default list applies.
+func Activate(ctx context.Context, s *xmpp.Session, name string) error {
+	return ActivateIQ(ctx, stanza.IQ{}, s, name)
+}
+
+// ActivateIQ is like Activate but it allows you to customize the IQ.
+// Changing the type of the provided IQ has no effect.
+func ActivateIQ(ctx context.Context, iq stanza.IQ, s *xmpp.Session, name string) error {
+	iq.Type = stanza.SetIQ
+	return s.UnmarshalIQ(ctx, iq.Wrap(wrapQuery(named("active", name))), nil)
+}
+
+// SetDefault makes the named list the default list for all of the user's
+// sessions.
+// If name is empty, the default list is declined and no list applies unless
+// one has been activated.
+func SetDefault(ctx context.Context, s *xmpp.Session, name string) error {
+	return SetDefaultIQ(ctx, stanza.IQ{}, s, name)
+}
+
+// SetDefaultIQ is like SetDefault but it allows you to customize the IQ.
+// Changing the type of the provided IQ has no effect.
+func SetDefaultIQ(ctx context.Context, iq stanza.IQ, s *xmpp.Session, name string) error {
+	iq.Type = stanza.SetIQ
+	return s.UnmarshalIQ(ctx, iq.Wrap(wrapQuery(named("default", name))), nil)
+}
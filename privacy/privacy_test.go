@@ -0,0 +1,233 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package privacy_test
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/blocklist"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/privacy"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/stanza"
+)
+
+var publicList = privacy.List{
+	Name: "public",
+	Items: []privacy.Item{{
+		Type:   privacy.TypeSubscription,
+		Value:  "none",
+		Action: privacy.ActionDeny,
+		Order:  3,
+	}, {
+		Type:   privacy.TypeJID,
+		Value:  "tybalt@example.com",
+		Action: privacy.ActionDeny,
+		Order:  1,
+	}, {
+		Type:    privacy.TypeGroup,
+		Value:   "Friends",
+		Action:  privacy.ActionAllow,
+		Order:   2,
+		Stanzas: []privacy.Kind{privacy.KindMessage, privacy.KindPresenceIn},
+	}, {
+		Type:    privacy.TypeGroup,
+		Value:   "Friends",
+		Action:  privacy.ActionDeny,
+		Order:   4,
+		Stanzas: []privacy.Kind{privacy.KindIQ},
+	}},
+}
+
+func TestMarshal(t *testing.T) {
+	var b strings.Builder
+	err := xml.NewEncoder(&b).Encode(publicList)
+	if err != nil {
+		t.Fatalf("error marshaling: %v", err)
+	}
+	const want = `<list name="public"><item type="subscription" value="none" action="deny" order="3"></item><item type="jid" value="tybalt@example.com" action="deny" order="1"></item><item type="group" value="Friends" action="allow" order="2"><message></message><presence-in></presence-in></item><item type="group" value="Friends" action="deny" order="4"><iq></iq></item></list>`
+	if out := b.String(); out != want {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", want, out)
+	}
+	var l privacy.List
+	err = xml.Unmarshal([]byte(b.String()), &l)
+	if err != nil {
+		t.Fatalf("error unmarshaling: %v", err)
+	}
+	if !reflect.DeepEqual(l, publicList) {
+		t.Errorf("wrong round trip:\nwant=%+v,\n got=%+v", publicList, l)
+	}
+}
+
+var allowedTests = [...]struct {
+	kind    privacy.Kind
+	j       string
+	contact roster.Item
+	allowed bool
+}{
+	0: {kind: privacy.KindMessage, j: "tybalt@example.com/street", contact: roster.Item{Group: []string{"Friends"}, Subscription: "both"}},
+	1: {kind: privacy.KindMessage, j: "mercutio@example.com", contact: roster.Item{Group: []string{"Friends"}}, allowed: true},
+	2: {kind: privacy.KindMessage, j: "paris@example.com"},
+	3: {kind: privacy.KindIQ, j: "mercutio@example.com", contact: roster.Item{Group: []string{"Friends"}, Subscription: "both"}},
+	4: {kind: privacy.KindPresenceOut, j: "nurse@example.com", contact: roster.Item{Subscription: "from"}, allowed: true},
+	5: {kind: "", j: "mercutio@example.com", contact: roster.Item{Group: []string{"Friends"}}},
+}
+
+func TestAllowed(t *testing.T) {
+	for i, tc := range allowedTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			allowed := publicList.Allowed(tc.kind, jid.MustParse(tc.j), tc.contact)
+			if allowed != tc.allowed {
+				t.Errorf("wrong result: want=%t, got=%t", tc.allowed, allowed)
+			}
+		})
+	}
+}
+
+var kindTests = [...]struct {
+	in      string
+	inbound bool
+	kind    privacy.Kind
+}{
+	0: {in: `<message/>`, inbound: true, kind: privacy.KindMessage},
+	1: {in: `<message/>`},
+	2: {in: `<iq type="get"/>`, inbound: true, kind: privacy.KindIQ},
+	3: {in: `<presence/>`, inbound: true, kind: privacy.KindPresenceIn},
+	4: {in: `<presence type="unavailable"/>`, kind: privacy.KindPresenceOut},
+	5: {in: `<presence type="subscribe"/>`, inbound: true},
+}
+
+func TestStanzaKind(t *testing.T) {
+	for i, tc := range kindTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			tok, err := xml.NewDecoder(strings.NewReader(tc.in)).Token()
+			if err != nil {
+				t.Fatalf("error decoding: %v", err)
+			}
+			if kind := privacy.StanzaKind(tok.(xml.StartElement), tc.inbound); kind != tc.kind {
+				t.Errorf("wrong kind: want=%q, got=%q", tc.kind, kind)
+			}
+		})
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	items := []blocklist.Item{
+		{JID: jid.MustParse("tybalt@example.com")},
+		{JID: jid.MustParse("capulet.example")},
+	}
+	l := privacy.FromBlocklist("blocked", items)
+	if l.Allowed(privacy.KindMessage, jid.MustParse("paris@capulet.example"), roster.Item{}) {
+		t.Errorf("expected messages from a blocked domain to be denied")
+	}
+	if !l.Allowed(privacy.KindMessage, jid.MustParse("juliet@example.com"), roster.Item{}) {
+		t.Errorf("expected messages from an unblocked JID to be allowed")
+	}
+	if out := l.Blocklist(); !reflect.DeepEqual(out, items) {
+		t.Errorf("wrong round trip: want=%v, got=%v", items, out)
+	}
+	if out, want := publicList.Blocklist(), []blocklist.Item{{JID: jid.MustParse("tybalt@example.com")}}; !reflect.DeepEqual(out, want) {
+		t.Errorf("wrong blocklist: want=%v, got=%v", want, out)
+	}
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	var reqs []string
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandler(mux.New(stanza.NSClient,
+			mux.IQFunc(stanza.GetIQ, xml.Name{Space: privacy.NS, Local: "query"}, func(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+				tok, err := r.Token()
+				if err != nil {
+					return err
+				}
+				child, ok := tok.(xml.StartElement)
+				if !ok {
+					_, err = xmlstream.Copy(r, iq.Result(xmlstream.Wrap(
+						xmlstream.MultiReader(
+							xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "active"}, Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: "public"}}}),
+							xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "default"}}),
+							xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "list"}, Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: "public"}}}),
+							xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "list"}, Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: "private"}}}),
+						),
+						*start,
+					)))
+					return err
+				}
+				reqs = append(reqs, "get:"+child.Attr[0].Value)
+				_, err = xmlstream.Copy(r, iq.Result(xmlstream.Wrap(publicList.TokenReader(), *start)))
+				return err
+			}),
+			mux.IQFunc(stanza.SetIQ, xml.Name{Space: privacy.NS, Local: "query"}, func(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+				tok, err := r.Token()
+				if err != nil {
+					return err
+				}
+				child := tok.(xml.StartElement)
+				var name string
+				if len(child.Attr) > 0 {
+					name = child.Attr[0].Value
+				}
+				var n int
+				for {
+					tok, err := r.Token()
+					if err != nil {
+						return err
+					}
+					if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "item" {
+						n++
+					}
+					if ee, ok := tok.(xml.EndElement); ok && ee.Name == child.Name {
+						break
+					}
+				}
+				reqs = append(reqs, child.Name.Local+":"+name+":"+strconv.Itoa(n))
+				_, err = xmlstream.Copy(r, iq.Result(nil))
+				return err
+			}),
+		)),
+	)
+	defer cs.Close()
+
+	lists, err := privacy.Fetch(ctx, cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching lists: %v", err)
+	}
+	if want := (privacy.Lists{Active: "public", Names: []string{"public", "private"}}); !reflect.DeepEqual(lists, want) {
+		t.Errorf("wrong lists: want=%+v, got=%+v", want, lists)
+	}
+	l, err := privacy.FetchList(ctx, cs.Client, "public")
+	if err != nil {
+		t.Fatalf("error fetching list: %v", err)
+	}
+	if !reflect.DeepEqual(l, publicList) {
+		t.Errorf("wrong list:\nwant=%+v,\n got=%+v", publicList, l)
+	}
+
+	for _, f := range []func() error{
+		func() error { return privacy.SetList(ctx, cs.Client, publicList) },
+		func() error { return privacy.DeleteList(ctx, cs.Client, "private") },
+		func() error { return privacy.Activate(ctx, cs.Client, "public") },
+		func() error { return privacy.Activate(ctx, cs.Client, "") },
+		func() error { return privacy.SetDefault(ctx, cs.Client, "public") },
+	} {
+		err = f()
+		if err != nil {
+			t.Fatalf("error sending request: %v", err)
+		}
+	}
+	want := []string{"get:public", "list:public:4", "list:private:0", "active:public:0", "active::0", "default:public:0"}
+	if !reflect.DeepEqual(reqs, want) {
+		t.Errorf("wrong requests:\nwant=%v,\n got=%v", want, reqs)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// Form fields used in subscription authorization requests.
+const (
+	fieldSubID      = "pubsub#subid"
+	fieldNode       = "pubsub#node"
+	fieldSubscriber = "pubsub#subscriber_jid"
+	fieldAllow      = "pubsub#allow"
+)
+
+// AuthRequest is a request sent by the service to a node owner asking them to
+// approve or deny a pending subscription.
+type AuthRequest struct {
+	Node  string
+	SubID string
+	Addr  jid.JID
+}
+
+// HandleAuth returns an option that registers a handler for subscription
+// authorization requests.
+// Forms that are not subscription authorization requests are ignored.
+//
+// Because the request arrives as a data form in a normal message, the option
+// registers a handler for all data forms in normal messages and should not be
+// used with other handlers for the same payload.
+func HandleAuth(f func(stanza.Message, AuthRequest) error) mux.Option {
+	return mux.MessageFunc(stanza.NormalMessage, xml.Name{Space: form.NS, Local: "x"}, func(msg stanza.Message, r xmlstream.TokenReadEncoder) error {
+		// Pop the message start token.
+		_, err := r.Token()
+		if err != nil {
+			return err
+		}
+		iter := xmlstream.NewIter(r)
+		/* #nosec */
+		defer iter.Close()
+		for iter.Next() {
+			start, child := iter.Current()
+			if start == nil || start.Name.Space != form.NS || start.Name.Local != "x" {
+				continue
+			}
+			data := &form.Data{}
+			err = xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), child)).Decode(data)
+			if err != nil {
+				return err
+			}
+			if v, _ := data.Raw("FORM_TYPE"); len(v) == 0 || v[0] != NSSubAuth {
+				continue
+			}
+			req := AuthRequest{}
+			if v, _ := data.Raw(fieldNode); len(v) > 0 {
+				req.Node = v[0]
+			}
+			if v, _ := data.Raw(fieldSubID); len(v) > 0 {
+				req.SubID = v[0]
+			}
+			if v, _ := data.Raw(fieldSubscriber); len(v) > 0 {
+				req.Addr, err = jid.Parse(v[0])
+				if err != nil {
+					return err
+				}
+			}
+			return f(msg, req)
+		}
+		return iter.Err()
+	})
+}
+
+// Approve responds to a subscription authorization request received from the
+// service at the provided address.
+// If allow is false, the subscription is denied.
+func Approve(ctx context.Context, s *xmpp.Session, to jid.JID, req AuthRequest, allow bool) error {
+	fields := []form.Field{
+		form.Hidden("FORM_TYPE", form.Value(NSSubAuth)),
+		form.Text(fieldNode, form.Value(req.Node)),
+		form.JID(fieldSubscriber, form.Value(req.Addr.String())),
+		form.Boolean(fieldAllow),
+	}
+	if req.SubID != "" {
+		fields = append(fields, form.Hidden(fieldSubID, form.Value(req.SubID)))
+	}
+	data := form.New(fields...)
+	_, err := data.Set(fieldAllow, allow)
+	if err != nil {
+		return err
+	}
+	submission, _ := data.Submit()
+	return s.Send(ctx, stanza.Message{
+		To:   to,
+		Type: stanza.NormalMessage,
+	}.Wrap(submission))
+}
@@ -34,11 +34,12 @@ const (
 	CondTooManySubscriptions             // too-many-subscriptions
 	CondUnsupported                      // unsupported
 	CondUnsupportedAccessModel           // unsupported-access-model
+	CondPreconditionNotMet               // precondition-not-met
 )
 
 // UnmarshalXML implements xml.Unmarshaler.
 func (c *Condition) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
-	for cond := CondNone; cond <= CondUnsupportedAccessModel; cond++ {
+	for cond := CondNone; cond <= CondPreconditionNotMet; cond++ {
 		if cond.String() == start.Name.Local {
 			*c = cond
 			break
@@ -0,0 +1,135 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/stanza"
+)
+
+// Error is a stanza error returned by a pubsub service that contains an
+// additional pubsub specific condition.
+//
+// Error wraps the underlying stanza error so that it may still be checked for
+// using errors.Is and errors.As.
+type Error struct {
+	Err       stanza.Error
+	Condition Condition
+
+	// Feature is the feature that is not supported by the service if the
+	// condition is CondUnsupported.
+	Feature Feature
+}
+
+// Error satisfies the error interface.
+func (e Error) Error() string {
+	if e.Condition == CondUnsupported {
+		return fmt.Sprintf("pubsub: %s: %s %s", e.Err.Error(), e.Condition, e.Feature)
+	}
+	return fmt.Sprintf("pubsub: %s: %s", e.Err.Error(), e.Condition)
+}
+
+// Unwrap returns the underlying stanza error.
+func (e Error) Unwrap() error {
+	return e.Err
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+// It returns the stanza error with the pubsub specific condition appended.
+func (e Error) TokenReader() xml.TokenReader {
+	start := xml.StartElement{Name: xml.Name{Space: NSErrors, Local: e.Condition.String()}}
+	if e.Condition == CondUnsupported {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "feature"}, Value: e.Feature.String()})
+	}
+	return e.Err.Wrap(xmlstream.Wrap(nil, start))
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (e Error) WriteXML(w xmlstream.TokenWriter) (n int, err error) {
+	return xmlstream.Copy(w, e.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (e Error) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+	_, err := e.WriteXML(enc)
+	if err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+// unmarshalIQ is like the sessions UnmarshalIQElement method except that if a
+// pubsub specific condition is found in the error it is returned as an Error.
+func unmarshalIQ(ctx context.Context, s *xmpp.Session, payload xml.TokenReader, iq stanza.IQ, v interface{}) (e error) {
+	resp, err := s.SendIQElement(ctx, payload, iq)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ee := resp.Close()
+		if e == nil {
+			e = ee
+		}
+	}()
+
+	tok, err := resp.Token()
+	if err != nil {
+		return err
+	}
+	start, ok := tok.(xml.StartElement)
+	if !ok {
+		return fmt.Errorf("pubsub: expected IQ start token, got %T %[1]v", tok)
+	}
+
+	var psErr Error
+	_, err = stanza.UnmarshalIQError(xmlstream.Inspect(func(t xml.Token) {
+		condStart, ok := t.(xml.StartElement)
+		if !ok || condStart.Name.Space != NSErrors {
+			return
+		}
+		for cond := CondNone + 1; cond <= CondPreconditionNotMet; cond++ {
+			if cond.String() == condStart.Name.Local {
+				psErr.Condition = cond
+				break
+			}
+		}
+		_, feature := attr.Get(condStart.Attr, "feature")
+		for f := FeatureAccessAuthorize; f <= FeatureSubscriptionNotifications; f++ {
+			if f.String() == feature {
+				psErr.Feature = f
+				break
+			}
+		}
+	})(resp), start)
+	if err != nil {
+		if psErr.Condition != CondNone && errors.As(err, &psErr.Err) {
+			return psErr
+		}
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	d := xml.NewTokenDecoder(xmlstream.Inner(resp))
+	startTok, err := d.Token()
+	switch err {
+	case io.EOF:
+		return nil
+	case nil:
+	default:
+		return err
+	}
+	start = startTok.(xml.StartElement)
+	return d.DecodeElement(v, &start)
+}
@@ -0,0 +1,306 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"context"
+	"encoding/xml"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// EventType is the kind of change described by an event notification.
+type EventType uint8
+
+// A list of possible event types.
+const (
+	// EventItem indicates that an item was published to the node.
+	EventItem EventType = iota
+
+	// EventRetract indicates that an item was removed from the node.
+	EventRetract
+
+	// EventPurge indicates that all items were removed from the node.
+	EventPurge
+
+	// EventDelete indicates that the node was deleted.
+	EventDelete
+
+	// EventConfig indicates that the node configuration was changed.
+	EventConfig
+
+	// EventSubscription indicates that the state of a subscription changed, for
+	// example because a pending subscription was approved.
+	EventSubscription
+)
+
+// Event is a notification sent by a pubsub service when something happens to a
+// node that we are subscribed to.
+type Event struct {
+	Type EventType
+	Node string
+
+	// ID is the ID of the published or retracted item.
+	// It is only set for EventItem and EventRetract.
+	ID string
+
+	// Publisher is the address of the entity that published the item if the
+	// service chose to include it.
+	Publisher jid.JID
+
+	// Item is a reader over the payload of a published item.
+	// If the service did not include the payload it will immediately return
+	// io.EOF.
+	// It is only valid for the duration of the call to HandleEvent and is nil for
+	// all events other than EventItem.
+	Item xml.TokenReader
+
+	// Redirect is the URI of a node that replaces a deleted node, if any.
+	Redirect string
+
+	// Config is the new configuration of the node if it was included in a
+	// configuration change notification.
+	Config *form.Data
+
+	// Subscription is the new state of a subscription.
+	// It is only set for EventSubscription.
+	Subscription Subscription
+}
+
+// Handler responds to pubsub events.
+// The message is provided so that a single handler may be registered against
+// multiple pubsub or PEP services and distinguish between different senders.
+type Handler interface {
+	HandleEvent(stanza.Message, Event) error
+}
+
+// The HandlerFunc type is an adapter to allow the use of ordinary functions as
+// event handlers.
+// If f is a function with the appropriate signature, HandlerFunc(f) is a
+// Handler that calls f.
+type HandlerFunc func(stanza.Message, Event) error
+
+// HandleEvent calls f(msg, e).
+func (f HandlerFunc) HandleEvent(msg stanza.Message, e Event) error {
+	return f(msg, e)
+}
+
+// Handle returns an option that registers the event multiplexer for incoming
+// event notifications.
+func Handle(e *Events) mux.Option {
+	return func(m *mux.ServeMux) {
+		event := xml.Name{Space: NSEvent, Local: "event"}
+		mux.Message(stanza.NormalMessage, event, e)(m)
+		mux.Message(stanza.HeadlineMessage, event, e)(m)
+	}
+}
+
+// Events multiplexes incoming event notifications to handlers registered for
+// individual nodes.
+// The zero value is ready to use.
+//
+// Events does not advertise interest in any nodes; to receive notifications from
+// PEP services the corresponding "+notify" features must also be advertised,
+// for example by using Interests.
+type Events struct {
+	handlers map[string]Handler
+	m        sync.RWMutex
+}
+
+// Handle registers the handler for events on the given node, replacing any
+// existing handler.
+func (e *Events) Handle(node string, h Handler) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.handlers == nil {
+		e.handlers = make(map[string]Handler)
+	}
+	e.handlers[node] = h
+}
+
+// HandleFunc registers the function for events on the given node.
+// For more information see Handle.
+func (e *Events) HandleFunc(node string, f HandlerFunc) {
+	e.Handle(node, f)
+}
+
+// Remove stops handling events for the given node.
+func (e *Events) Remove(node string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	delete(e.handlers, node)
+}
+
+// Handler returns the handler to use for events on the given node.
+// If no handler is registered, a default noop handler is returned (h is always
+// non-nil) and ok will be false.
+func (e *Events) Handler(node string) (h Handler, ok bool) {
+	e.m.RLock()
+	defer e.m.RUnlock()
+	h, ok = e.handlers[node]
+	if !ok {
+		return HandlerFunc(func(stanza.Message, Event) error { return nil }), false
+	}
+	return h, true
+}
+
+// Subscribe subscribes to the node and, if no error is returned, registers h to
+// handle events for the node.
+// Subscribe always sends the subscription request, even if a handler is already
+// registered for the node.
+func (e *Events) Subscribe(ctx context.Context, s *xmpp.Session, node string, opts *form.Data, h Handler) (Subscription, error) {
+	return e.SubscribeIQ(ctx, s, stanza.IQ{}, node, opts, h)
+}
+
+// SubscribeIQ is like Subscribe except that it allows modifying the IQ.
+// Changes to the IQ type will have no effect.
+func (e *Events) SubscribeIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node string, opts *form.Data, h Handler) (Subscription, error) {
+	sub, err := SubscribeIQ(ctx, s, iq, node, opts)
+	if err != nil {
+		return sub, err
+	}
+	e.Handle(node, h)
+	return sub, nil
+}
+
+// Unsubscribe removes any handler for the node and then sends an unsubscribe
+// request.
+// The request is sent even if no handler was registered in case the service
+// subscribed us automatically.
+func (e *Events) Unsubscribe(ctx context.Context, s *xmpp.Session, node, subID string) error {
+	return e.UnsubscribeIQ(ctx, s, stanza.IQ{}, node, subID)
+}
+
+// UnsubscribeIQ is like Unsubscribe except that it allows modifying the IQ.
+// Changes to the IQ type will have no effect.
+func (e *Events) UnsubscribeIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node, subID string) error {
+	e.Remove(node)
+	return UnsubscribeIQ(ctx, s, iq, node, subID)
+}
+
+// HandleMessage satisfies mux.MessageHandler.
+// it is used by the multiplexer and normally does not need to be called by the
+// user.
+func (e *Events) HandleMessage(msg stanza.Message, r xmlstream.TokenReadEncoder) error {
+	// Pop the message start token.
+	_, err := r.Token()
+	if err != nil {
+		return err
+	}
+	iter := xmlstream.NewIter(r)
+	/* #nosec */
+	defer iter.Close()
+	for iter.Next() {
+		start, child := iter.Current()
+		if start == nil || start.Name.Space != NSEvent || start.Name.Local != "event" {
+			continue
+		}
+		return e.handleEvent(msg, child)
+	}
+	return iter.Err()
+}
+
+func (e *Events) handleEvent(msg stanza.Message, r xml.TokenReader) error {
+	iter := xmlstream.NewIter(r)
+	/* #nosec */
+	defer iter.Close()
+	for iter.Next() {
+		start, child := iter.Current()
+		if start == nil {
+			continue
+		}
+		_, node := attr.Get(start.Attr, "node")
+		var err error
+		switch start.Name.Local {
+		case "items":
+			err = e.handleItems(msg, node, child)
+		case "purge":
+			err = e.dispatch(msg, Event{Type: EventPurge, Node: node})
+		case "delete":
+			var redirect struct {
+				Redirect struct {
+					URI string `xml:"uri,attr"`
+				} `xml:"redirect"`
+			}
+			err = xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), child)).Decode(&redirect)
+			if err != nil {
+				return err
+			}
+			err = e.dispatch(msg, Event{Type: EventDelete, Node: node, Redirect: redirect.Redirect.URI})
+		case "configuration":
+			var config struct {
+				Data *form.Data `xml:"jabber:x:data x"`
+			}
+			err = xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), child)).Decode(&config)
+			if err != nil {
+				return err
+			}
+			err = e.dispatch(msg, Event{Type: EventConfig, Node: node, Config: config.Data})
+		case "subscription":
+			var sub Subscription
+			err = xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), child)).Decode(&sub)
+			if err != nil {
+				return err
+			}
+			err = e.dispatch(msg, Event{Type: EventSubscription, Node: sub.Node, Subscription: sub})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+func (e *Events) handleItems(msg stanza.Message, node string, r xml.TokenReader) error {
+	iter := xmlstream.NewIter(r)
+	/* #nosec */
+	defer iter.Close()
+	for iter.Next() {
+		start, child := iter.Current()
+		if start == nil {
+			continue
+		}
+		_, id := attr.Get(start.Attr, "id")
+		var err error
+		switch start.Name.Local {
+		case "item":
+			ev := Event{
+				Type: EventItem,
+				Node: node,
+				ID:   id,
+				Item: xmlstream.Inner(child),
+			}
+			_, publisher := attr.Get(start.Attr, "publisher")
+			if publisher != "" {
+				ev.Publisher, err = jid.Parse(publisher)
+				if err != nil {
+					return err
+				}
+			}
+			err = e.dispatch(msg, ev)
+		case "retract":
+			err = e.dispatch(msg, Event{Type: EventRetract, Node: node, ID: id})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+func (e *Events) dispatch(msg stanza.Message, ev Event) error {
+	h, ok := e.Handler(ev.Node)
+	if !ok {
+		return nil
+	}
+	return h.HandleEvent(msg, ev)
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub_test
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/pubsub"
+	"mellium.im/xmpp/stanza"
+)
+
+type eventResult struct {
+	Type      pubsub.EventType
+	Node      string
+	ID        string
+	Publisher string
+	Payload   string
+	Redirect  string
+	Sub       pubsub.SubType
+}
+
+var eventTestCases = [...]struct {
+	in  string
+	out []eventResult
+}{
+	0: {
+		in: `<message xmlns="jabber:client" from="pubsub.shakespeare.lit" to="francisco@denmark.lit" id="foo"><event xmlns="http://jabber.org/protocol/pubsub#event"><items node="princely_musings"><item id="ae890ac52d0df67ed7cfdf51b644e901" publisher="hamlet@denmark.lit"><entry xmlns="http://www.w3.org/2005/Atom">Soliloquy</entry></item><retract id="123"/></items></event></message>`,
+		out: []eventResult{{
+			Type:      pubsub.EventItem,
+			Node:      "princely_musings",
+			ID:        "ae890ac52d0df67ed7cfdf51b644e901",
+			Publisher: "hamlet@denmark.lit",
+			Payload:   "Soliloquy",
+		}, {
+			Type: pubsub.EventRetract,
+			Node: "princely_musings",
+			ID:   "123",
+		}},
+	},
+	1: {
+		in:  `<message xmlns="jabber:client" from="pubsub.shakespeare.lit" type="headline"><event xmlns="http://jabber.org/protocol/pubsub#event"><purge node="princely_musings"/></event></message>`,
+		out: []eventResult{{Type: pubsub.EventPurge, Node: "princely_musings"}},
+	},
+	2: {
+		in:  `<message xmlns="jabber:client" from="pubsub.shakespeare.lit"><event xmlns="http://jabber.org/protocol/pubsub#event"><delete node="princely_musings"><redirect uri="xmpp:hamlet@denmark.lit?;node=blog"/></delete></event></message>`,
+		out: []eventResult{{Type: pubsub.EventDelete, Node: "princely_musings", Redirect: "xmpp:hamlet@denmark.lit?;node=blog"}},
+	},
+	3: {
+		in:  `<message xmlns="jabber:client" from="pubsub.shakespeare.lit"><event xmlns="http://jabber.org/protocol/pubsub#event"><subscription node="princely_musings" jid="horatio@denmark.lit" subscription="subscribed"/></event></message>`,
+		out: []eventResult{{Type: pubsub.EventSubscription, Node: "princely_musings", Sub: pubsub.SubSubscribed}},
+	},
+	4: {
+		in: `<message xmlns="jabber:client" from="pubsub.shakespeare.lit"><event xmlns="http://jabber.org/protocol/pubsub#event"><items node="unhandled"><retract id="123"/></items></event></message>`,
+	},
+}
+
+func TestEvents(t *testing.T) {
+	for i, tc := range eventTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var out []eventResult
+			done := make(chan struct{})
+			events := &pubsub.Events{}
+			events.HandleFunc("princely_musings", func(_ stanza.Message, e pubsub.Event) error {
+				res := eventResult{
+					Type:      e.Type,
+					Node:      e.Node,
+					ID:        e.ID,
+					Publisher: e.Publisher.String(),
+					Redirect:  e.Redirect,
+					Sub:       e.Subscription.Subscription,
+				}
+				if e.Item != nil {
+					var entry struct {
+						Text string `xml:",chardata"`
+					}
+					err := xml.NewTokenDecoder(e.Item).Decode(&entry)
+					if err != nil {
+						return err
+					}
+					res.Payload = entry.Text
+				}
+				out = append(out, res)
+				return nil
+			})
+			m := mux.New(stanza.NSClient, pubsub.Handle(events), mux.MessageFunc(stanza.ChatMessage, xml.Name{Local: "done"}, func(stanza.Message, xmlstream.TokenReadEncoder) error {
+				close(done)
+				return nil
+			}))
+			cs := xmpptest.NewClientServer(xmpptest.ClientHandler(m))
+			defer cs.Close()
+
+			err := cs.Server.Send(context.Background(), xml.NewDecoder(strings.NewReader(tc.in)))
+			if err != nil {
+				t.Fatalf("error sending event: %v", err)
+			}
+			err = cs.Server.Send(context.Background(), xml.NewDecoder(strings.NewReader(`<message xmlns="jabber:client" type="chat"><done/></message>`)))
+			if err != nil {
+				t.Fatalf("error sending sentinel: %v", err)
+			}
+			<-done
+			if !reflect.DeepEqual(out, tc.out) {
+				t.Errorf("wrong events:\nwant=%+v,\n got=%+v", tc.out, out)
+			}
+		})
+	}
+}
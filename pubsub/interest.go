@@ -0,0 +1,190 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"context"
+	/* #nosec */
+	_ "crypto/sha1"
+	"encoding/xml"
+	"sort"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/crypto"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// NotifySuffix is appended to the name of a node to create the feature that
+// advertises interest in notifications from that node.
+const NotifySuffix = "+notify"
+
+// Interests is a registry of nodes that we want to receive event notifications
+// for from PEP services.
+// Packages that handle PEP nodes (for example, bookmarks or avatars) may
+// register their nodes when they are in use and remove them when they are not.
+//
+// Interests implements info.FeatureIter and advertises a "+notify" feature for
+// each registered node.
+// To advertise the features it should be registered on a multiplexer with
+// mux.Feature.
+// When the set of interests changes, the entity capabilities verification
+// string is recalculated from the features, identities, and forms of Mux and a
+// new presence containing the updated caps is sent over Session.
+//
+// The exported fields should not be changed after the first node is added.
+type Interests struct {
+	// Session is used to send presence when the set of interests changes.
+	// If Session is nil, no presence is sent.
+	Session *xmpp.Session
+
+	// Mux is the multiplexer that the entity capabilities are calculated from.
+	// If Mux is nil, only the features advertised by Interests are used.
+	Mux *mux.ServeMux
+
+	// Node is a URI that uniquely identifies the software sending the presence
+	// (eg. https://example.com/myclient).
+	Node string
+
+	// Hash is the hash function used to calculate the entity capabilities.
+	// If Hash is zero, SHA-1 is used.
+	Hash crypto.Hash
+
+	// Payload, if set, is called each time presence is sent and returns any
+	// additional payload (such as a show or status element) to include in the
+	// presence.
+	Payload func() xml.TokenReader
+
+	m     sync.Mutex
+	nodes map[string]int
+}
+
+// Add registers interest in notifications from the node.
+// Interest is reference counted so that multiple packages may add the same
+// node; it is advertised until Remove has been called the same number of
+// times.
+// If the node was not previously registered, updated entity capabilities are
+// sent in a new presence.
+func (i *Interests) Add(ctx context.Context, node string) error {
+	i.m.Lock()
+	if i.nodes == nil {
+		i.nodes = make(map[string]int)
+	}
+	i.nodes[node]++
+	changed := i.nodes[node] == 1
+	i.m.Unlock()
+
+	if !changed {
+		return nil
+	}
+	return i.Announce(ctx)
+}
+
+// Remove unregisters interest in notifications from the node.
+// If no interest remains in the node, updated entity capabilities are sent in
+// a new presence.
+func (i *Interests) Remove(ctx context.Context, node string) error {
+	i.m.Lock()
+	count, ok := i.nodes[node]
+	if ok {
+		if count <= 1 {
+			delete(i.nodes, node)
+		} else {
+			i.nodes[node] = count - 1
+		}
+	}
+	changed := ok && count <= 1
+	i.m.Unlock()
+
+	if !changed {
+		return nil
+	}
+	return i.Announce(ctx)
+}
+
+// Interested reports whether interest in the node is currently registered.
+func (i *Interests) Interested(node string) bool {
+	i.m.Lock()
+	defer i.m.Unlock()
+	_, ok := i.nodes[node]
+	return ok
+}
+
+// ForFeatures implements info.FeatureIter.
+func (i *Interests) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	i.m.Lock()
+	names := make([]string, 0, len(i.nodes))
+	for name := range i.nodes {
+		names = append(names, name)
+	}
+	i.m.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := f(info.Feature{Var: name + NotifySuffix})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Caps returns the entity capabilities for the current set of features.
+func (i *Interests) Caps() (disco.Caps, error) {
+	h := i.Hash
+	if h == 0 {
+		h = crypto.SHA1
+	}
+	if !h.Available() {
+		return disco.Caps{}, crypto.ErrUnlinkedAlgo
+	}
+
+	if i.Mux != nil {
+		return disco.MuxCaps(i.Mux, i.Node, h)
+	}
+
+	var discoInfo disco.Info
+	err := i.ForFeatures("", func(f info.Feature) error {
+		discoInfo.Features = append(discoInfo.Features, f)
+		return nil
+	})
+	if err != nil {
+		return disco.Caps{}, err
+	}
+	return disco.Caps{
+		Hash: h,
+		Node: i.Node,
+		Ver:  discoInfo.Hash(h.New()),
+	}, nil
+}
+
+// Announce sends an available presence containing the current entity
+// capabilities.
+// It is called automatically when the set of interests changes and normally
+// only needs to be called directly to send the initial presence.
+// If Session is nil, Announce does nothing.
+func (i *Interests) Announce(ctx context.Context) error {
+	if i.Session == nil {
+		return nil
+	}
+	caps, err := i.Caps()
+	if err != nil {
+		return err
+	}
+	var payload xml.TokenReader = caps.TokenReader()
+	if i.Payload != nil {
+		if extra := i.Payload(); extra != nil {
+			payload = xmlstream.MultiReader(extra, payload)
+		}
+	}
+	return i.Session.Send(ctx, stanza.Presence{}.Wrap(payload))
+}
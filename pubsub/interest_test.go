@@ -0,0 +1,93 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"testing"
+
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/pubsub"
+	"mellium.im/xmpp/stanza"
+)
+
+func TestInterests(t *testing.T) {
+	caps := make(chan disco.Caps, 4)
+	serverMux := mux.New(stanza.NSClient, disco.HandleCaps(func(_ stanza.Presence, c disco.Caps) {
+		caps <- c
+	}))
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(serverMux))
+	defer cs.Close()
+
+	interests := &pubsub.Interests{
+		Session: cs.Client,
+		Node:    "https://mellium.im/xmpp",
+	}
+	interests.Mux = mux.New(stanza.NSClient, mux.Feature(interests), disco.Handle())
+
+	wantVer := func(nodes ...string) string {
+		discoInfo := disco.Info{Features: []info.Feature{disco.Feature}}
+		for _, node := range nodes {
+			discoInfo.Features = append(discoInfo.Features, info.Feature{Var: node + pubsub.NotifySuffix})
+		}
+		return discoInfo.Hash(sha1.New())
+	}
+
+	ctx := context.Background()
+	for _, step := range []struct {
+		add   bool
+		node  string
+		nodes []string
+		sent  bool
+	}{
+		{add: true, node: "urn:xmpp:bookmarks:1", nodes: []string{"urn:xmpp:bookmarks:1"}, sent: true},
+		{add: true, node: "urn:xmpp:avatar:metadata", nodes: []string{"urn:xmpp:avatar:metadata", "urn:xmpp:bookmarks:1"}, sent: true},
+		{add: true, node: "urn:xmpp:bookmarks:1", nodes: []string{"urn:xmpp:avatar:metadata", "urn:xmpp:bookmarks:1"}},
+		{node: "urn:xmpp:bookmarks:1", nodes: []string{"urn:xmpp:avatar:metadata", "urn:xmpp:bookmarks:1"}},
+		{node: "urn:xmpp:bookmarks:1", nodes: []string{"urn:xmpp:avatar:metadata"}, sent: true},
+		{node: "urn:xmpp:bookmarks:1", nodes: []string{"urn:xmpp:avatar:metadata"}},
+	} {
+		var err error
+		if step.add {
+			err = interests.Add(ctx, step.node)
+		} else {
+			err = interests.Remove(ctx, step.node)
+		}
+		if err != nil {
+			t.Fatalf("error updating interest in %s: %v", step.node, err)
+		}
+		var want bool
+		for _, node := range step.nodes {
+			want = want || node == "urn:xmpp:bookmarks:1"
+		}
+		if interested := interests.Interested("urn:xmpp:bookmarks:1"); interested != want {
+			t.Errorf("wrong interest after updating %s: want=%t, got=%t", step.node, want, interested)
+		}
+
+		c, err := interests.Caps()
+		if err != nil {
+			t.Fatalf("error calculating caps: %v", err)
+		}
+		if want := wantVer(step.nodes...); c.Ver != want {
+			t.Errorf("wrong ver after updating %s: want=%s, got=%s", step.node, want, c.Ver)
+		}
+		if !step.sent {
+			continue
+		}
+		sent := <-caps
+		if sent != c {
+			t.Errorf("wrong caps sent: want=%+v, got=%+v", c, sent)
+		}
+	}
+	select {
+	case c := <-caps:
+		t.Errorf("unexpected caps sent: %+v", c)
+	default:
+	}
+}
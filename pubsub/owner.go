@@ -0,0 +1,247 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// AffType is the affiliation of an entity with a node.
+type AffType uint8
+
+// A list of possible affiliations.
+const (
+	AffNone        AffType = iota // none
+	AffOwner                      // owner
+	AffPublisher                  // publisher
+	AffPublishOnly                // publish-only
+	AffMember                     // member
+	AffOutcast                    // outcast
+)
+
+// MarshalXMLAttr satisfies xml.MarshalerAttr.
+func (a AffType) MarshalXMLAttr(name xml.Name) (xml.Attr, error) {
+	return xml.Attr{Name: name, Value: a.String()}, nil
+}
+
+// UnmarshalXMLAttr satisfies xml.UnmarshalerAttr.
+func (a *AffType) UnmarshalXMLAttr(attr xml.Attr) error {
+	for typ := AffNone; typ <= AffOutcast; typ++ {
+		if typ.String() == attr.Value {
+			*a = typ
+			return nil
+		}
+	}
+	return fmt.Errorf("pubsub: unknown affiliation %q", attr.Value)
+}
+
+// Affiliation is the affiliation of a JID with a node as seen by the node
+// owner.
+type Affiliation struct {
+	Addr        jid.JID
+	Affiliation AffType
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (a Affiliation) TokenReader() xml.TokenReader {
+	/* #nosec */
+	affAttr, _ := a.Affiliation.MarshalXMLAttr(xml.Name{Local: "affiliation"})
+	return xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: NSOwner, Local: "affiliation"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "jid"}, Value: a.Addr.String()},
+			affAttr,
+		},
+	})
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (a Affiliation) WriteXML(w xmlstream.TokenWriter) (n int, err error) {
+	return xmlstream.Copy(w, a.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (a Affiliation) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := a.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (a *Affiliation) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	data := struct {
+		Addr        jid.JID `xml:"jid,attr"`
+		Affiliation AffType `xml:"affiliation,attr"`
+	}{}
+	err := d.DecodeElement(&data, &start)
+	if err != nil {
+		return err
+	}
+	a.Addr = data.Addr
+	a.Affiliation = data.Affiliation
+	return nil
+}
+
+// Affiliations fetches the list of entities affiliated with a node.
+// The session's account must be an owner of the node.
+func Affiliations(ctx context.Context, s *xmpp.Session, node string) ([]Affiliation, error) {
+	return AffiliationsIQ(ctx, s, stanza.IQ{}, node)
+}
+
+// AffiliationsIQ is like Affiliations except that it allows modifying the IQ.
+// Changes to the IQ type will have no effect.
+func AffiliationsIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node string) ([]Affiliation, error) {
+	iq.Type = stanza.GetIQ
+	var resp struct {
+		XMLName      xml.Name      `xml:"http://jabber.org/protocol/pubsub#owner pubsub"`
+		Affiliations []Affiliation `xml:"affiliations>affiliation"`
+	}
+	err := s.UnmarshalIQElement(ctx, ownerPayload("affiliations", node, nil), iq, &resp)
+	return resp.Affiliations, err
+}
+
+// SetAffiliations modifies the affiliations of entities with a node.
+// To remove an entity's affiliation set it to AffNone.
+func SetAffiliations(ctx context.Context, s *xmpp.Session, node string, affs ...Affiliation) error {
+	return SetAffiliationsIQ(ctx, s, stanza.IQ{}, node, affs...)
+}
+
+// SetAffiliationsIQ is like SetAffiliations except that it allows modifying
+// the IQ.
+// Changes to the IQ type will have no effect.
+func SetAffiliationsIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node string, affs ...Affiliation) error {
+	iq.Type = stanza.SetIQ
+	inner := make([]xml.TokenReader, 0, len(affs))
+	for _, aff := range affs {
+		inner = append(inner, aff.TokenReader())
+	}
+	return s.UnmarshalIQElement(ctx, ownerPayload("affiliations", node, xmlstream.MultiReader(inner...)), iq, nil)
+}
+
+// Subscribers fetches the list of subscriptions to a node.
+// The session's account must be an owner of the node.
+// The Node field of the returned subscriptions is always set to node.
+func Subscribers(ctx context.Context, s *xmpp.Session, node string) ([]Subscription, error) {
+	return SubscribersIQ(ctx, s, stanza.IQ{}, node)
+}
+
+// SubscribersIQ is like Subscribers except that it allows modifying the IQ.
+// Changes to the IQ type will have no effect.
+func SubscribersIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node string) ([]Subscription, error) {
+	iq.Type = stanza.GetIQ
+	var resp struct {
+		XMLName       xml.Name       `xml:"http://jabber.org/protocol/pubsub#owner pubsub"`
+		Subscriptions []Subscription `xml:"subscriptions>subscription"`
+	}
+	err := s.UnmarshalIQElement(ctx, ownerPayload("subscriptions", node, nil), iq, &resp)
+	for i := range resp.Subscriptions {
+		resp.Subscriptions[i].Node = node
+	}
+	return resp.Subscriptions, err
+}
+
+// SetSubscribers modifies the state of subscriptions to a node.
+// Subscriptions may be removed by setting their state to SubNone, and pending
+// subscriptions may be approved by setting their state to SubSubscribed.
+// The Node field of the subscriptions is ignored.
+func SetSubscribers(ctx context.Context, s *xmpp.Session, node string, subs ...Subscription) error {
+	return SetSubscribersIQ(ctx, s, stanza.IQ{}, node, subs...)
+}
+
+// SetSubscribersIQ is like SetSubscribers except that it allows modifying the
+// IQ.
+// Changes to the IQ type will have no effect.
+func SetSubscribersIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node string, subs ...Subscription) error {
+	iq.Type = stanza.SetIQ
+	inner := make([]xml.TokenReader, 0, len(subs))
+	for _, sub := range subs {
+		sub.Node = ""
+		sub.Configurable = false
+		sub.ConfigRequired = false
+		inner = append(inner, sub.wrap(NSOwner))
+	}
+	return s.UnmarshalIQElement(ctx, ownerPayload("subscriptions", node, xmlstream.MultiReader(inner...)), iq, nil)
+}
+
+// Purge removes all items from a node.
+func Purge(ctx context.Context, s *xmpp.Session, node string) error {
+	return PurgeIQ(ctx, s, stanza.IQ{}, node)
+}
+
+// PurgeIQ is like Purge except that it allows modifying the IQ.
+// Changes to the IQ type will have no effect.
+func PurgeIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node string) error {
+	iq.Type = stanza.SetIQ
+	return s.UnmarshalIQElement(ctx, ownerPayload("purge", node, nil), iq, nil)
+}
+
+// DeleteNode deletes a node and all of its items.
+// If redirect is not empty, subscribers are informed that the node has been
+// replaced by the node at the provided URI (eg.
+// "xmpp:hamlet@denmark.lit?;node=blog").
+func DeleteNode(ctx context.Context, s *xmpp.Session, node, redirect string) error {
+	return DeleteNodeIQ(ctx, s, stanza.IQ{}, node, redirect)
+}
+
+// DeleteNodeIQ is like DeleteNode except that it allows modifying the IQ.
+// Changes to the IQ type will have no effect.
+func DeleteNodeIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node, redirect string) error {
+	iq.Type = stanza.SetIQ
+	var inner xml.TokenReader
+	if redirect != "" {
+		inner = xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Local: "redirect"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "uri"}, Value: redirect}},
+		})
+	}
+	return s.UnmarshalIQElement(ctx, ownerPayload("delete", node, inner), iq, nil)
+}
+
+// GetDefaultOptions fetches the default subscription options for a node.
+// If node is empty, the default options for all nodes on the service are
+// returned.
+func GetDefaultOptions(ctx context.Context, s *xmpp.Session, node string) (*form.Data, error) {
+	return GetDefaultOptionsIQ(ctx, s, stanza.IQ{}, node)
+}
+
+// GetDefaultOptionsIQ is like GetDefaultOptions except that it allows modifying
+// the IQ.
+// Changes to the IQ type will have no effect.
+func GetDefaultOptionsIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node string) (*form.Data, error) {
+	iq.Type = stanza.GetIQ
+	start := xml.StartElement{Name: xml.Name{Local: "default"}}
+	if node != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "node"}, Value: node})
+	}
+	var resp struct {
+		XMLName xml.Name `xml:"http://jabber.org/protocol/pubsub pubsub"`
+		Default struct {
+			Data *form.Data `xml:"jabber:x:data x"`
+		} `xml:"default"`
+	}
+	err := s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		xmlstream.Wrap(nil, start),
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "pubsub"}},
+	), iq, &resp)
+	return resp.Default.Data, err
+}
+
+func ownerPayload(name, node string, inner xml.TokenReader) xml.TokenReader {
+	return xmlstream.Wrap(
+		xmlstream.Wrap(
+			inner,
+			xml.StartElement{Name: xml.Name{Local: name}, Attr: []xml.Attr{{Name: xml.Name{Local: "node"}, Value: node}}},
+		),
+		xml.StartElement{Name: xml.Name{Space: NSOwner, Local: "pubsub"}},
+	)
+}
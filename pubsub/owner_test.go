@@ -0,0 +1,192 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub_test
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/pubsub"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = pubsub.Affiliation{}
+	_ xml.Unmarshaler     = (*pubsub.Affiliation)(nil)
+	_ xmlstream.Marshaler = pubsub.Affiliation{}
+	_ xmlstream.WriterTo  = pubsub.Affiliation{}
+	_ xml.MarshalerAttr   = pubsub.AffType(0)
+	_ xml.UnmarshalerAttr = (*pubsub.AffType)(nil)
+)
+
+func TestEncodeAffiliation(t *testing.T) {
+	xmpptest.RunEncodingTests(t, []xmpptest.EncodingTestCase{
+		0: {
+			Value: &pubsub.Affiliation{
+				Addr:        jid.MustParse("bard@shakespeare.lit"),
+				Affiliation: pubsub.AffPublishOnly,
+			},
+			XML: `<affiliation xmlns="http://jabber.org/protocol/pubsub#owner" jid="bard@shakespeare.lit" affiliation="publish-only"></affiliation>`,
+		},
+	})
+}
+
+// ownerRecorder returns a mux option that records the payload of owner
+// requests (without namespaces) and responds with the provided result payload.
+func ownerRecorder(typ stanza.IQType, out *strings.Builder, result string) mux.Option {
+	return mux.IQFunc(typ, xml.Name{Space: pubsub.NSOwner, Local: "pubsub"}, func(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		tokens := xmlstream.MultiReader(xmlstream.Token(*start), r)
+		for {
+			tok, err := tokens.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			switch tok := tok.(type) {
+			case xml.StartElement:
+				out.WriteString("<" + tok.Name.Local)
+				for _, a := range tok.Attr {
+					if a.Name.Local != "xmlns" {
+						fmt.Fprintf(out, " %s=%q", a.Name.Local, a.Value)
+					}
+				}
+				out.WriteString(">")
+			case xml.EndElement:
+				out.WriteString("</" + tok.Name.Local + ">")
+			}
+		}
+		var payload xml.TokenReader
+		if result != "" {
+			payload = xml.NewDecoder(strings.NewReader(result))
+		}
+		_, err := xmlstream.Copy(r, iq.Result(payload))
+		return err
+	})
+}
+
+func TestAffiliations(t *testing.T) {
+	var req strings.Builder
+	m := mux.New(stanza.NSClient, ownerRecorder(stanza.GetIQ, &req, `<pubsub xmlns="http://jabber.org/protocol/pubsub#owner"><affiliations node="princely_musings"><affiliation jid="hamlet@denmark.lit" affiliation="owner"/><affiliation jid="polonius@denmark.lit" affiliation="outcast"/></affiliations></pubsub>`))
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(m))
+	defer cs.Close()
+
+	affs, err := pubsub.Affiliations(context.Background(), cs.Client, "princely_musings")
+	if err != nil {
+		t.Fatalf("error fetching affiliations: %v", err)
+	}
+	const wantReq = `<pubsub><affiliations node="princely_musings"></affiliations></pubsub>`
+	if s := req.String(); s != wantReq {
+		t.Errorf("wrong request:\nwant=%s,\n got=%s", wantReq, s)
+	}
+	if len(affs) != 2 {
+		t.Fatalf("wrong number of affiliations: want=2, got=%d", len(affs))
+	}
+	if affs[0].Addr.String() != "hamlet@denmark.lit" || affs[0].Affiliation != pubsub.AffOwner {
+		t.Errorf("wrong first affiliation: %+v", affs[0])
+	}
+	if affs[1].Addr.String() != "polonius@denmark.lit" || affs[1].Affiliation != pubsub.AffOutcast {
+		t.Errorf("wrong second affiliation: %+v", affs[1])
+	}
+}
+
+var ownerSetTestCases = map[string]struct {
+	f   func(context.Context, *xmpptest.ClientServer) error
+	out string
+}{
+	"affiliations": {
+		f: func(ctx context.Context, cs *xmpptest.ClientServer) error {
+			return pubsub.SetAffiliations(ctx, cs.Client, "princely_musings", pubsub.Affiliation{
+				Addr:        jid.MustParse("bard@shakespeare.lit"),
+				Affiliation: pubsub.AffPublisher,
+			})
+		},
+		out: `<pubsub><affiliations node="princely_musings"><affiliation jid="bard@shakespeare.lit" affiliation="publisher"></affiliation></affiliations></pubsub>`,
+	},
+	"subscribers": {
+		f: func(ctx context.Context, cs *xmpptest.ClientServer) error {
+			return pubsub.SetSubscribers(ctx, cs.Client, "princely_musings", pubsub.Subscription{
+				Node:         "ignored",
+				Addr:         jid.MustParse("bard@shakespeare.lit"),
+				ID:           "123",
+				Subscription: pubsub.SubSubscribed,
+			})
+		},
+		out: `<pubsub><subscriptions node="princely_musings"><subscription jid="bard@shakespeare.lit" subid="123" subscription="subscribed"></subscription></subscriptions></pubsub>`,
+	},
+	"purge": {
+		f: func(ctx context.Context, cs *xmpptest.ClientServer) error {
+			return pubsub.Purge(ctx, cs.Client, "princely_musings")
+		},
+		out: `<pubsub><purge node="princely_musings"></purge></pubsub>`,
+	},
+	"delete": {
+		f: func(ctx context.Context, cs *xmpptest.ClientServer) error {
+			return pubsub.DeleteNode(ctx, cs.Client, "princely_musings", "xmpp:hamlet@denmark.lit?;node=blog")
+		},
+		out: `<pubsub><delete node="princely_musings"><redirect uri="xmpp:hamlet@denmark.lit?;node=blog"></redirect></delete></pubsub>`,
+	},
+}
+
+func TestOwnerSet(t *testing.T) {
+	for name, tc := range ownerSetTestCases {
+		t.Run(name, func(t *testing.T) {
+			var req strings.Builder
+			m := mux.New(stanza.NSClient, ownerRecorder(stanza.SetIQ, &req, ""))
+			cs := xmpptest.NewClientServer(xmpptest.ServerHandler(m))
+			defer cs.Close()
+
+			err := tc.f(context.Background(), cs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if s := req.String(); s != tc.out {
+				t.Errorf("wrong request:\nwant=%s,\n got=%s", tc.out, s)
+			}
+		})
+	}
+}
+
+func TestApprove(t *testing.T) {
+	reqs := make(chan pubsub.AuthRequest, 1)
+	m := mux.New(stanza.NSClient, pubsub.HandleAuth(func(_ stanza.Message, req pubsub.AuthRequest) error {
+		reqs <- req
+		return nil
+	}))
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(m))
+	defer cs.Close()
+
+	want := pubsub.AuthRequest{
+		Node:  "princely_musings",
+		SubID: "123-abc",
+		Addr:  jid.MustParse("horatio@denmark.lit"),
+	}
+	// Unrelated forms should be ignored by the handler.
+	err := cs.Client.Send(context.Background(), stanza.Message{
+		To:   jid.MustParse("pubsub.shakespeare.lit"),
+		Type: stanza.NormalMessage,
+	}.Wrap(form.New(form.Hidden("FORM_TYPE", form.Value("urn:example"))).TokenReader()))
+	if err != nil {
+		t.Fatalf("error sending unrelated form: %v", err)
+	}
+	err = pubsub.Approve(context.Background(), cs.Client, jid.MustParse("pubsub.shakespeare.lit"), want, true)
+	if err != nil {
+		t.Fatalf("error sending approval: %v", err)
+	}
+	got := <-reqs
+	if got.Node != want.Node || got.SubID != want.SubID || !got.Addr.Equal(want.Addr) {
+		t.Errorf("wrong request: want=%+v, got=%+v", want, got)
+	}
+}
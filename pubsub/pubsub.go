@@ -7,9 +7,13 @@ package pubsub
 import (
 	"context"
 	"encoding/xml"
+	"errors"
+	"strconv"
 
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/xmltok"
 	"mellium.im/xmpp/stanza"
 )
 
@@ -31,6 +35,92 @@ func Publish(ctx context.Context, s *xmpp.Session, node, id string, item xml.Tok
 // PublishIQ is like Publish except that it allows modifying the IQ.
 // Changes to the IQ type will have no effect.
 func PublishIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node, id string, item xml.TokenReader) (string, error) {
+	return publish(ctx, s, iq, node, id, nil, item)
+}
+
+// PublishWithOptions is like Publish except that it also submits
+// publish-options.
+// The options act as preconditions: if the node already exists and its
+// configuration does not match the options the service returns an Error with
+// the condition CondPreconditionNotMet.
+//
+// If reconfigure is true and the preconditions are not met, the node is
+// reconfigured to match the options using SetConfig and the publish is retried
+// once.
+func PublishWithOptions(ctx context.Context, s *xmpp.Session, node, id string, opts *form.Data, reconfigure bool, item xml.TokenReader) (string, error) {
+	return PublishWithOptionsIQ(ctx, s, stanza.IQ{}, node, id, opts, reconfigure, item)
+}
+
+// PublishWithOptionsIQ is like PublishWithOptions except that it allows
+// modifying the IQ.
+// Changes to the IQ type will have no effect.
+func PublishWithOptionsIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node, id string, opts *form.Data, reconfigure bool, item xml.TokenReader) (string, error) {
+	if !reconfigure {
+		return publish(ctx, s, iq, node, id, opts, item)
+	}
+
+	// Buffer the item so that we can send it again if we have to retry.
+	start, err := item.Token()
+	if err != nil {
+		return "", err
+	}
+	toks, err := xmlstream.ReadAll(xmlstream.InnerElement(item))
+	if err != nil {
+		return "", err
+	}
+	toks = append([]xml.Token{start}, toks...)
+
+	newID, err := publish(ctx, s, iq, node, id, opts, xmltok.Replay(toks))
+	var psErr Error
+	if !errors.As(err, &psErr) || psErr.Condition != CondPreconditionNotMet {
+		return newID, err
+	}
+
+	// Never reuse the IQ ID for subsequent requests.
+	iq.ID = ""
+	cfg, err := GetConfigIQ(ctx, s, iq, node)
+	if err != nil {
+		return "", err
+	}
+	err = applyOptions(cfg, opts)
+	if err != nil {
+		return "", err
+	}
+	err = SetConfigIQ(ctx, s, iq, node, cfg)
+	if err != nil {
+		return "", err
+	}
+	return publish(ctx, s, iq, node, id, opts, xmltok.Replay(toks))
+}
+
+// PrivateOptions returns publish-options suitable for storing private data
+// in PEP as described in XEP-0223: Persistent Storage of Private Data via
+// PubSub.
+// Items are persisted and only the account owner may access them.
+func PrivateOptions() *form.Data {
+	return form.New(
+		form.Hidden("FORM_TYPE", form.Value(NSPublishOptions)),
+		form.Boolean("pubsub#persist_items", form.Value("true")),
+		form.List("pubsub#access_model", form.Value("whitelist")),
+	)
+}
+
+// PublishPrivate publishes an item to a PEP node using the options from
+// PrivateOptions.
+// If the node already exists with a different configuration it is reconfigured
+// and the publish is retried.
+func PublishPrivate(ctx context.Context, s *xmpp.Session, node, id string, item xml.TokenReader) (string, error) {
+	return PublishPrivateIQ(ctx, s, stanza.IQ{}, node, id, item)
+}
+
+// PublishPrivateIQ is like PublishPrivate except that it allows modifying the
+// IQ.
+// Changes to the IQ type will have no effect.
+func PublishPrivateIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node, id string, item xml.TokenReader) (string, error) {
+	return PublishWithOptionsIQ(ctx, s, iq, node, id, PrivateOptions(), true, item)
+}
+
+func publish(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node, id string, opts *form.Data, item xml.TokenReader) (string, error) {
 	iq.Type = stanza.SetIQ
 	start, err := item.Token()
 	if err != nil {
@@ -43,15 +133,23 @@ func PublishIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node, id stri
 			Value: id,
 		})
 	}
-	resp := publishResponse{}
-	err = s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+	var payload xml.TokenReader = xmlstream.Wrap(
 		xmlstream.Wrap(
-			xmlstream.Wrap(
-				xmlstream.MultiReader(xmlstream.Token(start), xmlstream.InnerElement(item)),
-				xml.StartElement{Name: xml.Name{Local: "item"}, Attr: itemAttrs},
-			),
-			xml.StartElement{Name: xml.Name{Local: "publish"}, Attr: []xml.Attr{{Name: xml.Name{Local: "node"}, Value: node}}},
+			xmlstream.MultiReader(xmlstream.Token(start), xmlstream.InnerElement(item)),
+			xml.StartElement{Name: xml.Name{Local: "item"}, Attr: itemAttrs},
 		),
+		xml.StartElement{Name: xml.Name{Local: "publish"}, Attr: []xml.Attr{{Name: xml.Name{Local: "node"}, Value: node}}},
+	)
+	if opts != nil {
+		submitted, _ := opts.Submit()
+		payload = xmlstream.MultiReader(payload, xmlstream.Wrap(
+			submitted,
+			xml.StartElement{Name: xml.Name{Local: "publish-options"}},
+		))
+	}
+	resp := publishResponse{}
+	err = unmarshalIQ(ctx, s, xmlstream.Wrap(
+		payload,
 		xml.StartElement{Name: xml.Name{Space: NS, Local: "pubsub"}},
 	), iq, &resp)
 	if resp.Publish.Item.ID == "" {
@@ -59,3 +157,38 @@ func PublishIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node, id stri
 	}
 	return resp.Publish.Item.ID, err
 }
+
+// applyOptions sets the node configuration fields that correspond to the
+// provided publish-options, converting between boolean and string values where
+// the field types differ.
+func applyOptions(cfg, opts *form.Data) error {
+	types := make(map[string]form.FieldType)
+	cfg.ForFields(func(f form.FieldData) {
+		types[f.Var] = f.Type
+	})
+	var err error
+	opts.ForFields(func(f form.FieldData) {
+		if err != nil || f.Var == "" || f.Var == "FORM_TYPE" {
+			return
+		}
+		v, ok := opts.Get(f.Var)
+		if !ok {
+			return
+		}
+		switch vv := v.(type) {
+		case bool:
+			if types[f.Var] != form.TypeBoolean {
+				v = strconv.FormatBool(vv)
+			}
+		case string:
+			if types[f.Var] == form.TypeBoolean {
+				v, err = strconv.ParseBool(vv)
+				if err != nil {
+					return
+				}
+			}
+		}
+		_, err = cfg.Set(f.Var, v)
+	})
+	return err
+}
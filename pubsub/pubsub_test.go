@@ -0,0 +1,114 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/pubsub"
+	"mellium.im/xmpp/stanza"
+)
+
+// preconditionServer returns options for a mux that reject publishes with a
+// precondition-not-met error until the node access model is reconfigured.
+func preconditionServer(accessModel *string, published *int) []mux.Option {
+	return []mux.Option{
+		mux.IQFunc(stanza.SetIQ, xml.Name{Space: pubsub.NS, Local: "pubsub"}, func(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			var req struct {
+				Publish struct {
+					Item struct {
+						Inner string `xml:",innerxml"`
+					} `xml:"item"`
+				} `xml:"publish"`
+				Options struct {
+					Data *form.Data `xml:"jabber:x:data x"`
+				} `xml:"publish-options"`
+			}
+			err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&req)
+			if err != nil {
+				return err
+			}
+			model, _ := req.Options.Data.GetString("pubsub#access_model")
+			if model != *accessModel {
+				reply := iq
+				reply.Type = stanza.ErrorIQ
+				reply.From, reply.To = iq.To, iq.From
+				_, err = xmlstream.Copy(r, reply.Wrap(stanza.Error{
+					Type:      stanza.Cancel,
+					Condition: stanza.Conflict,
+				}.Wrap(xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Space: pubsub.NSErrors, Local: "precondition-not-met"}}))))
+				return err
+			}
+			*published++
+			_, err = xmlstream.Copy(r, iq.Result(nil))
+			return err
+		}),
+		mux.IQFunc(stanza.GetIQ, xml.Name{Space: pubsub.NSOwner, Local: "pubsub"}, func(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			cfg := form.New(
+				form.Hidden("FORM_TYPE", form.Value("http://jabber.org/protocol/pubsub#node_config")),
+				form.Text("pubsub#persist_items", form.Value("0")),
+				form.List("pubsub#access_model", form.Value(*accessModel)),
+			)
+			_, err := xmlstream.Copy(r, iq.Result(xmlstream.Wrap(
+				xmlstream.Wrap(cfg.TokenReader(), xml.StartElement{Name: xml.Name{Local: "configure"}}),
+				xml.StartElement{Name: xml.Name{Space: pubsub.NSOwner, Local: "pubsub"}},
+			)))
+			return err
+		}),
+		mux.IQFunc(stanza.SetIQ, xml.Name{Space: pubsub.NSOwner, Local: "pubsub"}, func(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			var req struct {
+				Configure struct {
+					Data *form.Data `xml:"jabber:x:data x"`
+				} `xml:"configure"`
+			}
+			err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&req)
+			if err != nil {
+				return err
+			}
+			*accessModel, _ = req.Configure.Data.GetString("pubsub#access_model")
+			_, err = xmlstream.Copy(r, iq.Result(nil))
+			return err
+		}),
+	}
+}
+
+func TestPublishPreconditionNotMet(t *testing.T) {
+	accessModel := "open"
+	var published int
+	m := mux.New(stanza.NSClient, preconditionServer(&accessModel, &published)...)
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(m))
+	defer cs.Close()
+
+	_, err := pubsub.PublishWithOptions(context.Background(), cs.Client, "storage:bookmarks", "current", pubsub.PrivateOptions(), false, xml.NewDecoder(strings.NewReader(`<storage xmlns="storage:bookmarks"/>`)))
+	var psErr pubsub.Error
+	if !errors.As(err, &psErr) || psErr.Condition != pubsub.CondPreconditionNotMet {
+		t.Fatalf("expected precondition-not-met error, got: %v", err)
+	}
+	if !errors.Is(err, stanza.Error{Condition: stanza.Conflict}) {
+		t.Errorf("expected error to wrap conflict, got: %v", err)
+	}
+	if published != 0 {
+		t.Errorf("item was published without reconfiguring the node")
+	}
+
+	_, err = pubsub.PublishPrivate(context.Background(), cs.Client, "storage:bookmarks", "current", xml.NewDecoder(strings.NewReader(`<storage xmlns="storage:bookmarks"/>`)))
+	if err != nil {
+		t.Fatalf("error publishing with reconfiguration: %v", err)
+	}
+	if accessModel != "whitelist" {
+		t.Errorf("node was not reconfigured: want access model whitelist, got %q", accessModel)
+	}
+	if published != 1 {
+		t.Errorf("wrong number of publishes: want=1, got=%d", published)
+	}
+}
@@ -0,0 +1,926 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/xmltok"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/paging"
+	"mellium.im/xmpp/stanza"
+)
+
+// Sender is used by a Service to send event notifications.
+// It is satisfied by *xmpp.Session, but a server will normally provide an
+// implementation that routes stanzas to the correct session.
+type Sender interface {
+	Send(context.Context, xml.TokenReader) error
+}
+
+// HandleService returns an option that registers a pubsub service on the mux.
+func HandleService(srv *Service) mux.Option {
+	return func(m *mux.ServeMux) {
+		pubsub := xml.Name{Space: NS, Local: "pubsub"}
+		owner := xml.Name{Space: NSOwner, Local: "pubsub"}
+		mux.IQ(stanza.GetIQ, pubsub, srv)(m)
+		mux.IQ(stanza.SetIQ, pubsub, srv)(m)
+		mux.IQ(stanza.GetIQ, owner, srv)(m)
+		mux.IQ(stanza.SetIQ, owner, srv)(m)
+	}
+}
+
+// Service is a pubsub or personal eventing (PEP) service.
+//
+// The IQ handled by the service must have its from attribute set to the
+// address of the requesting entity.
+// The zero value is a pubsub service that stores nodes and items in memory and
+// does not send event notifications.
+type Service struct {
+	// Store persists nodes and items.
+	// If nil, items are stored in memory.
+	Store Store
+
+	// Sender sends event notifications to subscribers.
+	// If nil, no notifications are sent.
+	Sender Sender
+
+	// Addr is the address of the service, used when an IQ does not have a to
+	// attribute.
+	// It is ignored for PEP services.
+	Addr jid.JID
+
+	// PEP makes the service behave as a personal eventing service.
+	// Each bare JID has its own set of nodes which it owns, and publishing to a
+	// node that does not exist creates it automatically.
+	PEP bool
+
+	// Presence reports whether contact is subscribed to the presence of owner.
+	// It is used to implement the presence access model, and if it is nil only
+	// affiliated entities can access nodes with the presence access model.
+	Presence func(owner, contact jid.JID) bool
+
+	m   sync.Mutex
+	mem MemStore
+}
+
+// request is a parsed pubsub IQ payload.
+type request struct {
+	op    xml.StartElement
+	inner []xml.Token
+	form  *form.Data
+	rsm   *paging.Request
+}
+
+// HandleIQ implements mux.IQHandler.
+func (srv *Service) HandleIQ(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	ctx := context.Background()
+	var (
+		payload xml.TokenReader
+		events  []xml.TokenReader
+	)
+	req, err := parseRequest(r)
+	if err == nil {
+		srv.m.Lock()
+		payload, events, err = srv.handle(ctx, iq, start.Name.Space, req)
+		srv.m.Unlock()
+	}
+
+	var (
+		psErr Error
+		se    stanza.Error
+	)
+	switch {
+	case err == nil:
+		_, err = xmlstream.Copy(r, iq.Result(payload))
+	case errors.As(err, &psErr):
+		reply := iq
+		reply.Type = stanza.ErrorIQ
+		reply.From, reply.To = iq.To, iq.From
+		_, err = xmlstream.Copy(r, reply.Wrap(psErr.TokenReader()))
+	case errors.As(err, &se):
+		_, err = xmlstream.Copy(r, iq.Error(se))
+	default:
+		/* #nosec */
+		xmlstream.Copy(r, iq.Error(stanza.Error{Type: stanza.Wait, Condition: stanza.InternalServerError}))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if srv.Sender == nil {
+		return nil
+	}
+	for _, e := range events {
+		err = srv.Sender.Send(ctx, e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseRequest(r xml.TokenReader) (request, error) {
+	var req request
+	iter := xmlstream.NewIter(r)
+	/* #nosec */
+	defer iter.Close()
+	var found bool
+	for iter.Next() {
+		start, child := iter.Current()
+		if start == nil {
+			continue
+		}
+		var err error
+		switch {
+		case !found:
+			found = true
+			req.op = start.Copy()
+			req.inner, err = xmlstream.ReadAll(xmlstream.Inner(child))
+		case start.Name.Space == paging.NS && start.Name.Local == "set":
+			req.rsm = &paging.Request{}
+			err = xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), child)).Decode(req.rsm)
+		case start.Name.Local == "configure" || start.Name.Local == "publish-options" || start.Name.Local == "options":
+			req.form, err = decodeForm(child)
+		}
+		if err != nil {
+			return req, err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return req, err
+	}
+	if !found {
+		return req, stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}
+	}
+	return req, nil
+}
+
+// decodeForm decodes the first data form found in r.
+func decodeForm(r xml.TokenReader) (*form.Data, error) {
+	iter := xmlstream.NewIter(r)
+	/* #nosec */
+	defer iter.Close()
+	for iter.Next() {
+		start, child := iter.Current()
+		if start == nil || start.Name.Space != form.NS || start.Name.Local != "x" {
+			continue
+		}
+		data := &form.Data{}
+		err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), child)).Decode(data)
+		return data, err
+	}
+	return nil, iter.Err()
+}
+
+func (srv *Service) store() Store {
+	if srv.Store != nil {
+		return srv.Store
+	}
+	return &srv.mem
+}
+
+func (srv *Service) serviceAddr(iq stanza.IQ) jid.JID {
+	switch {
+	case srv.PEP && !iq.To.Equal(jid.JID{}):
+		return iq.To.Bare()
+	case srv.PEP:
+		return iq.From.Bare()
+	case !iq.To.Equal(jid.JID{}):
+		return iq.To
+	}
+	return srv.Addr
+}
+
+func (srv *Service) defaultConfig() NodeConfig {
+	if srv.PEP {
+		return NodeConfig{
+			AccessModel:  AccessPresence,
+			PersistItems: true,
+			MaxItems:     1,
+		}
+	}
+	return NodeConfig{
+		AccessModel:   AccessOpen,
+		PersistItems:  true,
+		NotifyRetract: true,
+	}
+}
+
+func (srv *Service) handle(ctx context.Context, iq stanza.IQ, ns string, req request) (xml.TokenReader, []xml.TokenReader, error) {
+	service := srv.serviceAddr(iq)
+	_, node := attr.Get(req.op.Attr, "node")
+	op := req.op.Name.Local
+
+	if op == "options" || (ns == NS && op == "default") {
+		return nil, nil, Error{
+			Err:       stanza.Error{Type: stanza.Cancel, Condition: stanza.FeatureNotImplemented},
+			Condition: CondUnsupported,
+			Feature:   FeatureSubscriptionOptions,
+		}
+	}
+	if ns == NSOwner && op == "default" {
+		return ownerResult(xml.StartElement{Name: xml.Name{Local: "default"}}, srv.defaultConfig().Form().TokenReader()), nil, nil
+	}
+	if ns == NS && iq.Type == stanza.SetIQ && op == "create" {
+		payload, err := srv.create(ctx, service, iq.From, node, req.form)
+		return payload, nil, err
+	}
+	if ns == NS && iq.Type == stanza.GetIQ && op == "subscriptions" {
+		payload, err := srv.subscriptions(ctx, service, iq.From, node)
+		return payload, nil, err
+	}
+
+	if node == "" {
+		return nil, nil, Error{
+			Err:       stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest},
+			Condition: CondNodeIDRequired,
+		}
+	}
+	n, ok, err := srv.store().Node(ctx, service, node)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok && ns == NS && op == "publish" && srv.PEP && iq.From.Bare().Equal(service) {
+		// PEP nodes are created automatically when first published to.
+		n = Node{
+			Config:       srv.defaultConfig(),
+			Affiliations: []Affiliation{{Addr: service, Affiliation: AffOwner}},
+		}
+		if req.form != nil {
+			err = n.Config.apply(req.form)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		err = srv.store().SetNode(ctx, service, node, n)
+		if err != nil {
+			return nil, nil, err
+		}
+		ok = true
+	}
+	if !ok {
+		return nil, nil, stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound}
+	}
+	aff := srv.affiliation(service, n, iq.From)
+
+	if ns == NSOwner {
+		if aff != AffOwner {
+			return nil, nil, stanza.Error{Type: stanza.Auth, Condition: stanza.Forbidden}
+		}
+		return srv.handleOwner(ctx, iq, service, node, n, req)
+	}
+
+	switch {
+	case iq.Type == stanza.SetIQ && op == "publish":
+		return srv.publish(ctx, service, iq.From, node, n, aff, req)
+	case iq.Type == stanza.SetIQ && op == "retract":
+		return srv.retract(ctx, service, node, n, aff, req)
+	case iq.Type == stanza.SetIQ && op == "subscribe":
+		payload, err := srv.subscribe(ctx, service, iq.From, node, n, req)
+		return payload, nil, err
+	case iq.Type == stanza.SetIQ && op == "unsubscribe":
+		return nil, nil, srv.unsubscribe(ctx, service, iq.From, node, n, aff, req)
+	case iq.Type == stanza.GetIQ && op == "items":
+		err = srv.canAccess(service, n, iq.From)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload, err := srv.items(ctx, service, node, req)
+		return payload, nil, err
+	}
+	return nil, nil, stanza.Error{Type: stanza.Cancel, Condition: stanza.FeatureNotImplemented}
+}
+
+func (srv *Service) handleOwner(ctx context.Context, iq stanza.IQ, service jid.JID, node string, n Node, req request) (xml.TokenReader, []xml.TokenReader, error) {
+	nodeAttr := []xml.Attr{{Name: xml.Name{Local: "node"}, Value: node}}
+	switch op := req.op.Name.Local; {
+	case iq.Type == stanza.GetIQ && op == "configure":
+		return ownerResult(xml.StartElement{Name: xml.Name{Local: "configure"}, Attr: nodeAttr}, n.Config.Form().TokenReader()), nil, nil
+	case iq.Type == stanza.SetIQ && op == "configure":
+		data, err := decodeForm(xmltok.Replay(req.inner))
+		if err != nil {
+			return nil, nil, err
+		}
+		if data == nil {
+			return nil, nil, stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}
+		}
+		err = n.Config.apply(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, srv.store().SetNode(ctx, service, node, n)
+	case iq.Type == stanza.SetIQ && op == "delete":
+		var redirect xml.TokenReader
+		iter := xmlstream.NewIter(xmltok.Replay(req.inner))
+		for iter.Next() {
+			start, _ := iter.Current()
+			if start != nil && start.Name.Local == "redirect" {
+				_, uri := attr.Get(start.Attr, "uri")
+				redirect = xmlstream.Wrap(nil, xml.StartElement{
+					Name: xml.Name{Local: "redirect"},
+					Attr: []xml.Attr{{Name: xml.Name{Local: "uri"}, Value: uri}},
+				})
+			}
+		}
+		err := iter.Err()
+		if err != nil {
+			return nil, nil, err
+		}
+		var redirectToks []xml.Token
+		if redirect != nil {
+			redirectToks, err = xmlstream.ReadAll(redirect)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		err = srv.store().DeleteNode(ctx, service, node)
+		if err != nil {
+			return nil, nil, err
+		}
+		events := srv.events(service, n, func() xml.TokenReader {
+			return xmlstream.Wrap(
+				xmltok.Replay(redirectToks),
+				xml.StartElement{Name: xml.Name{Local: "delete"}, Attr: nodeAttr},
+			)
+		})
+		return nil, events, nil
+	case iq.Type == stanza.SetIQ && op == "purge":
+		err := srv.store().Purge(ctx, service, node)
+		if err != nil {
+			return nil, nil, err
+		}
+		events := srv.events(service, n, func() xml.TokenReader {
+			return xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "purge"}, Attr: nodeAttr})
+		})
+		return nil, events, nil
+	case iq.Type == stanza.GetIQ && op == "affiliations":
+		var affs []xml.TokenReader
+		for _, aff := range n.Affiliations {
+			affs = append(affs, aff.TokenReader())
+		}
+		return ownerResult(req.op, xmlstream.MultiReader(affs...)), nil, nil
+	case iq.Type == stanza.SetIQ && op == "affiliations":
+		var affs []Affiliation
+		err := decodeChildren(req.inner, func(d *xml.Decoder, start xml.StartElement) error {
+			var aff Affiliation
+			err := d.DecodeElement(&aff, &start)
+			affs = append(affs, aff)
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, aff := range affs {
+			for i := 0; i < len(n.Affiliations); i++ {
+				if n.Affiliations[i].Addr.Equal(aff.Addr) {
+					n.Affiliations = append(n.Affiliations[:i], n.Affiliations[i+1:]...)
+					i--
+				}
+			}
+			if aff.Affiliation != AffNone {
+				n.Affiliations = append(n.Affiliations, aff)
+			}
+		}
+		return nil, nil, srv.store().SetNode(ctx, service, node, n)
+	case iq.Type == stanza.GetIQ && op == "subscriptions":
+		var subs []xml.TokenReader
+		for _, sub := range n.Subscriptions {
+			sub.Node = ""
+			subs = append(subs, sub.wrap(NSOwner))
+		}
+		return ownerResult(req.op, xmlstream.MultiReader(subs...)), nil, nil
+	case iq.Type == stanza.SetIQ && op == "subscriptions":
+		var subs []Subscription
+		err := decodeChildren(req.inner, func(d *xml.Decoder, start xml.StartElement) error {
+			var sub Subscription
+			err := d.DecodeElement(&sub, &start)
+			subs = append(subs, sub)
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, sub := range subs {
+			sub.Node = node
+			var found bool
+			for i := 0; i < len(n.Subscriptions); i++ {
+				existing := n.Subscriptions[i]
+				if !existing.Addr.Equal(sub.Addr) || (sub.ID != "" && sub.ID != existing.ID) {
+					continue
+				}
+				found = true
+				if sub.Subscription == SubNone {
+					n.Subscriptions = append(n.Subscriptions[:i], n.Subscriptions[i+1:]...)
+					i--
+					continue
+				}
+				n.Subscriptions[i].Subscription = sub.Subscription
+			}
+			if !found && sub.Subscription != SubNone {
+				if sub.ID == "" {
+					sub.ID = attr.RandomID()
+				}
+				n.Subscriptions = append(n.Subscriptions, sub)
+			}
+		}
+		return nil, nil, srv.store().SetNode(ctx, service, node, n)
+	}
+	return nil, nil, stanza.Error{Type: stanza.Cancel, Condition: stanza.FeatureNotImplemented}
+}
+
+func (srv *Service) create(ctx context.Context, service, from jid.JID, node string, cfg *form.Data) (xml.TokenReader, error) {
+	if srv.PEP && !from.Bare().Equal(service) {
+		return nil, stanza.Error{Type: stanza.Auth, Condition: stanza.Forbidden}
+	}
+	instant := node == ""
+	if instant {
+		node = attr.RandomID()
+	}
+	_, exists, err := srv.store().Node(ctx, service, node)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, stanza.Error{Type: stanza.Cancel, Condition: stanza.Conflict}
+	}
+	n := Node{
+		Config:       srv.defaultConfig(),
+		Affiliations: []Affiliation{{Addr: from.Bare(), Affiliation: AffOwner}},
+	}
+	if cfg != nil {
+		err = n.Config.apply(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = srv.store().SetNode(ctx, service, node, n)
+	if err != nil || !instant {
+		return nil, err
+	}
+	return xmlstream.Wrap(
+		xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Local: "create"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "node"}, Value: node}},
+		}),
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "pubsub"}},
+	), nil
+}
+
+func (srv *Service) publish(ctx context.Context, service, from jid.JID, node string, n Node, aff AffType, req request) (xml.TokenReader, []xml.TokenReader, error) {
+	if aff != AffOwner && aff != AffPublisher && aff != AffPublishOnly {
+		return nil, nil, stanza.Error{Type: stanza.Auth, Condition: stanza.Forbidden}
+	}
+	if req.form != nil {
+		want := n.Config
+		err := want.apply(req.form)
+		if err != nil || want != n.Config {
+			return nil, nil, Error{
+				Err:       stanza.Error{Type: stanza.Cancel, Condition: stanza.Conflict},
+				Condition: CondPreconditionNotMet,
+			}
+		}
+	}
+
+	var (
+		item  Item
+		found bool
+	)
+	iter := xmlstream.NewIter(xmltok.Replay(req.inner))
+	for iter.Next() {
+		start, child := iter.Current()
+		if start == nil || start.Name.Local != "item" || found {
+			continue
+		}
+		found = true
+		_, item.ID = attr.Get(start.Attr, "id")
+		var err error
+		item.Payload, err = xmlstream.ReadAll(xmlstream.Inner(child))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return nil, nil, Error{
+			Err:       stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest},
+			Condition: CondItemRequired,
+		}
+	}
+	if item.ID == "" {
+		item.ID = attr.RandomID()
+	}
+	item.Publisher = from.Bare()
+
+	if n.Config.PersistItems {
+		err := srv.store().Publish(ctx, service, node, item, n.Config.MaxItems)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	itemAttr := []xml.Attr{{Name: xml.Name{Local: "id"}, Value: item.ID}}
+	nodeAttr := []xml.Attr{{Name: xml.Name{Local: "node"}, Value: node}}
+	events := srv.events(service, n, func() xml.TokenReader {
+		return xmlstream.Wrap(
+			xmlstream.Wrap(
+				xmltok.Replay(item.Payload),
+				xml.StartElement{Name: xml.Name{Local: "item"}, Attr: append(itemAttr, xml.Attr{
+					Name:  xml.Name{Local: "publisher"},
+					Value: item.Publisher.String(),
+				})},
+			),
+			xml.StartElement{Name: xml.Name{Local: "items"}, Attr: nodeAttr},
+		)
+	})
+	return xmlstream.Wrap(
+		xmlstream.Wrap(
+			xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "item"}, Attr: itemAttr}),
+			xml.StartElement{Name: xml.Name{Local: "publish"}, Attr: nodeAttr},
+		),
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "pubsub"}},
+	), events, nil
+}
+
+func (srv *Service) retract(ctx context.Context, service jid.JID, node string, n Node, aff AffType, req request) (xml.TokenReader, []xml.TokenReader, error) {
+	if aff != AffOwner && aff != AffPublisher {
+		return nil, nil, stanza.Error{Type: stanza.Auth, Condition: stanza.Forbidden}
+	}
+	var id string
+	iter := xmlstream.NewIter(xmltok.Replay(req.inner))
+	for iter.Next() {
+		start, _ := iter.Current()
+		if start != nil && start.Name.Local == "item" && id == "" {
+			_, id = attr.Get(start.Attr, "id")
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, nil, err
+	}
+	if id == "" {
+		return nil, nil, Error{
+			Err:       stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest},
+			Condition: CondItemRequired,
+		}
+	}
+	ok, err := srv.store().Retract(ctx, service, node, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound}
+	}
+
+	notify := n.Config.NotifyRetract
+	if _, v := attr.Get(req.op.Attr, "notify"); v != "" {
+		notify, _ = strconv.ParseBool(v)
+	}
+	if !notify {
+		return nil, nil, nil
+	}
+	events := srv.events(service, n, func() xml.TokenReader {
+		return xmlstream.Wrap(
+			xmlstream.Wrap(nil, xml.StartElement{
+				Name: xml.Name{Local: "retract"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: id}},
+			}),
+			xml.StartElement{
+				Name: xml.Name{Local: "items"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "node"}, Value: node}},
+			},
+		)
+	})
+	return nil, events, nil
+}
+
+func (srv *Service) subscribe(ctx context.Context, service, from jid.JID, node string, n Node, req request) (xml.TokenReader, error) {
+	result := func(sub Subscription) xml.TokenReader {
+		return xmlstream.Wrap(sub.TokenReader(), xml.StartElement{Name: xml.Name{Space: NS, Local: "pubsub"}})
+	}
+	_, addr := attr.Get(req.op.Attr, "jid")
+	j, err := jid.Parse(addr)
+	if err != nil || !j.Bare().Equal(from.Bare()) {
+		return nil, Error{
+			Err:       stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest},
+			Condition: CondInvalidJID,
+		}
+	}
+	err = srv.canAccess(service, n, j)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range n.Subscriptions {
+		if sub.Addr.Equal(j) {
+			return result(sub), nil
+		}
+	}
+	sub := Subscription{
+		ID:           attr.RandomID(),
+		Node:         node,
+		Addr:         j,
+		Subscription: SubSubscribed,
+	}
+	n.Subscriptions = append(n.Subscriptions, sub)
+	err = srv.store().SetNode(ctx, service, node, n)
+	if err != nil {
+		return nil, err
+	}
+	return result(sub), nil
+}
+
+func (srv *Service) unsubscribe(ctx context.Context, service, from jid.JID, node string, n Node, aff AffType, req request) error {
+	_, addr := attr.Get(req.op.Attr, "jid")
+	_, subID := attr.Get(req.op.Attr, "subid")
+	j, err := jid.Parse(addr)
+	if err != nil {
+		return Error{
+			Err:       stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest},
+			Condition: CondInvalidJID,
+		}
+	}
+	if !j.Bare().Equal(from.Bare()) && aff != AffOwner {
+		return stanza.Error{Type: stanza.Auth, Condition: stanza.Forbidden}
+	}
+	var found bool
+	for i := 0; i < len(n.Subscriptions); i++ {
+		sub := n.Subscriptions[i]
+		if sub.Addr.Equal(j) && (subID == "" || sub.ID == subID) {
+			n.Subscriptions = append(n.Subscriptions[:i], n.Subscriptions[i+1:]...)
+			i--
+			found = true
+		}
+	}
+	if !found {
+		return Error{
+			Err:       stanza.Error{Type: stanza.Cancel, Condition: stanza.UnexpectedRequest},
+			Condition: CondNotSubscribed,
+		}
+	}
+	return srv.store().SetNode(ctx, service, node, n)
+}
+
+func (srv *Service) subscriptions(ctx context.Context, service, from jid.JID, node string) (xml.TokenReader, error) {
+	nodes := []string{node}
+	if node == "" {
+		var err error
+		nodes, err = srv.store().Nodes(ctx, service)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var subs []xml.TokenReader
+	for _, name := range nodes {
+		n, ok, err := srv.store().Node(ctx, service, name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		for _, sub := range n.Subscriptions {
+			if sub.Addr.Bare().Equal(from.Bare()) {
+				sub.Node = name
+				subs = append(subs, sub.TokenReader())
+			}
+		}
+	}
+	start := xml.StartElement{Name: xml.Name{Local: "subscriptions"}}
+	if node != "" {
+		start.Attr = []xml.Attr{{Name: xml.Name{Local: "node"}, Value: node}}
+	}
+	return xmlstream.Wrap(
+		xmlstream.Wrap(xmlstream.MultiReader(subs...), start),
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "pubsub"}},
+	), nil
+}
+
+func (srv *Service) items(ctx context.Context, service jid.JID, node string, req request) (xml.TokenReader, error) {
+	items, err := srv.store().Items(ctx, service, node)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect any specific item IDs that were requested.
+	var ids []string
+	iter := xmlstream.NewIter(xmltok.Replay(req.inner))
+	for iter.Next() {
+		start, _ := iter.Current()
+		if start != nil && start.Name.Local == "item" {
+			_, id := attr.Get(start.Attr, "id")
+			ids = append(ids, id)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	var set xml.TokenReader
+	switch {
+	case len(ids) > 0:
+		var filtered []Item
+		for _, id := range ids {
+			for _, item := range items {
+				if item.ID == id {
+					filtered = append(filtered, item)
+					break
+				}
+			}
+		}
+		items = filtered
+	case req.rsm != nil:
+		items, set, err = page(items, req.rsm)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		_, maxItems := attr.Get(req.op.Attr, "max_items")
+		if maxItems != "" {
+			max, err := strconv.ParseUint(maxItems, 10, 64)
+			if err != nil {
+				return nil, stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}
+			}
+			if max < uint64(len(items)) {
+				items = items[uint64(len(items))-max:]
+			}
+		}
+	}
+
+	var payloads []xml.TokenReader
+	for _, item := range items {
+		payloads = append(payloads, xmlstream.Wrap(
+			xmltok.Replay(item.Payload),
+			xml.StartElement{
+				Name: xml.Name{Local: "item"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: item.ID}},
+			},
+		))
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(
+			xmlstream.Wrap(
+				xmlstream.MultiReader(payloads...),
+				xml.StartElement{
+					Name: xml.Name{Local: "items"},
+					Attr: []xml.Attr{{Name: xml.Name{Local: "node"}, Value: node}},
+				},
+			),
+			set,
+		),
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "pubsub"}},
+	), nil
+}
+
+// itemSlice is a paging.Source over a list of items.
+type itemSlice []Item
+
+func (s itemSlice) Len() (uint64, error) {
+	return uint64(len(s)), nil
+}
+
+func (s itemSlice) Index(id string) (uint64, bool, error) {
+	for i, item := range s {
+		if item.ID == id {
+			return uint64(i), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (s itemSlice) Page(offset, max uint64, f func(id string) error) error {
+	for _, item := range s[offset : offset+max] {
+		err := f(item.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// page returns the page of items selected by the result set management
+// request along with the set describing the page.
+func page(items []Item, req *paging.Request) ([]Item, xml.TokenReader, error) {
+	p, err := paging.Respond(itemSlice(items), req, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var offset uint64
+	if p.Set.First.Index != nil {
+		offset = *p.Set.First.Index
+	}
+	return items[offset : offset+uint64(len(p.IDs))], p.TokenReader(), nil
+}
+
+// affiliation returns the affiliation of j with the node.
+func (srv *Service) affiliation(service jid.JID, n Node, j jid.JID) AffType {
+	if srv.PEP && j.Bare().Equal(service) {
+		return AffOwner
+	}
+	for _, aff := range n.Affiliations {
+		if aff.Addr.Equal(j.Bare()) {
+			return aff.Affiliation
+		}
+	}
+	return AffNone
+}
+
+// canAccess returns an error if j may not subscribe to the node or retrieve
+// its items.
+func (srv *Service) canAccess(service jid.JID, n Node, j jid.JID) error {
+	switch srv.affiliation(service, n, j) {
+	case AffOwner, AffPublisher, AffMember:
+		return nil
+	case AffOutcast:
+		return stanza.Error{Type: stanza.Auth, Condition: stanza.Forbidden}
+	}
+	switch n.Config.AccessModel {
+	case AccessOpen:
+		return nil
+	case AccessPresence:
+		owner := service
+		if !srv.PEP {
+			for _, aff := range n.Affiliations {
+				if aff.Affiliation == AffOwner {
+					owner = aff.Addr
+					break
+				}
+			}
+		}
+		if srv.Presence != nil && srv.Presence(owner, j.Bare()) {
+			return nil
+		}
+		return Error{
+			Err:       stanza.Error{Type: stanza.Auth, Condition: stanza.NotAuthorized},
+			Condition: CondPresenceRequired,
+		}
+	}
+	return Error{
+		Err:       stanza.Error{Type: stanza.Cancel, Condition: stanza.NotAllowed},
+		Condition: CondClosedNode,
+	}
+}
+
+// events returns event notifications containing the payload for each
+// subscriber that can access the node.
+func (srv *Service) events(service jid.JID, n Node, payload func() xml.TokenReader) []xml.TokenReader {
+	if srv.Sender == nil {
+		return nil
+	}
+	var events []xml.TokenReader
+	for _, sub := range n.Subscriptions {
+		if sub.Subscription != SubSubscribed || srv.canAccess(service, n, sub.Addr) != nil {
+			continue
+		}
+		events = append(events, stanza.Message{
+			From: service,
+			To:   sub.Addr,
+			Type: stanza.HeadlineMessage,
+		}.Wrap(xmlstream.Wrap(
+			payload(),
+			xml.StartElement{Name: xml.Name{Space: NSEvent, Local: "event"}},
+		)))
+	}
+	return events
+}
+
+func ownerResult(start xml.StartElement, inner xml.TokenReader) xml.TokenReader {
+	return xmlstream.Wrap(
+		xmlstream.Wrap(inner, start),
+		xml.StartElement{Name: xml.Name{Space: NSOwner, Local: "pubsub"}},
+	)
+}
+
+// decodeChildren calls f for each child element in the token stream.
+func decodeChildren(toks []xml.Token, f func(*xml.Decoder, xml.StartElement) error) error {
+	d := xml.NewTokenDecoder(xmltok.Replay(toks))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		err = f(d, start)
+		if err != nil {
+			return err
+		}
+	}
+}
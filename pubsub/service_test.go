@@ -0,0 +1,324 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/paging"
+	"mellium.im/xmpp/pubsub"
+	"mellium.im/xmpp/stanza"
+)
+
+var _ pubsub.Store = (*pubsub.MemStore)(nil)
+
+type eventSender chan string
+
+func (s eventSender) Send(_ context.Context, r xml.TokenReader) error {
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	_, err := xmlstream.Copy(e, r)
+	if err != nil {
+		return err
+	}
+	err = e.Flush()
+	if err != nil {
+		return err
+	}
+	s <- b.String()
+	return nil
+}
+
+func entry(s string) xml.TokenReader {
+	return xml.NewDecoder(strings.NewReader(`<entry xmlns="http://www.w3.org/2005/Atom">` + s + `</entry>`))
+}
+
+func fetchIDs(t *testing.T, iter *pubsub.Iter) []string {
+	t.Helper()
+	var ids []string
+	for iter.Next() {
+		id, _ := iter.Item()
+		ids = append(ids, id)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("error fetching items: %v", err)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatalf("error closing iter: %v", err)
+	}
+	return ids
+}
+
+func TestService(t *testing.T) {
+	events := make(eventSender, 10)
+	srv := &pubsub.Service{
+		Addr:   jid.MustParse("pubsub.example.net"),
+		Sender: events,
+	}
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(mux.New(stanza.NSClient, pubsub.HandleService(srv))))
+	defer cs.Close()
+
+	ctx := context.Background()
+	owner := stanza.IQ{From: jid.MustParse("hamlet@example.net/elsinore")}
+	user := stanza.IQ{From: cs.Client.LocalAddr()}
+	const node = "princely_musings"
+
+	err := pubsub.CreateNodeIQ(ctx, cs.Client, owner, node, nil)
+	if err != nil {
+		t.Fatalf("error creating node: %v", err)
+	}
+	err = pubsub.CreateNodeIQ(ctx, cs.Client, owner, node, nil)
+	if !errors.Is(err, stanza.Error{Condition: stanza.Conflict}) {
+		t.Fatalf("expected conflict creating duplicate node, got: %v", err)
+	}
+
+	sub, err := pubsub.SubscribeIQ(ctx, cs.Client, user, node, nil)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	if sub.Subscription != pubsub.SubSubscribed {
+		t.Errorf("wrong subscription state: want=%v, got=%v", pubsub.SubSubscribed, sub.Subscription)
+	}
+
+	_, err = pubsub.PublishIQ(ctx, cs.Client, user, node, "1", entry("forbidden"))
+	if !errors.Is(err, stanza.Error{Condition: stanza.Forbidden}) {
+		t.Errorf("expected non-publisher to be forbidden, got: %v", err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		_, err = pubsub.PublishIQ(ctx, cs.Client, owner, node, id, entry("Soliloquy "+id))
+		if err != nil {
+			t.Fatalf("error publishing item %s: %v", id, err)
+		}
+		ev := <-events
+		if !strings.Contains(ev, `id="`+id+`"`) || !strings.Contains(ev, "Soliloquy "+id) {
+			t.Errorf("wrong event for item %s: %s", id, ev)
+		}
+	}
+
+	ids := fetchIDs(t, pubsub.FetchIQ(ctx, user, cs.Client, pubsub.Query{Node: node, MaxItems: 2}))
+	if want := "2,3"; strings.Join(ids, ",") != want {
+		t.Errorf("wrong items fetched: want=%s, got=%v", want, ids)
+	}
+
+	err = pubsub.DeleteIQ(ctx, cs.Client, owner, node, "2", true)
+	if err != nil {
+		t.Fatalf("error retracting item: %v", err)
+	}
+	if ev := <-events; !strings.Contains(ev, `<retract id="2">`) {
+		t.Errorf("wrong retract event: %s", ev)
+	}
+	ids = fetchIDs(t, pubsub.FetchIQ(ctx, user, cs.Client, pubsub.Query{Node: node}))
+	if want := "1,3"; strings.Join(ids, ",") != want {
+		t.Errorf("wrong items after retract: want=%s, got=%v", want, ids)
+	}
+
+	err = pubsub.PurgeIQ(ctx, cs.Client, user, node)
+	if !errors.Is(err, stanza.Error{Condition: stanza.Forbidden}) {
+		t.Errorf("expected non-owner purge to be forbidden, got: %v", err)
+	}
+	err = pubsub.PurgeIQ(ctx, cs.Client, owner, node)
+	if err != nil {
+		t.Fatalf("error purging node: %v", err)
+	}
+	if ev := <-events; !strings.Contains(ev, `<purge node="princely_musings">`) {
+		t.Errorf("wrong purge event: %s", ev)
+	}
+	ids = fetchIDs(t, pubsub.FetchIQ(ctx, user, cs.Client, pubsub.Query{Node: node}))
+	if len(ids) != 0 {
+		t.Errorf("expected no items after purge, got: %v", ids)
+	}
+
+	err = pubsub.DeleteNodeIQ(ctx, cs.Client, owner, node, "xmpp:pubsub.example.net?;node=blog")
+	if err != nil {
+		t.Fatalf("error deleting node: %v", err)
+	}
+	if ev := <-events; !strings.Contains(ev, `<redirect uri="xmpp:pubsub.example.net?;node=blog">`) {
+		t.Errorf("wrong delete event: %s", ev)
+	}
+	_, err = pubsub.SubscriptionsIQ(ctx, cs.Client, user, node)
+	if err != nil {
+		t.Errorf("unexpected error listing subscriptions: %v", err)
+	}
+}
+
+func TestServiceAccessModel(t *testing.T) {
+	presence := map[string]bool{}
+	srv := &pubsub.Service{
+		Addr: jid.MustParse("pubsub.example.net"),
+		Presence: func(owner, contact jid.JID) bool {
+			return presence[owner.String()+" "+contact.String()]
+		},
+	}
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(mux.New(stanza.NSClient, pubsub.HandleService(srv))))
+	defer cs.Close()
+
+	ctx := context.Background()
+	owner := stanza.IQ{From: jid.MustParse("hamlet@example.net/elsinore")}
+	user := stanza.IQ{From: cs.Client.LocalAddr()}
+	const node = "secrets"
+
+	cfg := form.New(
+		form.Hidden("FORM_TYPE", form.Value("http://jabber.org/protocol/pubsub#node_config")),
+		form.List("pubsub#access_model", form.Value("whitelist")),
+	)
+	err := pubsub.CreateNodeIQ(ctx, cs.Client, owner, node, cfg)
+	if err != nil {
+		t.Fatalf("error creating node: %v", err)
+	}
+
+	var se stanza.Error
+	_, err = pubsub.SubscribeIQ(ctx, cs.Client, user, node, nil)
+	if !errors.As(err, &se) || se.Condition != stanza.NotAllowed {
+		t.Errorf("expected not-allowed error subscribing to whitelist node, got: %v", err)
+	}
+
+	err = pubsub.SetAffiliationsIQ(ctx, cs.Client, owner, node, pubsub.Affiliation{
+		Addr:        cs.Client.LocalAddr().Bare(),
+		Affiliation: pubsub.AffMember,
+	})
+	if err != nil {
+		t.Fatalf("error setting affiliation: %v", err)
+	}
+	_, err = pubsub.SubscribeIQ(ctx, cs.Client, user, node, nil)
+	if err != nil {
+		t.Errorf("error subscribing as member: %v", err)
+	}
+
+	cfg, err = pubsub.GetConfigIQ(ctx, cs.Client, owner, node)
+	if err != nil {
+		t.Fatalf("error fetching config: %v", err)
+	}
+	_, err = cfg.Set("pubsub#access_model", "presence")
+	if err != nil {
+		t.Fatalf("error setting access model: %v", err)
+	}
+	err = pubsub.SetConfigIQ(ctx, cs.Client, owner, node, cfg)
+	if err != nil {
+		t.Fatalf("error configuring node: %v", err)
+	}
+	err = pubsub.SetAffiliationsIQ(ctx, cs.Client, owner, node, pubsub.Affiliation{
+		Addr:        cs.Client.LocalAddr().Bare(),
+		Affiliation: pubsub.AffNone,
+	})
+	if err != nil {
+		t.Fatalf("error removing affiliation: %v", err)
+	}
+
+	iter := pubsub.FetchIQ(ctx, user, cs.Client, pubsub.Query{Node: node})
+	iter.Next()
+	if err = iter.Err(); !errors.As(err, &se) || se.Condition != stanza.NotAuthorized {
+		t.Errorf("expected not-authorized error, got: %v", err)
+	}
+	/* #nosec */
+	iter.Close()
+
+	presence["hamlet@example.net "+cs.Client.LocalAddr().Bare().String()] = true
+	fetchIDs(t, pubsub.FetchIQ(ctx, user, cs.Client, pubsub.Query{Node: node}))
+}
+
+func TestServicePEP(t *testing.T) {
+	srv := &pubsub.Service{PEP: true}
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(mux.New(stanza.NSClient, pubsub.HandleService(srv))))
+	defer cs.Close()
+
+	ctx := context.Background()
+	self := stanza.IQ{From: cs.Client.LocalAddr()}
+	other := stanza.IQ{From: jid.MustParse("hamlet@example.net"), To: cs.Client.LocalAddr().Bare()}
+	const node = "urn:xmpp:bookmarks:1"
+
+	_, err := pubsub.PublishIQ(ctx, cs.Client, other, node, "1", entry("nope"))
+	if !errors.Is(err, stanza.Error{Condition: stanza.ItemNotFound}) {
+		t.Errorf("expected other entities not to auto-create nodes, got: %v", err)
+	}
+	_, err = pubsub.PublishPrivateIQ(ctx, cs.Client, self, node, "1", entry("private"))
+	if err != nil {
+		t.Fatalf("error publishing to PEP: %v", err)
+	}
+	cfg, err := pubsub.GetConfigIQ(ctx, cs.Client, self, node)
+	if err != nil {
+		t.Fatalf("error fetching PEP node config: %v", err)
+	}
+	if model, _ := cfg.GetString("pubsub#access_model"); model != "whitelist" {
+		t.Errorf("wrong access model for auto-created node: want=whitelist, got=%s", model)
+	}
+
+	iter := pubsub.FetchIQ(ctx, other, cs.Client, pubsub.Query{Node: node})
+	iter.Next()
+	if err = iter.Err(); err == nil {
+		t.Errorf("expected other entities not to be able to fetch private items")
+	}
+	/* #nosec */
+	iter.Close()
+}
+
+func TestServicePaging(t *testing.T) {
+	srv := &pubsub.Service{Addr: jid.MustParse("pubsub.example.net")}
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(mux.New(stanza.NSClient, pubsub.HandleService(srv))))
+	defer cs.Close()
+
+	ctx := context.Background()
+	owner := stanza.IQ{From: cs.Client.LocalAddr()}
+	const node = "princely_musings"
+	err := pubsub.CreateNodeIQ(ctx, cs.Client, owner, node, nil)
+	if err != nil {
+		t.Fatalf("error creating node: %v", err)
+	}
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		_, err = pubsub.PublishIQ(ctx, cs.Client, owner, node, id, entry(id))
+		if err != nil {
+			t.Fatalf("error publishing item %s: %v", id, err)
+		}
+	}
+
+	var resp struct {
+		Items []struct {
+			ID string `xml:"id,attr"`
+		} `xml:"items>item"`
+		Set paging.Set `xml:"http://jabber.org/protocol/rsm set"`
+	}
+	owner.Type = stanza.GetIQ
+	err = cs.Client.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		xmlstream.MultiReader(
+			xmlstream.Wrap(nil, xml.StartElement{
+				Name: xml.Name{Local: "items"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "node"}, Value: node}},
+			}),
+			(&paging.RequestNext{Max: 2, After: "b"}).TokenReader(),
+		),
+		xml.StartElement{Name: xml.Name{Space: pubsub.NS, Local: "pubsub"}},
+	), owner, &resp)
+	if err != nil {
+		t.Fatalf("error fetching page: %v", err)
+	}
+	if len(resp.Items) != 2 || resp.Items[0].ID != "c" || resp.Items[1].ID != "d" {
+		t.Errorf("wrong page: %+v", resp.Items)
+	}
+	if resp.Set.First.ID != "c" || resp.Set.Last != "d" || resp.Set.Count == nil || *resp.Set.Count != 5 || resp.Set.First.Index == nil || *resp.Set.First.Index != 2 {
+		t.Errorf("wrong set: %+v", resp.Set)
+	}
+}
+
+func TestErrorMarshal(t *testing.T) {
+	out, err := xml.Marshal(pubsub.Error{
+		Err:       stanza.Error{Type: stanza.Cancel, Condition: stanza.NotAllowed},
+		Condition: pubsub.CondClosedNode,
+	})
+	if err != nil {
+		t.Fatalf("error marshaling: %v", err)
+	}
+	const want = `<error type="cancel"><not-allowed xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></not-allowed><closed-node xmlns="http://jabber.org/protocol/pubsub#errors"></closed-node></error>`
+	if string(out) != want {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", want, out)
+	}
+}
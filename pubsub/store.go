@@ -0,0 +1,315 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"context"
+	"encoding/xml"
+	"strconv"
+	"sync"
+
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// AccessModel controls which entities may subscribe to a node and retrieve
+// its items.
+type AccessModel string
+
+// A list of access models supported by Service.
+const (
+	// AccessOpen allows any entity that is not an outcast to subscribe and
+	// retrieve items.
+	AccessOpen AccessModel = "open"
+
+	// AccessPresence allows any entity that is subscribed to the owner's
+	// presence to subscribe and retrieve items.
+	AccessPresence AccessModel = "presence"
+
+	// AccessWhitelist allows only owners, publishers, and members to subscribe
+	// and retrieve items.
+	AccessWhitelist AccessModel = "whitelist"
+)
+
+// Form fields used in node configuration forms.
+const (
+	nodeConfigType     = NS + "#node_config"
+	fieldTitle         = "pubsub#title"
+	fieldAccessModel   = "pubsub#access_model"
+	fieldPersistItems  = "pubsub#persist_items"
+	fieldMaxItems      = "pubsub#max_items"
+	fieldNotifyRetract = "pubsub#notify_retract"
+)
+
+// NodeConfig is the configuration of a node stored by a Service.
+type NodeConfig struct {
+	Title       string
+	AccessModel AccessModel
+
+	// PersistItems controls whether published items are stored.
+	// If false, items are only sent to subscribers.
+	PersistItems bool
+
+	// MaxItems is the maximum number of items to store.
+	// If it is zero, there is no limit.
+	MaxItems uint64
+
+	// NotifyRetract controls whether subscribers are notified when an item is
+	// retracted.
+	NotifyRetract bool
+}
+
+// Form returns a node configuration form populated with the values from the
+// config.
+func (c NodeConfig) Form() *form.Data {
+	maxItems := "max"
+	if c.MaxItems > 0 {
+		maxItems = strconv.FormatUint(c.MaxItems, 10)
+	}
+	return form.New(
+		form.Hidden("FORM_TYPE", form.Value(nodeConfigType)),
+		form.Text(fieldTitle, form.Value(c.Title)),
+		form.List(fieldAccessModel,
+			form.Value(string(c.AccessModel)),
+			form.ListItem("", string(AccessOpen)),
+			form.ListItem("", string(AccessPresence)),
+			form.ListItem("", string(AccessWhitelist)),
+		),
+		form.Boolean(fieldPersistItems, form.Value(strconv.FormatBool(c.PersistItems))),
+		form.Text(fieldMaxItems, form.Value(maxItems)),
+		form.Boolean(fieldNotifyRetract, form.Value(strconv.FormatBool(c.NotifyRetract))),
+	)
+}
+
+// apply updates the config with the values of any known fields in the
+// submitted form.
+// Values are read as they appeared in the XML so that the type of the
+// submitted fields does not matter.
+func (c *NodeConfig) apply(d *form.Data) error {
+	if v, ok := d.Raw(fieldTitle); ok && len(v) > 0 {
+		c.Title = v[0]
+	}
+	if v, ok := d.Raw(fieldAccessModel); ok && len(v) > 0 {
+		switch model := AccessModel(v[0]); model {
+		case AccessOpen, AccessPresence, AccessWhitelist:
+			c.AccessModel = model
+		default:
+			return Error{
+				Err:       stanza.Error{Type: stanza.Modify, Condition: stanza.NotAcceptable},
+				Condition: CondUnsupportedAccessModel,
+			}
+		}
+	}
+	if v, ok := d.Raw(fieldPersistItems); ok && len(v) > 0 {
+		b, err := strconv.ParseBool(v[0])
+		if err != nil {
+			return stanza.Error{Type: stanza.Modify, Condition: stanza.NotAcceptable}
+		}
+		c.PersistItems = b
+	}
+	if v, ok := d.Raw(fieldMaxItems); ok && len(v) > 0 {
+		if v[0] == "max" {
+			c.MaxItems = 0
+		} else {
+			n, err := strconv.ParseUint(v[0], 10, 64)
+			if err != nil {
+				return stanza.Error{Type: stanza.Modify, Condition: stanza.NotAcceptable}
+			}
+			c.MaxItems = n
+		}
+	}
+	if v, ok := d.Raw(fieldNotifyRetract); ok && len(v) > 0 {
+		b, err := strconv.ParseBool(v[0])
+		if err != nil {
+			return stanza.Error{Type: stanza.Modify, Condition: stanza.NotAcceptable}
+		}
+		c.NotifyRetract = b
+	}
+	return nil
+}
+
+// Item is an item stored by a Service.
+type Item struct {
+	ID        string
+	Publisher jid.JID
+
+	// Payload is the tokens that make up the items payload.
+	Payload []xml.Token
+}
+
+// Node is the state of a node stored by a Service.
+type Node struct {
+	Config        NodeConfig
+	Affiliations  []Affiliation
+	Subscriptions []Subscription
+}
+
+// Store is used by a Service to persist nodes and items.
+// The service address passed to each method is the bare JID of the PEP account
+// or the address of the pubsub service.
+//
+// Service serializes all calls to the store, so implementations do not need to
+// be safe for concurrent use unless they are shared between services.
+type Store interface {
+	// Nodes returns the names of all nodes on the service.
+	Nodes(ctx context.Context, service jid.JID) ([]string, error)
+
+	// Node returns the state of a node.
+	// If the node does not exist, ok is false.
+	Node(ctx context.Context, service jid.JID, node string) (n Node, ok bool, err error)
+
+	// SetNode creates a node or replaces the state of an existing node.
+	SetNode(ctx context.Context, service jid.JID, node string, n Node) error
+
+	// DeleteNode removes a node and all of its items.
+	DeleteNode(ctx context.Context, service jid.JID, node string) error
+
+	// Items returns all items stored in a node, ordered from oldest to newest.
+	Items(ctx context.Context, service jid.JID, node string) ([]Item, error)
+
+	// Publish stores an item, replacing any existing item with the same ID.
+	// The item becomes the newest item in the node.
+	// If max is not zero, the oldest items are removed until at most max items
+	// remain.
+	Publish(ctx context.Context, service jid.JID, node string, item Item, max uint64) error
+
+	// Retract removes the item with the given ID.
+	// If no such item exists, ok is false.
+	Retract(ctx context.Context, service jid.JID, node, id string) (ok bool, err error)
+
+	// Purge removes all items from a node.
+	Purge(ctx context.Context, service jid.JID, node string) error
+}
+
+// MemStore is an in-memory implementation of Store.
+// The zero value is ready to use.
+type MemStore struct {
+	m        sync.Mutex
+	services map[string]map[string]*memNode
+}
+
+type memNode struct {
+	node  Node
+	items []Item
+}
+
+func (s *MemStore) lookup(service jid.JID, node string) *memNode {
+	return s.services[service.String()][node]
+}
+
+// Nodes implements Store.
+func (s *MemStore) Nodes(_ context.Context, service jid.JID) ([]string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var names []string
+	for name := range s.services[service.String()] {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Node implements Store.
+func (s *MemStore) Node(_ context.Context, service jid.JID, node string) (Node, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	n := s.lookup(service, node)
+	if n == nil {
+		return Node{}, false, nil
+	}
+	return Node{
+		Config:        n.node.Config,
+		Affiliations:  append([]Affiliation(nil), n.node.Affiliations...),
+		Subscriptions: append([]Subscription(nil), n.node.Subscriptions...),
+	}, true, nil
+}
+
+// SetNode implements Store.
+func (s *MemStore) SetNode(_ context.Context, service jid.JID, node string, n Node) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.services == nil {
+		s.services = make(map[string]map[string]*memNode)
+	}
+	nodes := s.services[service.String()]
+	if nodes == nil {
+		nodes = make(map[string]*memNode)
+		s.services[service.String()] = nodes
+	}
+	if existing := nodes[node]; existing != nil {
+		existing.node = n
+		return nil
+	}
+	nodes[node] = &memNode{node: n}
+	return nil
+}
+
+// DeleteNode implements Store.
+func (s *MemStore) DeleteNode(_ context.Context, service jid.JID, node string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.services[service.String()], node)
+	return nil
+}
+
+// Items implements Store.
+func (s *MemStore) Items(_ context.Context, service jid.JID, node string) ([]Item, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	n := s.lookup(service, node)
+	if n == nil {
+		return nil, nil
+	}
+	return append([]Item(nil), n.items...), nil
+}
+
+// Publish implements Store.
+func (s *MemStore) Publish(_ context.Context, service jid.JID, node string, item Item, max uint64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	n := s.lookup(service, node)
+	if n == nil {
+		return stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound}
+	}
+	for i, existing := range n.items {
+		if existing.ID == item.ID {
+			n.items = append(n.items[:i], n.items[i+1:]...)
+			break
+		}
+	}
+	n.items = append(n.items, item)
+	if max > 0 && uint64(len(n.items)) > max {
+		n.items = append([]Item(nil), n.items[uint64(len(n.items))-max:]...)
+	}
+	return nil
+}
+
+// Retract implements Store.
+func (s *MemStore) Retract(_ context.Context, service jid.JID, node, id string) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	n := s.lookup(service, node)
+	if n == nil {
+		return false, nil
+	}
+	for i, existing := range n.items {
+		if existing.ID == id {
+			n.items = append(n.items[:i], n.items[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Purge implements Store.
+func (s *MemStore) Purge(_ context.Context, service jid.JID, node string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	n := s.lookup(service, node)
+	if n != nil {
+		n.items = nil
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// MarshalXMLAttr satisfies xml.MarshalerAttr.
+func (s SubType) MarshalXMLAttr(name xml.Name) (xml.Attr, error) {
+	return xml.Attr{Name: name, Value: s.String()}, nil
+}
+
+// UnmarshalXMLAttr satisfies xml.UnmarshalerAttr.
+func (s *SubType) UnmarshalXMLAttr(attr xml.Attr) error {
+	for typ := SubNone; typ <= SubUnconfigured; typ++ {
+		if typ.String() == attr.Value {
+			*s = typ
+			return nil
+		}
+	}
+	return fmt.Errorf("pubsub: unknown subscription type %q", attr.Value)
+}
+
+// Subscription is a description of a particular subscription for which we will
+// receive events.
+type Subscription struct {
+	ID           string
+	Node         string
+	Addr         jid.JID
+	Subscription SubType
+
+	// Configurable is true if the service supports configuring the subscription
+	// using GetOptions and SetOptions.
+	Configurable bool
+
+	// ConfigRequired is true if the subscription must be configured before it
+	// becomes active (the subscription will normally be SubUnconfigured).
+	ConfigRequired bool
+}
+
+// TokenReader satisfies the xmlstream.Marshaler interface.
+func (s Subscription) TokenReader() xml.TokenReader {
+	return s.wrap(NS)
+}
+
+func (s Subscription) wrap(ns string) xml.TokenReader {
+	var attrs []xml.Attr
+	if s.Node != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "node"}, Value: s.Node})
+	}
+	if !s.Addr.Equal(jid.JID{}) {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "jid"}, Value: s.Addr.String()})
+	}
+	if s.ID != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "subid"}, Value: s.ID})
+	}
+	/* #nosec */
+	subAttr, _ := s.Subscription.MarshalXMLAttr(xml.Name{Local: "subscription"})
+	attrs = append(attrs, subAttr)
+
+	var inner xml.TokenReader
+	if s.Configurable || s.ConfigRequired {
+		var required xml.TokenReader
+		if s.ConfigRequired {
+			required = xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Local: "required"}})
+		}
+		inner = xmlstream.Wrap(
+			required,
+			xml.StartElement{Name: xml.Name{Local: "subscribe-options"}},
+		)
+	}
+	return xmlstream.Wrap(inner, xml.StartElement{
+		Name: xml.Name{Space: ns, Local: "subscription"},
+		Attr: attrs,
+	})
+}
+
+// WriteXML satisfies the xmlstream.WriterTo interface.
+// It is like MarshalXML except it writes tokens to w.
+func (s Subscription) WriteXML(w xmlstream.TokenWriter) (n int, err error) {
+	return xmlstream.Copy(w, s.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (s Subscription) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := s.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (s *Subscription) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	data := struct {
+		Node         string  `xml:"node,attr"`
+		Addr         jid.JID `xml:"jid,attr"`
+		ID           string  `xml:"subid,attr"`
+		Subscription SubType `xml:"subscription,attr"`
+		Options      *struct {
+			Required *struct{} `xml:"required"`
+		} `xml:"subscribe-options"`
+	}{}
+	err := d.DecodeElement(&data, &start)
+	if err != nil {
+		return err
+	}
+	s.Node = data.Node
+	s.Addr = data.Addr
+	s.ID = data.ID
+	s.Subscription = data.Subscription
+	s.Configurable = data.Options != nil
+	s.ConfigRequired = data.Options != nil && data.Options.Required != nil
+	return nil
+}
+
+// Subscribe subscribes the sessions bare JID to a node.
+// If opts is not nil, it is submitted along with the subscription request as
+// the subscription options.
+//
+// The returned subscription may be pending (if the node owner must approve the
+// request) or unconfigured (if options must be set with SetOptions before the
+// subscription becomes active).
+func Subscribe(ctx context.Context, s *xmpp.Session, node string, opts *form.Data) (Subscription, error) {
+	return SubscribeIQ(ctx, s, stanza.IQ{}, node, opts)
+}
+
+// SubscribeIQ is like Subscribe except that it allows modifying the IQ.
+// Changes to the IQ type will have no effect.
+func SubscribeIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node string, opts *form.Data) (Subscription, error) {
+	iq.Type = stanza.SetIQ
+	addr := s.LocalAddr().Bare()
+	payload := xmlstream.Wrap(
+		nil,
+		xml.StartElement{Name: xml.Name{Local: "subscribe"}, Attr: []xml.Attr{
+			{Name: xml.Name{Local: "node"}, Value: node},
+			{Name: xml.Name{Local: "jid"}, Value: addr.String()},
+		}},
+	)
+	if opts != nil {
+		submitted, _ := opts.Submit()
+		payload = xmlstream.MultiReader(payload, xmlstream.Wrap(
+			submitted,
+			xml.StartElement{Name: xml.Name{Local: "options"}},
+		))
+	}
+	var resp struct {
+		XMLName      xml.Name      `xml:"http://jabber.org/protocol/pubsub pubsub"`
+		Subscription *Subscription `xml:"subscription"`
+	}
+	err := s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		payload,
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "pubsub"}},
+	), iq, &resp)
+	if err != nil {
+		return Subscription{}, err
+	}
+	// Services may respond with an empty result, in which case the subscription
+	// is active.
+	if resp.Subscription == nil {
+		return Subscription{
+			Node:         node,
+			Addr:         addr,
+			Subscription: SubSubscribed,
+		}, nil
+	}
+	sub := *resp.Subscription
+	if sub.Node == "" {
+		sub.Node = node
+	}
+	return sub, nil
+}
+
+// Unsubscribe removes the sessions bare JID from the subscribers of a node.
+// If subID is not empty only the subscription with the given ID is removed.
+func Unsubscribe(ctx context.Context, s *xmpp.Session, node, subID string) error {
+	return UnsubscribeIQ(ctx, s, stanza.IQ{}, node, subID)
+}
+
+// UnsubscribeIQ is like Unsubscribe except that it allows modifying the IQ.
+// Changes to the IQ type will have no effect.
+func UnsubscribeIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node, subID string) error {
+	iq.Type = stanza.SetIQ
+	return s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		xmlstream.Wrap(
+			nil,
+			xml.StartElement{Name: xml.Name{Local: "unsubscribe"}, Attr: subAttrs(s, node, subID)},
+		),
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "pubsub"}},
+	), iq, nil)
+}
+
+// Subscriptions returns the subscriptions of the sessions account.
+// If node is not empty, only subscriptions to the given node are returned.
+func Subscriptions(ctx context.Context, s *xmpp.Session, node string) ([]Subscription, error) {
+	return SubscriptionsIQ(ctx, s, stanza.IQ{}, node)
+}
+
+// SubscriptionsIQ is like Subscriptions except that it allows modifying the IQ.
+// Changes to the IQ type will have no effect.
+func SubscriptionsIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node string) ([]Subscription, error) {
+	iq.Type = stanza.GetIQ
+	start := xml.StartElement{Name: xml.Name{Local: "subscriptions"}}
+	if node != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "node"}, Value: node})
+	}
+	var resp struct {
+		XMLName       xml.Name `xml:"http://jabber.org/protocol/pubsub pubsub"`
+		Subscriptions struct {
+			Node string         `xml:"node,attr"`
+			Subs []Subscription `xml:"subscription"`
+		} `xml:"subscriptions"`
+	}
+	err := s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		xmlstream.Wrap(nil, start),
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "pubsub"}},
+	), iq, &resp)
+	subs := resp.Subscriptions.Subs
+	for i, sub := range subs {
+		if sub.Node == "" {
+			subs[i].Node = resp.Subscriptions.Node
+		}
+	}
+	return subs, err
+}
+
+// GetOptions fetches the subscription options form for the sessions bare JID.
+// If the JID has multiple subscriptions to the node, subID must be set.
+func GetOptions(ctx context.Context, s *xmpp.Session, node, subID string) (*form.Data, error) {
+	return GetOptionsIQ(ctx, s, stanza.IQ{}, node, subID)
+}
+
+// GetOptionsIQ is like GetOptions except that it allows modifying the IQ.
+// Changes to the IQ type will have no effect.
+func GetOptionsIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node, subID string) (*form.Data, error) {
+	iq.Type = stanza.GetIQ
+	var resp struct {
+		XMLName xml.Name `xml:"http://jabber.org/protocol/pubsub pubsub"`
+		Options struct {
+			Data *form.Data `xml:"jabber:x:data x"`
+		} `xml:"options"`
+	}
+	err := s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		xmlstream.Wrap(
+			nil,
+			xml.StartElement{Name: xml.Name{Local: "options"}, Attr: subAttrs(s, node, subID)},
+		),
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "pubsub"}},
+	), iq, &resp)
+	return resp.Options.Data, err
+}
+
+// SetOptions submits the provided subscription options form for the sessions
+// bare JID.
+// If the JID has multiple subscriptions to the node, subID must be set.
+func SetOptions(ctx context.Context, s *xmpp.Session, node, subID string, opts *form.Data) error {
+	return SetOptionsIQ(ctx, s, stanza.IQ{}, node, subID, opts)
+}
+
+// SetOptionsIQ is like SetOptions except that it allows modifying the IQ.
+// Changes to the IQ type will have no effect.
+func SetOptionsIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, node, subID string, opts *form.Data) error {
+	iq.Type = stanza.SetIQ
+	data, _ := opts.Submit()
+	return s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		xmlstream.Wrap(
+			data,
+			xml.StartElement{Name: xml.Name{Local: "options"}, Attr: subAttrs(s, node, subID)},
+		),
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "pubsub"}},
+	), iq, nil)
+}
+
+func subAttrs(s *xmpp.Session, node, subID string) []xml.Attr {
+	attrs := []xml.Attr{
+		{Name: xml.Name{Local: "node"}, Value: node},
+		{Name: xml.Name{Local: "jid"}, Value: s.LocalAddr().Bare().String()},
+	}
+	if subID != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "subid"}, Value: subID})
+	}
+	return attrs
+}
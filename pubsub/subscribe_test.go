@@ -0,0 +1,139 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package pubsub_test
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/pubsub"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = pubsub.Subscription{}
+	_ xml.Unmarshaler     = (*pubsub.Subscription)(nil)
+	_ xmlstream.Marshaler = pubsub.Subscription{}
+	_ xmlstream.WriterTo  = pubsub.Subscription{}
+	_ xml.MarshalerAttr   = pubsub.SubType(0)
+	_ xml.UnmarshalerAttr = (*pubsub.SubType)(nil)
+)
+
+func TestEncodeSubscription(t *testing.T) {
+	xmpptest.RunEncodingTests(t, []xmpptest.EncodingTestCase{
+		0: {
+			Value: &pubsub.Subscription{
+				Node:         "princely_musings",
+				Addr:         jid.MustParse("francisco@denmark.lit"),
+				ID:           "ba49252aaa4f5d320c24d3766f0bdcade78c78d3",
+				Subscription: pubsub.SubSubscribed,
+			},
+			XML: `<subscription xmlns="http://jabber.org/protocol/pubsub" node="princely_musings" jid="francisco@denmark.lit" subid="ba49252aaa4f5d320c24d3766f0bdcade78c78d3" subscription="subscribed"></subscription>`,
+		},
+		1: {
+			Value: &pubsub.Subscription{
+				Node:           "princely_musings",
+				Addr:           jid.MustParse("francisco@denmark.lit"),
+				Subscription:   pubsub.SubUnconfigured,
+				Configurable:   true,
+				ConfigRequired: true,
+			},
+			XML: `<subscription xmlns="http://jabber.org/protocol/pubsub" node="princely_musings" jid="francisco@denmark.lit" subscription="unconfigured"><subscribe-options><required></required></subscribe-options></subscription>`,
+		},
+		2: {
+			Value: &pubsub.Subscription{
+				Node:         "princely_musings",
+				Subscription: pubsub.SubPending,
+				Configurable: true,
+			},
+			XML: `<subscription xmlns="http://jabber.org/protocol/pubsub" node="princely_musings" subscription="pending"><subscribe-options></subscribe-options></subscription>`,
+		},
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	var gotNode, gotJID string
+	m := mux.New(stanza.NSClient, mux.IQFunc(stanza.SetIQ, xml.Name{Space: pubsub.NS, Local: "pubsub"}, func(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		var req struct {
+			Subscribe struct {
+				Node string `xml:"node,attr"`
+				JID  string `xml:"jid,attr"`
+			} `xml:"subscribe"`
+		}
+		err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&req)
+		if err != nil {
+			return err
+		}
+		gotNode, gotJID = req.Subscribe.Node, req.Subscribe.JID
+		_, err = xmlstream.Copy(r, iq.Result(xmlstream.Wrap(
+			pubsub.Subscription{
+				Node:           req.Subscribe.Node,
+				Addr:           jid.MustParse(req.Subscribe.JID),
+				ID:             "123",
+				Subscription:   pubsub.SubUnconfigured,
+				ConfigRequired: true,
+			}.TokenReader(),
+			xml.StartElement{Name: xml.Name{Space: pubsub.NS, Local: "pubsub"}},
+		)))
+		return err
+	}))
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(m))
+	defer cs.Close()
+
+	sub, err := pubsub.Subscribe(context.Background(), cs.Client, "princely_musings", nil)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	const node = "princely_musings"
+	if gotNode != node {
+		t.Errorf("wrong node sent: want=%q, got=%q", node, gotNode)
+	}
+	if bare := cs.Client.LocalAddr().Bare().String(); gotJID != bare {
+		t.Errorf("wrong JID sent: want=%q, got=%q", bare, gotJID)
+	}
+	if sub.Subscription != pubsub.SubUnconfigured || !sub.ConfigRequired || sub.ID != "123" {
+		t.Errorf("unexpected subscription: %+v", sub)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	m := mux.New(stanza.NSClient, mux.IQFunc(stanza.GetIQ, xml.Name{Space: pubsub.NS, Local: "pubsub"}, func(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		_, err := xmlstream.Copy(r, iq.Result(xmlstream.Wrap(
+			xmlstream.Wrap(
+				xmlstream.MultiReader(
+					pubsub.Subscription{Subscription: pubsub.SubSubscribed, Addr: jid.MustParse("francisco@denmark.lit")}.TokenReader(),
+					pubsub.Subscription{Node: "other", Subscription: pubsub.SubPending, Addr: jid.MustParse("francisco@denmark.lit")}.TokenReader(),
+				),
+				xml.StartElement{
+					Name: xml.Name{Local: "subscriptions"},
+					Attr: []xml.Attr{{Name: xml.Name{Local: "node"}, Value: "princely_musings"}},
+				},
+			),
+			xml.StartElement{Name: xml.Name{Space: pubsub.NS, Local: "pubsub"}},
+		)))
+		return err
+	}))
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(m))
+	defer cs.Close()
+
+	subs, err := pubsub.Subscriptions(context.Background(), cs.Client, "princely_musings")
+	if err != nil {
+		t.Fatalf("error fetching subscriptions: %v", err)
+	}
+	if len(subs) != 2 {
+		t.Fatalf("wrong number of subscriptions: want=2, got=%d", len(subs))
+	}
+	if subs[0].Node != "princely_musings" || subs[0].Subscription != pubsub.SubSubscribed {
+		t.Errorf("wrong first subscription: %+v", subs[0])
+	}
+	if subs[1].Node != "other" || subs[1].Subscription != pubsub.SubPending {
+		t.Errorf("wrong second subscription: %+v", subs[1])
+	}
+}
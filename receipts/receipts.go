@@ -17,6 +17,7 @@ import (
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp"
 	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/mux"
 	"mellium.im/xmpp/stanza"
 )
@@ -154,8 +155,12 @@ func Handle(h *Handler) mux.Option {
 // messages sent with SendMessage or SendMessageElement.
 // If Unhandled is set it is called for every receipt that cannot be matched to
 // a message sent through the handler.
+// If Received is set it is called for every receipt with the address of the
+// entity that sent it and the ID of the message being acknowledged before the
+// receipt is matched, and any error it returns is returned by the handler.
 type Handler struct {
 	Unhandled func(string)
+	Received  func(from jid.JID, id string) error
 	sent      map[string]chan struct{}
 	m         sync.Mutex
 }
@@ -178,6 +183,12 @@ func (h *Handler) HandleMessage(msg stanza.Message, t xmlstream.TokenReadEncoder
 		switch start.Name.Local {
 		case "received":
 			_, id := attr.Get(start.Attr, "id")
+			if h.Received != nil {
+				err = h.Received(msg.From, id)
+				if err != nil {
+					return err
+				}
+			}
 			h.m.Lock()
 			c, ok := h.sent[id]
 			if ok {
@@ -0,0 +1,392 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+)
+
+// Store is used by a Cache to persist the roster between sessions.
+type Store interface {
+	// Roster returns the stored roster version and items.
+	// If no roster has been stored, an empty version and no items are returned.
+	Roster(ctx context.Context) (ver string, items []Item, err error)
+
+	// SetRoster replaces the stored roster.
+	SetRoster(ctx context.Context, ver string, items []Item) error
+
+	// SetItem updates the stored roster version and creates or updates a single
+	// item.
+	// If the subscription of the item is "remove" it is deleted instead.
+	SetItem(ctx context.Context, ver string, item Item) error
+}
+
+// MemStore is an in-memory implementation of Store.
+// The zero value is ready to use.
+type MemStore struct {
+	m     sync.Mutex
+	ver   string
+	items map[string]Item
+}
+
+// Roster implements Store.
+func (s *MemStore) Roster(context.Context) (string, []Item, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	items := make([]Item, 0, len(s.items))
+	for _, item := range s.items {
+		items = append(items, item)
+	}
+	sortItems(items)
+	return s.ver, items, nil
+}
+
+// SetRoster implements Store.
+func (s *MemStore) SetRoster(_ context.Context, ver string, items []Item) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.ver = ver
+	s.items = make(map[string]Item, len(items))
+	for _, item := range items {
+		s.items[item.JID.String()] = item
+	}
+	return nil
+}
+
+// SetItem implements Store.
+func (s *MemStore) SetItem(_ context.Context, ver string, item Item) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.ver = ver
+	if item.Subscription == "remove" {
+		delete(s.items, item.JID.String())
+		return nil
+	}
+	if s.items == nil {
+		s.items = make(map[string]Item)
+	}
+	s.items[item.JID.String()] = item
+	return nil
+}
+
+// Change is a change to a roster item.
+type Change struct {
+	// Item is the new roster item.
+	// If the item was removed its subscription is "remove".
+	Item Item
+
+	// Prev is the item before the change.
+	// If the item was added it is the zero value.
+	Prev Item
+}
+
+type push struct {
+	ver  string
+	item Item
+}
+
+// Cache is a local copy of the roster that is kept up to date by applying
+// roster pushes.
+//
+// To receive pushes the Push method must be registered with a multiplexer
+// using Handle:
+//
+//	roster.Handle(roster.Handler{Push: cache.Push})
+type Cache struct {
+	// Store persists the roster.
+	// If nil, the roster is only kept in memory.
+	Store Store
+
+	// Changed is called for each item that is added, updated, or removed.
+	Changed func(Change)
+
+	m        sync.Mutex
+	restored bool
+	loading  bool
+	ver      string
+	items    map[string]Item
+	pending  []push
+}
+
+// Restore loads the roster from the Store without contacting the server so
+// that it can be used while offline.
+// It is called automatically by Load the first time the roster is loaded.
+func (c *Cache) Restore(ctx context.Context) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.restore(ctx)
+}
+
+func (c *Cache) restore(ctx context.Context) error {
+	if c.restored || c.Store == nil {
+		c.restored = true
+		return nil
+	}
+	ver, items, err := c.Store.Roster(ctx)
+	if err != nil {
+		return err
+	}
+	c.ver = ver
+	c.items = make(map[string]Item, len(items))
+	for _, item := range items {
+		c.items[item.JID.String()] = item
+	}
+	c.restored = true
+	return nil
+}
+
+// Load fetches the roster and replaces the contents of the cache.
+// If the server advertised roster versioning, the cached version is sent with
+// the request so that the server may respond with an empty result if the
+// roster has not changed.
+// Pushes received while the roster is being loaded are applied in order after
+// it has been loaded.
+func (c *Cache) Load(ctx context.Context, s *xmpp.Session) error {
+	return c.LoadIQ(ctx, IQ{}, s)
+}
+
+// LoadIQ is like Load but it allows you to customize the IQ.
+// Changing the type of the provided IQ, adding items, or setting the version
+// has no effect.
+func (c *Cache) LoadIQ(ctx context.Context, iq IQ, s *xmpp.Session) error {
+	c.m.Lock()
+	if c.loading {
+		c.m.Unlock()
+		return errors.New("roster: the roster is already being loaded")
+	}
+	err := c.restore(ctx)
+	if err != nil {
+		c.m.Unlock()
+		return err
+	}
+	iq.Query.Ver = ""
+	if _, ok := s.Feature(NSFeatures); ok {
+		iq.Query.Ver = c.ver
+	}
+	c.loading = true
+	c.m.Unlock()
+
+	iter := FetchIQ(ctx, iq, s)
+	var items []Item
+	for iter.Next() {
+		items = append(items, iter.Item())
+	}
+	err = iter.Err()
+	if err == nil {
+		err = iter.Close()
+	} else {
+		/* #nosec */
+		iter.Close()
+	}
+
+	c.m.Lock()
+	var changes []Change
+	if err == nil && !iter.Unchanged() {
+		changes, err = c.replace(ctx, iter.Version(), items)
+	}
+	// Any pushes that arrived while the request was in flight are newer than the
+	// result, so apply them after it.
+	pending := c.pending
+	c.pending = nil
+	c.loading = false
+	for _, p := range pending {
+		change, perr := c.apply(ctx, p.ver, p.item)
+		if perr != nil && err == nil {
+			err = perr
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	c.m.Unlock()
+
+	c.emit(changes)
+	return err
+}
+
+// Push applies a roster push to the cache.
+// It has the signature of the Push callback on Handler.
+func (c *Cache) Push(ver string, item Item) error {
+	c.m.Lock()
+	if c.loading {
+		c.pending = append(c.pending, push{ver: ver, item: item})
+		c.m.Unlock()
+		return nil
+	}
+	change, err := c.apply(context.Background(), ver, item)
+	c.m.Unlock()
+	if change != nil {
+		c.emit([]Change{*change})
+	}
+	return err
+}
+
+// Version returns the version of the cached roster.
+func (c *Cache) Version() string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.ver
+}
+
+// Items returns a snapshot of the cached roster sorted by JID.
+func (c *Cache) Items() []Item {
+	c.m.Lock()
+	defer c.m.Unlock()
+	items := make([]Item, 0, len(c.items))
+	for _, item := range c.items {
+		items = append(items, item)
+	}
+	sortItems(items)
+	return items
+}
+
+// Item returns the roster item for the bare JID of j.
+func (c *Cache) Item(j jid.JID) (Item, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	item, ok := c.items[j.Bare().String()]
+	return item, ok
+}
+
+// Group returns the items in the named group sorted by JID.
+// If name is empty, the items that are not in any group are returned.
+func (c *Cache) Group(name string) []Item {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var items []Item
+	for _, item := range c.items {
+		if (name == "" && len(item.Group) == 0) || inGroup(item, name) {
+			items = append(items, item)
+		}
+	}
+	sortItems(items)
+	return items
+}
+
+// Groups returns the names of all groups used by items in the roster, sorted.
+func (c *Cache) Groups() []string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	seen := make(map[string]struct{})
+	var groups []string
+	for _, item := range c.items {
+		for _, g := range item.Group {
+			if _, ok := seen[g]; ok {
+				continue
+			}
+			seen[g] = struct{}{}
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// replace replaces the items in the cache and returns the differences.
+// It must be called with the lock held.
+func (c *Cache) replace(ctx context.Context, ver string, items []Item) ([]Change, error) {
+	if c.Store != nil {
+		err := c.Store.SetRoster(ctx, ver, items)
+		if err != nil {
+			return nil, err
+		}
+	}
+	next := make(map[string]Item, len(items))
+	var changes []Change
+	for _, item := range items {
+		key := item.JID.String()
+		next[key] = item
+		prev, ok := c.items[key]
+		if !ok || !itemEqual(prev, item) {
+			changes = append(changes, Change{Item: item, Prev: prev})
+		}
+	}
+	for key, prev := range c.items {
+		if _, ok := next[key]; !ok {
+			changes = append(changes, Change{
+				Item: Item{JID: prev.JID, Subscription: "remove"},
+				Prev: prev,
+			})
+		}
+	}
+	c.ver = ver
+	c.items = next
+	return changes, nil
+}
+
+// apply applies a single pushed item to the cache.
+// It must be called with the lock held.
+func (c *Cache) apply(ctx context.Context, ver string, item Item) (*Change, error) {
+	if ver == "" {
+		ver = c.ver
+	}
+	if c.Store != nil {
+		err := c.Store.SetItem(ctx, ver, item)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.ver = ver
+	key := item.JID.String()
+	prev, ok := c.items[key]
+	if item.Subscription == "remove" {
+		if !ok {
+			return nil, nil
+		}
+		delete(c.items, key)
+		return &Change{Item: item, Prev: prev}, nil
+	}
+	if c.items == nil {
+		c.items = make(map[string]Item)
+	}
+	c.items[key] = item
+	if ok && itemEqual(prev, item) {
+		return nil, nil
+	}
+	return &Change{Item: item, Prev: prev}, nil
+}
+
+func (c *Cache) emit(changes []Change) {
+	if c.Changed == nil {
+		return
+	}
+	for _, change := range changes {
+		c.Changed(change)
+	}
+}
+
+func inGroup(item Item, name string) bool {
+	for _, g := range item.Group {
+		if g == name {
+			return true
+		}
+	}
+	return false
+}
+
+func itemEqual(a, b Item) bool {
+	if !a.JID.Equal(b.JID) || a.Name != b.Name || a.Subscription != b.Subscription ||
+		a.Ask != b.Ask || a.Approved != b.Approved || len(a.Group) != len(b.Group) {
+		return false
+	}
+	for i := range a.Group {
+		if a.Group[i] != b.Group[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sortItems(items []Item) {
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].JID.String() < items[j].JID.String()
+	})
+}
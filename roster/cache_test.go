@@ -0,0 +1,248 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster_test
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	juliet   = roster.Item{JID: jid.MustParse("juliet@example.com"), Name: "Juliet", Subscription: "both", Group: []string{"Friends"}}
+	benvolio = roster.Item{JID: jid.MustParse("benvolio@example.org"), Subscription: "to"}
+	mercutio = roster.Item{JID: jid.MustParse("mercutio@example.org"), Subscription: "from", Group: []string{"Friends"}}
+)
+
+// rosterServer responds to roster requests by sending any pushes followed by
+// the result and records the version sent in each request.
+type rosterServer struct {
+	ver    string
+	items  []roster.Item
+	pushes []roster.IQ
+	reqs   chan string
+}
+
+func (srv *rosterServer) HandleXMPP(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	iq, err := stanza.NewIQ(*start)
+	if err != nil {
+		return err
+	}
+	if iq.Type != stanza.GetIQ {
+		return nil
+	}
+	tok, err := t.Token()
+	if err != nil {
+		return err
+	}
+	_, ver := attr.Get(tok.(xml.StartElement).Attr, "ver")
+	srv.reqs <- ver
+
+	for _, push := range srv.pushes {
+		push.Type = stanza.SetIQ
+		push.ID = attr.RandomID()
+		_, err = push.WriteXML(t)
+		if err != nil {
+			return err
+		}
+	}
+	if ver != "" && ver == srv.ver {
+		_, err = xmlstream.Copy(t, iq.Result(nil))
+		return err
+	}
+	resp := roster.IQ{IQ: stanza.IQ{ID: iq.ID, Type: stanza.ResultIQ}}
+	resp.Query.Ver = srv.ver
+	resp.Query.Item = srv.items
+	_, err = resp.WriteXML(t)
+	return err
+}
+
+// skipHeader discards the XML declaration and stream header written by the
+// client so that the test server, which does not negotiate a stream, only sees
+// stanzas.
+type skipHeader struct {
+	r    io.Reader
+	seen int
+}
+
+func (s *skipHeader) Read(p []byte) (int, error) {
+	for s.seen < 2 {
+		var b [1]byte
+		_, err := s.r.Read(b[:])
+		if err != nil {
+			return 0, err
+		}
+		if b[0] == '>' {
+			s.seen++
+		}
+	}
+	return s.r.Read(p)
+}
+
+// versionedClientServer is like xmpptest.NewClientServer except that the
+// client negotiates roster versioning.
+func versionedClientServer(t *testing.T, srv xmpp.Handler, client xmpp.Handler) (*xmpp.Session, func()) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	serverSession := xmpptest.NewServerSession(xmpp.Received, struct {
+		io.Reader
+		io.Writer
+	}{
+		Reader: &skipHeader{r: serverConn},
+		Writer: serverConn,
+	})
+	/* #nosec */
+	go serverSession.Serve(srv)
+
+	const features = `<stream:stream from="example.net" to="romeo@example.net" id="123" version="1.0" xmlns="jabber:client" xmlns:stream="http://etherx.jabber.org/streams"><stream:features><ver xmlns="urn:xmpp:features:rosterver"/></stream:features>`
+	clientJID := jid.MustParse("romeo@example.net")
+	clientSession, err := xmpp.NewSession(context.Background(), clientJID.Domain(), clientJID, struct {
+		io.Reader
+		io.Writer
+	}{
+		Reader: io.MultiReader(strings.NewReader(features), clientConn),
+		Writer: clientConn,
+	}, xmpp.Secure, xmpp.NewNegotiator(func(*xmpp.Session, *xmpp.StreamConfig) xmpp.StreamConfig {
+		return xmpp.StreamConfig{Features: []xmpp.StreamFeature{roster.Versioning()}}
+	}))
+	if err != nil {
+		t.Fatalf("error negotiating session: %v", err)
+	}
+	/* #nosec */
+	go clientSession.Serve(client)
+	return clientSession, func() {
+		/* #nosec */
+		clientSession.Close()
+		/* #nosec */
+		serverSession.Close()
+	}
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	store := &roster.MemStore{}
+	srv := &rosterServer{
+		ver:   "1",
+		items: []roster.Item{juliet, benvolio},
+		reqs:  make(chan string, 1),
+	}
+	var changes []roster.Change
+	cache := &roster.Cache{
+		Store: store,
+		Changed: func(c roster.Change) {
+			changes = append(changes, c)
+		},
+	}
+	s, closeSessions := versionedClientServer(t, srv, mux.New("", roster.Handle(roster.Handler{Push: cache.Push})))
+	defer closeSessions()
+
+	// The first load fetches the entire roster.
+	err := cache.Load(ctx, s)
+	if err != nil {
+		t.Fatalf("error loading roster: %v", err)
+	}
+	if ver := <-srv.reqs; ver != "" {
+		t.Errorf("unexpected version in first request: %q", ver)
+	}
+	if items, want := cache.Items(), []roster.Item{benvolio, juliet}; !reflect.DeepEqual(items, want) {
+		t.Errorf("wrong items after first load: want=%+v, got=%+v", want, items)
+	}
+	if len(changes) != 2 {
+		t.Errorf("wrong number of changes after first load: want=2, got=%d", len(changes))
+	}
+	if ver, items, _ := store.Roster(ctx); ver != "1" || len(items) != 2 {
+		t.Errorf("roster not stored: ver=%q, items=%+v", ver, items)
+	}
+
+	// Reloading sends the cached version and applies any pushes received before
+	// the empty result in order.
+	changes = nil
+	mercutioPush := roster.IQ{}
+	mercutioPush.Query.Ver = "2"
+	mercutioPush.Query.Item = []roster.Item{mercutio}
+	removePush := roster.IQ{}
+	removePush.Query.Ver = "3"
+	removePush.Query.Item = []roster.Item{{JID: benvolio.JID, Subscription: "remove"}}
+	srv.pushes = []roster.IQ{mercutioPush, removePush}
+
+	err = cache.Load(ctx, s)
+	if err != nil {
+		t.Fatalf("error reloading roster: %v", err)
+	}
+	if ver := <-srv.reqs; ver != "1" {
+		t.Errorf("wrong version in second request: want=1, got=%q", ver)
+	}
+	if ver := cache.Version(); ver != "3" {
+		t.Errorf("wrong version after pushes: want=3, got=%q", ver)
+	}
+	if items, want := cache.Items(), []roster.Item{juliet, mercutio}; !reflect.DeepEqual(items, want) {
+		t.Errorf("wrong items after pushes: want=%+v, got=%+v", want, items)
+	}
+	if want := []roster.Change{
+		{Item: mercutio},
+		{Item: roster.Item{JID: benvolio.JID, Subscription: "remove"}, Prev: benvolio},
+	}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("wrong changes from pushes: want=%+v, got=%+v", want, changes)
+	}
+
+	if item, ok := cache.Item(jid.MustParse("juliet@example.com/balcony")); !ok || !reflect.DeepEqual(item, juliet) {
+		t.Errorf("wrong item for juliet: %+v", item)
+	}
+	if items, want := cache.Group("Friends"), []roster.Item{juliet, mercutio}; !reflect.DeepEqual(items, want) {
+		t.Errorf("wrong items in group: want=%+v, got=%+v", want, items)
+	}
+	if groups, want := cache.Groups(), []string{"Friends"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("wrong groups: want=%v, got=%v", want, groups)
+	}
+}
+
+func TestCacheNoVersioning(t *testing.T) {
+	srv := &rosterServer{
+		ver:   "2",
+		items: []roster.Item{juliet},
+		reqs:  make(chan string, 1),
+	}
+	store := &roster.MemStore{}
+	err := store.SetRoster(context.Background(), "2", []roster.Item{benvolio})
+	if err != nil {
+		t.Fatalf("error storing roster: %v", err)
+	}
+	cache := &roster.Cache{Store: store}
+	err = cache.Restore(context.Background())
+	if err != nil {
+		t.Fatalf("error restoring roster: %v", err)
+	}
+	if items, want := cache.Items(), []roster.Item{benvolio}; !reflect.DeepEqual(items, want) {
+		t.Errorf("wrong items after restoring: want=%+v, got=%+v", want, items)
+	}
+
+	// If the server does not support versioning the stored version must not be
+	// sent.
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(srv))
+	defer cs.Close()
+	err = cache.Load(context.Background(), cs.Client)
+	if err != nil {
+		t.Fatalf("error loading roster: %v", err)
+	}
+	if ver := <-srv.reqs; ver != "" {
+		t.Errorf("unexpected version in request: %q", ver)
+	}
+	if items, want := cache.Items(), []roster.Item{juliet}; !reflect.DeepEqual(items, want) {
+		t.Errorf("wrong items after loading: want=%+v, got=%+v", want, items)
+	}
+}
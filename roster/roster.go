@@ -20,8 +20,9 @@ import (
 
 // Namespaces used by this package provided as a convenience.
 const (
-	NS         = "jabber:iq:roster"
-	NSFeatures = "urn:xmpp:features:rosterver"
+	NS            = "jabber:iq:roster"
+	NSFeatures    = "urn:xmpp:features:rosterver"
+	NSPreApproval = "urn:xmpp:features:pre-approval"
 )
 
 // Handle returns an option that registers a Handler for roster pushes.
@@ -66,10 +67,11 @@ func (h Handler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml
 
 // Iter is an iterator over roster items.
 type Iter struct {
-	iter    *xmlstream.Iter
-	current Item
-	err     error
-	ver     string
+	iter      *xmlstream.Iter
+	current   Item
+	err       error
+	ver       string
+	unchanged bool
 }
 
 // Next returns true if there are more items to decode.
@@ -100,6 +102,14 @@ func (i *Iter) Version() string {
 	return i.ver
 }
 
+// Unchanged reports whether the server responded with an empty result instead
+// of a roster, indicating that the roster has not changed since the version
+// sent in the request.
+// Any changes will instead be sent as roster pushes.
+func (i *Iter) Unchanged() bool {
+	return i.unchanged
+}
+
 // Err returns the last error encountered by the iterator (if any).
 func (i *Iter) Err() error {
 	if i.err != nil {
@@ -157,8 +167,9 @@ func FetchIQ(ctx context.Context, iq IQ, s *xmpp.Session) *Iter {
 
 	// Return the iterator which will parse the rest of the payload incrementally.
 	return &Iter{
-		iter: iter,
-		ver:  ver,
+		iter:      iter,
+		ver:       ver,
+		unchanged: start.Name.Local == "",
 	}
 }
 
@@ -239,6 +250,14 @@ type Item struct {
 	Name         string   `xml:"name,attr,omitempty"`
 	Subscription string   `xml:"subscription,attr,omitempty"`
 	Group        []string `xml:"group,omitempty"`
+
+	// Ask is "subscribe" if a subscription request has been sent to the contact
+	// and is pending.
+	Ask string `xml:"ask,attr,omitempty"`
+
+	// Approved is true if a subscription request from the contact has been
+	// pre-approved.
+	Approved bool `xml:"approved,attr,omitempty"`
 }
 
 // TokenReader satisfies the xmlstream.Marshaler interface.
@@ -263,6 +282,12 @@ func (item Item) TokenReader() xml.TokenReader {
 	if item.Subscription != "" {
 		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "subscription"}, Value: item.Subscription})
 	}
+	if item.Ask != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "ask"}, Value: item.Ask})
+	}
+	if item.Approved {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "approved"}, Value: "true"})
+	}
 
 	return xmlstream.Wrap(
 		xmlstream.MultiReader(group...),
@@ -271,6 +271,15 @@ var marshalTests = [...]struct {
 		},
 		out: `<item jid="example.net" name="foo" subscription="sub"><group>one</group><group>two</group></item>`,
 	},
+	4: {
+		in: roster.Item{
+			JID:          jid.MustParse("example.net"),
+			Subscription: "none",
+			Ask:          "subscribe",
+			Approved:     true,
+		},
+		out: `<item jid="example.net" subscription="none" ask="subscribe" approved="true"></item>`,
+	},
 }
 
 func TestMarshal(t *testing.T) {
@@ -0,0 +1,504 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// Sender is used by a Service to send roster pushes and automatic replies to
+// subscription requests.
+// It is satisfied by *xmpp.Session, but a server will normally provide an
+// implementation that routes stanzas to the correct session.
+type Sender interface {
+	Send(context.Context, xml.TokenReader) error
+}
+
+// HandleService returns an option that registers a roster service on the mux.
+func HandleService(srv *Service) mux.Option {
+	return func(m *mux.ServeMux) {
+		query := xml.Name{Space: NS, Local: "query"}
+		mux.IQ(stanza.GetIQ, query, srv)(m)
+		mux.IQ(stanza.SetIQ, query, srv)(m)
+	}
+}
+
+// Service manages the rosters of a server's users.
+// It responds to roster gets and sets, sends roster pushes to each of the
+// user's interested resources, and tracks subscription state as described in
+// RFC 6121.
+//
+// The IQ handled by the service must have its from attribute set to the full
+// JID of the requesting resource.
+// Subscription presence is not handled by the service directly, instead the
+// server should call Outbound and Inbound as it routes it.
+// The zero value is a service that stores rosters in memory and does not send
+// pushes.
+type Service struct {
+	// Store persists rosters.
+	// If nil, rosters are stored in memory.
+	Store ServiceStore
+
+	// Sender sends roster pushes and replies to subscription requests.
+	// If nil, nothing is sent.
+	Sender Sender
+
+	// PreApproval enables subscription pre-approval.
+	// If enabled, the PreApproval stream feature should also be advertised.
+	PreApproval bool
+
+	m          sync.Mutex
+	mem        MemServiceStore
+	interested map[string]map[string]jid.JID
+}
+
+func (srv *Service) store() ServiceStore {
+	if srv.Store != nil {
+		return srv.Store
+	}
+	return &srv.mem
+}
+
+// HandleIQ implements mux.IQHandler.
+func (srv *Service) HandleIQ(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	ctx := context.Background()
+	var q struct {
+		Ver  *string `xml:"ver,attr"`
+		Item []Item  `xml:"item"`
+	}
+	err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&q)
+	if err != nil {
+		_, err = xmlstream.Copy(r, iq.Error(stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}))
+		return err
+	}
+
+	user := iq.From.Bare()
+	var (
+		payload xml.TokenReader
+		diff    []xml.TokenReader
+		pushes  []xml.TokenReader
+	)
+	switch {
+	case iq.From.Equal(jid.JID{}):
+		err = stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}
+	case !iq.To.Equal(jid.JID{}) && !iq.To.Equal(user):
+		err = stanza.Error{Type: stanza.Auth, Condition: stanza.Forbidden}
+	case iq.Type == stanza.GetIQ:
+		payload, diff, err = srv.get(ctx, iq.From, q.Ver)
+	default:
+		pushes, err = srv.set(ctx, user, q.Item)
+	}
+
+	var se stanza.Error
+	switch {
+	case err == nil:
+		_, err = xmlstream.Copy(r, iq.Result(payload))
+	case errors.As(err, &se):
+		_, err = xmlstream.Copy(r, iq.Error(se))
+		return err
+	default:
+		/* #nosec */
+		xmlstream.Copy(r, iq.Error(stanza.Error{Type: stanza.Wait, Condition: stanza.InternalServerError}))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	// When only the changes since the requested version are returned they are
+	// sent as pushes to the requesting resource after the empty result.
+	for _, push := range diff {
+		_, err = xmlstream.Copy(r, push)
+		if err != nil {
+			return err
+		}
+	}
+	return srv.send(ctx, pushes)
+}
+
+// get handles a roster get from the resource j and returns the result payload
+// or, if ver is a version the store knows, the pushes that bring the resource
+// up to date.
+func (srv *Service) get(ctx context.Context, j jid.JID, ver *string) (xml.TokenReader, []xml.TokenReader, error) {
+	srv.m.Lock()
+	defer srv.m.Unlock()
+
+	user := j.Bare()
+	store := srv.store()
+	cur, items, err := store.Roster(ctx, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	srv.addInterested(j)
+
+	if ver != nil && *ver != "" {
+		if *ver == cur {
+			return nil, nil, nil
+		}
+		changes, ok, err := store.Changes(ctx, user, *ver)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			var diff []xml.TokenReader
+			for _, item := range changes {
+				diff = append(diff, pushIQ(j, cur, item))
+			}
+			return nil, diff, nil
+		}
+	}
+
+	resp := IQ{}
+	resp.Query.Ver = cur
+	resp.Query.Item = items
+	return resp.payload(), nil, nil
+}
+
+// set validates and applies a roster set from user and returns the pushes and
+// presence that should be sent as a result.
+func (srv *Service) set(ctx context.Context, user jid.JID, items []Item) ([]xml.TokenReader, error) {
+	if len(items) != 1 {
+		return nil, stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}
+	}
+	item := items[0]
+	err := validItem(item)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.m.Lock()
+	defer srv.m.Unlock()
+
+	store := srv.store()
+	prev, exists, err := store.Item(ctx, user, item.JID)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []xml.TokenReader
+	if item.Subscription == "remove" {
+		if !exists {
+			return nil, stanza.Error{Type: stanza.Cancel, Condition: stanza.ItemNotFound}
+		}
+		// Removing an item cancels any subscriptions in both directions.
+		pending, err := srv.pending(ctx, user, item.JID)
+		if err != nil {
+			return nil, err
+		}
+		if pending {
+			err = store.SetPending(ctx, user, item.JID, false)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if hasSub(prev.Subscription, "to") || prev.Ask != "" {
+			out = append(out, subscriptionPresence(user, item.JID, stanza.UnsubscribePresence))
+		}
+		if hasSub(prev.Subscription, "from") || pending {
+			out = append(out, subscriptionPresence(user, item.JID, stanza.UnsubscribedPresence))
+		}
+		item = Item{JID: item.JID, Subscription: "remove"}
+	} else {
+		// The subscription state is controlled by the server and any values
+		// provided by the client are ignored.
+		item.Subscription = "none"
+		item.Ask = ""
+		item.Approved = false
+		if exists {
+			item.Subscription = prev.Subscription
+			item.Ask = prev.Ask
+			item.Approved = prev.Approved
+		}
+	}
+
+	ver, err := store.SetItem(ctx, user, item)
+	if err != nil {
+		return nil, err
+	}
+	return append(srv.pushes(user, ver, item), out...), nil
+}
+
+// validItem checks that an item in a roster set is acceptable.
+func validItem(item Item) error {
+	switch {
+	case item.JID.Equal(jid.JID{}):
+		return stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}
+	case item.JID.Resourcepart() != "":
+		return stanza.Error{Type: stanza.Modify, Condition: stanza.JIDMalformed}
+	}
+	seen := make(map[string]struct{}, len(item.Group))
+	for _, g := range item.Group {
+		if g == "" {
+			return stanza.Error{Type: stanza.Modify, Condition: stanza.NotAcceptable}
+		}
+		if _, ok := seen[g]; ok {
+			return stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}
+		}
+		seen[g] = struct{}{}
+	}
+	return nil
+}
+
+// Unavailable removes the resource j from the list of interested resources.
+// It should be called when the session for j ends so that it no longer
+// receives roster pushes.
+func (srv *Service) Unavailable(j jid.JID) {
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	resources := srv.interested[j.Bare().String()]
+	delete(resources, j.String())
+	if len(resources) == 0 {
+		delete(srv.interested, j.Bare().String())
+	}
+}
+
+// Interested returns the resources of user that have requested the roster and
+// therefore receive roster pushes.
+func (srv *Service) Interested(user jid.JID) []jid.JID {
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	var resources []jid.JID
+	for _, j := range srv.interested[user.Bare().String()] {
+		resources = append(resources, j)
+	}
+	return resources
+}
+
+// Pending returns the contacts that have requested a subscription to the
+// presence of user that has not yet been approved or denied.
+// Pending requests should be redelivered when the user next becomes available.
+func (srv *Service) Pending(ctx context.Context, user jid.JID) ([]jid.JID, error) {
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	return srv.store().Pending(ctx, user.Bare())
+}
+
+// Outbound updates the roster of user when they send a subscription presence
+// of type typ to contact and reports whether the presence should be routed to
+// the contact.
+func (srv *Service) Outbound(ctx context.Context, user, contact jid.JID, typ stanza.PresenceType) (bool, error) {
+	user = user.Bare()
+	contact = contact.Bare()
+	srv.m.Lock()
+	store := srv.store()
+	item, exists, err := store.Item(ctx, user, contact)
+	if err != nil {
+		srv.m.Unlock()
+		return false, err
+	}
+	if !exists {
+		item = Item{JID: contact, Subscription: "none"}
+	}
+
+	var forward, changed bool
+	switch typ {
+	case stanza.SubscribePresence:
+		forward = true
+		if !hasSub(item.Subscription, "to") && item.Ask == "" {
+			item.Ask = "subscribe"
+			changed = true
+		}
+	case stanza.SubscribedPresence:
+		var pending bool
+		pending, err = srv.pending(ctx, user, contact)
+		if err != nil {
+			break
+		}
+		switch {
+		case pending:
+			err = store.SetPending(ctx, user, contact, false)
+			item.Subscription = addSub(item.Subscription, "from")
+			item.Approved = false
+			forward, changed = true, true
+		case srv.PreApproval && !hasSub(item.Subscription, "from") && !item.Approved:
+			item.Approved = true
+			changed = true
+		}
+	case stanza.UnsubscribePresence:
+		forward = true
+		if exists && (hasSub(item.Subscription, "to") || item.Ask != "") {
+			item.Subscription = removeSub(item.Subscription, "to")
+			item.Ask = ""
+			changed = true
+		}
+	case stanza.UnsubscribedPresence:
+		forward = true
+		var pending bool
+		pending, err = srv.pending(ctx, user, contact)
+		if err == nil && pending {
+			err = store.SetPending(ctx, user, contact, false)
+		}
+		if exists && (hasSub(item.Subscription, "from") || item.Approved) {
+			item.Subscription = removeSub(item.Subscription, "from")
+			item.Approved = false
+			changed = true
+		}
+	}
+	var pushes []xml.TokenReader
+	if err == nil && changed {
+		pushes, err = srv.setItem(ctx, user, item)
+	}
+	srv.m.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return forward, srv.send(ctx, pushes)
+}
+
+// Inbound updates the roster of user when they receive a subscription presence
+// of type typ from contact and reports whether the presence should be
+// delivered to the user.
+// If the user has already approved the subscription, a reply is sent to the
+// contact instead of delivering the request.
+func (srv *Service) Inbound(ctx context.Context, user, contact jid.JID, typ stanza.PresenceType) (bool, error) {
+	user = user.Bare()
+	contact = contact.Bare()
+	srv.m.Lock()
+	store := srv.store()
+	item, exists, err := store.Item(ctx, user, contact)
+	if err != nil {
+		srv.m.Unlock()
+		return false, err
+	}
+
+	var deliver, changed bool
+	var out []xml.TokenReader
+	switch typ {
+	case stanza.SubscribePresence:
+		switch {
+		case exists && hasSub(item.Subscription, "from"):
+			out = append(out, subscriptionPresence(user, contact, stanza.SubscribedPresence))
+		case exists && item.Approved:
+			item.Subscription = addSub(item.Subscription, "from")
+			item.Approved = false
+			changed = true
+			out = append(out, subscriptionPresence(user, contact, stanza.SubscribedPresence))
+		default:
+			err = store.SetPending(ctx, user, contact, true)
+			deliver = true
+		}
+	case stanza.SubscribedPresence:
+		if exists && item.Ask != "" {
+			item.Subscription = addSub(item.Subscription, "to")
+			item.Ask = ""
+			deliver, changed = true, true
+		}
+	case stanza.UnsubscribePresence:
+		var pending bool
+		pending, err = srv.pending(ctx, user, contact)
+		if err == nil && pending {
+			err = store.SetPending(ctx, user, contact, false)
+			deliver = true
+		}
+		if exists && hasSub(item.Subscription, "from") {
+			item.Subscription = removeSub(item.Subscription, "from")
+			deliver, changed = true, true
+		}
+	case stanza.UnsubscribedPresence:
+		if exists && (hasSub(item.Subscription, "to") || item.Ask != "") {
+			item.Subscription = removeSub(item.Subscription, "to")
+			item.Ask = ""
+			deliver, changed = true, true
+		}
+	}
+	if err == nil && changed {
+		var pushes []xml.TokenReader
+		pushes, err = srv.setItem(ctx, user, item)
+		out = append(pushes, out...)
+	}
+	srv.m.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return deliver, srv.send(ctx, out)
+}
+
+// setItem stores item and returns the resulting pushes.
+// It must be called with the lock held.
+func (srv *Service) setItem(ctx context.Context, user jid.JID, item Item) ([]xml.TokenReader, error) {
+	ver, err := srv.store().SetItem(ctx, user, item)
+	if err != nil {
+		return nil, err
+	}
+	return srv.pushes(user, ver, item), nil
+}
+
+// pending reports whether contact has a pending subscription request to user.
+// It must be called with the lock held.
+func (srv *Service) pending(ctx context.Context, user, contact jid.JID) (bool, error) {
+	pending, err := srv.store().Pending(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	for _, j := range pending {
+		if j.Equal(contact) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// pushes returns a roster push for each interested resource of user.
+// It must be called with the lock held.
+func (srv *Service) pushes(user jid.JID, ver string, item Item) []xml.TokenReader {
+	var pushes []xml.TokenReader
+	for _, j := range srv.interested[user.String()] {
+		pushes = append(pushes, pushIQ(j, ver, item))
+	}
+	return pushes
+}
+
+// addInterested must be called with the lock held.
+func (srv *Service) addInterested(j jid.JID) {
+	if srv.interested == nil {
+		srv.interested = make(map[string]map[string]jid.JID)
+	}
+	bare := j.Bare().String()
+	resources, ok := srv.interested[bare]
+	if !ok {
+		resources = make(map[string]jid.JID)
+		srv.interested[bare] = resources
+	}
+	resources[j.String()] = j
+}
+
+func (srv *Service) send(ctx context.Context, out []xml.TokenReader) error {
+	if srv.Sender == nil {
+		return nil
+	}
+	for _, r := range out {
+		err := srv.Sender.Send(ctx, r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pushIQ(to jid.JID, ver string, item Item) xml.TokenReader {
+	push := IQ{IQ: stanza.IQ{ID: attr.RandomID(), To: to, Type: stanza.SetIQ}}
+	push.Query.Ver = ver
+	push.Query.Item = []Item{item}
+	return push.TokenReader()
+}
+
+func subscriptionPresence(from, to jid.JID, typ stanza.PresenceType) xml.TokenReader {
+	return stanza.Presence{From: from, To: to, Type: typ}.Wrap(nil)
+}
+
+// hasSub reports whether the subscription state includes a subscription in
+// the provided direction ("to" or "from").
+func hasSub(sub, dir string) bool {
+	return sub == dir || sub == "both"
+}
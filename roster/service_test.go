@@ -0,0 +1,236 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster_test
+
+import (
+	"context"
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/stanza"
+)
+
+// recordSender records the stanzas sent by a service.
+type recordSender struct {
+	sent []string
+}
+
+func (s *recordSender) Send(_ context.Context, r xml.TokenReader) error {
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	_, err := xmlstream.Copy(e, r)
+	if err != nil {
+		return err
+	}
+	err = e.Flush()
+	if err != nil {
+		return err
+	}
+	s.sent = append(s.sent, b.String())
+	return nil
+}
+
+// serviceHandle passes the IQ to the mux and returns everything written in
+// response.
+func serviceHandle(t *testing.T, m *mux.ServeMux, in string) string {
+	t.Helper()
+	d := xml.NewDecoder(strings.NewReader(in))
+	tok, err := d.Token()
+	if err != nil {
+		t.Fatalf("error decoding IQ: %v", err)
+	}
+	start := tok.(xml.StartElement)
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	err = m.HandleXMPP(struct {
+		xml.TokenReader
+		xmlstream.Encoder
+	}{
+		TokenReader: d,
+		Encoder:     e,
+	}, &start)
+	if err != nil {
+		t.Fatalf("error handling IQ: %v", err)
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatalf("error flushing encoder: %v", err)
+	}
+	return b.String()
+}
+
+const (
+	rosterGet = `<iq xmlns="jabber:client" type="get" id="get" from="romeo@example.net/orchard"><query xmlns="jabber:iq:roster" ver="%s"/></iq>`
+	rosterSet = `<iq xmlns="jabber:client" type="set" id="set" from="romeo@example.net/orchard"><query xmlns="jabber:iq:roster">%s</query></iq>`
+)
+
+var invalidSetTests = [...]struct {
+	items string
+	cond  stanza.Condition
+}{
+	0: {items: ``, cond: stanza.BadRequest},
+	1: {items: `<item jid="juliet@example.com"/><item jid="nurse@example.com"/>`, cond: stanza.BadRequest},
+	2: {items: `<item/>`, cond: stanza.BadRequest},
+	3: {items: `<item jid="juliet@example.com/balcony"/>`, cond: stanza.JIDMalformed},
+	4: {items: `<item jid="juliet@example.com"><group></group></item>`, cond: stanza.NotAcceptable},
+	5: {items: `<item jid="juliet@example.com"><group>A</group><group>A</group></item>`, cond: stanza.BadRequest},
+	6: {items: `<item jid="tybalt@example.com" subscription="remove"/>`, cond: stanza.ItemNotFound},
+	7: {items: `<item jid="@@"/>`, cond: stanza.BadRequest},
+}
+
+func TestServiceInvalidSet(t *testing.T) {
+	srv := &roster.Service{}
+	m := mux.New(stanza.NSClient, roster.HandleService(srv))
+	for i, tc := range invalidSetTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			out := serviceHandle(t, m, strings.Replace(rosterSet, "%s", tc.items, 1))
+			if !strings.Contains(out, `type="error"`) || !strings.Contains(out, "<"+string(tc.cond)) {
+				t.Errorf("expected %s error, got %s", tc.cond, out)
+			}
+		})
+	}
+}
+
+func TestServiceVersioning(t *testing.T) {
+	sender := &recordSender{}
+	srv := &roster.Service{Sender: sender}
+	m := mux.New(stanza.NSClient, roster.HandleService(srv))
+	get := func(ver string) string {
+		t.Helper()
+		return serviceHandle(t, m, strings.Replace(rosterGet, "%s", ver, 1))
+	}
+
+	out := get("")
+	if want := `<iq xmlns="jabber:client" type="result" to="romeo@example.net/orchard" id="get"><query xmlns="jabber:iq:roster" ver="0"></query></iq>`; out != want {
+		t.Errorf("wrong initial roster:\nwant=%s,\n got=%s", want, out)
+	}
+
+	// Sets are pushed to the interested resource and the client provided
+	// subscription state is ignored.
+	out = serviceHandle(t, m, strings.Replace(rosterSet, "%s", `<item jid="juliet@example.com" name="Juliet" subscription="both"><group>Friends</group></item>`, 1))
+	if want := `<iq xmlns="jabber:client" type="result" to="romeo@example.net/orchard" id="set"></iq>`; out != want {
+		t.Errorf("wrong set response:\nwant=%s,\n got=%s", want, out)
+	}
+	if len(sender.sent) != 1 || !strings.Contains(sender.sent[0], `<item jid="juliet@example.com" name="Juliet" subscription="none"><group>Friends</group></item>`) ||
+		!strings.Contains(sender.sent[0], `to="romeo@example.net/orchard"`) || !strings.Contains(sender.sent[0], `ver="1"`) {
+		t.Errorf("wrong push: %v", sender.sent)
+	}
+	serviceHandle(t, m, strings.Replace(rosterSet, "%s", `<item jid="nurse@example.com"/>`, 1))
+	serviceHandle(t, m, strings.Replace(rosterSet, "%s", `<item jid="juliet@example.com" subscription="remove"/>`, 1))
+
+	// A known version returns an empty result followed by the changes.
+	out = get("1")
+	if !strings.HasPrefix(out, `<iq xmlns="jabber:client" type="result" to="romeo@example.net/orchard" id="get"></iq>`) {
+		t.Errorf("expected empty result, got %s", out)
+	}
+	if n := strings.Count(out, `type="set"`); n != 2 {
+		t.Errorf("wrong number of pushes: want=2, got=%d: %s", n, out)
+	}
+	if !strings.Contains(out, `<item jid="nurse@example.com" subscription="none">`) || !strings.Contains(out, `<item jid="juliet@example.com" subscription="remove">`) {
+		t.Errorf("wrong pushes: %s", out)
+	}
+
+	// The current version returns only an empty result.
+	out = get("3")
+	if want := `<iq xmlns="jabber:client" type="result" to="romeo@example.net/orchard" id="get"></iq>`; out != want {
+		t.Errorf("wrong response for current version:\nwant=%s,\n got=%s", want, out)
+	}
+
+	// An unknown version returns the entire roster.
+	out = get("bad")
+	if !strings.Contains(out, `ver="3"`) || !strings.Contains(out, `nurse@example.com`) || strings.Contains(out, `juliet@example.com`) {
+		t.Errorf("expected full roster, got %s", out)
+	}
+
+	srv.Unavailable(jid.MustParse("romeo@example.net/orchard"))
+	if r := srv.Interested(jid.MustParse("romeo@example.net")); len(r) != 0 {
+		t.Errorf("resource still interested after becoming unavailable: %v", r)
+	}
+}
+
+func TestServiceSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	romeo := jid.MustParse("romeo@example.net")
+	juliet := jid.MustParse("juliet@example.com")
+	sender := &recordSender{}
+	srv := &roster.Service{Sender: sender, PreApproval: true}
+	store := &roster.MemServiceStore{}
+	srv.Store = store
+
+	check := func(sub, ask string, approved bool) {
+		t.Helper()
+		item, _, err := store.Item(ctx, romeo, juliet)
+		if err != nil {
+			t.Fatalf("error fetching item: %v", err)
+		}
+		if item.Subscription != sub || item.Ask != ask || item.Approved != approved {
+			t.Errorf("wrong state: want=%s/%q/%t, got=%s/%q/%t", sub, ask, approved, item.Subscription, item.Ask, item.Approved)
+		}
+	}
+	expect := func(ok bool, err error, want bool) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("error updating state: %v", err)
+		}
+		if ok != want {
+			t.Errorf("wrong routing decision: want=%t, got=%t", want, ok)
+		}
+	}
+
+	ok, err := srv.Outbound(ctx, romeo, juliet, stanza.SubscribePresence)
+	expect(ok, err, true)
+	check("none", "subscribe", false)
+	ok, err = srv.Inbound(ctx, romeo, juliet, stanza.SubscribedPresence)
+	expect(ok, err, true)
+	check("to", "", false)
+	// Unsolicited approvals are not delivered.
+	ok, err = srv.Inbound(ctx, romeo, juliet, stanza.SubscribedPresence)
+	expect(ok, err, false)
+
+	ok, err = srv.Inbound(ctx, romeo, juliet, stanza.SubscribePresence)
+	expect(ok, err, true)
+	if pending, _ := srv.Pending(ctx, romeo); len(pending) != 1 || !pending[0].Equal(juliet) {
+		t.Errorf("wrong pending requests: %v", pending)
+	}
+	ok, err = srv.Outbound(ctx, romeo, juliet, stanza.SubscribedPresence)
+	expect(ok, err, true)
+	check("both", "", false)
+	if pending, _ := srv.Pending(ctx, romeo); len(pending) != 0 {
+		t.Errorf("request still pending after approval: %v", pending)
+	}
+
+	// Requests from contacts that are already subscribed are answered by the
+	// server.
+	sender.sent = nil
+	ok, err = srv.Inbound(ctx, romeo, juliet, stanza.SubscribePresence)
+	expect(ok, err, false)
+	if want := `<presence type="subscribed" to="juliet@example.com" from="romeo@example.net"></presence>`; len(sender.sent) != 1 || sender.sent[0] != want {
+		t.Errorf("wrong automatic reply: want=%s, got=%v", want, sender.sent)
+	}
+
+	ok, err = srv.Inbound(ctx, romeo, juliet, stanza.UnsubscribePresence)
+	expect(ok, err, true)
+	check("to", "", false)
+	ok, err = srv.Outbound(ctx, romeo, juliet, stanza.UnsubscribePresence)
+	expect(ok, err, true)
+	check("none", "", false)
+
+	// Pre-approved requests are approved without being delivered.
+	ok, err = srv.Outbound(ctx, romeo, juliet, stanza.SubscribedPresence)
+	expect(ok, err, false)
+	check("none", "", true)
+	ok, err = srv.Inbound(ctx, romeo, juliet, stanza.SubscribePresence)
+	expect(ok, err, false)
+	check("from", "", false)
+	ok, err = srv.Outbound(ctx, romeo, juliet, stanza.UnsubscribedPresence)
+	expect(ok, err, true)
+	check("none", "", false)
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+
+	"mellium.im/xmpp/jid"
+)
+
+// ServiceStore is used by a Service to persist the rosters of its users.
+// The user passed to each method is a bare JID.
+type ServiceStore interface {
+	// Roster returns the current version and all items in the roster of user.
+	Roster(ctx context.Context, user jid.JID) (ver string, items []Item, err error)
+
+	// Item returns the item for contact in the roster of user.
+	// If no such item exists, ok is false.
+	Item(ctx context.Context, user, contact jid.JID) (item Item, ok bool, err error)
+
+	// SetItem creates or updates an item in the roster of user and returns the
+	// new roster version.
+	// If the subscription of the item is "remove" it is deleted instead.
+	SetItem(ctx context.Context, user jid.JID, item Item) (ver string, err error)
+
+	// Changes returns the items that changed after the provided version, in the
+	// order they were changed, with removed items having the subscription
+	// "remove".
+	// If the version is unknown, ok is false.
+	Changes(ctx context.Context, user jid.JID, ver string) (items []Item, ok bool, err error)
+
+	// Pending returns the contacts that have sent user a subscription request
+	// that has not yet been approved or denied.
+	Pending(ctx context.Context, user jid.JID) ([]jid.JID, error)
+
+	// SetPending records or clears a pending subscription request from contact.
+	SetPending(ctx context.Context, user, contact jid.JID, pending bool) error
+}
+
+type memChange struct {
+	ver  uint64
+	item Item
+}
+
+type memRoster struct {
+	ver     uint64
+	items   map[string]Item
+	changes []memChange
+	pending map[string]jid.JID
+}
+
+// MemServiceStore is an in-memory implementation of ServiceStore.
+// Roster versions are sequence numbers.
+// The zero value is ready to use.
+type MemServiceStore struct {
+	m       sync.Mutex
+	rosters map[string]*memRoster
+}
+
+func (s *MemServiceStore) roster(user jid.JID) *memRoster {
+	if s.rosters == nil {
+		s.rosters = make(map[string]*memRoster)
+	}
+	key := user.Bare().String()
+	r, ok := s.rosters[key]
+	if !ok {
+		r = &memRoster{
+			items:   make(map[string]Item),
+			pending: make(map[string]jid.JID),
+		}
+		s.rosters[key] = r
+	}
+	return r
+}
+
+// Roster implements ServiceStore.
+func (s *MemServiceStore) Roster(_ context.Context, user jid.JID) (string, []Item, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.roster(user)
+	items := make([]Item, 0, len(r.items))
+	for _, item := range r.items {
+		items = append(items, item)
+	}
+	sortItems(items)
+	return strconv.FormatUint(r.ver, 10), items, nil
+}
+
+// Item implements ServiceStore.
+func (s *MemServiceStore) Item(_ context.Context, user, contact jid.JID) (Item, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	item, ok := s.roster(user).items[contact.Bare().String()]
+	return item, ok, nil
+}
+
+// SetItem implements ServiceStore.
+func (s *MemServiceStore) SetItem(_ context.Context, user jid.JID, item Item) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.roster(user)
+	key := item.JID.Bare().String()
+	if item.Subscription == "remove" {
+		delete(r.items, key)
+	} else {
+		r.items[key] = item
+	}
+	r.ver++
+	r.changes = append(r.changes, memChange{ver: r.ver, item: item})
+	return strconv.FormatUint(r.ver, 10), nil
+}
+
+// Changes implements ServiceStore.
+func (s *MemServiceStore) Changes(_ context.Context, user jid.JID, ver string) ([]Item, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.roster(user)
+	v, err := strconv.ParseUint(ver, 10, 64)
+	if err != nil || v > r.ver {
+		return nil, false, nil
+	}
+	// Only report the latest change to each item.
+	idx := sort.Search(len(r.changes), func(i int) bool {
+		return r.changes[i].ver > v
+	})
+	latest := make(map[string]int)
+	for i := idx; i < len(r.changes); i++ {
+		latest[r.changes[i].item.JID.String()] = i
+	}
+	var items []Item
+	for i := idx; i < len(r.changes); i++ {
+		item := r.changes[i].item
+		if latest[item.JID.String()] == i {
+			items = append(items, item)
+		}
+	}
+	return items, true, nil
+}
+
+// Pending implements ServiceStore.
+func (s *MemServiceStore) Pending(_ context.Context, user jid.JID) ([]jid.JID, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var pending []jid.JID
+	for _, j := range s.roster(user).pending {
+		pending = append(pending, j)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].String() < pending[j].String()
+	})
+	return pending, nil
+}
+
+// SetPending implements ServiceStore.
+func (s *MemServiceStore) SetPending(_ context.Context, user, contact jid.JID, pending bool) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.roster(user)
+	contact = contact.Bare()
+	if pending {
+		r.pending[contact.String()] = contact
+	} else {
+		delete(r.pending, contact.String())
+	}
+	return nil
+}
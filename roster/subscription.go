@@ -0,0 +1,208 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// PreApproval returns a stream feature that advertises support for
+// subscription pre-approval.
+//
+// Actually attempting to negotiate the feature does nothing as it is meant to
+// be informational only.
+func PreApproval() xmpp.StreamFeature {
+	return xmpp.StreamFeature{
+		Name:      xml.Name{Space: NSPreApproval, Local: "sub"},
+		Necessary: xmpp.Secure,
+		List: func(_ context.Context, e xmlstream.TokenWriter, start xml.StartElement) (bool, error) {
+			err := e.EncodeToken(start)
+			if err != nil {
+				return true, err
+			}
+			return true, e.EncodeToken(start.End())
+		},
+		Parse: func(_ context.Context, d *xml.Decoder, _ *xml.StartElement) (bool, interface{}, error) {
+			return false, nil, d.Skip()
+		},
+		Negotiate: func(context.Context, *xmpp.Session, interface{}) (xmpp.SessionState, io.ReadWriter, error) {
+			return 0, nil, nil
+		},
+	}
+}
+
+func sendSubscription(ctx context.Context, s *xmpp.Session, j jid.JID, typ stanza.PresenceType) error {
+	return s.Send(ctx, stanza.Presence{To: j.Bare(), Type: typ}.Wrap(nil))
+}
+
+// Subscribe requests a subscription to the presence of the contact.
+func Subscribe(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+	return sendSubscription(ctx, s, j, stanza.SubscribePresence)
+}
+
+// Approve approves a subscription request from the contact.
+func Approve(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+	return sendSubscription(ctx, s, j, stanza.SubscribedPresence)
+}
+
+// Deny denies a subscription request from the contact.
+func Deny(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+	return sendSubscription(ctx, s, j, stanza.UnsubscribedPresence)
+}
+
+// Unsubscribe unsubscribes from the presence of the contact.
+func Unsubscribe(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+	return sendSubscription(ctx, s, j, stanza.UnsubscribePresence)
+}
+
+// Cancel revokes a subscription that was previously approved so that the
+// contact no longer receives our presence.
+func Cancel(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+	return sendSubscription(ctx, s, j, stanza.UnsubscribedPresence)
+}
+
+// PreApprove approves a subscription request from the contact before it has
+// been received.
+// If the server did not advertise support for pre-approval (see PreApproval)
+// an error is returned.
+func PreApprove(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+	if _, ok := s.Feature(NSPreApproval); !ok {
+		return errors.New("roster: server does not support subscription pre-approval")
+	}
+	return sendSubscription(ctx, s, j, stanza.SubscribedPresence)
+}
+
+// SubscriptionHandler responds to inbound subscription requests and tracks the
+// changes to subscription state caused by subscription presence.
+type SubscriptionHandler struct {
+	// Approve is called for each inbound subscription request and reports
+	// whether the request should be approved or denied.
+	// If Approve is nil requests are left pending so that they can be handled
+	// later with Approve or Deny.
+	Approve func(from jid.JID) (bool, error)
+
+	// Cache, if set, is updated with the subscription and ask state implied by
+	// inbound subscription presence.
+	// The server will also send roster pushes for these changes.
+	Cache *Cache
+}
+
+// Handler returns a handler that responds to inbound subscription requests
+// and updates the cache before passing them on to next.
+// Each stanza is only processed once, and all stanzas are passed to next
+// unchanged.
+func (h *SubscriptionHandler) Handler(next xmpp.Handler) xmpp.Handler {
+	return xmpp.HandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		if start.Name.Local != "presence" {
+			return next.HandleXMPP(t, start)
+		}
+		p, err := stanza.NewPresence(*start)
+		if err != nil {
+			return err
+		}
+		err = h.handle(p, t)
+		if err != nil {
+			return err
+		}
+		return next.HandleXMPP(t, start)
+	})
+}
+
+// handle responds to subscription presence and applies the resulting changes
+// to the cache.
+func (h *SubscriptionHandler) handle(p stanza.Presence, e xmlstream.Encoder) error {
+	from := p.From.Bare()
+	switch p.Type {
+	case stanza.SubscribePresence:
+		if h.Approve == nil {
+			return nil
+		}
+		ok, err := h.Approve(from)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			_, err = xmlstream.Copy(e, stanza.Presence{To: from, Type: stanza.UnsubscribedPresence}.Wrap(nil))
+			return err
+		}
+		_, err = xmlstream.Copy(e, stanza.Presence{To: from, Type: stanza.SubscribedPresence}.Wrap(nil))
+		if err != nil {
+			return err
+		}
+		return h.update(from, true, func(item Item) Item {
+			item.Subscription = addSub(item.Subscription, "from")
+			return item
+		})
+	case stanza.SubscribedPresence:
+		return h.update(from, true, func(item Item) Item {
+			item.Ask = ""
+			item.Subscription = addSub(item.Subscription, "to")
+			return item
+		})
+	case stanza.UnsubscribedPresence:
+		return h.update(from, false, func(item Item) Item {
+			item.Ask = ""
+			item.Subscription = removeSub(item.Subscription, "to")
+			return item
+		})
+	case stanza.UnsubscribePresence:
+		return h.update(from, false, func(item Item) Item {
+			item.Subscription = removeSub(item.Subscription, "from")
+			return item
+		})
+	}
+	return nil
+}
+
+// update applies a change to the cached item for j.
+// If create is true and there is no item, one is created.
+func (h *SubscriptionHandler) update(j jid.JID, create bool, f func(Item) Item) error {
+	if h.Cache == nil {
+		return nil
+	}
+	item, ok := h.Cache.Item(j)
+	if !ok {
+		if !create {
+			return nil
+		}
+		item = Item{JID: j, Subscription: "none"}
+	}
+	return h.Cache.Push("", f(item))
+}
+
+// addSub returns the subscription state after adding a subscription in the
+// provided direction ("to" or "from").
+func addSub(sub, dir string) string {
+	switch sub {
+	case "", "none":
+		return dir
+	case dir, "both":
+		return sub
+	}
+	return "both"
+}
+
+// removeSub returns the subscription state after removing a subscription in
+// the provided direction ("to" or "from").
+func removeSub(sub, dir string) string {
+	switch sub {
+	case dir:
+		return "none"
+	case "both":
+		if dir == "to" {
+			return "from"
+		}
+		return "to"
+	}
+	return sub
+}
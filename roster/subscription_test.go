@@ -0,0 +1,254 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/stanza"
+)
+
+// handlePresence passes the presence in to h and returns anything h writes.
+func handlePresence(t *testing.T, h xmpp.Handler, in string) string {
+	t.Helper()
+	d := xml.NewDecoder(strings.NewReader(in))
+	tok, err := d.Token()
+	if err != nil {
+		t.Fatalf("error decoding presence: %v", err)
+	}
+	start := tok.(xml.StartElement)
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	err = h.HandleXMPP(struct {
+		xml.TokenReader
+		xmlstream.Encoder
+	}{
+		TokenReader: d,
+		Encoder:     e,
+	}, &start)
+	if err != nil {
+		t.Fatalf("error handling presence: %v", err)
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatalf("error flushing encoder: %v", err)
+	}
+	return b.String()
+}
+
+var subscriptionTests = [...]struct {
+	f   func(context.Context, *xmpp.Session, jid.JID) error
+	typ stanza.PresenceType
+}{
+	0: {f: roster.Subscribe, typ: stanza.SubscribePresence},
+	1: {f: roster.Approve, typ: stanza.SubscribedPresence},
+	2: {f: roster.Deny, typ: stanza.UnsubscribedPresence},
+	3: {f: roster.Unsubscribe, typ: stanza.UnsubscribePresence},
+	4: {f: roster.Cancel, typ: stanza.UnsubscribedPresence},
+}
+
+func TestSubscriptions(t *testing.T) {
+	for i, tc := range subscriptionTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var buf bytes.Buffer
+			s := xmpptest.NewClientSession(0, &buf)
+			err := tc.f(context.Background(), s, jid.MustParse("juliet@example.com/balcony"))
+			if err != nil {
+				t.Fatalf("error sending presence: %v", err)
+			}
+			var p stanza.Presence
+			err = xml.NewDecoder(&buf).Decode(&p)
+			if err != nil {
+				t.Fatalf("error decoding presence: %v", err)
+			}
+			if p.Type != tc.typ {
+				t.Errorf("wrong presence type: want=%s, got=%s", tc.typ, p.Type)
+			}
+			if to := p.To.String(); to != "juliet@example.com" {
+				t.Errorf("presence should be sent to the bare JID, got %s", to)
+			}
+		})
+	}
+}
+
+func TestPreApproveUnsupported(t *testing.T) {
+	var buf bytes.Buffer
+	s := xmpptest.NewClientSession(0, &buf)
+	err := roster.PreApprove(context.Background(), s, jid.MustParse("juliet@example.com"))
+	if err == nil {
+		t.Errorf("expected an error when pre-approval is not supported")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("did not expect anything to be sent, got %s", buf.String())
+	}
+}
+
+func TestSubscriptionHandler(t *testing.T) {
+	romeo := jid.MustParse("romeo@example.net")
+	var requests []jid.JID
+	h := &roster.SubscriptionHandler{
+		Approve: func(from jid.JID) (bool, error) {
+			requests = append(requests, from)
+			return from.Equal(romeo), nil
+		},
+	}
+	var handled []string
+	handler := h.Handler(mux.New(stanza.NSClient,
+		mux.PresenceFunc(stanza.SubscribePresence, xml.Name{}, func(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+			handled = append(handled, p.From.String())
+			return nil
+		}),
+	))
+
+	handle := func(in string) string {
+		t.Helper()
+		return handlePresence(t, handler, in)
+	}
+
+	// Requests are only passed to the callback once, even if the presence has
+	// multiple children, and are still passed on to the next handler.
+	out := handle(`<presence xmlns="jabber:client" from="romeo@example.net/orchard" type="subscribe"><status>Hi</status><nick xmlns="http://jabber.org/protocol/nick">Romeo</nick></presence>`)
+	if want := `<presence type="subscribed" to="romeo@example.net"></presence>`; out != want {
+		t.Errorf("wrong response:\nwant=%s,\n got=%s", want, out)
+	}
+	if len(requests) != 1 || !requests[0].Equal(romeo) {
+		t.Errorf("wrong requests: want=[%s], got=%v", romeo, requests)
+	}
+	if len(handled) != 2 {
+		t.Errorf("request not passed on to the next handler: %v", handled)
+	}
+
+	// Repeated requests from the same contact are not ignored.
+	handle(`<presence xmlns="jabber:client" from="romeo@example.net/orchard" type="subscribe"><status>Hi</status><nick xmlns="http://jabber.org/protocol/nick">Romeo</nick></presence>`)
+	if len(requests) != 2 {
+		t.Errorf("wrong number of requests: want=2, got=%d", len(requests))
+	}
+
+	out = handle(`<presence xmlns="jabber:client" from="tybalt@example.net" type="subscribe"/>`)
+	if want := `<presence type="unsubscribed" to="tybalt@example.net"></presence>`; out != want {
+		t.Errorf("wrong response:\nwant=%s,\n got=%s", want, out)
+	}
+
+	// Other subscription presence is passed through without a response.
+	if out := handle(`<presence xmlns="jabber:client" from="romeo@example.net" type="subscribed"/>`); out != "" {
+		t.Errorf("unexpected response to subscribed presence: %s", out)
+	}
+	if len(requests) != 3 {
+		t.Errorf("wrong number of requests: want=3, got=%d", len(requests))
+	}
+}
+
+var subscriptionCacheTests = [...]struct {
+	item    *roster.Item
+	typ     stanza.PresenceType
+	approve bool
+	want    *roster.Item
+}{
+	0: {
+		typ:     stanza.SubscribePresence,
+		approve: true,
+		want:    &roster.Item{Subscription: "from"},
+	},
+	1: {
+		item:    &roster.Item{Subscription: "to"},
+		typ:     stanza.SubscribePresence,
+		approve: true,
+		want:    &roster.Item{Subscription: "both"},
+	},
+	2: {
+		typ: stanza.SubscribePresence,
+	},
+	3: {
+		item: &roster.Item{Subscription: "to"},
+		typ:  stanza.SubscribePresence,
+		want: &roster.Item{Subscription: "to"},
+	},
+	4: {
+		item: &roster.Item{Subscription: "none", Ask: "subscribe"},
+		typ:  stanza.SubscribedPresence,
+		want: &roster.Item{Subscription: "to"},
+	},
+	5: {
+		item: &roster.Item{Subscription: "from", Ask: "subscribe"},
+		typ:  stanza.SubscribedPresence,
+		want: &roster.Item{Subscription: "both"},
+	},
+	6: {
+		typ:  stanza.SubscribedPresence,
+		want: &roster.Item{Subscription: "to"},
+	},
+	7: {
+		item: &roster.Item{Subscription: "none", Ask: "subscribe"},
+		typ:  stanza.UnsubscribedPresence,
+		want: &roster.Item{Subscription: "none"},
+	},
+	8: {
+		item: &roster.Item{Subscription: "both"},
+		typ:  stanza.UnsubscribedPresence,
+		want: &roster.Item{Subscription: "from"},
+	},
+	9: {
+		typ: stanza.UnsubscribedPresence,
+	},
+	10: {
+		item: &roster.Item{Subscription: "both"},
+		typ:  stanza.UnsubscribePresence,
+		want: &roster.Item{Subscription: "to"},
+	},
+	11: {
+		item: &roster.Item{Subscription: "from"},
+		typ:  stanza.UnsubscribePresence,
+		want: &roster.Item{Subscription: "none"},
+	},
+	12: {
+		typ: stanza.UnsubscribePresence,
+	},
+}
+
+func TestSubscriptionHandlerCache(t *testing.T) {
+	romeo := jid.MustParse("romeo@example.net")
+	for i, tc := range subscriptionCacheTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			cache := &roster.Cache{}
+			if tc.item != nil {
+				item := *tc.item
+				item.JID = romeo
+				err := cache.Push("", item)
+				if err != nil {
+					t.Fatalf("error adding item: %v", err)
+				}
+			}
+			h := &roster.SubscriptionHandler{
+				Approve: func(jid.JID) (bool, error) {
+					return tc.approve, nil
+				},
+				Cache: cache,
+			}
+			handlePresence(t, h.Handler(mux.New(stanza.NSClient)), `<presence xmlns="jabber:client" from="romeo@example.net/orchard" type="`+string(tc.typ)+`"><status>Hi</status><priority>1</priority></presence>`)
+
+			item, ok := cache.Item(romeo)
+			switch {
+			case tc.want == nil && ok:
+				t.Errorf("did not expect an item, got %+v", item)
+			case tc.want == nil:
+			case !ok:
+				t.Errorf("expected an item")
+			case item.Subscription != tc.want.Subscription || item.Ask != tc.want.Ask:
+				t.Errorf("wrong item: want=%+v, got=%+v", *tc.want, item)
+			}
+		})
+	}
+}
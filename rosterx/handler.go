@@ -0,0 +1,228 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package rosterx
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/stanza"
+)
+
+// Handle returns an option that registers a Handler for roster item exchanges
+// sent in messages and IQs.
+func Handle(h *Handler) mux.Option {
+	return func(m *mux.ServeMux) {
+		x := xml.Name{Space: NS, Local: "x"}
+		mux.Message(stanza.NormalMessage, x, h)(m)
+		mux.Message(stanza.ChatMessage, x, h)(m)
+		mux.IQ(stanza.SetIQ, x, h)(m)
+	}
+}
+
+// Handler applies roster item exchanges from trusted senders to the roster.
+//
+// Because roster changes can only be made after the handler returns (the
+// session would otherwise be blocked waiting for the response to the roster
+// set), accepted changes are applied in a separate goroutine.
+type Handler struct {
+	// Session is used to apply accepted changes with roster.Set and
+	// roster.Delete.
+	Session *xmpp.Session
+
+	// Roster, if set, is used to determine whether senders are contacts and to
+	// merge suggested groups with the groups of existing items.
+	// Without it, suggestions that delete an item from a group are ignored.
+	Roster *roster.Cache
+
+	// Trusted reports whether suggestions from an entity should be considered.
+	// If nil, only suggestions from the server, the user's own account, and
+	// contacts in Roster are considered.
+	Trusted func(from jid.JID) bool
+
+	// Accept is called with the suggestions from a trusted sender and returns
+	// the items that should be applied, for example after asking the user.
+	// If nil, all suggestions are accepted.
+	Accept func(from jid.JID, items []Item) []Item
+
+	// Done, if set, is called after the changes accepted from a sender have been
+	// applied with any error that occurred.
+	Done func(from jid.JID, err error)
+}
+
+// HandleMessage implements mux.MessageHandler.
+func (h *Handler) HandleMessage(msg stanza.Message, r xmlstream.TokenReadEncoder) error {
+	v := struct {
+		stanza.Message
+		X Exchange `xml:"http://jabber.org/protocol/rosterx x"`
+	}{}
+	err := xml.NewTokenDecoder(r).Decode(&v)
+	if err != nil {
+		return err
+	}
+	if !h.trusted(msg.From) {
+		return nil
+	}
+	h.accept(msg.From, v.X.Items)
+	return nil
+}
+
+// HandleIQ implements mux.IQHandler.
+func (h *Handler) HandleIQ(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	var x Exchange
+	err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&x)
+	if err != nil {
+		_, err = xmlstream.Copy(r, iq.Error(stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}))
+		return err
+	}
+	if !h.trusted(iq.From) {
+		_, err = xmlstream.Copy(r, iq.Error(stanza.Error{Type: stanza.Auth, Condition: stanza.Forbidden}))
+		return err
+	}
+	_, err = xmlstream.Copy(r, iq.Result(nil))
+	if err != nil {
+		return err
+	}
+	h.accept(iq.From, x.Items)
+	return nil
+}
+
+func (h *Handler) trusted(from jid.JID) bool {
+	if h.Trusted != nil {
+		return h.Trusted(from)
+	}
+	if from.Equal(jid.JID{}) {
+		return true
+	}
+	if h.Session != nil {
+		local := h.Session.LocalAddr()
+		if from.Equal(local.Domain()) || from.Bare().Equal(local.Bare()) {
+			return true
+		}
+	}
+	if h.Roster != nil {
+		_, ok := h.Roster.Item(from)
+		return ok
+	}
+	return false
+}
+
+func (h *Handler) accept(from jid.JID, items []Item) {
+	var valid []Item
+	for _, item := range items {
+		switch item.Action {
+		case "", ActionAdd, ActionDelete, ActionModify:
+		default:
+			continue
+		}
+		if item.JID.Equal(jid.JID{}) {
+			continue
+		}
+		item.JID = item.JID.Bare()
+		valid = append(valid, item)
+	}
+	if h.Accept != nil && len(valid) > 0 {
+		valid = h.Accept(from, valid)
+	}
+	if len(valid) == 0 || h.Session == nil {
+		return
+	}
+	go func() {
+		err := h.apply(context.Background(), valid)
+		if h.Done != nil {
+			h.Done(from, err)
+		}
+	}()
+}
+
+// apply makes the changes to the roster suggested by each item.
+func (h *Handler) apply(ctx context.Context, items []Item) error {
+	for _, item := range items {
+		var (
+			cur    roster.Item
+			exists bool
+		)
+		if h.Roster != nil {
+			cur, exists = h.Roster.Item(item.JID)
+		}
+
+		var err error
+		switch item.Action {
+		case ActionModify:
+			if h.Roster != nil && !exists {
+				continue
+			}
+			err = roster.Set(ctx, h.Session, roster.Item{JID: item.JID, Name: item.Name, Group: item.Group})
+		case ActionDelete:
+			if len(item.Group) == 0 {
+				if h.Roster != nil && !exists {
+					continue
+				}
+				err = roster.Delete(ctx, h.Session, item.JID)
+				break
+			}
+			if !exists {
+				continue
+			}
+			remaining := removeGroups(cur.Group, item.Group)
+			switch {
+			case len(remaining) == len(cur.Group):
+				continue
+			case len(remaining) == 0:
+				err = roster.Delete(ctx, h.Session, item.JID)
+			default:
+				err = roster.Set(ctx, h.Session, roster.Item{JID: item.JID, Name: cur.Name, Group: remaining})
+			}
+		default:
+			if !exists {
+				err = roster.Set(ctx, h.Session, roster.Item{JID: item.JID, Name: item.Name, Group: item.Group})
+				break
+			}
+			groups := addGroups(cur.Group, item.Group)
+			if len(groups) == len(cur.Group) {
+				continue
+			}
+			err = roster.Set(ctx, h.Session, roster.Item{JID: item.JID, Name: cur.Name, Group: groups})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addGroups(groups, add []string) []string {
+	out := append([]string(nil), groups...)
+	for _, g := range add {
+		if !contains(out, g) {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+func removeGroups(groups, remove []string) []string {
+	var out []string
+	for _, g := range groups {
+		if !contains(remove, g) {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+func contains(groups []string, name string) bool {
+	for _, g := range groups {
+		if g == name {
+			return true
+		}
+	}
+	return false
+}
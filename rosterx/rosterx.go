@@ -0,0 +1,138 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+//go:generate go run ../internal/genfeature -receiver "h *Handler"
+
+// Package rosterx implements XEP-0144: Roster Item Exchange.
+//
+// Roster item exchanges are used to suggest that contacts be added to,
+// modified in, or deleted from the roster of another entity.
+// They may be sent by a server (for example, to push a shared roster to its
+// users) or by other entities (for example, a bot that introduces users to
+// each other).
+package rosterx // import "mellium.im/xmpp/rosterx"
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the namespace used by this package.
+const NS = "http://jabber.org/protocol/rosterx"
+
+// Actions that may be suggested for an item.
+const (
+	ActionAdd    = "add"
+	ActionDelete = "delete"
+	ActionModify = "modify"
+)
+
+// Item is a suggested change to a roster item.
+type Item struct {
+	// Action is one of ActionAdd, ActionDelete, or ActionModify.
+	// If it is empty, ActionAdd is assumed.
+	Action string   `xml:"action,attr,omitempty"`
+	JID    jid.JID  `xml:"jid,attr"`
+	Name   string   `xml:"name,attr,omitempty"`
+	Group  []string `xml:"group,omitempty"`
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (item Item) TokenReader() xml.TokenReader {
+	var group []xml.TokenReader
+	for _, g := range item.Group {
+		group = append(group, xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(g)),
+			xml.StartElement{Name: xml.Name{Local: "group"}},
+		))
+	}
+
+	var attrs []xml.Attr
+	if item.Action != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "action"}, Value: item.Action})
+	}
+	attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "jid"}, Value: item.JID.String()})
+	if item.Name != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "name"}, Value: item.Name})
+	}
+
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(group...),
+		xml.StartElement{Name: xml.Name{Local: "item"}, Attr: attrs},
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (item Item) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, item.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (item Item) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := item.WriteXML(e)
+	if err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// Exchange is a set of suggested roster changes.
+type Exchange struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/rosterx x"`
+	Items   []Item   `xml:"item"`
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (x Exchange) TokenReader() xml.TokenReader {
+	var items []xml.TokenReader
+	for _, item := range x.Items {
+		items = append(items, item.TokenReader())
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(items...),
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "x"}},
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (x Exchange) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, x.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (x Exchange) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := x.WriteXML(e)
+	if err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// Send suggests roster changes to another entity in a message.
+func Send(ctx context.Context, s *xmpp.Session, to jid.JID, items []Item) error {
+	return SendMessage(ctx, s, stanza.Message{To: to, Type: stanza.NormalMessage}, items)
+}
+
+// SendMessage is like Send except that it allows you to customize the message.
+// Any other payload (such as a body explaining the suggestion) may be added
+// to the message before it is sent.
+func SendMessage(ctx context.Context, s *xmpp.Session, msg stanza.Message, items []Item) error {
+	return s.Send(ctx, msg.Wrap(Exchange{Items: items}.TokenReader()))
+}
+
+// SendIQ suggests roster changes to another entity in an IQ and blocks until a
+// response is received.
+// IQs should only be used to send exchanges to a particular resource, for
+// example from a server to a connected client.
+func SendIQ(ctx context.Context, s *xmpp.Session, to jid.JID, items []Item) error {
+	return s.UnmarshalIQ(ctx, stanza.IQ{
+		To:   to,
+		Type: stanza.SetIQ,
+	}.Wrap(Exchange{Items: items}.TokenReader()), nil)
+}
@@ -0,0 +1,190 @@
+// Copyright 2023 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package rosterx_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/rosterx"
+	"mellium.im/xmpp/stanza"
+)
+
+var marshalTests = [...]struct {
+	in  rosterx.Exchange
+	out string
+}{
+	0: {
+		out: `<x xmlns="http://jabber.org/protocol/rosterx"></x>`,
+	},
+	1: {
+		in: rosterx.Exchange{Items: []rosterx.Item{{
+			Action: rosterx.ActionAdd,
+			JID:    jid.MustParse("juliet@example.com"),
+			Name:   "Juliet",
+			Group:  []string{"Friends", "Lovers"},
+		}, {
+			Action: rosterx.ActionDelete,
+			JID:    jid.MustParse("tybalt@example.com"),
+		}}},
+		out: `<x xmlns="http://jabber.org/protocol/rosterx"><item action="add" jid="juliet@example.com" name="Juliet"><group>Friends</group><group>Lovers</group></item><item action="delete" jid="tybalt@example.com"></item></x>`,
+	},
+}
+
+func TestMarshal(t *testing.T) {
+	for i, tc := range marshalTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var b strings.Builder
+			err := xml.NewEncoder(&b).Encode(tc.in)
+			if err != nil {
+				t.Fatalf("error marshaling: %v", err)
+			}
+			out := b.String()
+			if out != tc.out {
+				t.Errorf("wrong output:\nwant=%s,\n got=%s", tc.out, out)
+			}
+			var x rosterx.Exchange
+			err = xml.Unmarshal([]byte(out), &x)
+			if err != nil {
+				t.Fatalf("error unmarshaling: %v", err)
+			}
+			if len(x.Items) != len(tc.in.Items) || (len(x.Items) > 0 && !reflect.DeepEqual(x.Items, tc.in.Items)) {
+				t.Errorf("wrong round trip: want=%+v, got=%+v", tc.in.Items, x.Items)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	sets := make(chan roster.Item, 10)
+	done := make(chan error, 1)
+
+	cache := &roster.Cache{}
+	for _, item := range []roster.Item{
+		{JID: jid.MustParse("nurse@example.com"), Name: "Nurse", Group: []string{"Capulet"}},
+		{JID: jid.MustParse("mercutio@example.com"), Group: []string{"Friends", "Montague"}},
+		{JID: jid.MustParse("benvolio@example.com"), Group: []string{"Montague"}},
+	} {
+		err := cache.Push("", item)
+		if err != nil {
+			t.Fatalf("error populating roster: %v", err)
+		}
+	}
+	h := &rosterx.Handler{
+		Roster: cache,
+		Accept: func(_ jid.JID, items []rosterx.Item) []rosterx.Item {
+			// Reject suggestions to add Tybalt.
+			var accepted []rosterx.Item
+			for _, item := range items {
+				if item.JID.Localpart() != "tybalt" {
+					accepted = append(accepted, item)
+				}
+			}
+			return accepted
+		},
+		Done: func(_ jid.JID, err error) {
+			done <- err
+		},
+	}
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandler(mux.New(stanza.NSClient, mux.IQFunc(stanza.SetIQ, xml.Name{Space: roster.NS, Local: "query"}, func(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			var q struct {
+				Item []roster.Item `xml:"item"`
+			}
+			err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&q)
+			if err != nil {
+				return err
+			}
+			for _, item := range q.Item {
+				sets <- item
+			}
+			_, err = xmlstream.Copy(r, iq.Result(nil))
+			return err
+		}))),
+		xmpptest.ClientHandler(mux.New("", rosterx.Handle(h))),
+	)
+	defer cs.Close()
+	h.Session = cs.Client
+
+	// Suggestions from strangers are ignored.
+	err := cs.Server.Send(ctx, stanza.Message{
+		From: jid.MustParse("tybalt@example.com"),
+		To:   cs.Client.LocalAddr(),
+		Type: stanza.NormalMessage,
+	}.Wrap(rosterx.Exchange{Items: []rosterx.Item{{JID: jid.MustParse("tybalt@example.com")}}}.TokenReader()))
+	if err != nil {
+		t.Fatalf("error sending untrusted exchange: %v", err)
+	}
+
+	// Suggestions from contacts are applied.
+	err = rosterx.SendMessage(ctx, cs.Server, stanza.Message{
+		From: jid.MustParse("nurse@example.com/balcony"),
+		To:   cs.Client.LocalAddr(),
+	}, []rosterx.Item{
+		{JID: jid.MustParse("juliet@example.com/balcony"), Name: "Juliet", Group: []string{"Capulet"}},
+		{JID: jid.MustParse("tybalt@example.com")},
+		{Action: rosterx.ActionAdd, JID: jid.MustParse("mercutio@example.com"), Group: []string{"Friends"}},
+		{Action: rosterx.ActionDelete, JID: jid.MustParse("mercutio@example.com"), Group: []string{"Montague"}},
+		{Action: rosterx.ActionDelete, JID: jid.MustParse("benvolio@example.com"), Group: []string{"Montague"}},
+		{Action: rosterx.ActionModify, JID: jid.MustParse("nurse@example.com"), Name: "Angelica"},
+		{Action: "bad", JID: jid.MustParse("paris@example.com")},
+	})
+	if err != nil {
+		t.Fatalf("error sending exchange: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("error applying changes: %v", err)
+	}
+	close(sets)
+	var got []roster.Item
+	for item := range sets {
+		got = append(got, item)
+	}
+	want := []roster.Item{
+		{JID: jid.MustParse("juliet@example.com"), Name: "Juliet", Group: []string{"Capulet"}},
+		{JID: jid.MustParse("mercutio@example.com"), Group: []string{"Friends"}},
+		{JID: jid.MustParse("benvolio@example.com"), Subscription: "remove"},
+		{JID: jid.MustParse("nurse@example.com"), Name: "Angelica"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong roster sets:\nwant=%+v,\n got=%+v", want, got)
+	}
+}
+
+func TestIQ(t *testing.T) {
+	var trusted bool
+	h := &rosterx.Handler{
+		Trusted: func(jid.JID) bool {
+			return trusted
+		},
+	}
+	cs := xmpptest.NewClientServer(
+		xmpptest.ClientHandler(mux.New("", rosterx.Handle(h))),
+	)
+	defer cs.Close()
+
+	items := []rosterx.Item{{JID: jid.MustParse("juliet@example.com")}}
+	err := rosterx.SendIQ(context.Background(), cs.Server, cs.Client.LocalAddr(), items)
+	var se stanza.Error
+	if !errors.As(err, &se) || se.Condition != stanza.Forbidden {
+		t.Errorf("expected forbidden error from untrusted sender, got %v", err)
+	}
+	trusted = true
+	err = rosterx.SendIQ(context.Background(), cs.Server, cs.Client.LocalAddr(), items)
+	if err != nil {
+		t.Errorf("unexpected error from trusted sender: %v", err)
+	}
+}